@@ -29,9 +29,12 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/mholt/acmez/v3"
 	"github.com/mholt/acmez/v3/acme"
 	"go.uber.org/zap"
 )
@@ -183,10 +186,20 @@ func (am *ACMEIssuer) lookUpAccount(ctx context.Context, privateKeyPEM []byte) (
 	return account, nil
 }
 
+// storedAccount is the account info that is persisted to storage.
+type storedAccount struct {
+	acme.Account
+
+	// When the private key of the account was created, if known.
+	KeyCreated time.Time `json:"key_created,omitzero"`
+}
+
 // saveAccount persists an ACME account's info and private key to storage.
-// It does NOT register the account via ACME or prompt the user.
+// It does NOT register the account via ACME or prompt the user. Since
+// accounts are saved when they are registered or their key is replaced,
+// the time of saving is recorded as the creation time of the key.
 func (am *ACMEIssuer) saveAccount(ctx context.Context, ca string, account acme.Account) error {
-	regBytes, err := json.MarshalIndent(account, "", "\t")
+	regBytes, err := json.MarshalIndent(storedAccount{Account: account, KeyCreated: time.Now()}, "", "\t")
 	if err != nil {
 		return err
 	}
@@ -219,6 +232,171 @@ func (am *ACMEIssuer) deleteAccountLocally(ctx context.Context, ca string, accou
 	return am.config.Storage.Delete(ctx, am.storageKeyUserPrivateKey(ca, primaryContact))
 }
 
+// RolloverAccountKey replaces the private key of the issuer's ACME
+// account with a newly generated one, both on the ACME server
+// (RFC 8555 §7.3.5) and in storage; with an account pool, the keys
+// of all registered accounts in the pool are replaced. It cannot be
+// used if AccountKeyPEM is set, since that key would no longer be
+// valid for the account afterward.
+func (am *ACMEIssuer) RolloverAccountKey(ctx context.Context) error {
+	if am.AccountKeyPEM != "" {
+		return fmt.Errorf("cannot roll over configured account key")
+	}
+	return am.forEachRegisteredAccount(ctx, func(iss *ACMEIssuer, client *acmez.Client, account acme.Account) error {
+		_, err := iss.rolloverAccountKey(ctx, client, account, 0)
+		return err
+	})
+}
+
+// DeactivateAccount deactivates the issuer's ACME account on the
+// ACME server (RFC 8555 §7.3.6) and deletes it from storage; with
+// an account pool, all registered accounts in the pool are
+// deactivated. Deactivation cannot be undone; if the issuer is used
+// again afterward, a new account will be created for it, unless
+// AccountKeyPEM is set, in which case it can no longer be used.
+func (am *ACMEIssuer) DeactivateAccount(ctx context.Context) error {
+	return am.forEachRegisteredAccount(ctx, func(iss *ACMEIssuer, client *acmez.Client, account acme.Account) error {
+		return iss.deactivateAccount(ctx, client, account)
+	})
+}
+
+// deactivateAccount deactivates account on the server and deletes it from storage.
+func (am *ACMEIssuer) deactivateAccount(ctx context.Context, client *acmez.Client, account acme.Account) error {
+	acctLockKey := am.accountRegLockKey(account)
+	if err := acquireLock(ctx, am.config.Storage, acctLockKey); err != nil {
+		return fmt.Errorf("locking account: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, am.config.Storage, acctLockKey); err != nil {
+			am.Logger.Error("failed to unlock account lock", zap.Error(err))
+		}
+	}()
+
+	account.Status = acme.StatusDeactivated
+	account, err := client.UpdateAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("deactivating account %v with server: %w", account.Contact, err)
+	}
+	am.Logger.Info("ACME account deactivated",
+		zap.Strings("contact", account.Contact),
+		zap.String("location", account.Location))
+
+	if err := am.deleteAccountLocally(ctx, client.Directory, account); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting deactivated account %v from storage: %v", account.Contact, err)
+	}
+	return nil
+}
+
+// accountKeyDue returns true if the private key of account in
+// storage is older than lifetime. If the age of the key is not
+// known, e.g. because the account was saved by an older version,
+// it is not considered due.
+func (am *ACMEIssuer) accountKeyDue(ctx context.Context, ca string, account acme.Account, lifetime time.Duration) bool {
+	regBytes, err := am.config.Storage.Load(ctx, am.storageKeyUserReg(ca, getPrimaryContact(account)))
+	if err != nil {
+		return false
+	}
+	var stored storedAccount
+	if err := json.Unmarshal(regBytes, &stored); err != nil {
+		return false
+	}
+	if stored.KeyCreated.IsZero() {
+		am.Logger.Warn("age of ACME account key is unknown; not rolling it over automatically",
+			zap.Strings("contact", account.Contact),
+			zap.String("location", account.Location))
+		return false
+	}
+	return time.Since(stored.KeyCreated) > lifetime
+}
+
+// rolloverAccountKey replaces the private key of account with a new
+// one on the server and in storage, and returns the updated account.
+// If olderThan is nonzero, the key is only replaced if it is still
+// older than that once the lock is held, since another instance may
+// have replaced it already.
+//
+// The new key is stored before the server is asked to change keys,
+// so that if we are interrupted before the account is updated in
+// storage, the next rollover can recover the account.
+func (am *ACMEIssuer) rolloverAccountKey(ctx context.Context, client *acmez.Client, account acme.Account, olderThan time.Duration) (acme.Account, error) {
+	acctLockKey := am.accountRegLockKey(account)
+	if err := acquireLock(ctx, am.config.Storage, acctLockKey); err != nil {
+		return account, fmt.Errorf("locking account: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, am.config.Storage, acctLockKey); err != nil {
+			am.Logger.Error("failed to unlock account lock", zap.Error(err))
+		}
+	}()
+
+	// reload the account in case another instance changed it while we waited
+	primaryContact := getPrimaryContact(account)
+	account, err := am.loadAccount(ctx, client.Directory, primaryContact)
+	if err != nil {
+		return account, fmt.Errorf("reloading account: %w", err)
+	}
+	if olderThan > 0 && !am.accountKeyDue(ctx, client.Directory, account, olderThan) {
+		return account, nil
+	}
+
+	// if a previous rollover was interrupted after the server
+	// accepted the new key, the old key no longer works
+	nextKeyStorageKey := am.storageKeyUserNextPrivateKey(client.Directory, primaryContact)
+	if nextKeyPEM, err := am.config.Storage.Load(ctx, nextKeyStorageKey); err == nil {
+		if nextKey, err := PEMDecodePrivateKey(nextKeyPEM); err == nil {
+			found, err := client.GetAccount(ctx, acme.Account{PrivateKey: nextKey})
+			if err == nil && found.Location == account.Location {
+				am.Logger.Info("completing interrupted ACME account key rollover",
+					zap.Strings("contact", account.Contact),
+					zap.String("location", account.Location))
+				account.PrivateKey = nextKey
+				return am.finishAccountKeyRollover(ctx, client.Directory, account, nextKeyStorageKey)
+			}
+		}
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return account, fmt.Errorf("generating private key: %v", err)
+	}
+	newKeyPEM, err := PEMEncodePrivateKey(newKey)
+	if err != nil {
+		return account, err
+	}
+	if err := am.config.Storage.Store(ctx, nextKeyStorageKey, newKeyPEM); err != nil {
+		return account, fmt.Errorf("storing new account key: %v", err)
+	}
+
+	rolled, err := client.AccountKeyRollover(ctx, account, newKey)
+	if err != nil {
+		if err := am.config.Storage.Delete(ctx, nextKeyStorageKey); err != nil {
+			am.Logger.Error("could not delete unused account key",
+				zap.String("key", nextKeyStorageKey),
+				zap.Error(err))
+		}
+		return account, fmt.Errorf("rolling over key of account %v: %w", account.Contact, err)
+	}
+	am.Logger.Info("ACME account key rolled over",
+		zap.Strings("contact", rolled.Contact),
+		zap.String("location", rolled.Location))
+
+	return am.finishAccountKeyRollover(ctx, client.Directory, rolled, nextKeyStorageKey)
+}
+
+// finishAccountKeyRollover saves account, which has its new private
+// key, and deletes the new key from nextKeyStorageKey.
+func (am *ACMEIssuer) finishAccountKeyRollover(ctx context.Context, ca string, account acme.Account, nextKeyStorageKey string) (acme.Account, error) {
+	if err := am.saveAccount(ctx, ca, account); err != nil {
+		return account, fmt.Errorf("saving account %v with new key (which remains at %s): %v", account.Contact, nextKeyStorageKey, err)
+	}
+	if err := am.config.Storage.Delete(ctx, nextKeyStorageKey); err != nil {
+		am.Logger.Error("could not delete new account key after saving account",
+			zap.String("key", nextKeyStorageKey),
+			zap.Error(err))
+	}
+	return account, nil
+}
+
 // setEmail does everything it can to obtain an email address
 // from the user within the scope of memory and storage to use
 // for ACME TLS. If it cannot get an email address, it does nothing
@@ -340,11 +518,18 @@ func (am *ACMEIssuer) storageKeyUsersPrefix(caURL string) string {
 	return path.Join(am.storageKeyCAPrefix(caURL), "users")
 }
 
+// storageKeyUserPrefix returns the prefix of the account for the given email.
+// Accounts in a pool other than the first are stored under the first one's
+// prefix, so that the pool shares the email's folder.
 func (am *ACMEIssuer) storageKeyUserPrefix(caURL, email string) string {
 	if email == "" {
 		email = emptyEmail
 	}
-	return path.Join(am.storageKeyUsersPrefix(caURL), StorageKeys.Safe(email))
+	prefix := path.Join(am.storageKeyUsersPrefix(caURL), StorageKeys.Safe(email))
+	if am.accountPoolMember > 0 {
+		prefix = path.Join(prefix, "pool", strconv.Itoa(am.accountPoolMember))
+	}
+	return prefix
 }
 
 func (am *ACMEIssuer) storageKeyUserReg(caURL, email string) string {
@@ -355,6 +540,10 @@ func (am *ACMEIssuer) storageKeyUserPrivateKey(caURL, email string) string {
 	return am.storageSafeUserKey(caURL, email, "private", ".key")
 }
 
+func (am *ACMEIssuer) storageKeyUserNextPrivateKey(caURL, email string) string {
+	return am.storageSafeUserKey(caURL, email, "private", ".next.key")
+}
+
 // storageSafeUserKey returns a key for the given email, with the default
 // filename, and the filename ending in the given extension.
 func (am *ACMEIssuer) storageSafeUserKey(ca, email, defaultFilename, extension string) string {
@@ -425,7 +614,15 @@ func (am *ACMEIssuer) mostRecentAccountEmail(ctx context.Context, caURL string)
 		return "", false
 	}
 
-	account, err := am.loadOrCreateAccount(ctx, caURL, path.Base(accountList[0]))
+	// with an account pool, the first account in the pool may not exist
+	email := path.Base(accountList[0])
+	for _, iss := range am.accountPool() {
+		if account, err := iss.loadAccount(ctx, caURL, email); err == nil {
+			return getPrimaryContact(account), true
+		}
+	}
+
+	account, err := am.loadOrCreateAccount(ctx, caURL, email)
 	if err != nil {
 		return "", false
 	}
@@ -433,12 +630,14 @@ func (am *ACMEIssuer) mostRecentAccountEmail(ctx context.Context, caURL string)
 	return getPrimaryContact(account), true
 }
 
-func accountRegLockKey(acc acme.Account) string {
+func (am *ACMEIssuer) accountRegLockKey(acc acme.Account) string {
 	key := "register_acme_account"
-	if len(acc.Contact) == 0 {
-		return key
+	if len(acc.Contact) > 0 {
+		key += "_" + getPrimaryContact(acc)
+	}
+	if am.accountPoolMember > 0 {
+		key += "_" + strconv.Itoa(am.accountPoolMember)
 	}
-	key += "_" + getPrimaryContact(acc)
 	return key
 }
 
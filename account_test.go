@@ -17,6 +17,7 @@ package certmagic
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -26,6 +27,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/caddyserver/certmagic/certmagictest"
+	"github.com/mholt/acmez/v3/acme"
 	"go.uber.org/zap"
 )
 
@@ -518,6 +521,143 @@ func TestGetEmailFromRecent(t *testing.T) {
 	}
 }
 
+func TestRolloverAccountKey(t *testing.T) {
+	ctx := context.Background()
+	solver := &interruptibleDNSSolver{records: make(map[string][]string)}
+	srv := &certmagictest.Server{LookupTXT: solver.lookupTXT}
+	srv.Start()
+	defer srv.Close()
+
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{Email: "me@example.com", DNS01Solver: solver})
+	if err := iss.RolloverAccountKey(ctx); err == nil {
+		t.Error("Expected error rolling over key of unregistered account")
+	}
+	if _, err := iss.newACMEClientWithAccount(ctx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	storage := iss.config.Storage.(*FileStorage)
+	keyStorageKey := iss.storageKeyUserPrivateKey(srv.DirectoryURL(), iss.Email)
+	nextKeyStorageKey := iss.storageKeyUserNextPrivateKey(srv.DirectoryURL(), iss.Email)
+	loadKey := func() []byte {
+		t.Helper()
+		keyPEM, err := storage.Load(ctx, keyStorageKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyPEM
+	}
+	thumbprint := func() string {
+		t.Helper()
+		accounts := srv.Accounts()
+		if len(accounts) != 1 {
+			t.Fatalf("Expected 1 account, got %d", len(accounts))
+		}
+		return accounts[0].Thumbprint
+	}
+
+	// on demand
+	oldKey, oldThumbprint := loadKey(), thumbprint()
+	if err := iss.RolloverAccountKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldKey, loadKey()) || oldThumbprint == thumbprint() {
+		t.Error("Expected new account key in storage and on server")
+	}
+	if storage.Exists(ctx, nextKeyStorageKey) {
+		t.Error("Expected no leftover new key in storage")
+	}
+	if _, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"example.com"}, nil)); err != nil {
+		t.Fatalf("Issuing with new account key: %v", err)
+	}
+
+	// scheduled; only once the key is older than its lifetime
+	iss.AccountKeyLifetime = time.Hour
+	oldKey = loadKey()
+	if _, err := iss.newACMEClientWithAccount(ctx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oldKey, loadKey()) {
+		t.Error("Expected account key not to be rolled over before its lifetime")
+	}
+	setKeyCreated := func(keyCreated time.Time) {
+		t.Helper()
+		regStorageKey := iss.storageKeyUserReg(srv.DirectoryURL(), iss.Email)
+		regBytes, err := storage.Load(ctx, regStorageKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored storedAccount
+		if err := json.Unmarshal(regBytes, &stored); err != nil {
+			t.Fatal(err)
+		}
+		stored.KeyCreated = keyCreated
+		if regBytes, err = json.Marshal(stored); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Store(ctx, regStorageKey, regBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setKeyCreated(time.Time{})
+	if _, err := iss.newACMEClientWithAccount(ctx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oldKey, loadKey()) {
+		t.Error("Expected account key of unknown age not to be rolled over")
+	}
+	setKeyCreated(time.Now().Add(-2 * time.Hour))
+	if _, err := iss.newACMEClientWithAccount(ctx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldKey, loadKey()) {
+		t.Error("Expected account key to be rolled over after its lifetime")
+	}
+
+	// interrupted after the server changed keys, but before storage was updated
+	client, err := iss.newACMEClient(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := iss.loadAccount(ctx, srv.DirectoryURL(), iss.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAccount, err := iss.newAccount(iss.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeyPEM, err := PEMEncodePrivateKey(newAccount.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(ctx, nextKeyStorageKey, newKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AccountKeyRollover(ctx, account, newAccount.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := iss.RolloverAccountKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newKeyPEM, loadKey()) {
+		t.Error("Expected account key of interrupted rollover to be recovered")
+	}
+	if storage.Exists(ctx, nextKeyStorageKey) {
+		t.Error("Expected no leftover new key in storage")
+	}
+
+	// deactivation
+	if err := iss.DeactivateAccount(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if accounts := srv.Accounts(); accounts[0].Status != acme.StatusDeactivated {
+		t.Errorf("Expected account to be deactivated, got: %+v", accounts[0])
+	}
+	if storage.Exists(ctx, keyStorageKey) || storage.Exists(ctx, iss.storageKeyUserReg(srv.DirectoryURL(), iss.Email)) {
+		t.Error("Expected deactivated account to be deleted from storage")
+	}
+}
+
 // agreementTestURL is set during tests to skip requiring
 // setting up an entire ACME CA endpoint.
 var agreementTestURL string
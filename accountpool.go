@@ -0,0 +1,191 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// AccountPoolAssignment is how an ACMEIssuer with a pool of
+// accounts chooses the account to get a certificate with.
+type AccountPoolAssignment string
+
+// Supported account pool assignments.
+const (
+	// AssignAccountByIdentifier always uses the same account
+	// for the same identifier, chosen by hashing it; if a
+	// certificate has several, the first in lexical order is
+	// used. Since every instance in a cluster chooses the same
+	// account, orders can be resumed by any of them. This is
+	// the default.
+	AssignAccountByIdentifier AccountPoolAssignment = "identifier"
+
+	// AssignLeastLoadedAccount uses the account that this process
+	// has created the fewest orders with in the last 3 hours,
+	// which is a common window for per-account rate limits. Other
+	// instances in a cluster are not taken into account.
+	//
+	// Since another attempt to get a certificate is usually made
+	// with a different account, interrupted orders are abandoned
+	// rather than resumed (see ACMEIssuer.DisableOrderResumption),
+	// and certificates can only be revoked with their private key.
+	AssignLeastLoadedAccount AccountPoolAssignment = "least_loaded"
+)
+
+// accountPoolSize returns the number of accounts in the pool;
+// it is 1 if the issuer does not use a pool.
+func (am *ACMEIssuer) accountPoolSize() int {
+	if am.AccountPoolSize < 1 || am.AccountKeyPEM != "" {
+		return 1
+	}
+	return am.AccountPoolSize
+}
+
+// accountPool returns one issuer for each account in the pool,
+// which can be used to load and register that account.
+func (am *ACMEIssuer) accountPool() []*ACMEIssuer {
+	size := am.accountPoolSize()
+	if size == 1 {
+		return []*ACMEIssuer{am}
+	}
+	pool := make([]*ACMEIssuer, size)
+	for i := range pool {
+		pool[i] = am.withAccountPoolMember(i)
+	}
+	return pool
+}
+
+// withAccountPoolMember returns a copy of am that uses the
+// account with the given index in the pool. The account with
+// index 0 is the one that is used when there is no pool.
+func (am *ACMEIssuer) withAccountPoolMember(member int) *ACMEIssuer {
+	am.mu.Lock()
+	iss := *am
+	am.mu.Unlock()
+	iss.accountPoolMember = member
+	return &iss
+}
+
+// assignAccount returns an issuer that uses the account from
+// the pool that should be used to get a certificate for the
+// identifiers. If there is no pool, it returns am.
+func (am *ACMEIssuer) assignAccount(identifiers []string) *ACMEIssuer {
+	size := am.accountPoolSize()
+	if size == 1 || len(identifiers) == 0 {
+		return am
+	}
+	if am.AccountPoolAssignment == AssignLeastLoadedAccount {
+		keys := make([]string, size)
+		for i := range keys {
+			keys[i] = am.withAccountPoolMember(i).accountKey(am.CA)
+		}
+		return am.withAccountPoolMember(assignLeastLoadedAccount(keys))
+	}
+	identifier := strings.ToLower(identifiers[0])
+	for _, id := range identifiers[1:] {
+		identifier = min(identifier, strings.ToLower(id))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(identifier))
+	return am.withAccountPoolMember(int(h.Sum32() % uint32(size)))
+}
+
+// accountKey returns a key that identifies the account am uses
+// with the given CA, for keeping state about the account in memory.
+func (am *ACMEIssuer) accountKey(ca string) string {
+	key := ca + "," + am.getEmail()
+	if am.accountPoolMember > 0 {
+		key += "," + strconv.Itoa(am.accountPoolMember)
+	}
+	return key
+}
+
+// forEachRegisteredAccount calls fn for each account in the pool that
+// is registered with the issuer's primary CA. It returns an error if
+// there are none.
+func (am *ACMEIssuer) forEachRegisteredAccount(ctx context.Context, fn func(*ACMEIssuer, *acmez.Client, acme.Account) error) error {
+	client, err := am.newACMEClient(false)
+	if err != nil {
+		return fmt.Errorf("creating ACME client: %v", err)
+	}
+	if err := am.setEmail(ctx, false); err != nil {
+		return err
+	}
+	var registered int
+	for _, iss := range am.accountPool() {
+		var account acme.Account
+		if am.AccountKeyPEM != "" {
+			account, err = iss.GetAccount(ctx, []byte(am.AccountKeyPEM))
+		} else {
+			account, err = iss.loadAccount(ctx, client.Directory, iss.getEmail())
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("getting ACME account: %v", err)
+		}
+		registered++
+		if err := fn(iss, client, account); err != nil {
+			return err
+		}
+	}
+	if registered == 0 {
+		return fmt.Errorf("no registered ACME account for %s", client.Directory)
+	}
+	return nil
+}
+
+// assignLeastLoadedAccount returns the index of the account key
+// with the fewest recent orders, and counts an order for it.
+func assignLeastLoadedAccount(accountKeys []string) int {
+	accountOrdersMu.Lock()
+	defer accountOrdersMu.Unlock()
+
+	cutoff := time.Now().Add(-accountOrdersWindow)
+	least := -1
+	for i, key := range accountKeys {
+		orders := accountOrders[key]
+		for len(orders) > 0 && orders[0].Before(cutoff) {
+			orders = orders[1:]
+		}
+		accountOrders[key] = orders
+		if least < 0 || len(orders) < len(accountOrders[accountKeys[least]]) {
+			least = i
+		}
+	}
+	accountOrders[accountKeys[least]] = append(accountOrders[accountKeys[least]], time.Now())
+	return least
+}
+
+// accountOrders holds the times of recent orders by account key,
+// for choosing the least-loaded account from a pool.
+var (
+	accountOrders   = make(map[string][]time.Time)
+	accountOrdersMu sync.Mutex
+)
+
+const accountOrdersWindow = 3 * time.Hour
@@ -0,0 +1,171 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/caddyserver/certmagic/certmagictest"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestAccountPoolByIdentifier(t *testing.T) {
+	ctx := context.Background()
+	solver := &interruptibleDNSSolver{records: make(map[string][]string)}
+	srv := &certmagictest.Server{LookupTXT: solver.lookupTXT}
+	srv.Start()
+	defer srv.Close()
+
+	const email = "pool@example.com"
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{Email: email, DNS01Solver: solver, AccountPoolSize: 3})
+	iss.email = email
+
+	names := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com", "f.example.com"}
+	for range 2 {
+		for _, name := range names {
+			if _, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{name}, nil)); err != nil {
+				t.Fatalf("Issuing for %s: %v", name, err)
+			}
+		}
+	}
+
+	// each identifier always uses the same account from the pool
+	accountsByName := make(map[string]string)
+	for _, order := range srv.Orders() {
+		name := order.Identifiers[0].Value
+		if acct, ok := accountsByName[name]; ok && acct != order.Account {
+			t.Errorf("Expected %s to always use account %s, also used %s", name, acct, order.Account)
+		}
+		accountsByName[name] = order.Account
+	}
+	for _, name := range names {
+		member := iss.assignAccount([]string{name})
+		account, err := member.loadAccount(ctx, srv.DirectoryURL(), email)
+		if err != nil {
+			t.Fatalf("Loading account %d for %s: %v", member.accountPoolMember, name, err)
+		}
+		if account.Location != accountsByName[name] {
+			t.Errorf("Expected %s to use account %d (%s), got %s", name, member.accountPoolMember, account.Location, accountsByName[name])
+		}
+		expectPrefix := path.Join(iss.storageKeyUsersPrefix(srv.DirectoryURL()), email)
+		if member.accountPoolMember > 0 {
+			expectPrefix = path.Join(expectPrefix, "pool", fmt.Sprint(member.accountPoolMember))
+		}
+		if actual := path.Dir(member.storageKeyUserReg(srv.DirectoryURL(), email)); actual != expectPrefix {
+			t.Errorf("Expected account %d in %s, got %s", member.accountPoolMember, expectPrefix, actual)
+		}
+	}
+	if accounts := srv.Accounts(); len(accounts) < 2 || len(accounts) > 3 {
+		t.Errorf("Expected orders to be spread across 2 or 3 accounts, got %d", len(accounts))
+	}
+
+	// the email is found even if the first account in the pool does not exist
+	_ = iss.deleteAccountLocally(ctx, srv.DirectoryURL(), acme.Account{Contact: []string{"mailto:" + email}})
+	if actual, ok := iss.mostRecentAccountEmail(ctx, srv.DirectoryURL()); !ok || actual != email {
+		t.Errorf("Expected most recent account email %s, got %q (ok=%t)", email, actual, ok)
+	}
+
+	// all accounts in the pool that are in storage are deactivated together
+	var stored int
+	for _, member := range iss.accountPool() {
+		if _, err := member.loadAccount(ctx, srv.DirectoryURL(), email); err == nil {
+			stored++
+		}
+	}
+	if err := iss.DeactivateAccount(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var deactivated int
+	for _, account := range srv.Accounts() {
+		if account.Status == acme.StatusDeactivated {
+			deactivated++
+		}
+	}
+	if deactivated != stored {
+		t.Errorf("Expected %d accounts to be deactivated, got %d", stored, deactivated)
+	}
+}
+
+func TestAccountPoolLeastLoaded(t *testing.T) {
+	ctx := context.Background()
+	solver := &interruptibleDNSSolver{records: make(map[string][]string)}
+	srv := &certmagictest.Server{LookupTXT: solver.lookupTXT}
+	srv.Start()
+	defer srv.Close()
+
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{
+		DNS01Solver:           solver,
+		AccountPoolSize:       2,
+		AccountPoolAssignment: AssignLeastLoadedAccount,
+	})
+
+	var issued []CertificateResource
+	for i := range 4 {
+		key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"example.com"}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := iss.Issue(ctx, csr)
+		if err != nil {
+			t.Fatalf("Issuance %d: %v", i, err)
+		}
+		keyPEM, err := PEMEncodePrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issued = append(issued, CertificateResource{CertificatePEM: cert.Certificate, PrivateKeyPEM: keyPEM})
+	}
+
+	ordersByAccount := make(map[string]int)
+	for _, order := range srv.Orders() {
+		ordersByAccount[order.Account]++
+	}
+	if len(ordersByAccount) != 2 {
+		t.Fatalf("Expected 2 accounts, got %d", len(ordersByAccount))
+	}
+	for acct, orders := range ordersByAccount {
+		if orders != 2 {
+			t.Errorf("Expected 2 orders with account %s, got %d", acct, orders)
+		}
+	}
+
+	// the account that got a certificate is not known, but its key can revoke it
+	if err := iss.Revoke(ctx, CertificateResource{CertificatePEM: issued[0].CertificatePEM}, acme.ReasonSuperseded); err == nil {
+		t.Error("Expected revocation without the private key to fail")
+	}
+	for _, cert := range issued {
+		if err := iss.Revoke(ctx, cert, acme.ReasonSuperseded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, cert := range srv.Certificates() {
+		if !cert.Revoked {
+			t.Errorf("Expected certificate %d to be revoked", i)
+		}
+	}
+}
@@ -67,7 +67,7 @@ func (iss *ACMEIssuer) newACMEClientWithAccount(ctx context.Context, useTestCA,
 			zap.String("location", account.Location))
 
 		// synchronize this so the account is only created once
-		acctLockKey := accountRegLockKey(account)
+		acctLockKey := iss.accountRegLockKey(account)
 		err = acquireLock(ctx, iss.config.Storage, acctLockKey)
 		if err != nil {
 			return nil, fmt.Errorf("locking account registration: %v", err)
@@ -156,6 +156,21 @@ func (iss *ACMEIssuer) newACMEClientWithAccount(ctx context.Context, useTestCA,
 		}
 	}
 
+	// roll over the account key if it is due; by checking first
+	// without the lock, we avoid locking whenever the account is used
+	if iss.AccountKeyLifetime > 0 && iss.AccountKeyPEM == "" &&
+		iss.accountKeyDue(ctx, client.Directory, account, iss.AccountKeyLifetime) {
+		rolled, err := iss.rolloverAccountKey(ctx, client, account, iss.AccountKeyLifetime)
+		if err != nil {
+			iss.Logger.Error("could not roll over ACME account key; continuing with current key",
+				zap.Strings("contact", account.Contact),
+				zap.String("location", account.Location),
+				zap.Error(err))
+		} else {
+			account = rolled
+		}
+	}
+
 	c := &acmeClient{
 		iss:        iss,
 		acmeClient: client,
@@ -188,6 +203,7 @@ func (iss *ACMEIssuer) newACMEClient(useTestCA bool) (*acmez.Client, error) {
 	// configure challenges (most of the time, DNS challenge is
 	// exclusive of other ones because it is usually only used
 	// in situations where the default challenges would fail)
+	var preferred []string // challenge types to prefer, in order
 	if iss.DNS01Solver == nil {
 		// enable HTTP-01 challenge
 		if !iss.DisableHTTPChallenge {
@@ -223,6 +239,22 @@ func (iss *ACMEIssuer) newACMEClient(useTestCA bool) (*acmez.Client, error) {
 	} else {
 		// use DNS challenge exclusively
 		client.ChallengeSolvers[acme.ChallengeTypeDNS01] = iss.DNS01Solver
+
+		// and prefer dns-account-01 if the solver can solve it
+		if solver, ok := iss.DNS01Solver.(DNSAccount01Solver); ok && solver.SupportsDNSAccount01() {
+			client.ChallengeSolvers[acme.ChallengeTypeDNSAccount01] = iss.DNS01Solver
+			preferred = append(preferred, acme.ChallengeTypeDNSAccount01)
+		}
+	}
+
+	// the persistent DNS challenge needs no DNS changes once its
+	// record exists, so it is preferred over all other challenges
+	if iss.DNSPersist01Solver != nil {
+		client.ChallengeSolvers[ChallengeTypeDNSPersist01] = iss.DNSPersist01Solver
+		preferred = append([]string{ChallengeTypeDNSPersist01}, preferred...)
+	}
+	if len(preferred) > 0 {
+		preferChallenges(client, preferred, iss.challengeFailures)
 	}
 
 	// wrap solvers in our wrapper so that we can keep track of challenge
@@ -309,8 +341,8 @@ func (iss *ACMEIssuer) getTLSALPNPort() int {
 func (c *acmeClient) throttle(ctx context.Context, names []string) error {
 	email := c.iss.getEmail()
 
-	// throttling is scoped to CA + account email
-	rateLimiterKey := c.acmeClient.Directory + "," + email
+	// throttling is scoped to CA + account email (+ account in pool)
+	rateLimiterKey := c.iss.accountKey(c.acmeClient.Directory)
 	rateLimitersMu.Lock()
 	rl, ok := rateLimiters[rateLimiterKey]
 	if !ok {
@@ -336,6 +368,28 @@ func (c *acmeClient) throttle(ctx context.Context, names []string) error {
 	return nil
 }
 
+// solverContext returns a context for solving the challenges of an
+// order with c, which has the information some DNS challenges need:
+// the account, and the issuer domain names of the CA, if known. It
+// also scopes batches of DNS records to the order.
+func (c *acmeClient) solverContext(ctx context.Context) context.Context {
+	ctx = ContextWithACMEAccount(ctx, c.account)
+	ctx = contextWithDNSBatches(ctx)
+	if names := knownIssuerDomainNames(c.acmeClient.Directory); len(names) > 0 {
+		ctx = context.WithValue(ctx, ctxKeyIssuerDomainNames, names)
+	}
+	return ctx
+}
+
+// rateLimitAccount returns the account that CA rate limits
+// encountered by c apply to (see CARateLimits).
+func (c *acmeClient) rateLimitAccount() string {
+	if c.account.Location == "" {
+		return c.acmeClient.Directory
+	}
+	return c.account.Location
+}
+
 func (c *acmeClient) usingTestCA() bool {
 	return c.iss.TestCA != "" && c.acmeClient.Directory == c.iss.TestCA
 }
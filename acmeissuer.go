@@ -63,6 +63,28 @@ type ACMEIssuer struct {
 	// can be looked up with the ACME protocol
 	AccountKeyPEM string
 
+	// If set, the private key of the ACME account
+	// is rolled over to a new one when it is older
+	// than this, which is checked whenever the
+	// account is used; has no effect if
+	// AccountKeyPEM is set
+	AccountKeyLifetime time.Duration
+
+	// The number of ACME accounts to use with
+	// each CA; if more than 1, orders are spread
+	// across the accounts to stay within per-account
+	// rate limits (such as for new orders) when
+	// managing many certificates, and each account
+	// has its own internal rate limiter. Has no
+	// effect if AccountKeyPEM is set. Accounts are
+	// created as needed with the same email address.
+	AccountPoolSize int
+
+	// How to choose the account from the pool for
+	// each certificate; default is to choose it by
+	// identifier (see AccountPoolAssignment)
+	AccountPoolAssignment AccountPoolAssignment
+
 	// Set to true if agreed to the CA's
 	// subscriber agreement
 	Agreed bool
@@ -102,6 +124,17 @@ type ACMEIssuer struct {
 	// as read from request URI
 	DisableDistributedSolvers bool
 
+	// Disable persisting in-flight orders to storage;
+	// by default, orders are persisted so that if
+	// issuance is interrupted (for example, by a
+	// restart), the order can be resumed by the next
+	// attempt, even on another instance, instead of
+	// creating a new one and using up rate limits;
+	// the private key of a certificate is then also
+	// kept in storage while it is being issued, since
+	// finalized orders can only be resumed with it
+	DisableOrderResumption bool
+
 	// The host (ONLY the host, not port) to listen
 	// on if necessary to start a listener to solve
 	// an ACME challenge
@@ -124,6 +157,14 @@ type ACMEIssuer struct {
 	// from this package
 	DNS01Solver acmez.Solver
 
+	// The solver for the dns-persist-01 challenge;
+	// usually this is a DNSPersist01Solver value
+	// from this package. If set, this challenge is
+	// preferred over all others when the CA offers
+	// it, so once its record exists, renewals need
+	// no DNS changes at all
+	DNSPersist01Solver acmez.Solver
+
 	// TrustedRoots specifies a pool of root CA
 	// certificates to trust when communicating
 	// over a network to a peer.
@@ -151,6 +192,18 @@ type ACMEIssuer struct {
 	// certificate chains
 	PreferredChains ChainPreference
 
+	// If set, the CAA records of names are checked
+	// before ordering certificates, so that names
+	// whose CAA records do not allow the CA fail
+	// early with a CAAError
+	CAACheck *CAACheck
+
+	// If set, whether the CA can reach this node or
+	// cluster is checked before ordering certificates,
+	// and challenge types that cannot succeed are not
+	// tried
+	ReachabilityCheck *ReachabilityCheck
+
 	// Set a logger to configure logging; a default
 	// logger must always be set; if no logging is
 	// desired, set this to zap.NewNop().
@@ -163,6 +216,15 @@ type ACMEIssuer struct {
 	config     *Config
 	httpClient *http.Client
 
+	// the index of the account to use in the
+	// account pool (see withAccountPoolMember)
+	accountPoolMember int
+
+	// the preferred challenges that have failed for
+	// identifiers, which are not preferred for them
+	// anymore (see preferChallenges); shared by copies
+	challengeFailures *challengeFailureCache
+
 	// Some fields are changed on-the-fly during
 	// certificate management. For example, the
 	// email might be implicitly discovered if not
@@ -204,6 +266,15 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.AccountKeyPEM == "" {
 		template.AccountKeyPEM = DefaultACME.AccountKeyPEM
 	}
+	if template.AccountKeyLifetime == 0 {
+		template.AccountKeyLifetime = DefaultACME.AccountKeyLifetime
+	}
+	if template.AccountPoolSize == 0 {
+		template.AccountPoolSize = DefaultACME.AccountPoolSize
+	}
+	if template.AccountPoolAssignment == "" {
+		template.AccountPoolAssignment = DefaultACME.AccountPoolAssignment
+	}
 	if !template.Agreed {
 		template.Agreed = DefaultACME.Agreed
 	}
@@ -222,6 +293,9 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if !template.DisableTLSALPNChallenge {
 		template.DisableTLSALPNChallenge = DefaultACME.DisableTLSALPNChallenge
 	}
+	if !template.DisableOrderResumption {
+		template.DisableOrderResumption = DefaultACME.DisableOrderResumption
+	}
 	if template.ListenHost == "" {
 		template.ListenHost = DefaultACME.ListenHost
 	}
@@ -234,6 +308,9 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.DNS01Solver == nil {
 		template.DNS01Solver = DefaultACME.DNS01Solver
 	}
+	if template.DNSPersist01Solver == nil {
+		template.DNSPersist01Solver = DefaultACME.DNSPersist01Solver
+	}
 	if template.TrustedRoots == nil {
 		template.TrustedRoots = DefaultACME.TrustedRoots
 	}
@@ -246,6 +323,12 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.NewAccountFunc == nil {
 		template.NewAccountFunc = DefaultACME.NewAccountFunc
 	}
+	if template.CAACheck == nil {
+		template.CAACheck = DefaultACME.CAACheck
+	}
+	if template.ReachabilityCheck == nil {
+		template.ReachabilityCheck = DefaultACME.ReachabilityCheck
+	}
 	if template.Logger == nil {
 		template.Logger = DefaultACME.Logger
 	}
@@ -264,6 +347,7 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 
 	template.config = cfg
 	template.mu = new(sync.Mutex)
+	template.challengeFailures = new(challengeFailureCache)
 
 	// set up the dialer and transport / HTTP client
 	dialer := &net.Dialer{
@@ -372,7 +456,13 @@ func (am *ACMEIssuer) PreCheck(ctx context.Context, names []string, interactive
 			}
 		}
 	}
-	return am.setEmail(ctx, interactive)
+	if err := am.setEmail(ctx, interactive); err != nil {
+		return err
+	}
+	if am.CAACheck != nil {
+		return am.checkCAA(ctx, names)
+	}
+	return nil
 }
 
 // Issue implements the Issuer interface. It obtains a certificate for the given csr using
@@ -424,6 +514,10 @@ func (am *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (
 			// externally; it is hard to tell which! one easy cue is whether the
 			// error is specifically a 429 (Too Many Requests); if so, we should
 			// probably keep retrying
+			if errors.As(err, new(ErrRateLimited)) {
+				// keep retrying once the rate limit expires
+				return nil, err
+			}
 			var problem acme.Problem
 			if errors.As(err, &problem) {
 				if problem.Status == http.StatusTooManyRequests {
@@ -446,13 +540,25 @@ func (am *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (
 
 func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest, attempts int) (*IssuedCertificate, bool, error) {
 	useTestCA := attempts > 0
-	client, err := am.newACMEClientWithAccount(ctx, useTestCA, false)
+	nameSet := namesFromCSR(csr)
+	iss, err := am.withReachableChallenges(ctx, nameSet)
+	if err != nil {
+		return nil, false, err
+	}
+	client, err := iss.assignAccount(nameSet).newACMEClientWithAccount(ctx, useTestCA, false)
 	if err != nil {
 		return nil, false, err
 	}
 	usingTestCA := client.usingTestCA()
 
-	nameSet := namesFromCSR(csr)
+	// DNS challenge records are named after, or authorize, the account
+	ctx = client.solverContext(ctx)
+
+	// don't ask for certificates the CA has said it won't issue yet
+	if err := am.config.CARateLimits.check(ctx, client.rateLimitAccount(), nameSet); err != nil {
+		return nil, usingTestCA, err
+	}
+	retryAfter := recordRetryAfter(client.acmeClient)
 
 	if !useTestCA {
 		if err := client.throttle(ctx, nameSet); err != nil {
@@ -488,9 +594,27 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 		}
 	}
 
-	// do this in a loop because there's an error case that may necessitate a retry, but not more than once
+	// if an earlier attempt was interrupted, try to complete its order first
 	var certChains []acme.Certificate
+	if !am.DisableOrderResumption {
+		certChains, err = am.resumeOrder(ctx, client, csr, params.Identifiers)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, usingTestCA, err
+			}
+			am.Logger.Warn("could not resume in-flight order; creating new order",
+				zap.Strings("identifiers", nameSet),
+				zap.Error(err))
+		}
+		am.recordOrders(client, csr)
+	}
+
+	// do this in a loop because there's an error case that may necessitate a retry, but not more than once
 	for range 2 {
+		if len(certChains) > 0 {
+			break // resumed an in-flight order
+		}
+
 		am.Logger.Info("using ACME account",
 			zap.String("account_id", params.Account.Location),
 			zap.Strings("account_contact", params.Account.Contact))
@@ -502,29 +626,38 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 				am.Logger.Warn("ACME account does not exist on server; attempting to recreate",
 					zap.String("account_id", client.account.Location),
 					zap.Strings("account_contact", client.account.Contact),
-					zap.String("key_location", am.storageKeyUserPrivateKey(client.acmeClient.Directory, am.getEmail())),
+					zap.String("key_location", client.iss.storageKeyUserPrivateKey(client.acmeClient.Directory, am.getEmail())),
 					zap.Any("problem", prob))
 
 				// the account we have no longer exists on the CA, so we need to create a new one;
 				// we could use the same key pair, but this is a good opportunity to rotate keys
 				// (see https://caddy.community/t/acme-account-is-not-regenerated-when-acme-server-gets-reinstalled/22627)
 				// (basically this happens if the CA gets reset or reinstalled; usually just internal PKI)
-				err := am.deleteAccountLocally(ctx, client.iss.CA, client.account)
+				err := client.iss.deleteAccountLocally(ctx, client.iss.CA, client.account)
 				if err != nil {
 					return nil, usingTestCA, fmt.Errorf("%v ACME account no longer exists on CA, but resetting our local copy of the account info failed: %v", nameSet, err)
 				}
 
 				// recreate account and try again
-				client, err = am.newACMEClientWithAccount(ctx, useTestCA, false)
+				client, err = client.iss.newACMEClientWithAccount(ctx, useTestCA, false)
 				if err != nil {
 					return nil, false, err
 				}
+				ctx = client.solverContext(ctx)
+				if !am.DisableOrderResumption {
+					am.recordOrders(client, csr)
+				}
+				retryAfter = recordRetryAfter(client.acmeClient)
 				continue
 			}
-			return nil, usingTestCA, fmt.Errorf("%v %w (ca=%s)", nameSet, err, client.acmeClient.Directory)
+			err = fmt.Errorf("%v %w (ca=%s)", nameSet, err, client.acmeClient.Directory)
+			return nil, usingTestCA, am.config.rateLimitError(ctx, client.rateLimitAccount(), nameSet, err, retryAfter())
 		}
 		break
 	}
+	if !am.DisableOrderResumption {
+		am.deleteOrder(ctx, am.storageKeyOrder(client.acmeClient.Directory, params.Identifiers))
+	}
 	if len(certChains) == 0 {
 		return nil, usingTestCA, fmt.Errorf("no certificate chains")
 	}
@@ -615,12 +748,36 @@ func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.C
 
 // Revoke implements the Revoker interface. It revokes the given certificate.
 func (am *ACMEIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
-	client, err := am.newACMEClientWithAccount(ctx, false, false)
+	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
 	if err != nil {
 		return err
 	}
 
-	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
+	// with an account pool, the account that got the certificate may not
+	// be known, but any holder of the certificate's key can revoke it
+	if am.accountPoolSize() > 1 && am.AccountPoolAssignment == AssignLeastLoadedAccount {
+		if len(cert.PrivateKeyPEM) == 0 {
+			return fmt.Errorf("the private key of the certificate is required to revoke it, since the account that obtained it is not known with account pool assignment %q", am.AccountPoolAssignment)
+		}
+		certKey, err := PEMDecodePrivateKey(cert.PrivateKeyPEM)
+		if err != nil {
+			return fmt.Errorf("decoding certificate private key: %v", err)
+		}
+		client, err := am.newACMEClient(false)
+		if err != nil {
+			return err
+		}
+		return client.RevokeCertificate(ctx, acme.Account{}, certs[0], certKey, reason)
+	}
+
+	names := certs[0].DNSNames
+	if certs[0].Subject.CommonName != "" {
+		names = append([]string{certs[0].Subject.CommonName}, names...)
+	}
+	for _, ip := range certs[0].IPAddresses {
+		names = append(names, ip.String())
+	}
+	client, err := am.assignAccount(names).newACMEClientWithAccount(ctx, false, false)
 	if err != nil {
 		return err
 	}
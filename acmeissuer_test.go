@@ -1,3 +1,311 @@
 package certmagic
 
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic/certmagictest"
+	"github.com/mholt/acmez/v3/acme"
+)
+
 const dummyCA = "https://example.com/acme/directory"
+
+func TestACMEIssuerIssue(t *testing.T) {
+	ctx := context.Background()
+	httpPort := freeTCPPort(t)
+	srv := &certmagictest.Server{
+		HTTPChallengeAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(httpPort)),
+		AlternateChains:   1,
+	}
+	srv.Start()
+	defer srv.Close()
+
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{
+		AltHTTPPort:             httpPort,
+		DisableTLSALPNChallenge: true,
+		PreferredChains:         ChainPreference{RootCommonName: []string{srv.Roots()[1].Subject.CommonName}},
+	})
+
+	issued, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"example.com"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs[0].DNSNames) != 1 || certs[0].DNSNames[0] != "example.com" {
+		t.Errorf("Expected certificate for example.com, got: %v", certs[0].DNSNames)
+	}
+	if root := srv.Roots()[1]; certs[len(certs)-1].Issuer.CommonName != root.Subject.CommonName {
+		t.Errorf("Expected preferred chain to %s, got chain to %s", root.Subject.CommonName, certs[len(certs)-1].Issuer.CommonName)
+	}
+	if orders := srv.Orders(); len(orders) != 1 || len(orders[0].Challenges) != 1 || orders[0].Challenges[0] != acme.ChallengeTypeHTTP01 {
+		t.Errorf("Expected one order validated with http-01, got: %+v", orders)
+	}
+
+	if err := iss.Revoke(ctx, CertificateResource{CertificatePEM: issued.Certificate}, acme.ReasonSuperseded); err != nil {
+		t.Fatal(err)
+	}
+	if issuedCerts := srv.Certificates(); !issuedCerts[0].Revoked || issuedCerts[0].RevocationReason != acme.ReasonSuperseded {
+		t.Errorf("Expected certificate to be revoked, got: %+v", issuedCerts[0])
+	}
+
+	// CA errors are surfaced as ACME problems
+	srv.InjectError(certmagictest.EndpointNewOrder, 1, certmagictest.RateLimited(time.Minute))
+	_, err = iss.Issue(ctx, makeInternalTestCSR(t, []string{"example.com"}, nil))
+	var problem acme.Problem
+	if !errors.As(err, &problem) || problem.Status != http.StatusTooManyRequests {
+		t.Errorf("Expected rate limit error, got: %v", err)
+	}
+	if accounts := srv.Accounts(); len(accounts) != 1 {
+		t.Errorf("Expected account to be reused, got %d accounts", len(accounts))
+	}
+}
+
+func TestACMEIssuerResumeOrder(t *testing.T) {
+	ctx := context.Background()
+	solver := &interruptibleDNSSolver{records: make(map[string][]string)}
+	srv := &certmagictest.Server{LookupTXT: solver.lookupTXT}
+	srv.Start()
+	defer srv.Close()
+
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{DNS01Solver: solver})
+	orderKey := func(name string) string {
+		return iss.storageKeyOrder(srv.DirectoryURL(), []acme.Identifier{{Type: "dns", Value: name}})
+	}
+
+	// interrupted while presenting the challenge; the order is kept
+	csr := makeInternalTestCSR(t, []string{"example.com"}, nil)
+	interruptedCtx, cancel := context.WithCancel(ctx)
+	solver.setInterrupt(cancel)
+	if _, err := iss.Issue(interruptedCtx, csr); err == nil {
+		t.Fatal("Expected interrupted issuance to fail")
+	}
+	solver.setInterrupt(nil)
+	if !iss.config.Storage.Exists(ctx, orderKey("example.com")) {
+		t.Fatal("Expected in-flight order in storage")
+	}
+
+	// the next attempt completes the same order
+	if _, err := iss.Issue(ctx, csr); err != nil {
+		t.Fatal(err)
+	}
+	if orders := srv.Orders(); len(orders) != 1 || orders[0].Status != acme.StatusValid {
+		t.Fatalf("Expected the one order to be resumed, got: %+v", orders)
+	}
+	if iss.config.Storage.Exists(ctx, orderKey("example.com")) {
+		t.Error("Expected completed order to be removed from storage")
+	}
+
+	// interrupted after finalizing; the certificate can only be
+	// downloaded when resuming with the same key, otherwise the
+	// order is abandoned for a new one
+	downloadFailure := certmagictest.Error{Problem: acme.Problem{
+		Type:   acme.ProblemTypeUnauthorized,
+		Status: http.StatusForbidden,
+		Detail: "download interrupted",
+	}}
+	csr = makeInternalTestCSR(t, []string{"example.net"}, nil)
+	for i, tc := range []struct {
+		csr          *x509.CertificateRequest
+		expectOrders int
+	}{
+		{csr: csr, expectOrders: 2},
+		{csr: makeInternalTestCSR(t, []string{"example.net"}, nil), expectOrders: 4},
+	} {
+		srv.InjectError(certmagictest.EndpointCertificate, 1, downloadFailure)
+		if _, err := iss.Issue(ctx, csr); err == nil {
+			t.Fatalf("Test %d: Expected interrupted download to fail", i)
+		}
+		if _, err := iss.Issue(ctx, tc.csr); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if orders := srv.Orders(); len(orders) != tc.expectOrders {
+			t.Errorf("Test %d: Expected %d orders, got %d", i, tc.expectOrders, len(orders))
+		}
+	}
+}
+
+func TestConfigInFlightPrivateKey(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+	}
+	resumer := &ACMEIssuer{}
+
+	_, keyPEM1, err := cfg.certPrivateKey(ctx, "example.com", P256, []Issuer{newSelfSigningIssuer(t), resumer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keyPEM2, err := cfg.certPrivateKey(ctx, "example.com", P256, []Issuer{resumer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keyPEM1, keyPEM2) {
+		t.Error("Expected key of interrupted issuance to be reused")
+	}
+
+	cfg.deleteInFlightPrivateKey(ctx, "example.com")
+	_, keyPEM3, err := cfg.certPrivateKey(ctx, "example.com", P256, []Issuer{newSelfSigningIssuer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(keyPEM1, keyPEM3) {
+		t.Error("Expected new key after issuance completed")
+	}
+	if _, err := cfg.Storage.Stat(ctx, inFlightPrivateKeyStorageKey("example.com")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected no key in storage for issuers that do not resume orders, got: %v", err)
+	}
+
+	// keys that can't be used anymore are not kept around
+	storage := cfg.Storage.(*FileStorage)
+	_, keyPEM4, err := cfg.certPrivateKey(ctx, "example.com", P256, []Issuer{resumer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-inFlightPrivateKeyMaxAge - time.Hour)
+	if err := os.Chtimes(storage.Filename(inFlightPrivateKeyStorageKey("example.com")), past, past); err != nil {
+		t.Fatal(err)
+	}
+	_, keyPEM5, err := cfg.certPrivateKey(ctx, "example.com", P256, []Issuer{resumer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(keyPEM4, keyPEM5) {
+		t.Error("Expected stale key not to be reused")
+	}
+	if _, _, err := cfg.certPrivateKey(ctx, "example.com", P256, []Issuer{newSelfSigningIssuer(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.Storage.Stat(ctx, inFlightPrivateKeyStorageKey("example.com")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected leftover key to be deleted once no issuer resumes orders, got: %v", err)
+	}
+
+	// keeping the key is best-effort
+	readOnly := &Config{Storage: readOnlyStorage{cfg.Storage}, Logger: defaultTestLogger}
+	if _, _, err := readOnly.certPrivateKey(ctx, "example.com", P256, []Issuer{resumer}); err != nil {
+		t.Errorf("Expected key even if it cannot be stored, got: %v", err)
+	}
+}
+
+func TestConfigDeletesInFlightPrivateKeyOnFailure(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{rejectingResumer{}},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		DisableStorageCheck: true,
+		Logger:              defaultTestLogger,
+	})
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err == nil {
+		t.Fatal("Expected issuance to fail")
+	}
+	if _, err := cfg.Storage.Stat(ctx, inFlightPrivateKeyStorageKey("example.com")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected key to be deleted after issuance failed for good, got: %v", err)
+	}
+}
+
+// readOnlyStorage is a Storage for tests that fails to store anything.
+type readOnlyStorage struct{ Storage }
+
+func (readOnlyStorage) Store(context.Context, string, []byte) error {
+	return errors.New("read-only storage")
+}
+
+// rejectingResumer is an Issuer for tests that resumes orders
+// and fails every issuance with an error that is not retried.
+type rejectingResumer struct{}
+
+func (rejectingResumer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	return nil, ErrNoRetry{errors.New("identifier rejected")}
+}
+
+func (rejectingResumer) IssuerKey() string { return "rejecting" }
+
+func (rejectingResumer) resumesOrders() bool { return true }
+
+// interruptibleDNSSolver is a dns-01 solver for tests that keeps
+// records in memory and can simulate being interrupted.
+type interruptibleDNSSolver struct {
+	mu        sync.Mutex
+	records   map[string][]string
+	interrupt context.CancelFunc
+}
+
+func (s *interruptibleDNSSolver) setInterrupt(interrupt context.CancelFunc) {
+	s.mu.Lock()
+	s.interrupt = interrupt
+	s.mu.Unlock()
+}
+
+func (s *interruptibleDNSSolver) Present(ctx context.Context, chal acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.interrupt != nil {
+		s.interrupt()
+		return ctx.Err()
+	}
+	name := strings.TrimSuffix(chal.DNS01TXTRecordName(), ".")
+	s.records[name] = append(s.records[name], chal.DNS01KeyAuthorization())
+	return nil
+}
+
+func (s *interruptibleDNSSolver) CleanUp(_ context.Context, chal acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, strings.TrimSuffix(chal.DNS01TXTRecordName(), "."))
+	return nil
+}
+
+func (s *interruptibleDNSSolver) lookupTXT(_ context.Context, fqdn string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[strings.TrimSuffix(fqdn, ".")], nil
+}
+
+func newTestACMEIssuer(t *testing.T, srv *certmagictest.Server, template ACMEIssuer) *ACMEIssuer {
+	t.Helper()
+	cfg := &Config{
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		certCache: new(Cache),
+	}
+	template.CA = srv.DirectoryURL()
+	template.TrustedRoots = srv.TrustedRoots()
+	template.Agreed = true
+	template.ListenHost = "127.0.0.1"
+	template.Logger = defaultTestLogger
+	template.HTTPProxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	iss := NewACMEIssuer(cfg, template)
+	cfg.Issuers = []Issuer{iss}
+	return iss
+}
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
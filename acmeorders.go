@@ -0,0 +1,411 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// acmeOrder is an in-flight ACME order as persisted to storage, so
+// that issuance can resume it after being interrupted (for example,
+// by a restart, or on another instance) instead of creating a new
+// order. Orders are persisted and resumed while the Config holds
+// the issuance lock for the certificate.
+type acmeOrder struct {
+	// The URL of the order.
+	Location string `json:"location"`
+
+	// The URL of the account the order belongs to.
+	Account string `json:"account"`
+
+	// The identifiers of the order.
+	Identifiers []acme.Identifier `json:"identifiers"`
+
+	// The URLs of the authorizations of the order.
+	Authorizations []string `json:"authorizations,omitempty"`
+
+	// The hex-encoded SHA-256 of the public key of the CSR
+	// the order was created for. Once an order is finalized,
+	// its certificate is for that key, so it can only be
+	// resumed with a CSR for the same key; the Config keeps
+	// the key in storage while issuance is in flight (see
+	// Config.certPrivateKey).
+	CSRKeySHA256 string `json:"csr_key_sha256"`
+
+	// When the order was created, and when it expires.
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// resumeOrder resumes the order persisted for the identifiers of csr,
+// if there is one, and returns the resulting certificate chains. It
+// returns nil chains and no error if there is no order to resume, or
+// if the order cannot be completed; then, a new order should be made.
+func (am *ACMEIssuer) resumeOrder(ctx context.Context, client *acmeClient, csr *x509.CertificateRequest, identifiers []acme.Identifier) ([]acme.Certificate, error) {
+	orderKey := am.storageKeyOrder(client.acmeClient.Directory, identifiers)
+	orderBytes, err := am.config.Storage.Load(ctx, orderKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading in-flight order: %v", err)
+	}
+	var record acmeOrder
+	if err := json.Unmarshal(orderBytes, &record); err != nil {
+		return nil, am.abandonOrder(ctx, orderKey, fmt.Errorf("decoding in-flight order: %v", err))
+	}
+	if record.Account != client.account.Location {
+		return nil, am.abandonOrder(ctx, orderKey, fmt.Errorf("in-flight order %s belongs to different account %s", record.Location, record.Account))
+	}
+	if !record.Expires.IsZero() && time.Now().After(record.Expires) {
+		return nil, am.abandonOrder(ctx, orderKey, fmt.Errorf("in-flight order %s expired", record.Location))
+	}
+
+	logger := am.Logger.With(zap.String("order", record.Location), zap.Strings("identifiers", namesFromCSR(csr)))
+	logger.Info("resuming in-flight order")
+
+	acc := client.account
+	order, err := client.acmeClient.GetOrder(ctx, acc, acme.Order{Location: record.Location})
+	if err != nil {
+		return nil, am.abandonOrder(ctx, orderKey, fmt.Errorf("getting in-flight order %s: %w", record.Location, err))
+	}
+
+	if order.Status == acme.StatusPending {
+		logger.Info("solving remaining authorizations of in-flight order")
+		if err := am.solvePendingAuthorizations(ctx, client, order); err != nil {
+			return nil, fmt.Errorf("solving authorizations of in-flight order %s: %w", record.Location, err)
+		}
+		order, err = client.acmeClient.GetOrder(ctx, acc, order)
+		if err != nil {
+			return nil, fmt.Errorf("getting in-flight order %s: %w", record.Location, err)
+		}
+	}
+
+	switch order.Status {
+	case acme.StatusReady:
+		order, err = client.acmeClient.FinalizeOrder(ctx, acc, order, csr.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("finalizing in-flight order %s: %w", record.Location, err)
+		}
+
+	case acme.StatusProcessing, acme.StatusValid:
+		if csrKeySHA256(csr) != record.CSRKeySHA256 {
+			return nil, am.abandonOrder(ctx, orderKey, fmt.Errorf("in-flight order %s was finalized with a different key", record.Location))
+		}
+		order, err = pollOrder(ctx, client.acmeClient, acc, order)
+		if err != nil {
+			return nil, fmt.Errorf("waiting for in-flight order %s: %w", record.Location, err)
+		}
+
+	default:
+		return nil, am.abandonOrder(ctx, orderKey, fmt.Errorf("in-flight order %s is %s: %v", record.Location, order.Status, order.Error))
+	}
+
+	certChains, err := client.acmeClient.GetCertificateChain(ctx, acc, order.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("downloading certificate chain of in-flight order %s: %w", record.Location, err)
+	}
+	logger.Info("completed in-flight order")
+	return certChains, nil
+}
+
+// solvePendingAuthorizations solves one challenge of each pending
+// authorization of order, using the challenge solvers of client.
+func (am *ACMEIssuer) solvePendingAuthorizations(ctx context.Context, client *acmeClient, order acme.Order) error {
+	for _, authzURL := range order.Authorizations {
+		authz, err := client.acmeClient.GetAuthorization(ctx, client.account, authzURL)
+		if err != nil {
+			return fmt.Errorf("getting authorization %s: %w", authzURL, err)
+		}
+		if authz.Status != acme.StatusPending {
+			continue
+		}
+		idx := slices.IndexFunc(authz.Challenges, func(chal acme.Challenge) bool {
+			_, ok := client.acmeClient.ChallengeSolvers[chal.Type]
+			return ok
+		})
+		if idx < 0 {
+			return fmt.Errorf("no solvers available for challenges offered for %s: %v", authz.IdentifierValue(), authz.Challenges)
+		}
+		if err := am.solveChallenge(ctx, client, authz, authz.Challenges[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// solveChallenge solves chal of authz and waits for the
+// authorization to be finalized.
+func (am *ACMEIssuer) solveChallenge(ctx context.Context, client *acmeClient, authz acme.Authorization, chal acme.Challenge) error {
+	solver := client.acmeClient.ChallengeSolvers[chal.Type]
+	if err := solver.Present(ctx, chal); err != nil {
+		return fmt.Errorf("presenting %s challenge for %s: %w", chal.Type, authz.IdentifierValue(), err)
+	}
+	defer func() {
+		if err := solver.CleanUp(ctx, chal); err != nil {
+			am.Logger.Error("cleaning up challenge",
+				zap.String("identifier", authz.IdentifierValue()),
+				zap.String("challenge_type", chal.Type),
+				zap.Error(err))
+		}
+	}()
+	if waiter, ok := solver.(acmez.Waiter); ok {
+		if err := waiter.Wait(ctx, chal); err != nil {
+			return fmt.Errorf("waiting for %s challenge for %s: %w", chal.Type, authz.IdentifierValue(), err)
+		}
+	}
+	if _, err := client.acmeClient.InitiateChallenge(ctx, client.account, chal); err != nil {
+		return fmt.Errorf("initiating %s challenge for %s: %w", chal.Type, authz.IdentifierValue(), err)
+	}
+	if _, err := client.acmeClient.PollAuthorization(ctx, client.account, authz); err != nil {
+		return fmt.Errorf("validating %s challenge for %s: %w", chal.Type, authz.IdentifierValue(), err)
+	}
+	return nil
+}
+
+// pollOrder polls order until it is valid, which happens
+// some time after it was finalized.
+func pollOrder(ctx context.Context, client *acmez.Client, account acme.Account, order acme.Order) (acme.Order, error) {
+	timeout := client.PollTimeout
+	if timeout <= 0 {
+		timeout = DefaultACME.CertObtainTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for order.Status == acme.StatusProcessing {
+		if time.Now().After(deadline) {
+			return order, fmt.Errorf("order took too long")
+		}
+		select {
+		case <-time.After(orderPollInterval):
+		case <-ctx.Done():
+			return order, ctx.Err()
+		}
+		var err error
+		order, err = client.GetOrder(ctx, account, order)
+		if err != nil {
+			return order, err
+		}
+	}
+	if order.Status != acme.StatusValid {
+		return order, fmt.Errorf("order is %s: %v", order.Status, order.Error)
+	}
+	return order, nil
+}
+
+// abandonOrder deletes the persisted order at orderKey because
+// of reason, which it returns after logging it.
+func (am *ACMEIssuer) abandonOrder(ctx context.Context, orderKey string, reason error) error {
+	am.Logger.Warn("abandoning in-flight order", zap.String("order_key", orderKey), zap.Error(reason))
+	am.deleteOrder(ctx, orderKey)
+	return reason
+}
+
+// deleteOrder deletes the persisted order at orderKey.
+func (am *ACMEIssuer) deleteOrder(ctx context.Context, orderKey string) {
+	if err := am.config.Storage.Delete(ctx, orderKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		am.Logger.Error("deleting in-flight order", zap.String("order_key", orderKey), zap.Error(err))
+	}
+}
+
+// recordOrders makes client persist each order it creates
+// for csr to storage, so that it can be resumed.
+func (am *ACMEIssuer) recordOrders(client *acmeClient, csr *x509.CertificateRequest) {
+	httpClient := *client.acmeClient.HTTPClient
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = orderRecorder{
+		next: next,
+		record: func(ctx context.Context, order acme.Order) {
+			record := acmeOrder{
+				Location:       order.Location,
+				Account:        client.account.Location,
+				Identifiers:    order.Identifiers,
+				Authorizations: order.Authorizations,
+				CSRKeySHA256:   csrKeySHA256(csr),
+				Created:        time.Now(),
+				Expires:        order.Expires,
+			}
+			recordBytes, err := json.Marshal(record)
+			if err == nil {
+				err = am.config.Storage.Store(ctx, am.storageKeyOrder(client.acmeClient.Directory, order.Identifiers), recordBytes)
+			}
+			if err != nil {
+				am.Logger.Error("persisting in-flight order", zap.String("order", order.Location), zap.Error(err))
+			}
+		},
+	}
+	client.acmeClient.HTTPClient = &httpClient
+}
+
+// orderRecorder is an http.RoundTripper that calls record
+// with each order that is created through it.
+type orderRecorder struct {
+	next   http.RoundTripper
+	record func(context.Context, acme.Order)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (or orderRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := or.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") == "" ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	// accounts are created too, but only orders can be finalized
+	var order acme.Order
+	if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		order.Location = resp.Header.Get("Location")
+		or.record(req.Context(), order)
+	}
+	return resp, nil
+}
+
+// storageKeyOrder returns the storage key of the in-flight
+// order for identifiers with the CA at caURL.
+func (am *ACMEIssuer) storageKeyOrder(caURL string, identifiers []acme.Identifier) string {
+	values := make([]string, 0, len(identifiers))
+	for _, id := range identifiers {
+		values = append(values, strings.ToLower(id.Value))
+	}
+	slices.Sort(values)
+	sum := sha256.Sum256([]byte(strings.Join(values, ",")))
+	name := StorageKeys.Safe(values[0]) + "-" + hex.EncodeToString(sum[:8]) + ".json"
+	return path.Join(am.storageKeyCAPrefix(caURL), "orders", name)
+}
+
+// csrKeySHA256 returns the hex-encoded SHA-256 of the
+// public key (SubjectPublicKeyInfo) of csr.
+func csrKeySHA256(csr *x509.CertificateRequest) string {
+	sum := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// orderResumer is implemented by issuers that resume interrupted
+// orders. Since an order that was finalized can only be resumed
+// with the same certificate key, the Config keeps the key of an
+// issuance in flight in storage for such issuers.
+type orderResumer interface {
+	resumesOrders() bool
+}
+
+func (am *ACMEIssuer) resumesOrders() bool { return !am.DisableOrderResumption }
+
+// certPrivateKey returns the private key to use for a new certificate
+// to be stored as storageName. If any of issuers resumes orders, the
+// key of an earlier, interrupted attempt is returned if there is one;
+// otherwise a new key is generated and kept in storage until the
+// issuance is complete (see deleteInFlightPrivateKey). Keys which
+// can't be used anymore are deleted.
+func (cfg *Config) certPrivateKey(ctx context.Context, storageName string, keyType KeyType, issuers []Issuer) (crypto.PrivateKey, []byte, error) {
+	resumes := slices.ContainsFunc(issuers, func(iss Issuer) bool {
+		resumer, ok := iss.(orderResumer)
+		return ok && resumer.resumesOrders()
+	})
+	keyKey := inFlightPrivateKeyStorageKey(storageName)
+
+	if info, err := cfg.Storage.Stat(ctx, keyKey); err == nil {
+		if resumes && time.Since(info.Modified) < inFlightPrivateKeyMaxAge {
+			keyPEM, err := cfg.Storage.Load(ctx, keyKey)
+			if err == nil {
+				if key, err := PEMDecodePrivateKey(keyPEM); err == nil {
+					cfg.Logger.Info("reusing private key of interrupted issuance", zap.String("identifier", storageName))
+					return key, keyPEM, nil
+				}
+			}
+		} else {
+			// too old to resume an order with, or no issuer resumes orders
+			cfg.deleteInFlightPrivateKey(ctx, storageName)
+		}
+	}
+
+	key, err := cfg.keyGenerator(keyType).GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resumes {
+		// without the key, a finalized order cannot be resumed, but
+		// the issuance can still go ahead with a new order next time
+		if err := cfg.Storage.Store(ctx, keyKey, keyPEM); err != nil {
+			cfg.Logger.Warn("unable to store private key of in-flight issuance; interrupted orders will not be resumed",
+				zap.String("identifier", storageName),
+				zap.Error(err))
+		}
+	}
+	return key, keyPEM, nil
+}
+
+// deleteInFlightPrivateKey deletes the private key kept in storage
+// while the certificate for storageName was being issued, if any.
+// It is called once the issuance succeeded or failed for good.
+func (cfg *Config) deleteInFlightPrivateKey(ctx context.Context, storageName string) {
+	err := cfg.Storage.Delete(ctx, inFlightPrivateKeyStorageKey(storageName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		cfg.Logger.Error("deleting private key of in-flight issuance", zap.String("identifier", storageName), zap.Error(err))
+	}
+}
+
+// inFlightPrivateKeyStorageKey returns the storage key of the private
+// key of an issuance in flight for the certificate named storageName.
+func inFlightPrivateKeyStorageKey(storageName string) string {
+	return path.Join(prefixInFlightKeys, StorageKeys.Safe(storageName)+".key")
+}
+
+const (
+	prefixInFlightKeys = "in_flight_keys"
+
+	// keys of interrupted issuances are not reused after this long,
+	// which is about how long CAs keep orders around
+	inFlightPrivateKeyMaxAge = 7 * 24 * time.Hour
+
+	orderPollInterval = time.Second
+)
+
+// Interface guards
+var (
+	_ http.RoundTripper = orderRecorder{}
+	_ orderResumer      = (*ACMEIssuer)(nil)
+)
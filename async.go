@@ -85,16 +85,14 @@ func doWithRetry(ctx context.Context, log *zap.Logger, f func(context.Context) e
 	var attempts int
 	ctx = context.WithValue(ctx, AttemptsCtxKey, &attempts)
 
-	// the initial intervalIndex is -1, signaling
-	// that we should not wait for the first attempt
+	// the first attempt is made without waiting; the initial
+	// intervalIndex is -1 so that the first retry uses the
+	// first interval
 	start, intervalIndex := time.Now(), -1
+	var wait time.Duration
 	var err error
 
 	for time.Since(start) < maxRetryDuration {
-		var wait time.Duration
-		if intervalIndex >= 0 {
-			wait = retryIntervals[intervalIndex]
-		}
 		timer := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
@@ -113,11 +111,28 @@ func doWithRetry(ctx context.Context, log *zap.Logger, f func(context.Context) e
 			if intervalIndex < len(retryIntervals)-1 {
 				intervalIndex++
 			}
+			wait = retryIntervals[intervalIndex]
+
+			// no use trying again before the CA's rate limit expires
+			var errRateLimited ErrRateLimited
+			if errors.As(err, &errRateLimited) {
+				wait = max(wait, time.Until(errRateLimited.RetryAfter))
+				if time.Since(start)+wait >= maxRetryDuration {
+					log.Error("rate limited until after final attempt; giving up",
+						zap.Error(err),
+						zap.Int("attempt", attempts),
+						zap.Time("retry_after", errRateLimited.RetryAfter),
+						zap.Duration("elapsed", time.Since(start)),
+						zap.Duration("max_duration", maxRetryDuration))
+					return err
+				}
+			}
+
 			if time.Since(start) < maxRetryDuration {
 				log.Error("will retry",
 					zap.Error(err),
 					zap.Int("attempt", attempts),
-					zap.Duration("retrying_in", retryIntervals[intervalIndex]),
+					zap.Duration("retrying_in", wait),
 					zap.Duration("elapsed", time.Since(start)),
 					zap.Duration("max_duration", maxRetryDuration))
 
@@ -0,0 +1,279 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// CAACheck configures checking the CAA records (RFC 8659) of names
+// before ordering certificates for them, so that names whose CAA
+// records do not allow the CA fail right away, instead of failing
+// validation at the CA, which counts against its rate limits.
+type CAACheck struct {
+	// The issuer domain names that identify the CA in CAA
+	// records, like "letsencrypt.org". If empty, they are
+	// known for some public CAs; for other CAs, CAA records
+	// are not checked.
+	IssuerDomainNames []string
+
+	// The DNS resolvers to look up CAA records with.
+	// Default: the resolvers of the issuer's DNS01Solver,
+	// if any; otherwise the system's resolvers, or well-
+	// known public resolvers (see RecursiveNameservers).
+	Resolvers []string
+}
+
+// CAAError is returned when the CAA records of an identifier
+// do not allow the CA to issue a certificate for it.
+type CAAError struct {
+	// The identifier the certificate would be for.
+	Identifier string
+
+	// The domain name at which the CAA records were found.
+	Domain string
+
+	// The relevant CAA records, in presentation format.
+	Records []string
+
+	// Why the records do not allow the CA to issue.
+	Reason string
+}
+
+func (e CAAError) Error() string {
+	return fmt.Sprintf("CAA records of %s (at %s) do not allow the CA to issue a certificate: %s",
+		e.Identifier, e.Domain, e.Reason)
+}
+
+// checkCAA returns a CAAError if the CAA records of any of names do not
+// allow am's CA to issue a certificate. Names for which CAA records
+// cannot be looked up are skipped; the CA will have the final say.
+func (am *ACMEIssuer) checkCAA(ctx context.Context, names []string) error {
+	issuerDomainNames := am.CAACheck.IssuerDomainNames
+	if len(issuerDomainNames) == 0 {
+		issuerDomainNames = knownIssuerDomainNames(am.CA)
+	}
+	if len(issuerDomainNames) == 0 {
+		am.Logger.Debug("not checking CAA records because the CA's issuer domain names are not known",
+			zap.String("ca", am.CA))
+		return nil
+	}
+	resolvers := am.CAACheck.Resolvers
+	if dnsSolver, ok := am.DNS01Solver.(*DNS01Solver); ok && len(resolvers) == 0 {
+		resolvers = dnsSolver.Resolvers
+	}
+	resolvers = RecursiveNameservers(resolvers)
+
+	// only needed if a record restricts accounts, which is rare
+	var accountURIs []string
+	var accountsLoaded bool
+	getAccountURIs := func() []string {
+		if !accountsLoaded {
+			accountURIs, accountsLoaded = am.caaAccountURIs(ctx), true
+		}
+		return accountURIs
+	}
+
+	for _, name := range names {
+		if SubjectIsIP(name) {
+			continue // CAA applies only to domain names
+		}
+		domain, records, err := findCAARecords(ctx, strings.TrimPrefix(name, "*."), resolvers)
+		if err != nil {
+			am.Logger.Warn("could not look up CAA records; skipping check",
+				zap.String("identifier", name),
+				zap.Error(err))
+			continue
+		}
+		reason := caaDenialReason(records, strings.HasPrefix(name, "*."), issuerDomainNames, am.challengeTypes(), getAccountURIs)
+		if reason == "" {
+			continue
+		}
+		caaErr := CAAError{Identifier: name, Domain: strings.TrimSuffix(domain, "."), Reason: reason}
+		for _, rec := range records {
+			caaErr.Records = append(caaErr.Records, rec.String())
+		}
+		return caaErr
+	}
+	return nil
+}
+
+// caaAccountURIs returns the URIs of the accounts am may use with
+// its CA, as far as they are known from storage.
+func (am *ACMEIssuer) caaAccountURIs(ctx context.Context) []string {
+	var uris []string
+	for _, iss := range am.accountPool() {
+		account, err := iss.getAccountToUse(ctx, am.CA)
+		if err == nil && account.Location != "" {
+			uris = append(uris, account.Location)
+		}
+	}
+	return uris
+}
+
+// challengeTypes returns the challenge types am can solve.
+func (am *ACMEIssuer) challengeTypes() []string {
+	var types []string
+	if am.DNSPersist01Solver != nil {
+		types = append(types, ChallengeTypeDNSPersist01)
+	}
+	if am.DNS01Solver != nil {
+		if solver, ok := am.DNS01Solver.(DNSAccount01Solver); ok && solver.SupportsDNSAccount01() {
+			types = append(types, acme.ChallengeTypeDNSAccount01)
+		}
+		return append(types, acme.ChallengeTypeDNS01)
+	}
+	if !am.DisableHTTPChallenge {
+		types = append(types, acme.ChallengeTypeHTTP01)
+	}
+	if !am.DisableTLSALPNChallenge {
+		types = append(types, acme.ChallengeTypeTLSALPN01)
+	}
+	return types
+}
+
+// caaDenialReason returns why records, the relevant CAA RRset of a name,
+// do not allow a CA with the given issuer domain names to issue using
+// one of the challenge types with one of the accounts. It returns an
+// empty string if issuance is allowed.
+func caaDenialReason(records []*dns.CAA, wildcard bool, issuerDomainNames, challengeTypes []string, accountURIs func() []string) string {
+	tag := "issue"
+	for _, rec := range records {
+		recTag := strings.ToLower(rec.Tag)
+		switch recTag {
+		case "issue", "iodef":
+		case "issuewild":
+			if wildcard {
+				tag = "issuewild"
+			}
+		default:
+			// "the Issuer Critical Flag ... indicates that the corresponding
+			// property tag MUST be understood" (RFC 8659 §4.1)
+			if rec.Flag&128 != 0 {
+				return fmt.Sprintf("unknown critical property %q", rec.Tag)
+			}
+		}
+	}
+
+	var relevant, reasons []string
+	for _, rec := range records {
+		if strings.ToLower(rec.Tag) != tag {
+			continue
+		}
+		relevant = append(relevant, rec.Value)
+		issuer, params := parseCAAValue(rec.Value)
+		if !slices.ContainsFunc(issuerDomainNames, func(d string) bool { return strings.EqualFold(d, issuer) }) {
+			continue
+		}
+		if uri, ok := params["accounturi"]; ok && !slices.Contains(accountURIs(), uri) {
+			reasons = append(reasons, "account is not "+uri)
+			continue
+		}
+		if methods, ok := params["validationmethods"]; ok && !slices.ContainsFunc(strings.Split(methods, ","), func(m string) bool {
+			return slices.Contains(challengeTypes, strings.TrimSpace(m))
+		}) {
+			reasons = append(reasons, "no enabled challenge type is in "+methods)
+			continue
+		}
+		return ""
+	}
+	if len(relevant) == 0 {
+		return "" // no restrictions on issuers
+	}
+	if len(reasons) > 0 {
+		return strings.Join(reasons, "; ")
+	}
+	return fmt.Sprintf("%s property only allows %s", tag, strings.Join(relevant, ", "))
+}
+
+// parseCAAValue parses the value of an issue or issuewild property
+// into the issuer domain name and its parameters (RFC 8659 §4.2).
+func parseCAAValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	params := make(map[string]string)
+	for _, param := range parts[1:] {
+		key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(val)
+		}
+	}
+	return strings.TrimSpace(parts[0]), params
+}
+
+// findCAARecords finds the relevant CAA RRset of domain by climbing
+// the DNS tree until CAA records are found, up to and including the
+// top-level domain (RFC 8659 §3). It returns the domain name at which
+// they were found, which is empty if there are none.
+func findCAARecords(ctx context.Context, domain string, resolvers []string) (string, []*dns.CAA, error) {
+	fqdn := dns.Fqdn(strings.ToLower(domain))
+	for {
+		records, err := lookupCAA(ctx, fqdn, resolvers)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(records) > 0 {
+			return fqdn, records, nil
+		}
+		dot := strings.Index(fqdn, ".")
+		if dot < 0 || dot == len(fqdn)-1 {
+			return "", nil, nil
+		}
+		fqdn = fqdn[dot+1:]
+	}
+}
+
+// lookupCAA returns the CAA records of fqdn. Aliases are followed
+// by the resolvers, so records of the target are included.
+func lookupCAA(ctx context.Context, fqdn string, resolvers []string) ([]*dns.CAA, error) {
+	answer, err := lookupRecords(ctx, fqdn, dns.TypeCAA, resolvers)
+	if err != nil {
+		return nil, err
+	}
+	var records []*dns.CAA
+	for _, rr := range answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			records = append(records, caa)
+		}
+	}
+	return records, nil
+}
+
+// knownIssuerDomainNames returns the issuer domain names of
+// the CA with the directory URL caURL, if it is a known CA.
+func knownIssuerDomainNames(caURL string) []string {
+	for caSubstr, domains := range caaIssuerDomainNames {
+		if strings.Contains(caURL, caSubstr) {
+			return domains
+		}
+	}
+	return nil
+}
+
+// caaIssuerDomainNames maps substrings of the directory URLs of
+// public CAs to the issuer domain names they recognize in CAA records.
+var caaIssuerDomainNames = map[string][]string{
+	"api.letsencrypt.org": {"letsencrypt.org"},
+	"acme.zerossl.com":    {"sectigo.com", "zerossl.com"},
+	"api.pki.goog":        {"pki.goog"},
+	"api.buypass.com":     {"buypass.com"},
+	"acme.ssl.com":        {"ssl.com"},
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckCAA(t *testing.T) {
+	ctx := context.Background()
+	const accountURI = "https://ca.example/acct/1"
+	resolver := startTestDNSServer(t,
+		`example.com. 60 IN CAA 0 issue "ca.example"`,
+		`example.com. 60 IN CAA 0 issuewild ";"`,
+		`other.example.com. 60 IN CAA 0 issue "other-ca.example"`,
+		`account.example.com. 60 IN CAA 0 issue "ca.example; accounturi=`+accountURI+`"`,
+		`http.example.com. 60 IN CAA 0 issue "ca.example; validationmethods=http-01"`,
+		`dns.example.com. 60 IN CAA 0 issue "ca.example; validationmethods=dns-01,dns-account-01"`,
+		`critical.example.com. 60 IN CAA 0 issue "ca.example"`,
+		`critical.example.com. 60 IN CAA 128 unknown "x"`,
+		`iodef.example.net. 60 IN CAA 0 iodef "mailto:security@example.net"`,
+		`wild.example.org. 60 IN CAA 0 issue "other-ca.example"`,
+		`wild.example.org. 60 IN CAA 0 issuewild "CA.example"`,
+	)
+
+	cfg := &Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger}
+	am := NewACMEIssuer(cfg, ACMEIssuer{
+		CA:                      "https://ca.example/directory",
+		DisableTLSALPNChallenge: true,
+		CAACheck:                &CAACheck{IssuerDomainNames: []string{"ca.example"}, Resolvers: []string{resolver}},
+		Logger:                  defaultTestLogger,
+	})
+	for i, tc := range []struct {
+		name          string
+		allowed       bool
+		foundAtDomain string
+	}{
+		{name: "example.com", allowed: true},
+		{name: "sub.example.com", allowed: true}, // records found by climbing the tree
+		{name: "*.example.com", foundAtDomain: "example.com"},
+		{name: "a.b.other.example.com", foundAtDomain: "other.example.com"},
+		{name: "account.example.com", foundAtDomain: "account.example.com"},
+		{name: "http.example.com", allowed: true},
+		{name: "dns.example.com", foundAtDomain: "dns.example.com"},
+		{name: "critical.example.com", foundAtDomain: "critical.example.com"},
+		{name: "www.example.net", allowed: true}, // no issue property
+		{name: "example.invalid", allowed: true}, // no records at all
+		{name: "*.wild.example.org", allowed: true},
+		{name: "wild.example.org", foundAtDomain: "wild.example.org"},
+		{name: "127.0.0.1", allowed: true},
+	} {
+		err := am.checkCAA(ctx, []string{tc.name})
+		var caaErr CAAError
+		if tc.allowed {
+			if err != nil {
+				t.Errorf("Test %d (%s): expected issuance to be allowed, got: %v", i, tc.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &caaErr) {
+			t.Errorf("Test %d (%s): expected CAAError, got: %v", i, tc.name, err)
+			continue
+		}
+		if caaErr.Identifier != tc.name || caaErr.Domain != tc.foundAtDomain || len(caaErr.Records) == 0 {
+			t.Errorf("Test %d (%s): expected error for records at %s, got: %+v", i, tc.name, tc.foundAtDomain, caaErr)
+		}
+	}
+
+	// the account restriction is satisfied if the account is ours
+	records := []*dns.CAA{{Tag: "issue", Value: "ca.example; accounturi=" + accountURI}}
+	if reason := caaDenialReason(records, false, []string{"ca.example"}, []string{"http-01"}, func() []string { return []string{accountURI} }); reason != "" {
+		t.Errorf("Expected issuance with bound account to be allowed, got: %s", reason)
+	}
+
+	// only DNS challenges are enabled
+	am.DNS01Solver = &DNS01Solver{}
+	if err := am.checkCAA(ctx, []string{"dns.example.com"}); err != nil {
+		t.Errorf("Expected issuance with allowed validation method to be allowed, got: %v", err)
+	}
+	if err := am.checkCAA(ctx, []string{"http.example.com"}); err == nil {
+		t.Error("Expected issuance without allowed validation method to be refused")
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+	"golang.org/x/net/publicsuffix"
+)
+
+// CARateLimits remembers when CAs refused to issue certificates because
+// of their rate limits, so that certificates affected by a rate limit
+// are not requested again until the CA allows it; doing so would only
+// use up more of the limit, or even extend it. A rate limit applies to
+// the account (at the CA) that ran into it, and to the registered
+// domains of the names it was for, since that is how CAs usually count.
+// If the CA attributes the problem to some of the names, only their
+// domains are affected; if it says the limit is on the account (and
+// does not name any of the domains), all names are affected.
+//
+// If Storage is set, rate limits are also persisted there so that all
+// instances in a cluster respect them.
+type CARateLimits struct {
+	// How long to wait if the CA does not say when
+	// to try again. Default: 1 hour.
+	DefaultCoolDown time.Duration
+
+	// If set, rate limits are persisted to this storage.
+	Storage Storage
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu     sync.Mutex
+	limits map[string]CARateLimit
+}
+
+// CARateLimit describes a rate limit a CA has imposed.
+type CARateLimit struct {
+	// The URL of the account that ran into the rate
+	// limit, or the URL of the CA if there is none.
+	Account string `json:"account"`
+
+	// The registered domain the rate limit applies to,
+	// or "*" if it applies to all names, like a limit
+	// on the number of orders per account.
+	Domain string `json:"domain"`
+
+	// The CA's explanation.
+	Detail string `json:"detail,omitempty"`
+
+	// When the rate limit was run into.
+	Observed time.Time `json:"observed"`
+
+	// Certificates are not requested again before this time.
+	RetryAfter time.Time `json:"retry_after"`
+}
+
+// Get returns the rate limit that currently applies to certificates
+// for name with account, if any.
+func (rl *CARateLimits) Get(ctx context.Context, account, name string) (CARateLimit, bool, error) {
+	for _, domain := range []string{registeredDomain(name), caRateLimitAllDomains} {
+		limit, ok, err := rl.get(ctx, account, domain)
+		if err != nil || ok {
+			return limit, ok, err
+		}
+	}
+	return CARateLimit{}, false, nil
+}
+
+// get returns the rate limit that currently applies
+// to domain with account, if any.
+func (rl *CARateLimits) get(ctx context.Context, account, domain string) (CARateLimit, bool, error) {
+	key := account + " " + domain
+
+	rl.mu.Lock()
+	limit, ok := rl.limits[key]
+	rl.mu.Unlock()
+
+	if !ok && rl.Storage != nil {
+		limitBytes, err := rl.Storage.Load(ctx, caRateLimitStorageKey(account, domain))
+		if errors.Is(err, fs.ErrNotExist) {
+			return CARateLimit{}, false, nil
+		}
+		if err != nil {
+			return CARateLimit{}, false, fmt.Errorf("loading rate limit: %v", err)
+		}
+		if err := json.Unmarshal(limitBytes, &limit); err != nil {
+			return CARateLimit{}, false, fmt.Errorf("decoding rate limit: %v", err)
+		}
+		ok = true
+	}
+	if !ok {
+		return CARateLimit{}, false, nil
+	}
+	if time.Now().After(limit.RetryAfter) {
+		if err := rl.clear(ctx, account, domain); err != nil {
+			rl.logger().Error("clearing expired rate limit", zap.String("domain", domain), zap.Error(err))
+		}
+		return CARateLimit{}, false, nil
+	}
+
+	rl.mu.Lock()
+	if rl.limits == nil {
+		rl.limits = make(map[string]CARateLimit)
+	}
+	rl.limits[key] = limit
+	rl.mu.Unlock()
+
+	return limit, true, nil
+}
+
+// Clear removes the rate limits for name with account, including
+// one that applies to all names, allowing certificates to be
+// requested again immediately.
+func (rl *CARateLimits) Clear(ctx context.Context, account, name string) error {
+	for _, domain := range []string{registeredDomain(name), caRateLimitAllDomains} {
+		if err := rl.clear(ctx, account, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clear removes the rate limit for domain with account.
+func (rl *CARateLimits) clear(ctx context.Context, account, domain string) error {
+	rl.mu.Lock()
+	delete(rl.limits, account+" "+domain)
+	rl.mu.Unlock()
+	if rl.Storage == nil {
+		return nil
+	}
+	err := rl.Storage.Delete(ctx, caRateLimitStorageKey(account, domain))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// check returns an ErrRateLimited if any of names is
+// currently rate limited with account. rl may be nil.
+func (rl *CARateLimits) check(ctx context.Context, account string, names []string) error {
+	if rl == nil {
+		return nil
+	}
+	for _, name := range names {
+		limit, ok, err := rl.Get(ctx, account, name)
+		if err != nil {
+			// don't let a storage problem prevent issuance
+			rl.logger().Error("checking rate limits", zap.String("identifier", name), zap.Error(err))
+			continue
+		}
+		if ok {
+			return ErrRateLimited{
+				Err: fmt.Errorf("%s: %w of CA until %s (%s)",
+					name, errRateLimitedByCA, limit.RetryAfter.Format(time.RFC3339), limit.Detail),
+				RetryAfter: limit.RetryAfter,
+				Skipped:    true,
+			}
+		}
+	}
+	return nil
+}
+
+// record records that the CA refused to issue a certificate for names
+// with account because of the rate limit described by problem, and
+// returns when to try again, which is retryAfter if it is set. rl may
+// be nil.
+func (rl *CARateLimits) record(ctx context.Context, account string, names []string, problem acme.Problem, retryAfter time.Time) time.Time {
+	now := time.Now()
+	if retryAfter.IsZero() {
+		coolDown := defaultCARateLimitCoolDown
+		if rl != nil && rl.DefaultCoolDown > 0 {
+			coolDown = rl.DefaultCoolDown
+		}
+		retryAfter = now.Add(coolDown)
+	}
+	if rl == nil {
+		return retryAfter
+	}
+
+	domains := rateLimitedDomains(problem, names)
+	for _, domain := range domains {
+		limit := CARateLimit{
+			Account:    account,
+			Domain:     domain,
+			Detail:     problem.Detail,
+			Observed:   now,
+			RetryAfter: retryAfter,
+		}
+		rl.mu.Lock()
+		if rl.limits == nil {
+			rl.limits = make(map[string]CARateLimit)
+		}
+		rl.limits[account+" "+limit.Domain] = limit
+		rl.mu.Unlock()
+
+		if rl.Storage != nil {
+			limitBytes, err := json.Marshal(limit)
+			if err == nil {
+				err = rl.Storage.Store(ctx, caRateLimitStorageKey(account, limit.Domain), limitBytes)
+			}
+			if err != nil {
+				rl.logger().Error("storing rate limit", zap.String("domain", limit.Domain), zap.Error(err))
+			}
+		}
+	}
+
+	rl.logger().Warn("CA rate limit reached; not requesting affected certificates until it expires",
+		zap.String("account", account),
+		zap.Strings("identifiers", names),
+		zap.Strings("domains", domains),
+		zap.String("detail", problem.Detail),
+		zap.Time("retry_after", retryAfter))
+
+	return retryAfter
+}
+
+func (rl *CARateLimits) logger() *zap.Logger {
+	if rl.Logger == nil {
+		return zap.NewNop()
+	}
+	return rl.Logger
+}
+
+// ErrRateLimited is returned when a certificate is not issued because
+// of a CA's rate limit. Trying again before RetryAfter is pointless.
+type ErrRateLimited struct {
+	Err error
+
+	// When the CA allows trying again.
+	RetryAfter time.Time
+
+	// True if the CA was not asked for the certificate
+	// because the rate limit was already known.
+	Skipped bool
+}
+
+// Unwrap makes it so that e wraps e.Err.
+func (e ErrRateLimited) Unwrap() error { return e.Err }
+func (e ErrRateLimited) Error() string { return e.Err.Error() }
+
+// errRateLimitedByCA is wrapped by errors of issuances that
+// were skipped because of a known rate limit.
+var errRateLimitedByCA = errors.New("rate limited")
+
+// rateLimitError returns err as an ErrRateLimited if it is a rate limit
+// problem from the CA, after recording the rate limit for names with
+// account. Otherwise, it returns err.
+func (cfg *Config) rateLimitError(ctx context.Context, account string, names []string, err error, retryAfter time.Time) error {
+	var problem acme.Problem
+	if !errors.As(err, &problem) || problem.Type != acme.ProblemTypeRateLimited {
+		return err
+	}
+	return ErrRateLimited{
+		Err:        err,
+		RetryAfter: cfg.CARateLimits.record(ctx, account, names, problem, retryAfter),
+	}
+}
+
+// recordRetryAfter makes client remember the time given by the
+// Retry-After header of the last error response it receives, and
+// returns a function that returns that time.
+func recordRetryAfter(client *acmez.Client) func() time.Time {
+	httpClient := *client.HTTPClient
+	recorder := &retryAfterRecorder{next: httpClient.Transport}
+	if recorder.next == nil {
+		recorder.next = http.DefaultTransport
+	}
+	httpClient.Transport = recorder
+	client.HTTPClient = &httpClient
+	return func() time.Time {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return recorder.retryAfter
+	}
+}
+
+// retryAfterRecorder is an http.RoundTripper that remembers the
+// Retry-After of the last error response that goes through it.
+type retryAfterRecorder struct {
+	next       http.RoundTripper
+	mu         sync.Mutex
+	retryAfter time.Time
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rr *retryAfterRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rr.next.RoundTrip(req)
+	if err != nil || resp.StatusCode < http.StatusBadRequest {
+		return resp, err
+	}
+	if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		rr.mu.Lock()
+		rr.retryAfter = retryAfter
+		rr.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which
+// is either a number of seconds after now or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// registeredDomain returns the registered domain of name, or
+// name itself if it has none, like IP addresses.
+func registeredDomain(name string) string {
+	name = strings.ToLower(strings.TrimPrefix(name, "*."))
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// rateLimitedDomains returns the registered domains that the rate
+// limit described by problem applies to, after ordering a certificate
+// for names. If the CA attributes the problem to some identifiers, it
+// applies to their domains. Otherwise, if it is about the account and
+// does not mention any of the domains, it applies to all of them
+// (caRateLimitAllDomains); if not, to the domains of all names.
+func rateLimitedDomains(problem acme.Problem, names []string) []string {
+	var domains []string
+	for _, sub := range problem.Subproblems {
+		if sub.Identifier.Value == "" || (sub.Type != "" && sub.Type != acme.ProblemTypeRateLimited) {
+			continue
+		}
+		if domain := registeredDomain(sub.Identifier.Value); !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) > 0 {
+		return domains
+	}
+
+	for _, name := range names {
+		if domain := registeredDomain(name); !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	detail := strings.ToLower(problem.Detail)
+	mentioned := slices.ContainsFunc(domains, func(domain string) bool {
+		return strings.Contains(detail, domain)
+	})
+	if strings.Contains(detail, "account") && !mentioned {
+		return []string{caRateLimitAllDomains}
+	}
+	return domains
+}
+
+// caRateLimitStorageKey returns the storage key of
+// the rate limit for domain with account.
+func caRateLimitStorageKey(account, domain string) string {
+	return path.Join(prefixCARateLimits, StorageKeys.Safe(account), StorageKeys.Safe(domain)+".json")
+}
+
+// defaultCARateLimits is used by Configs without CARateLimits,
+// so that rate limits are respected by all of them.
+var defaultCARateLimits = &CARateLimits{Logger: defaultLogger}
+
+const (
+	prefixCARateLimits = "rate_limits"
+
+	// the domain of rate limits that apply to all names
+	caRateLimitAllDomains = "*"
+
+	defaultCARateLimitCoolDown = time.Hour
+)
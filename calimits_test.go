@@ -0,0 +1,191 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic/certmagictest"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestACMEIssuerRateLimited(t *testing.T) {
+	ctx := context.Background()
+	solver := &interruptibleDNSSolver{records: make(map[string][]string)}
+	srv := &certmagictest.Server{LookupTXT: solver.lookupTXT}
+	srv.Start()
+	defer srv.Close()
+
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{DNS01Solver: solver})
+	storage := &FileStorage{Path: t.TempDir()}
+	iss.config.CARateLimits = &CARateLimits{Storage: storage}
+
+	srv.InjectError(certmagictest.EndpointNewOrder, 1, certmagictest.RateLimited(2*time.Hour))
+	_, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"www.example.com"}, nil))
+	var errRateLimited ErrRateLimited
+	if !errors.As(err, &errRateLimited) || errRateLimited.Skipped {
+		t.Fatalf("Expected rate limit error from CA, got: %v", err)
+	}
+	if until := time.Until(errRateLimited.RetryAfter); until < time.Hour || until > 2*time.Hour {
+		t.Errorf("Expected to retry after about 2h from Retry-After header, got %s", until)
+	}
+
+	// other names in the same registered domain are not requested,
+	// even by another instance sharing the storage
+	other := &CARateLimits{Storage: storage}
+	for _, rl := range []*CARateLimits{iss.config.CARateLimits, other} {
+		iss.config.CARateLimits = rl
+		_, err = iss.Issue(ctx, makeInternalTestCSR(t, []string{"shop.example.com"}, nil))
+		if !errors.As(err, &errRateLimited) || !errRateLimited.Skipped {
+			t.Errorf("Expected issuance to be skipped, got: %v", err)
+		}
+		if class := ClassifyIssuerError(err); class != "" {
+			t.Errorf("Expected skipped issuance not to count for issuer health, got %q", class)
+		}
+	}
+	if len(srv.Orders()) != 0 {
+		t.Errorf("Expected no orders, got %d", len(srv.Orders()))
+	}
+
+	// names in other registered domains are not affected
+	if _, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"example.net"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// once cleared, names can be requested again
+	account := srv.Accounts()[0].URL
+	if _, ok, _ := other.Get(ctx, account, "*.example.com"); !ok {
+		t.Error("Expected rate limit for wildcard in registered domain")
+	}
+	if err := other.Clear(ctx, account, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"shop.example.com"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCARateLimitsExpire(t *testing.T) {
+	ctx := context.Background()
+	rl := &CARateLimits{DefaultCoolDown: time.Minute}
+	tooMany := acme.Problem{Type: acme.ProblemTypeRateLimited, Detail: "too many"}
+	retryAfter := rl.record(ctx, "acct", []string{"a.example.com"}, tooMany, time.Time{})
+	if until := time.Until(retryAfter); until <= 0 || until > time.Minute {
+		t.Errorf("Expected default cool-down of 1m, got %s", until)
+	}
+	if err := rl.check(ctx, "acct", []string{"b.example.com"}); !errors.Is(err, errRateLimitedByCA) {
+		t.Errorf("Expected rate limit, got: %v", err)
+	}
+	if err := rl.check(ctx, "other-acct", []string{"b.example.com"}); err != nil {
+		t.Errorf("Expected no rate limit for other account, got: %v", err)
+	}
+
+	rl.record(ctx, "acct", []string{"a.example.com"}, tooMany, time.Now().Add(-time.Second))
+	if err := rl.check(ctx, "acct", []string{"b.example.com"}); err != nil {
+		t.Errorf("Expected expired rate limit not to apply, got: %v", err)
+	}
+	if len(rl.limits) != 0 {
+		t.Errorf("Expected expired rate limit to be removed, got: %v", rl.limits)
+	}
+}
+
+func TestCARateLimitsScope(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"a.example.com", "b.example.net"}
+	for i, tc := range []struct {
+		problem acme.Problem
+		limited []string
+		allowed []string
+	}{
+		{
+			problem: acme.Problem{Detail: `too many certificates already issued for "example.com"`},
+			limited: []string{"www.example.com"},
+			allowed: []string{"www.example.org"},
+		},
+		{
+			problem: acme.Problem{
+				Detail: "too many certificates",
+				Subproblems: []acme.Subproblem{
+					{Identifier: acme.Identifier{Type: "dns", Value: "b.example.net"}},
+				},
+			},
+			limited: []string{"www.example.net"},
+			allowed: []string{"www.example.com"},
+		},
+		{
+			problem: acme.Problem{Detail: "too many new orders from this account in the last 3h0m0s"},
+			limited: []string{"www.example.com", "www.example.org"},
+		},
+	} {
+		rl := new(CARateLimits)
+		tc.problem.Type = acme.ProblemTypeRateLimited
+		rl.record(ctx, "acct", names, tc.problem, time.Time{})
+		for _, name := range tc.limited {
+			if err := rl.check(ctx, "acct", []string{name}); !errors.Is(err, errRateLimitedByCA) {
+				t.Errorf("Test %d: Expected %s to be rate limited, got: %v", i, name, err)
+			}
+		}
+		for _, name := range tc.allowed {
+			if err := rl.check(ctx, "acct", []string{name}); err != nil {
+				t.Errorf("Test %d: Expected %s not to be rate limited, got: %v", i, name, err)
+			}
+		}
+		if err := rl.Clear(ctx, "acct", tc.limited[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := rl.check(ctx, "acct", tc.limited[:1]); err != nil {
+			t.Errorf("Test %d: Expected no rate limit after clearing, got: %v", i, err)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		value  string
+		expect time.Time
+		ok     bool
+	}{
+		{value: "", ok: false},
+		{value: "120", expect: now.Add(2 * time.Minute), ok: true},
+		{value: " 0 ", expect: now, ok: true},
+		{value: "-5", ok: false},
+		{value: "Sat, 01 Mar 2025 15:00:00 GMT", expect: now.Add(3 * time.Hour), ok: true},
+		{value: "soon", ok: false},
+	} {
+		actual, ok := parseRetryAfter(tc.value, now)
+		if ok != tc.ok || !actual.Equal(tc.expect) {
+			t.Errorf("Test %d (%q): expected %s (ok=%t), got %s (ok=%t)", i, tc.value, tc.expect, tc.ok, actual, ok)
+		}
+	}
+}
+
+func TestDoWithRetryRateLimited(t *testing.T) {
+	var attempts int
+	rateLimited := ErrRateLimited{
+		Err:        acme.Problem{Type: acme.ProblemTypeRateLimited},
+		RetryAfter: time.Now().Add(maxRetryDuration + time.Hour),
+	}
+	err := doWithRetry(context.Background(), defaultTestLogger, func(context.Context) error {
+		attempts++
+		return rateLimited
+	})
+	if !errors.As(err, new(ErrRateLimited)) || attempts != 1 {
+		t.Errorf("Expected to give up after 1 attempt when rate limited for too long, got %d attempts and: %v", attempts, err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math/rand"
 	"net"
 	"os"
@@ -63,6 +64,10 @@ type Certificate struct {
 
 	// ACME Renewal Information, if available
 	ari acme.RenewalInfo
+
+	// The key type variant of this certificate, if it
+	// is not the primary one (see Config.KeyTypes).
+	keyType KeyType
 }
 
 // Empty returns true if the certificate struct is not filled out; at
@@ -252,21 +257,40 @@ func expiresAt(cert *x509.Certificate) time.Time {
 //
 // This method is safe for concurrent use.
 func (cfg *Config) CacheManagedCertificate(ctx context.Context, domain string) (Certificate, error) {
+	cert, err := cfg.cacheManagedCertificate(ctx, domain, "")
+	if err != nil {
+		return cert, err
+	}
+	// also cache any certificates of the other configured key types;
+	// it is not an error if they haven't been obtained yet
+	for _, keyType := range cfg.keyTypeVariants()[1:] {
+		_, err := cfg.cacheManagedCertificate(ctx, domain, keyType)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return cert, err
+		}
+	}
+	return cert, nil
+}
+
+// cacheManagedCertificate loads the managed certificate for domain of the
+// given key type variant from storage and caches it (see Config.KeyTypes).
+func (cfg *Config) cacheManagedCertificate(ctx context.Context, domain string, keyType KeyType) (Certificate, error) {
 	domain = cfg.transformSubject(ctx, nil, domain)
-	cert, err := cfg.loadManagedCertificate(ctx, domain)
+	cert, err := cfg.loadManagedCertificate(ctx, domain, keyType)
 	if err != nil {
 		return cert, err
 	}
 	cfg.certCache.cacheCertificate(cert)
-	cfg.emit(ctx, "cached_managed_cert", map[string]any{"sans": cert.Names})
+	cfg.emit(ctx, "cached_managed_cert", map[string]any{"sans": cert.Names, "key_type": keyType})
 	return cert, nil
 }
 
-// loadManagedCertificate loads the managed certificate for domain from any
-// of the configured issuers' storage locations, but it does not add it to
-// the cache. It just loads from storage and returns it.
-func (cfg *Config) loadManagedCertificate(ctx context.Context, domain string) (Certificate, error) {
-	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, domain)
+// loadManagedCertificate loads the managed certificate for domain of the
+// given key type variant from any of the configured issuers' storage
+// locations, but it does not add it to the cache. It just loads from
+// storage and returns it.
+func (cfg *Config) loadManagedCertificate(ctx context.Context, domain string, keyType KeyType) (Certificate, error) {
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, variantStorageName(domain, keyType))
 	if err != nil {
 		return Certificate{}, err
 	}
@@ -276,6 +300,7 @@ func (cfg *Config) loadManagedCertificate(ctx context.Context, domain string) (C
 	}
 	cert.managed = true
 	cert.issuerKey = certRes.issuerKey
+	cert.keyType = keyType
 	if ari, err := certRes.getARI(); err == nil && ari != nil {
 		cert.ari = *ari
 	}
@@ -531,7 +556,7 @@ func fillCertFromLeaf(cert *Certificate, tlsCert tls.Certificate) error {
 // meantime, and it would be a good idea to simply load the cert
 // into our cache rather than repeating the renewal process again.
 func (cfg *Config) managedCertInStorageNeedsRenewal(ctx context.Context, cert Certificate) (bool, error) {
-	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, cert.Names[0])
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, cert.storageName())
 	if err != nil {
 		return false, err
 	}
@@ -542,11 +567,11 @@ func (cfg *Config) managedCertInStorageNeedsRenewal(ctx context.Context, cert Ce
 // reloadManagedCertificate reloads the certificate corresponding to the name(s)
 // on oldCert into the cache, from storage. This also replaces the old certificate
 // with the new one, so that all configurations that used the old cert now point
-// to the new cert. It assumes that the new certificate for oldCert.Names[0] is
-// already in storage. It returns the newly-loaded certificate if successful.
+// to the new cert. It assumes that the new certificate for oldCert.Names[0] (of
+// the same key type) is already in storage. It returns the newly-loaded certificate if successful.
 func (cfg *Config) reloadManagedCertificate(ctx context.Context, oldCert Certificate) (Certificate, error) {
 	cfg.Logger.Info("reloading managed certificate", zap.Strings("identifiers", oldCert.Names))
-	newCert, err := cfg.loadManagedCertificate(ctx, oldCert.Names[0])
+	newCert, err := cfg.loadManagedCertificate(ctx, oldCert.Names[0], oldCert.keyType)
 	if err != nil {
 		return Certificate{}, fmt.Errorf("loading managed certificate for %v from storage: %v", oldCert.Names, err)
 	}
@@ -272,6 +272,17 @@ type OnDemandConfig struct {
 	// punycode.
 	DecisionFunc func(ctx context.Context, name string) error
 
+	// If set, this policy must allow the name before a
+	// certificate can be obtained or renewed for it; it
+	// is consulted before DecisionFunc. An event named
+	// "on_demand_decision" is emitted for each decision.
+	Policy *OnDemandPolicy
+
+	// If set, names for which obtaining a certificate
+	// failed are backed off exponentially, instead of
+	// retrying issuance with every handshake.
+	FailureCache *OnDemandFailureCache
+
 	// Sources for getting new, unmanaged certificates.
 	// They will be invoked only during TLS handshakes
 	// before on-demand certificate management occurs,
@@ -382,6 +393,12 @@ const (
 	// configured issuers, then uses the first one
 	// that successfully returns a certificate.
 	UseFirstRandomIssuer = "first_random"
+
+	// UseHealthiestIssuer uses the first issuer that
+	// successfully returns a certificate, skipping
+	// issuers that have been failing according to the
+	// Config's IssuerHealth (see IssuerHealth).
+	UseHealthiestIssuer = "healthiest"
 )
 
 // IssuedCertificate represents a certificate that was just issued.
@@ -417,6 +434,11 @@ type CertificateResource struct {
 	// The unique string identifying the issuer of the
 	// certificate; internally useful for storage access.
 	issuerKey string
+
+	// The key type variant of the certificate, if it is
+	// not the primary one; internally useful for storage
+	// access (see Config.KeyTypes).
+	keyType KeyType
 }
 
 // NamesKey returns the list of SANs as a single string,
@@ -432,6 +454,13 @@ func (cr *CertificateResource) NamesKey() string {
 	return result
 }
 
+// storageNamesKey returns the NamesKey of the resource as it
+// is used for storage, which is distinct for each key type
+// variant of a certificate (see Config.KeyTypes).
+func (cr *CertificateResource) storageNamesKey() string {
+	return variantStorageName(cr.NamesKey(), cr.keyType)
+}
+
 // Default contains the package defaults for the
 // various Config fields. This is used as a template
 // when creating your own Configs with New() or
@@ -0,0 +1,142 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// issuingCA is the hierarchy that signs certificates: a single
+// intermediate, which is signed by the primary root and cross-signed
+// by each alternate root, so that every issued certificate has one
+// chain per root.
+type issuingCA struct {
+	roots           []*x509.Certificate
+	intermediates   []*x509.Certificate // intermediates[i] is signed by roots[i]
+	intermediateKey crypto.Signer
+}
+
+// newIssuingCA creates a hierarchy with 1+alternates roots.
+func newIssuingCA(alternates int) (*issuingCA, error) {
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca := &issuingCA{intermediateKey: intermediateKey}
+
+	now := time.Now()
+	for i := 0; i <= alternates; i++ {
+		rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		rootTmpl := &x509.Certificate{
+			SerialNumber:          randomSerialNumber(),
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("certmagictest Root %d", i+1)},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+		if err != nil {
+			return nil, fmt.Errorf("creating root: %v", err)
+		}
+		root, err := x509.ParseCertificate(rootDER)
+		if err != nil {
+			return nil, err
+		}
+
+		intermediateTmpl := &x509.Certificate{
+			SerialNumber:          randomSerialNumber(),
+			Subject:               pkix.Name{CommonName: "certmagictest Intermediate"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(5 * 365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		intermediateDER, err := x509.CreateCertificate(rand.Reader, intermediateTmpl, root, intermediateKey.Public(), rootKey)
+		if err != nil {
+			return nil, fmt.Errorf("creating intermediate: %v", err)
+		}
+		intermediate, err := x509.ParseCertificate(intermediateDER)
+		if err != nil {
+			return nil, err
+		}
+
+		ca.roots = append(ca.roots, root)
+		ca.intermediates = append(ca.intermediates, intermediate)
+	}
+
+	return ca, nil
+}
+
+// issue signs a leaf certificate for csr and returns it
+// along with its PEM-encoded chains, one per root.
+func (ca *issuingCA) issue(csr *x509.CertificateRequest, notBefore, notAfter time.Time) (*x509.Certificate, [][]byte, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if len(csr.DNSNames) > 0 {
+		tmpl.Subject.CommonName = csr.DNSNames[0]
+	}
+
+	// all intermediates share subject and key, so the leaf
+	// chains to each of them; sign with the primary one
+	leafDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca.intermediates[0], csr.PublicKey, ca.intermediateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	chains := make([][]byte, 0, len(ca.intermediates))
+	for _, intermediate := range ca.intermediates {
+		chain := append([]byte{}, leafPEM...)
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+		chains = append(chains, chain)
+	}
+
+	return leaf, chains, nil
+}
+
+func randomSerialNumber() *big.Int {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(fmt.Sprintf("certmagictest: generating serial number: %v", err))
+	}
+	return serialNumber
+}
@@ -0,0 +1,242 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jwsMessage is a JWS in flattened JSON serialization (RFC 7515 §7.2.2),
+// which is the only serialization ACME allows (RFC 8555 §6.2).
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// jwsHeader is the protected header of a JWS.
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+	KID   string          `json:"kid,omitempty"`
+	Nonce string          `json:"nonce,omitempty"`
+	URL   string          `json:"url"`
+}
+
+// decode decodes the protected header and the payload of msg.
+func (msg jwsMessage) decode() (jwsHeader, []byte, error) {
+	var header jwsHeader
+	headerJSON, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return header, nil, fmt.Errorf("decoding protected header: %v", err)
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return header, nil, fmt.Errorf("parsing protected header: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err != nil {
+		return header, nil, fmt.Errorf("decoding payload: %v", err)
+	}
+	return header, payload, nil
+}
+
+// verify verifies the signature of msg, which uses alg, with pub.
+func (msg jwsMessage) verify(alg string, pub crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %v", err)
+	}
+	signingInput := []byte(msg.Protected + "." + msg.Payload)
+
+	switch alg {
+	case "ES256", "ES384", "ES512":
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an EC key, got %T", alg, pub)
+		}
+		var digest []byte
+		var curve elliptic.Curve
+		switch alg {
+		case "ES256":
+			h := sha256.Sum256(signingInput)
+			digest, curve = h[:], elliptic.P256()
+		case "ES384":
+			h := sha512.Sum384(signingInput)
+			digest, curve = h[:], elliptic.P384()
+		case "ES512":
+			h := sha512.Sum512(signingInput)
+			digest, curve = h[:], elliptic.P521()
+		}
+		if key.Curve != curve {
+			return fmt.Errorf("algorithm %s does not match curve %s", alg, key.Curve.Params().Name)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("signature has wrong length %d", len(sig))
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case "RS256":
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an RSA key, got %T", alg, pub)
+		}
+		digest := sha256.Sum256(signingInput)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid signature: %v", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported signature algorithm %q", alg)
+}
+
+// verifyHMAC verifies the signature of msg, which must use HS256, with key.
+// It is used for external account bindings (RFC 8555 §7.3.4).
+func (msg jwsMessage) verifyHMAC(alg string, key []byte) error {
+	if alg != "HS256" {
+		return fmt.Errorf("unsupported MAC algorithm %q", alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg.Protected + "." + msg.Payload))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return fmt.Errorf("invalid MAC")
+	}
+	return nil
+}
+
+// parseJWK parses a public key in JWK format (RFC 7517).
+func parseJWK(raw []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, fmt.Errorf("parsing JWK: %v", err)
+	}
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("decoding x: %v", err)
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("decoding y: %v", err)
+		}
+		if err := checkOnCurve(curve, x, y); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("decoding n: %v", err)
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("decoding e: %v", err)
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// checkOnCurve returns an error if (x, y) is not a valid point on curve.
+func checkOnCurve(curve elliptic.Curve, x, y *big.Int) error {
+	ecdhCurves := map[elliptic.Curve]ecdh.Curve{
+		elliptic.P256(): ecdh.P256(),
+		elliptic.P384(): ecdh.P384(),
+		elliptic.P521(): ecdh.P521(),
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if x.BitLen() > size*8 || y.BitLen() > size*8 {
+		return fmt.Errorf("point is not on curve %s", curve.Params().Name)
+	}
+	point := append([]byte{4}, x.FillBytes(make([]byte, size))...)
+	point = append(point, y.FillBytes(make([]byte, size))...)
+	if _, err := ecdhCurves[curve].NewPublicKey(point); err != nil {
+		return fmt.Errorf("point is not on curve %s: %v", curve.Params().Name, err)
+	}
+	return nil
+}
+
+// jwkThumbprint returns the JWK thumbprint (RFC 7638) of pub.
+func jwkThumbprint(pub crypto.PublicKey) (string, error) {
+	var canonical string
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`,
+			pub.Curve.Params().Name,
+			base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+			base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))))
+	case *rsa.PublicKey:
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`,
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			base64.RawURLEncoding.EncodeToString(pub.N.Bytes()))
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,1308 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certmagictest provides an in-memory ACME server (RFC 8555)
+// for testing ACME clients, such as certmagic's ACMEIssuer, end-to-end
+// without a real CA or network access.
+//
+// The server runs on an httptest TLS server. It supports accounts
+// (including external account binding and key rollover), orders,
+// validation of http-01, tls-alpn-01, dns-01, dns-account-01 and
+// dns-persist-01 challenges against local solvers, certificate revocation, ACME
+// Renewal Information (RFC 9773), profiles, and alternate certificate
+// chains. Errors like rate limits can be injected to exercise failure
+// handling.
+//
+// A typical test configures and starts a server, then points the
+// client at DirectoryURL and trusts TrustedRoots:
+//
+//	srv := &certmagictest.Server{HTTPChallengeAddr: "127.0.0.1:5002"}
+//	srv.Start()
+//	defer srv.Close()
+//
+// The server is meant for tests only: it keeps everything in memory
+// and its certificates are not trusted by anything but the test.
+package certmagictest
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// Server is an in-memory ACME server. Configure its exported fields,
+// then call Start. Do not change the fields after calling Start.
+type Server struct {
+	// The address (host:port) to connect to when validating
+	// http-01 challenges; the identifier being validated is
+	// sent as the Host header. If empty, http-01 challenges
+	// are not offered.
+	HTTPChallengeAddr string
+
+	// The address (host:port) to connect to when validating
+	// tls-alpn-01 challenges; the identifier being validated
+	// is sent as the server name. If empty, tls-alpn-01
+	// challenges are not offered.
+	TLSALPNChallengeAddr string
+
+	// The function used to look up TXT records when validating
+	// dns-01 challenges, for example from a fake DNS provider.
+	// If nil, dns-01 challenges are not offered.
+	LookupTXT func(ctx context.Context, fqdn string) ([]string, error)
+
+	// If true, dns-account-01 challenges are offered along
+	// with dns-01 challenges, and validated with LookupTXT.
+	DNSAccountChallenge bool
+
+	// If set, dns-persist-01 challenges are offered along
+	// with dns-01 challenges, and validated with LookupTXT:
+	// a persistent record must authorize the account to
+	// obtain certificates from this issuer domain name.
+	PersistIssuerDomainName string
+
+	// If set, new accounts must be bound to one of these
+	// external accounts, keyed by key ID, with their MAC keys.
+	ExternalAccountKeys map[string][]byte
+
+	// The URL of the terms of service; if set, new accounts
+	// must agree to them.
+	TermsOfService string
+
+	// The profiles the server offers, keyed by name.
+	Profiles map[string]Profile
+
+	// How long issued certificates are valid, unless the
+	// order or its profile says otherwise. Default: 90 days.
+	CertificateLifetime time.Duration
+
+	// The number of alternate chains to offer for issued
+	// certificates, each to a different root.
+	AlternateChains int
+
+	// Returns the suggested renewal window of cert for ARI.
+	// By default, the window is the second-to-last sixth of
+	// the certificate's lifetime, or in the past if the
+	// certificate was revoked.
+	RenewalWindow func(cert *x509.Certificate) (start, end time.Time)
+
+	// Disables ACME Renewal Information (ARI).
+	DisableARI bool
+
+	srv *httptest.Server
+	ca  *issuingCA
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	nonces   map[string]struct{}
+	faults   map[Endpoint][]Error
+	accounts []*account
+	orders   []*order
+	authzs   map[string]*authorization
+	chals    map[string]*challenge
+	certs    []*issuedCert
+}
+
+// Profile is a certificate profile offered by the server.
+type Profile struct {
+	// The description shown in the directory.
+	Description string
+
+	// How long certificates issued with this profile are valid.
+	// Default: the server's CertificateLifetime.
+	Lifetime time.Duration
+}
+
+// Start starts the server. It panics if the CA can't be created.
+func (s *Server) Start() {
+	ca, err := newIssuingCA(s.AlternateChains)
+	if err != nil {
+		panic(fmt.Sprintf("certmagictest: creating CA: %v", err))
+	}
+	s.ca = ca
+	s.nonces = make(map[string]struct{})
+	s.faults = make(map[Endpoint][]Error)
+	s.authzs = make(map[string]*authorization)
+	s.chals = make(map[string]*challenge)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handleDirectory)
+	mux.HandleFunc("HEAD /new-nonce", s.handleNewNonce)
+	mux.HandleFunc("GET /new-nonce", s.handleNewNonce)
+	mux.HandleFunc("POST /new-account", s.handleNewAccount)
+	mux.HandleFunc("POST /account/{id}", s.handleAccount)
+	mux.HandleFunc("POST /key-change", s.handleKeyChange)
+	mux.HandleFunc("POST /new-order", s.handleNewOrder)
+	mux.HandleFunc("POST /order/{id}", s.handleOrder)
+	mux.HandleFunc("POST /order/{id}/finalize", s.handleFinalize)
+	mux.HandleFunc("POST /authz/{id}", s.handleAuthorization)
+	mux.HandleFunc("POST /chall/{id}", s.handleChallenge)
+	mux.HandleFunc("POST /cert/{id}", s.handleCertificate)
+	mux.HandleFunc("POST /cert/{id}/{chain}", s.handleCertificate)
+	mux.HandleFunc("POST /revoke-cert", s.handleRevokeCert)
+	mux.HandleFunc("GET /renewal-info/{id}", s.handleRenewalInfo)
+
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every response carries a fresh nonce (RFC 8555 §6.5)
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		w.Header().Set("Cache-Control", "no-store")
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+// Close shuts down the server and waits for
+// pending challenge validations to finish.
+func (s *Server) Close() {
+	s.srv.Close()
+	s.wg.Wait()
+}
+
+// DirectoryURL returns the URL of the server's directory.
+func (s *Server) DirectoryURL() string {
+	return s.srv.URL + "/directory"
+}
+
+// TrustedRoots returns a pool with the certificate of
+// the server's HTTPS endpoint, for clients to trust.
+func (s *Server) TrustedRoots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.srv.Certificate())
+	return pool
+}
+
+// Roots returns the roots of the issued certificates' chains; the
+// first one is the root of the default chain, and the others are the
+// roots of the alternate chains, in order.
+func (s *Server) Roots() []*x509.Certificate {
+	return slices.Clone(s.ca.roots)
+}
+
+// InjectError makes the server respond to the next count requests
+// to endpoint with err instead of handling them.
+func (s *Server) InjectError(endpoint Endpoint, count int, err Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range count {
+		s.faults[endpoint] = append(s.faults[endpoint], err)
+	}
+}
+
+// Accounts returns the accounts registered with the server.
+func (s *Server) Accounts() []Account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := make([]Account, 0, len(s.accounts))
+	for _, acct := range s.accounts {
+		accounts = append(accounts, Account{
+			URL:                  acct.url,
+			Status:               acct.status,
+			Contact:              slices.Clone(acct.contact),
+			Thumbprint:           acct.thumbprint,
+			ExternalAccountKeyID: acct.eabKeyID,
+		})
+	}
+	return accounts
+}
+
+// Orders returns the orders created on the server.
+func (s *Server) Orders() []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := make([]Order, 0, len(s.orders))
+	for _, o := range s.orders {
+		info := Order{
+			URL:         o.url,
+			Account:     o.acct.url,
+			Status:      o.currentStatus(),
+			Identifiers: slices.Clone(o.identifiers),
+			Profile:     o.profile,
+			Replaces:    o.replaces,
+		}
+		for _, authz := range o.authzs {
+			for _, chal := range authz.challenges {
+				if chal.status == acme.StatusValid {
+					info.Challenges = append(info.Challenges, chal.typ)
+				}
+			}
+		}
+		orders = append(orders, info)
+	}
+	return orders
+}
+
+// Certificates returns the certificates issued by the server.
+func (s *Server) Certificates() []Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	certs := make([]Certificate, 0, len(s.certs))
+	for _, cert := range s.certs {
+		certs = append(certs, Certificate{
+			Leaf:             cert.leaf,
+			Account:          cert.acct.url,
+			Revoked:          cert.revoked,
+			RevocationReason: cert.reason,
+		})
+	}
+	return certs
+}
+
+// Account describes an account registered with the server.
+type Account struct {
+	URL                  string
+	Status               string
+	Contact              []string
+	Thumbprint           string // of the current account key
+	ExternalAccountKeyID string
+}
+
+// Order describes an order created on the server.
+type Order struct {
+	URL         string
+	Account     string
+	Status      string
+	Identifiers []acme.Identifier
+	Profile     string
+	Replaces    string   // ARI certificate ID
+	Challenges  []string // types of the challenges that were validated
+}
+
+// Certificate describes a certificate issued by the server.
+type Certificate struct {
+	Leaf             *x509.Certificate
+	Account          string
+	Revoked          bool
+	RevocationReason int
+}
+
+// Endpoint names an endpoint of the server, for injecting errors.
+type Endpoint string
+
+// The endpoints of the server.
+const (
+	EndpointNewAccount    Endpoint = "newAccount"
+	EndpointAccount       Endpoint = "account"
+	EndpointKeyChange     Endpoint = "keyChange"
+	EndpointNewOrder      Endpoint = "newOrder"
+	EndpointOrder         Endpoint = "order"
+	EndpointFinalize      Endpoint = "finalize"
+	EndpointAuthorization Endpoint = "authorization"
+	EndpointChallenge     Endpoint = "challenge"
+	EndpointCertificate   Endpoint = "certificate"
+	EndpointRevokeCert    Endpoint = "revokeCert"
+	EndpointRenewalInfo   Endpoint = "renewalInfo"
+)
+
+// Error is an error response to inject; see Server.InjectError.
+type Error struct {
+	Problem acme.Problem
+
+	// If set, the value of the Retry-After header.
+	RetryAfter time.Duration
+}
+
+// RateLimited returns an error that says the client is rate
+// limited and may retry after the given duration.
+func RateLimited(retryAfter time.Duration) Error {
+	return Error{
+		Problem: acme.Problem{
+			Type:   acme.ProblemTypeRateLimited,
+			Status: http.StatusTooManyRequests,
+			Detail: "too many requests (injected by certmagictest)",
+		},
+		RetryAfter: retryAfter,
+	}
+}
+
+// BadNonce returns an error that says the client's nonce was
+// invalid. ACME clients are expected to retry with a new nonce.
+func BadNonce() Error {
+	return Error{Problem: acme.Problem{
+		Type:   acme.ProblemTypeBadNonce,
+		Status: http.StatusBadRequest,
+		Detail: "bad nonce (injected by certmagictest)",
+	}}
+}
+
+// ServerInternal returns an error that says the server failed.
+func ServerInternal() Error {
+	return Error{Problem: acme.Problem{
+		Type:   acme.ProblemTypeServerInternal,
+		Status: http.StatusInternalServerError,
+		Detail: "internal error (injected by certmagictest)",
+	}}
+}
+
+type account struct {
+	id, url    string
+	key        crypto.PublicKey
+	thumbprint string
+	status     string
+	contact    []string
+	eabKeyID   string
+}
+
+type order struct {
+	id, url     string
+	acct        *account
+	identifiers []acme.Identifier
+	profile     string
+	replaces    string
+	notBefore   *time.Time
+	notAfter    *time.Time
+	expires     time.Time
+	authzs      []*authorization
+	finalized   bool
+	cert        *issuedCert
+}
+
+// currentStatus returns the status of o, which depends
+// on the status of its authorizations.
+func (o *order) currentStatus() string {
+	if o.cert != nil {
+		return acme.StatusValid
+	}
+	if time.Now().After(o.expires) {
+		return acme.StatusInvalid
+	}
+	status := acme.StatusReady
+	for _, authz := range o.authzs {
+		switch authz.status {
+		case acme.StatusValid:
+		case acme.StatusPending:
+			status = acme.StatusPending
+		default:
+			return acme.StatusInvalid
+		}
+	}
+	return status
+}
+
+type authorization struct {
+	id, url    string
+	acct       *account
+	identifier acme.Identifier
+	wildcard   bool
+	status     string
+	expires    time.Time
+	challenges []*challenge
+}
+
+type challenge struct {
+	id, url   string
+	authz     *authorization
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *acme.Problem
+}
+
+type issuedCert struct {
+	id, url string
+	acct    *account
+	leaf    *x509.Certificate
+	chains  [][]byte
+	ariID   string
+	revoked bool
+	reason  int
+}
+
+// request is an authenticated POST request.
+type request struct {
+	header  jwsHeader
+	payload []byte
+	acct    *account         // the account that signed the request, if signed with a key ID
+	jwk     crypto.PublicKey // the key that signed the request, if signed with a JWK
+	raw     jwsMessage
+}
+
+// keyMode says which kind of key a request must be signed with.
+type keyMode int
+
+const (
+	keyID keyMode = iota
+	embeddedKey
+	eitherKey
+)
+
+// readRequest reads and authenticates the JWS-signed request r to
+// endpoint (RFC 8555 §6.2-6.5). If it returns false, it has written
+// an error response. The server must not be locked.
+func (s *Server) readRequest(w http.ResponseWriter, r *http.Request, endpoint Endpoint, mode keyMode) (*request, bool) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/jose+json" {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusUnsupportedMediaType, "invalid Content-Type %q", ct))
+		return nil, false
+	}
+	var req request
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "reading body: %v", err))
+		return nil, false
+	}
+	if err := json.Unmarshal(body, &req.raw); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing JWS: %v", err))
+		return nil, false
+	}
+	req.header, req.payload, err = req.raw.decode()
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "%v", err))
+		return nil, false
+	}
+	if req.header.URL != s.srv.URL+r.URL.Path {
+		writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusUnauthorized, "JWS url %q does not match request URL", req.header.URL))
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nonces[req.header.Nonce]; !ok {
+		writeProblem(w, newProblem(acme.ProblemTypeBadNonce, http.StatusBadRequest, "invalid or reused nonce %q", req.header.Nonce))
+		return nil, false
+	}
+	delete(s.nonces, req.header.Nonce)
+
+	var pub crypto.PublicKey
+	switch {
+	case req.header.KID != "" && len(req.header.JWK) > 0:
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "JWS must not have both jwk and kid"))
+		return nil, false
+	case req.header.KID != "":
+		if mode == embeddedKey {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "JWS must be signed with an embedded jwk"))
+			return nil, false
+		}
+		idx := slices.IndexFunc(s.accounts, func(a *account) bool { return a.url == req.header.KID })
+		if idx < 0 {
+			writeProblem(w, newProblem(acme.ProblemTypeAccountDoesNotExist, http.StatusBadRequest, "account %s does not exist", req.header.KID))
+			return nil, false
+		}
+		req.acct = s.accounts[idx]
+		if req.acct.status != acme.StatusValid {
+			writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusUnauthorized, "account is %s", req.acct.status))
+			return nil, false
+		}
+		pub = req.acct.key
+	case len(req.header.JWK) > 0:
+		if mode == keyID {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "JWS must be signed with an account key ID"))
+			return nil, false
+		}
+		req.jwk, err = parseJWK(req.header.JWK)
+		if err != nil {
+			writeProblem(w, newProblem(acme.ProblemTypeBadPublicKey, http.StatusBadRequest, "%v", err))
+			return nil, false
+		}
+		pub = req.jwk
+	default:
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "JWS must have jwk or kid"))
+		return nil, false
+	}
+	if err := req.raw.verify(req.header.Alg, pub); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "verifying JWS: %v", err))
+		return nil, false
+	}
+
+	if s.injectedError(w, endpoint) {
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// injectedError writes the next injected error for endpoint, if
+// any, and returns true if it did. The server must be locked.
+func (s *Server) injectedError(w http.ResponseWriter, endpoint Endpoint) bool {
+	faults := s.faults[endpoint]
+	if len(faults) == 0 {
+		return false
+	}
+	fault := faults[0]
+	s.faults[endpoint] = faults[1:]
+	if fault.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((fault.RetryAfter+time.Second-1)/time.Second)))
+	}
+	prob := fault.Problem
+	writeProblem(w, &prob)
+	return true
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	dir := acme.Directory{
+		NewNonce:   s.srv.URL + "/new-nonce",
+		NewAccount: s.srv.URL + "/new-account",
+		NewOrder:   s.srv.URL + "/new-order",
+		RevokeCert: s.srv.URL + "/revoke-cert",
+		KeyChange:  s.srv.URL + "/key-change",
+		Meta: &acme.DirectoryMeta{
+			TermsOfService:          s.TermsOfService,
+			ExternalAccountRequired: s.ExternalAccountKeys != nil,
+		},
+	}
+	if !s.DisableARI {
+		dir.RenewalInfo = s.srv.URL + "/renewal-info"
+	}
+	if len(s.Profiles) > 0 {
+		dir.Meta.Profiles = make(map[string]string)
+		for name, profile := range s.Profiles {
+			dir.Meta.Profiles[name] = profile.Description
+		}
+	}
+	writeJSON(w, http.StatusOK, dir)
+}
+
+func (s *Server) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointNewAccount, embeddedKey)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Contact                []string        `json:"contact"`
+		TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+		ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing payload: %v", err))
+		return
+	}
+	thumbprint, err := jwkThumbprint(req.jwk)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadPublicKey, http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if idx := slices.IndexFunc(s.accounts, func(a *account) bool { return a.thumbprint == thumbprint }); idx >= 0 {
+		acct := s.accounts[idx]
+		if acct.status != acme.StatusValid {
+			writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusUnauthorized, "account is %s", acct.status))
+			return
+		}
+		w.Header().Set("Location", acct.url)
+		writeJSON(w, http.StatusOK, acct.object())
+		return
+	}
+	if payload.OnlyReturnExisting {
+		writeProblem(w, newProblem(acme.ProblemTypeAccountDoesNotExist, http.StatusBadRequest, "no account exists with this key"))
+		return
+	}
+	if s.TermsOfService != "" && !payload.TermsOfServiceAgreed {
+		writeProblem(w, newProblem(acme.ProblemTypeUserActionRequired, http.StatusForbidden, "must agree to terms of service"))
+		return
+	}
+
+	acct := &account{
+		id:         randomID(),
+		key:        req.jwk,
+		thumbprint: thumbprint,
+		status:     acme.StatusValid,
+		contact:    payload.Contact,
+	}
+	acct.url = s.srv.URL + "/account/" + acct.id
+
+	if s.ExternalAccountKeys != nil {
+		if len(payload.ExternalAccountBinding) == 0 {
+			writeProblem(w, newProblem(acme.ProblemTypeExternalAccountRequired, http.StatusUnauthorized, "external account binding required"))
+			return
+		}
+		acct.eabKeyID, err = s.verifyExternalAccountBinding(payload.ExternalAccountBinding, req.header.URL, thumbprint)
+		if err != nil {
+			writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusUnauthorized, "invalid external account binding: %v", err))
+			return
+		}
+	}
+
+	s.accounts = append(s.accounts, acct)
+	w.Header().Set("Location", acct.url)
+	writeJSON(w, http.StatusCreated, acct.object())
+}
+
+// verifyExternalAccountBinding verifies the external account binding eab
+// of a new account request to url with a key with the given thumbprint,
+// and returns the key ID of the external account (RFC 8555 §7.3.4).
+func (s *Server) verifyExternalAccountBinding(eab json.RawMessage, url, thumbprint string) (string, error) {
+	var msg jwsMessage
+	if err := json.Unmarshal(eab, &msg); err != nil {
+		return "", err
+	}
+	header, payload, err := msg.decode()
+	if err != nil {
+		return "", err
+	}
+	macKey, ok := s.ExternalAccountKeys[header.KID]
+	if !ok {
+		return "", fmt.Errorf("unknown key ID %q", header.KID)
+	}
+	if header.URL != url || header.Nonce != "" {
+		return "", fmt.Errorf("protected header must have url %q and no nonce", url)
+	}
+	if err := msg.verifyHMAC(header.Alg, macKey); err != nil {
+		return "", err
+	}
+	boundKey, err := parseJWK(payload)
+	if err != nil {
+		return "", err
+	}
+	if boundThumbprint, err := jwkThumbprint(boundKey); err != nil || boundThumbprint != thumbprint {
+		return "", fmt.Errorf("bound key is not the account key")
+	}
+	return header.KID, nil
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointAccount, keyID)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.acct.id != r.PathValue("id") {
+		writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "not your account"))
+		return
+	}
+	if len(req.payload) > 0 {
+		var payload struct {
+			Status  string   `json:"status"`
+			Contact []string `json:"contact"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing payload: %v", err))
+			return
+		}
+		switch payload.Status {
+		case "", acme.StatusValid:
+		case acme.StatusDeactivated:
+			req.acct.status = acme.StatusDeactivated
+		default:
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "invalid status %q", payload.Status))
+			return
+		}
+		if payload.Contact != nil {
+			req.acct.contact = payload.Contact
+		}
+	}
+	w.Header().Set("Location", req.acct.url)
+	writeJSON(w, http.StatusOK, req.acct.object())
+}
+
+func (s *Server) handleKeyChange(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointKeyChange, keyID)
+	if !ok {
+		return
+	}
+
+	// the payload is a JWS signed by the new key (RFC 8555 §7.3.5)
+	var inner jwsMessage
+	if err := json.Unmarshal(req.payload, &inner); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing inner JWS: %v", err))
+		return
+	}
+	header, payload, err := inner.decode()
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "inner JWS: %v", err))
+		return
+	}
+	if header.URL != req.header.URL || header.KID != "" || header.Nonce != "" {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "inner JWS must have the same url, a jwk and no nonce"))
+		return
+	}
+	newKey, err := parseJWK(header.JWK)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadPublicKey, http.StatusBadRequest, "%v", err))
+		return
+	}
+	if err := inner.verify(header.Alg, newKey); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "verifying inner JWS: %v", err))
+		return
+	}
+	var keyChange struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}
+	if err := json.Unmarshal(payload, &keyChange); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing inner payload: %v", err))
+		return
+	}
+	oldKey, err := parseJWK(keyChange.OldKey)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "old key: %v", err))
+		return
+	}
+	oldThumbprint, _ := jwkThumbprint(oldKey)
+	newThumbprint, err := jwkThumbprint(newKey)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadPublicKey, http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if keyChange.Account != req.acct.url || oldThumbprint != req.acct.thumbprint {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "inner payload does not match account and its current key"))
+		return
+	}
+	if idx := slices.IndexFunc(s.accounts, func(a *account) bool { return a.thumbprint == newThumbprint }); idx >= 0 {
+		w.Header().Set("Location", s.accounts[idx].url)
+		writeProblem(w, newProblem(problemTypeConflict, http.StatusConflict, "new key is already in use"))
+		return
+	}
+	req.acct.key, req.acct.thumbprint = newKey, newThumbprint
+	writeJSON(w, http.StatusOK, req.acct.object())
+}
+
+func (s *Server) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointNewOrder, keyID)
+	if !ok {
+		return
+	}
+	var payload acme.Order
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing payload: %v", err))
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "order has no identifiers"))
+		return
+	}
+	if payload.Profile != "" {
+		if _, ok := s.Profiles[payload.Profile]; !ok {
+			writeProblem(w, newProblem(problemTypeInvalidProfile, http.StatusBadRequest, "unknown profile %q", payload.Profile))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if payload.Replaces != "" {
+		idx := slices.IndexFunc(s.certs, func(c *issuedCert) bool { return c.ariID == payload.Replaces })
+		if idx < 0 || s.certs[idx].acct != req.acct {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "unknown certificate to replace %q", payload.Replaces))
+			return
+		}
+	}
+
+	now := time.Now()
+	o := &order{
+		id:          randomID(),
+		acct:        req.acct,
+		identifiers: payload.Identifiers,
+		profile:     payload.Profile,
+		replaces:    payload.Replaces,
+		notBefore:   payload.NotBefore,
+		notAfter:    payload.NotAfter,
+		expires:     now.Add(7 * 24 * time.Hour),
+	}
+	o.url = s.srv.URL + "/order/" + o.id
+
+	for _, id := range payload.Identifiers {
+		if err := validIdentifier(id); err != nil {
+			writeProblem(w, newProblem(acme.ProblemTypeRejectedIdentifier, http.StatusBadRequest, "%v", err))
+			return
+		}
+		authz := &authorization{
+			id:         randomID(),
+			acct:       req.acct,
+			identifier: acme.Identifier{Type: id.Type, Value: strings.ToLower(strings.TrimPrefix(id.Value, "*."))},
+			wildcard:   strings.HasPrefix(id.Value, "*."),
+			status:     acme.StatusPending,
+			expires:    o.expires,
+		}
+		authz.url = s.srv.URL + "/authz/" + authz.id
+		types := s.challengeTypes(authz.identifier, authz.wildcard)
+		if len(types) == 0 {
+			writeProblem(w, newProblem(acme.ProblemTypeRejectedIdentifier, http.StatusBadRequest, "no challenges available for %s", id.Value))
+			return
+		}
+		for _, typ := range types {
+			chal := &challenge{
+				id:     randomID(),
+				authz:  authz,
+				typ:    typ,
+				token:  randomToken(),
+				status: acme.StatusPending,
+			}
+			chal.url = s.srv.URL + "/chall/" + chal.id
+			authz.challenges = append(authz.challenges, chal)
+		}
+		o.authzs = append(o.authzs, authz)
+	}
+
+	for _, authz := range o.authzs {
+		s.authzs[authz.id] = authz
+		for _, chal := range authz.challenges {
+			s.chals[chal.id] = chal
+		}
+	}
+	s.orders = append(s.orders, o)
+
+	w.Header().Set("Location", o.url)
+	writeJSON(w, http.StatusCreated, o.object())
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointOrder, keyID)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.findOrder(w, r, req)
+	if o == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, o.object())
+}
+
+func (s *Server) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointFinalize, keyID)
+	if !ok {
+		return
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing payload: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.findOrder(w, r, req)
+	if o == nil {
+		return
+	}
+	if status := o.currentStatus(); status != acme.StatusReady || o.finalized {
+		writeProblem(w, newProblem(acme.ProblemTypeOrderNotReady, http.StatusForbidden, "order is %s", status))
+		return
+	}
+
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadCSR, http.StatusBadRequest, "decoding CSR: %v", err))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadCSR, http.StatusBadRequest, "parsing CSR: %v", err))
+		return
+	}
+	if err := csr.CheckSignature(); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadCSR, http.StatusBadRequest, "invalid CSR signature: %v", err))
+		return
+	}
+	if err := o.checkCSR(csr); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeBadCSR, http.StatusBadRequest, "%v", err))
+		return
+	}
+	if csrThumbprint, err := jwkThumbprint(csr.PublicKey); err == nil && csrThumbprint == o.acct.thumbprint {
+		writeProblem(w, newProblem(acme.ProblemTypeBadCSR, http.StatusBadRequest, "certificate key must not be the account key"))
+		return
+	}
+
+	notBefore, notAfter := time.Now().Add(-time.Minute), time.Now().Add(s.lifetime(o.profile))
+	if o.notBefore != nil {
+		notBefore = *o.notBefore
+	}
+	if o.notAfter != nil {
+		notAfter = *o.notAfter
+	}
+	leaf, chains, err := s.ca.issue(csr, notBefore, notAfter)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeServerInternal, http.StatusInternalServerError, "%v", err))
+		return
+	}
+	ariID, err := acme.ARIUniqueIdentifier(leaf)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeServerInternal, http.StatusInternalServerError, "%v", err))
+		return
+	}
+	cert := &issuedCert{
+		id:     randomID(),
+		acct:   o.acct,
+		leaf:   leaf,
+		chains: chains,
+		ariID:  ariID,
+	}
+	cert.url = s.srv.URL + "/cert/" + cert.id
+	s.certs = append(s.certs, cert)
+	o.cert, o.finalized = cert, true
+
+	w.Header().Set("Location", o.url)
+	writeJSON(w, http.StatusOK, o.object())
+}
+
+func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointAuthorization, keyID)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	authz, ok := s.authzs[r.PathValue("id")]
+	if !ok || authz.acct != req.acct {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "no such authorization"))
+		return
+	}
+	if len(req.payload) > 0 {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing payload: %v", err))
+			return
+		}
+		if payload.Status != acme.StatusDeactivated {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "invalid status %q", payload.Status))
+			return
+		}
+		authz.status = acme.StatusDeactivated
+	}
+	writeJSON(w, http.StatusOK, authz.object())
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointChallenge, keyID)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chal, ok := s.chals[r.PathValue("id")]
+	if !ok || chal.authz.acct != req.acct {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "no such challenge"))
+		return
+	}
+
+	// an empty object (rather than an empty payload) asks
+	// the server to validate the challenge (RFC 8555 §7.5.1)
+	if len(req.payload) > 0 && chal.status == acme.StatusPending && chal.authz.status == acme.StatusPending {
+		chal.status = acme.StatusProcessing
+		s.wg.Add(1)
+		go s.validate(chal, chal.token+"."+req.acct.thumbprint)
+	}
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="up"`, chal.authz.url))
+	writeJSON(w, http.StatusOK, chal.object())
+}
+
+func (s *Server) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointCertificate, keyID)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := slices.IndexFunc(s.certs, func(c *issuedCert) bool { return c.id == r.PathValue("id") })
+	if idx < 0 || s.certs[idx].acct != req.acct {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "no such certificate"))
+		return
+	}
+	cert := s.certs[idx]
+
+	chain := 0
+	if chainStr := r.PathValue("chain"); chainStr != "" {
+		var err error
+		chain, err = strconv.Atoi(chainStr)
+		if err != nil || chain < 1 || chain >= len(cert.chains) {
+			writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "no such chain"))
+			return
+		}
+	} else {
+		for i := 1; i < len(cert.chains); i++ {
+			w.Header().Add("Link", fmt.Sprintf(`<%s/%d>;rel="alternate"`, cert.url, i))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, _ = w.Write(cert.chains[chain])
+}
+
+func (s *Server) handleRevokeCert(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r, EndpointRevokeCert, eitherKey)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "parsing payload: %v", err))
+		return
+	}
+	certDER, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "decoding certificate: %v", err))
+		return
+	}
+	if payload.Reason < acme.ReasonUnspecified || payload.Reason > acme.ReasonAACompromise || payload.Reason == 7 {
+		writeProblem(w, newProblem(acme.ProblemTypeBadRevocationReason, http.StatusBadRequest, "invalid reason %d", payload.Reason))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := slices.IndexFunc(s.certs, func(c *issuedCert) bool { return string(c.leaf.Raw) == string(certDER) })
+	if idx < 0 {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "certificate was not issued by this server"))
+		return
+	}
+	cert := s.certs[idx]
+
+	// either the account that ordered the certificate, or
+	// the certificate's key, may revoke it (RFC 8555 §7.6)
+	if req.acct != nil && req.acct != cert.acct {
+		writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "account did not order this certificate"))
+		return
+	}
+	if req.jwk != nil {
+		jwkThumb, _ := jwkThumbprint(req.jwk)
+		certThumb, _ := jwkThumbprint(cert.leaf.PublicKey)
+		if jwkThumb == "" || jwkThumb != certThumb {
+			writeProblem(w, newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "key does not match certificate"))
+			return
+		}
+	}
+	if cert.revoked {
+		writeProblem(w, newProblem(acme.ProblemTypeAlreadyRevoked, http.StatusBadRequest, "certificate is already revoked"))
+		return
+	}
+	cert.revoked, cert.reason = true, payload.Reason
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleRenewalInfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.injectedError(w, EndpointRenewalInfo) {
+		return
+	}
+	idx := slices.IndexFunc(s.certs, func(c *issuedCert) bool { return c.ariID == r.PathValue("id") })
+	if idx < 0 {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "no such certificate"))
+		return
+	}
+	cert := s.certs[idx]
+
+	var ari acme.RenewalInfo
+	switch {
+	case s.RenewalWindow != nil:
+		ari.SuggestedWindow.Start, ari.SuggestedWindow.End = s.RenewalWindow(cert.leaf)
+	case cert.revoked:
+		ari.SuggestedWindow.Start, ari.SuggestedWindow.End = time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	default:
+		lifetime := cert.leaf.NotAfter.Sub(cert.leaf.NotBefore)
+		ari.SuggestedWindow.Start = cert.leaf.NotAfter.Add(-lifetime / 3)
+		ari.SuggestedWindow.End = cert.leaf.NotAfter.Add(-lifetime / 6)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(renewalInfoRetryAfter/time.Second)))
+	writeJSON(w, http.StatusOK, struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+	}{SuggestedWindow: ari.SuggestedWindow})
+}
+
+// findOrder returns the order requested by req, or writes an
+// error response and returns nil. The server must be locked.
+func (s *Server) findOrder(w http.ResponseWriter, r *http.Request, req *request) *order {
+	idx := slices.IndexFunc(s.orders, func(o *order) bool { return o.id == r.PathValue("id") })
+	if idx < 0 || s.orders[idx].acct != req.acct {
+		writeProblem(w, newProblem(acme.ProblemTypeMalformed, http.StatusNotFound, "no such order"))
+		return nil
+	}
+	return s.orders[idx]
+}
+
+// lifetime returns how long certificates issued with profile are valid.
+func (s *Server) lifetime(profile string) time.Duration {
+	if p, ok := s.Profiles[profile]; ok && p.Lifetime > 0 {
+		return p.Lifetime
+	}
+	if s.CertificateLifetime > 0 {
+		return s.CertificateLifetime
+	}
+	return defaultCertificateLifetime
+}
+
+// newNonce creates and remembers a new nonce.
+func (s *Server) newNonce() string {
+	nonce := randomToken()
+	s.mu.Lock()
+	s.nonces[nonce] = struct{}{}
+	s.mu.Unlock()
+	return nonce
+}
+
+// checkCSR returns an error if the identifiers
+// in csr are not exactly those of the order.
+func (o *order) checkCSR(csr *x509.CertificateRequest) error {
+	var csrIDs, orderIDs []string
+	for _, name := range csr.DNSNames {
+		csrIDs = append(csrIDs, "dns:"+strings.ToLower(name))
+	}
+	for _, ip := range csr.IPAddresses {
+		csrIDs = append(csrIDs, "ip:"+ip.String())
+	}
+	for _, id := range o.identifiers {
+		value := strings.ToLower(id.Value)
+		if id.Type == "ip" {
+			value = net.ParseIP(id.Value).String()
+		}
+		orderIDs = append(orderIDs, id.Type+":"+value)
+	}
+	slices.Sort(csrIDs)
+	slices.Sort(orderIDs)
+	if !slices.Equal(slices.Compact(csrIDs), slices.Compact(orderIDs)) {
+		return fmt.Errorf("CSR identifiers %v do not match order identifiers %v", csrIDs, orderIDs)
+	}
+	return nil
+}
+
+func (acct *account) object() acme.Account {
+	return acme.Account{
+		Status:  acct.status,
+		Contact: acct.contact,
+	}
+}
+
+func (o *order) object() acme.Order {
+	obj := acme.Order{
+		Status:      o.currentStatus(),
+		Expires:     o.expires,
+		Profile:     o.profile,
+		Identifiers: o.identifiers,
+		Replaces:    o.replaces,
+		NotBefore:   o.notBefore,
+		NotAfter:    o.notAfter,
+		Finalize:    o.url + "/finalize",
+	}
+	for _, authz := range o.authzs {
+		obj.Authorizations = append(obj.Authorizations, authz.url)
+		for _, chal := range authz.challenges {
+			if chal.err != nil && obj.Error == nil {
+				obj.Error = chal.err
+			}
+		}
+	}
+	if o.cert != nil {
+		obj.Certificate = o.cert.url
+	}
+	return obj
+}
+
+func (authz *authorization) object() acme.Authorization {
+	obj := acme.Authorization{
+		Identifier: authz.identifier,
+		Status:     authz.status,
+		Expires:    authz.expires,
+		Wildcard:   authz.wildcard,
+	}
+	for _, chal := range authz.challenges {
+		obj.Challenges = append(obj.Challenges, chal.object())
+	}
+	return obj
+}
+
+func (chal *challenge) object() acme.Challenge {
+	obj := acme.Challenge{
+		Type:   chal.typ,
+		URL:    chal.url,
+		Status: chal.status,
+		Token:  chal.token,
+		Error:  chal.err,
+	}
+	if !chal.validated.IsZero() {
+		obj.Validated = chal.validated.UTC().Format(time.RFC3339)
+	}
+	return obj
+}
+
+func newProblem(typ string, status int, format string, args ...any) *acme.Problem {
+	return &acme.Problem{Type: typ, Status: status, Detail: fmt.Sprintf(format, args...)}
+}
+
+func writeProblem(w http.ResponseWriter, prob *acme.Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(prob.Status)
+	_ = json.NewEncoder(w).Encode(prob)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+const (
+	problemTypeConflict       = acme.ProblemTypeNamespace + "conflict"
+	problemTypeInvalidProfile = acme.ProblemTypeNamespace + "invalidProfile"
+
+	defaultCertificateLifetime = 90 * 24 * time.Hour
+	renewalInfoRetryAfter      = 6 * time.Hour
+)
@@ -0,0 +1,481 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestServerIssuance(t *testing.T) {
+	ctx := context.Background()
+	httpSolver := newTestHTTPSolver(t)
+	macKey := []byte("0123456789abcdef0123456789abcdef")
+	srv := &Server{
+		HTTPChallengeAddr:   httpSolver.addr,
+		ExternalAccountKeys: map[string][]byte{"kid-1": macKey},
+		TermsOfService:      "https://example.com/tos",
+		Profiles:            map[string]Profile{"shortlived": {Description: "6 days", Lifetime: 6 * 24 * time.Hour}},
+		AlternateChains:     1,
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := newTestClient(srv, map[string]acmez.Solver{acme.ChallengeTypeHTTP01: httpSolver})
+
+	// accounts require external account binding
+	account := acme.Account{Contact: []string{"mailto:test@example.com"}, TermsOfServiceAgreed: true, PrivateKey: newTestKey(t)}
+	if _, err := client.NewAccount(ctx, account); !isProblem(err, acme.ProblemTypeExternalAccountRequired) {
+		t.Fatalf("Expected external account to be required, got: %v", err)
+	}
+	if err := account.SetExternalAccountBinding(ctx, client.Client, acme.EAB{KeyID: "kid-1", MACKey: base64.RawURLEncoding.EncodeToString(macKey)}); err != nil {
+		t.Fatal(err)
+	}
+	account, err := client.NewAccount(ctx, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accounts := srv.Accounts(); len(accounts) != 1 || accounts[0].ExternalAccountKeyID != "kid-1" {
+		t.Fatalf("Expected one account bound to kid-1, got: %+v", accounts)
+	}
+
+	certs := obtain(t, client, account, "shortlived", nil, "example.com", "www.example.com")
+	if len(certs) != 2 {
+		t.Fatalf("Expected default and alternate chain, got %d chains", len(certs))
+	}
+	roots := srv.Roots()
+	for i, chain := range certs {
+		leaf, intermediates := parseChain(t, chain.ChainPEM)
+		pool := x509.NewCertPool()
+		pool.AddCert(roots[i])
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: pool, Intermediates: intermediates}); err != nil {
+			t.Errorf("Chain %d: expected to verify against root %d: %v", i, i, err)
+		}
+		if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > 6*24*time.Hour+time.Minute {
+			t.Errorf("Chain %d: expected profile lifetime, got %s", i, lifetime)
+		}
+	}
+	leaf, _ := parseChain(t, certs[0].ChainPEM)
+
+	// renewal information, and replacing the certificate
+	if certs[0].RenewalInfo == nil || !certs[0].RenewalInfo.HasWindow() || !certs[0].RenewalInfo.SuggestedWindow.Start.After(time.Now()) {
+		t.Errorf("Expected future renewal window, got: %+v", certs[0].RenewalInfo)
+	}
+	obtain(t, client, account, "", leaf, "example.com", "www.example.com")
+	orders := srv.Orders()
+	if len(orders) != 2 || orders[1].Replaces != certs[0].RenewalInfo.UniqueIdentifier || orders[1].Status != acme.StatusValid {
+		t.Errorf("Expected second order to replace first certificate, got: %+v", orders)
+	}
+	if len(orders[0].Challenges) != 2 || orders[0].Challenges[0] != acme.ChallengeTypeHTTP01 {
+		t.Errorf("Expected orders to record validated challenges, got: %v", orders[0].Challenges)
+	}
+
+	// revocation
+	if err := client.RevokeCertificate(ctx, account, leaf, account.PrivateKey, acme.ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RevokeCertificate(ctx, account, leaf, account.PrivateKey, acme.ReasonKeyCompromise); !isProblem(err, acme.ProblemTypeAlreadyRevoked) {
+		t.Errorf("Expected certificate to already be revoked, got: %v", err)
+	}
+	if issued := srv.Certificates(); !issued[0].Revoked || issued[0].RevocationReason != acme.ReasonKeyCompromise || issued[1].Revoked {
+		t.Errorf("Expected only first certificate to be revoked, got: %+v", issued)
+	}
+	ari, err := client.GetRenewalInfo(ctx, leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ari.SuggestedWindow.End.Before(time.Now()) {
+		t.Errorf("Expected renewal window of revoked certificate to be in the past, got: %+v", ari.SuggestedWindow)
+	}
+}
+
+func TestServerChallengeTypes(t *testing.T) {
+	ctx := context.Background()
+
+	var txtMu sync.Mutex
+	txtRecords := make(map[string][]string)
+	dnsSolver := solverFuncs{
+		present: func(chal acme.Challenge) error {
+			txtMu.Lock()
+			defer txtMu.Unlock()
+			txtRecords[chal.DNS01TXTRecordName()] = append(txtRecords[chal.DNS01TXTRecordName()], chal.DNS01KeyAuthorization())
+			return nil
+		},
+	}
+	var account acme.Account
+	dnsAccountSolver := solverFuncs{
+		present: func(chal acme.Challenge) error {
+			txtMu.Lock()
+			defer txtMu.Unlock()
+			name := chal.DNSAccount01TXTRecordName(account)
+			txtRecords[name] = append(txtRecords[name], chal.DNS01KeyAuthorization())
+			return nil
+		},
+	}
+	dnsPersistSolver := solverFuncs{
+		present: func(chal acme.Challenge) error {
+			txtMu.Lock()
+			defer txtMu.Unlock()
+			name := "_validation-persist." + chal.Identifier.Value
+			txtRecords[name] = append(txtRecords[name], "ca.example; accounturi="+account.Location+"; policy=wildcard")
+			return nil
+		},
+	}
+	tlsALPNSolver := newTestTLSALPNSolver(t)
+
+	srv := &Server{
+		TLSALPNChallengeAddr:    tlsALPNSolver.addr,
+		DNSAccountChallenge:     true,
+		PersistIssuerDomainName: "ca.example",
+		LookupTXT: func(_ context.Context, fqdn string) ([]string, error) {
+			txtMu.Lock()
+			defer txtMu.Unlock()
+			return txtRecords[fqdn], nil
+		},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	for i, tc := range []struct {
+		solvers     map[string]acmez.Solver
+		names       []string
+		expectChals []string
+	}{
+		{
+			solvers:     map[string]acmez.Solver{acme.ChallengeTypeTLSALPN01: tlsALPNSolver},
+			names:       []string{"tls.example.com"},
+			expectChals: []string{acme.ChallengeTypeTLSALPN01},
+		},
+		{
+			solvers:     map[string]acmez.Solver{acme.ChallengeTypeDNS01: dnsSolver},
+			names:       []string{"*.example.com", "example.com"},
+			expectChals: []string{acme.ChallengeTypeDNS01, acme.ChallengeTypeDNS01},
+		},
+		{
+			solvers:     map[string]acmez.Solver{acme.ChallengeTypeDNSAccount01: dnsAccountSolver},
+			names:       []string{"*.account.example.com", "account.example.com"},
+			expectChals: []string{acme.ChallengeTypeDNSAccount01, acme.ChallengeTypeDNSAccount01},
+		},
+		{
+			solvers:     map[string]acmez.Solver{dnsPersist01: dnsPersistSolver},
+			names:       []string{"*.persist.example.com", "persist.example.com"},
+			expectChals: []string{dnsPersist01, dnsPersist01},
+		},
+	} {
+		client := newTestClient(srv, tc.solvers)
+		var err error
+		account, err = client.NewAccount(ctx, acme.Account{PrivateKey: newTestKey(t)})
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		obtain(t, client, account, "", nil, tc.names...)
+		orders := srv.Orders()
+		if chals := orders[len(orders)-1].Challenges; strings.Join(chals, ",") != strings.Join(tc.expectChals, ",") {
+			t.Errorf("Test %d: Expected challenges %v, got %v", i, tc.expectChals, chals)
+		}
+	}
+
+	// a wrong key authorization fails validation
+	client := newTestClient(srv, map[string]acmez.Solver{acme.ChallengeTypeDNS01: solverFuncs{}})
+	account, err := client.NewAccount(ctx, acme.Account{PrivateKey: newTestKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := newTestCSR(t, "fail.example.com")
+	params, err := acmez.OrderParametersFromCSR(account, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ObtainCertificate(ctx, params); !isProblem(err, acme.ProblemTypeUnauthorized) {
+		t.Errorf("Expected validation to fail, got: %v", err)
+	}
+}
+
+func TestServerInjectedErrors(t *testing.T) {
+	ctx := context.Background()
+	httpSolver := newTestHTTPSolver(t)
+	srv := &Server{HTTPChallengeAddr: httpSolver.addr}
+	srv.Start()
+	defer srv.Close()
+
+	client := newTestClient(srv, map[string]acmez.Solver{acme.ChallengeTypeHTTP01: httpSolver})
+	account, err := client.NewAccount(ctx, acme.Account{PrivateKey: newTestKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clients retry bad nonces
+	srv.InjectError(EndpointNewOrder, 2, BadNonce())
+	obtain(t, client, account, "", nil, "example.com")
+
+	// rate limits are reported with Retry-After
+	srv.InjectError(EndpointNewOrder, 1, RateLimited(time.Hour))
+	params, err := acmez.OrderParametersFromCSR(account, newTestCSR(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ObtainCertificate(ctx, params)
+	var problem acme.Problem
+	if !errors.As(err, &problem) || problem.Type != acme.ProblemTypeRateLimited || problem.Status != http.StatusTooManyRequests {
+		t.Errorf("Expected rate limit error, got: %v", err)
+	}
+	obtain(t, client, account, "", nil, "example.com")
+}
+
+func TestServerAccountManagement(t *testing.T) {
+	ctx := context.Background()
+	srv := &Server{HTTPChallengeAddr: "127.0.0.1:1"}
+	srv.Start()
+	defer srv.Close()
+	client := newTestClient(srv, nil)
+
+	oldKey := newTestKey(t)
+	account, err := client.NewAccount(ctx, acme.Account{PrivateKey: oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAccount(ctx, acme.Account{PrivateKey: newTestKey(t)}); !isProblem(err, acme.ProblemTypeAccountDoesNotExist) {
+		t.Errorf("Expected unknown account to not exist, got: %v", err)
+	}
+
+	// key rollover
+	account, err = client.AccountKeyRollover(ctx, account, newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := client.GetAccount(ctx, acme.Account{PrivateKey: account.PrivateKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Location != account.Location {
+		t.Errorf("Expected new key to find account %s, got %s", account.Location, found.Location)
+	}
+	if _, err := client.GetAccount(ctx, acme.Account{PrivateKey: oldKey}); !isProblem(err, acme.ProblemTypeAccountDoesNotExist) {
+		t.Errorf("Expected old key to no longer find the account, got: %v", err)
+	}
+
+	// deactivation
+	account.Status = acme.StatusDeactivated
+	if _, err := client.UpdateAccount(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewOrder(ctx, account, acme.Order{Identifiers: []acme.Identifier{{Type: "dns", Value: "example.com"}}}); !isProblem(err, acme.ProblemTypeUnauthorized) {
+		t.Errorf("Expected deactivated account to be unauthorized, got: %v", err)
+	}
+	if accounts := srv.Accounts(); accounts[0].Status != acme.StatusDeactivated {
+		t.Errorf("Expected account to be deactivated, got: %+v", accounts[0])
+	}
+}
+
+func obtain(t *testing.T, client *acmez.Client, account acme.Account, profile string, replaces *x509.Certificate, names ...string) []acme.Certificate {
+	t.Helper()
+	params, err := acmez.OrderParametersFromCSR(account, newTestCSR(t, names...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Profile, params.Replaces = profile, replaces
+	certs, err := client.ObtainCertificate(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Obtaining certificate for %v: %v", names, err)
+	}
+	return certs
+}
+
+func newTestClient(srv *Server, solvers map[string]acmez.Solver) *acmez.Client {
+	return &acmez.Client{
+		Client: &acme.Client{
+			Directory:    srv.DirectoryURL(),
+			HTTPClient:   &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: srv.TrustedRoots()}}},
+			PollInterval: 10 * time.Millisecond,
+			PollTimeout:  10 * time.Second,
+		},
+		ChallengeSolvers: solvers,
+	}
+}
+
+func newTestKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestCSR(t *testing.T, names ...string) *x509.CertificateRequest {
+	t.Helper()
+	csr, err := acmez.NewCSR(newTestKey(t), names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func parseChain(t *testing.T, chainPEM []byte) (*x509.Certificate, *x509.CertPool) {
+	t.Helper()
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(chainPEM); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 2 {
+		t.Fatalf("Expected chain with intermediate, got %d certificates", len(certs))
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return certs[0], intermediates
+}
+
+func isProblem(err error, typ string) bool {
+	var problem acme.Problem
+	return errors.As(err, &problem) && problem.Type == typ
+}
+
+type solverFuncs struct {
+	present func(acme.Challenge) error
+}
+
+func (s solverFuncs) Present(_ context.Context, chal acme.Challenge) error {
+	if s.present == nil {
+		return nil
+	}
+	return s.present(chal)
+}
+
+func (solverFuncs) CleanUp(context.Context, acme.Challenge) error { return nil }
+
+// testHTTPSolver serves http-01 challenges on a local listener.
+type testHTTPSolver struct {
+	addr  string
+	mu    sync.Mutex
+	chals map[string]string
+}
+
+func newTestHTTPSolver(t *testing.T) *testHTTPSolver {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testHTTPSolver{addr: ln.Addr().String(), chals: make(map[string]string)}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		keyAuth, ok := s.chals[r.Host+r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(keyAuth))
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { srv.Close() })
+	return s
+}
+
+func (s *testHTTPSolver) Present(_ context.Context, chal acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chals[chal.Identifier.Value+chal.HTTP01ResourcePath()] = chal.KeyAuthorization
+	return nil
+}
+
+func (s *testHTTPSolver) CleanUp(_ context.Context, chal acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.chals, chal.Identifier.Value+chal.HTTP01ResourcePath())
+	return nil
+}
+
+// testTLSALPNSolver serves tls-alpn-01 challenges on a local listener.
+type testTLSALPNSolver struct {
+	addr  string
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newTestTLSALPNSolver(t *testing.T) *testTLSALPNSolver {
+	t.Helper()
+	s := &testTLSALPNSolver{certs: make(map[string]*tls.Certificate)}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos: []string{acmez.ACMETLS1Protocol},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if cert, ok := s.certs[hello.ServerName]; ok {
+				return cert, nil
+			}
+			return nil, errors.New("no challenge certificate")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testTLSALPNSolver) Present(_ context.Context, chal acme.Challenge) error {
+	cert, err := acmez.TLSALPN01ChallengeCert(chal)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs[chal.Identifier.Value] = cert
+	return nil
+}
+
+func (s *testTLSALPNSolver) CleanUp(_ context.Context, chal acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.certs, chal.Identifier.Value)
+	return nil
+}
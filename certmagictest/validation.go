@@ -0,0 +1,242 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// validate performs the validation of chal and updates its
+// status, and the status of its authorization, accordingly.
+func (s *Server) validate(chal *challenge, keyAuth string) {
+	defer s.wg.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), validationTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	typ, identifier, accountURL, wildcard := chal.typ, chal.authz.identifier, chal.authz.acct.url, chal.authz.wildcard
+	s.mu.Unlock()
+
+	var prob *acme.Problem
+	switch typ {
+	case acme.ChallengeTypeHTTP01:
+		prob = s.validateHTTP01(ctx, identifier, chal.token, keyAuth)
+	case acme.ChallengeTypeTLSALPN01:
+		prob = s.validateTLSALPN01(ctx, identifier, keyAuth)
+	case acme.ChallengeTypeDNS01:
+		prob = s.validateDNSTXT(ctx, typ, "_acme-challenge."+identifier.Value, keyAuth)
+	case acme.ChallengeTypeDNSAccount01:
+		prob = s.validateDNSTXT(ctx, typ, dnsAccountLabel(accountURL)+"._acme-challenge."+identifier.Value, keyAuth)
+	case dnsPersist01:
+		prob = s.validateDNSPersist01(ctx, "_validation-persist."+identifier.Value, accountURL, wildcard)
+	default:
+		prob = newProblem(acme.ProblemTypeMalformed, http.StatusBadRequest, "unsupported challenge type %s", typ)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prob != nil {
+		chal.status, chal.err = acme.StatusInvalid, prob
+		chal.authz.status = acme.StatusInvalid
+		return
+	}
+	chal.status, chal.validated = acme.StatusValid, time.Now()
+	chal.authz.status = acme.StatusValid
+}
+
+func (s *Server) validateHTTP01(ctx context.Context, identifier acme.Identifier, token, keyAuth string) *acme.Problem {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.HTTPChallengeAddr+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return newProblem(acme.ProblemTypeServerInternal, http.StatusInternalServerError, "%v", err)
+	}
+	req.Host = identifier.Value
+	if identifier.Type == "ip" && strings.Contains(identifier.Value, ":") {
+		req.Host = "[" + identifier.Value + "]"
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return newProblem(acme.ProblemTypeConnection, http.StatusBadRequest, "fetching http-01 resource: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return newProblem(acme.ProblemTypeConnection, http.StatusBadRequest, "reading http-01 resource: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "http-01 resource returned HTTP %d", resp.StatusCode)
+	}
+	if string(bytes.TrimSpace(body)) != keyAuth {
+		return newProblem(acme.ProblemTypeIncorrectResponse, http.StatusForbidden, "http-01 resource has wrong key authorization %q", body)
+	}
+	return nil
+}
+
+func (s *Server) validateTLSALPN01(ctx context.Context, identifier acme.Identifier, keyAuth string) *acme.Problem {
+	dialer := &tls.Dialer{Config: &tls.Config{
+		ServerName:         identifier.Value,
+		NextProtos:         []string{acmeTLS1Protocol},
+		InsecureSkipVerify: true, // the challenge certificate is self-signed
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", s.TLSALPNChallengeAddr)
+	if err != nil {
+		return newProblem(acme.ProblemTypeTLS, http.StatusBadRequest, "tls-alpn-01 handshake: %v", err)
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if state.NegotiatedProtocol != acmeTLS1Protocol {
+		return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "tls-alpn-01 server did not negotiate %s", acmeTLS1Protocol)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], identifier.Value) {
+		return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "tls-alpn-01 certificate has wrong names %v", cert.DNSNames)
+	}
+	idx := slices.IndexFunc(cert.Extensions, func(ext pkix.Extension) bool { return ext.Id.Equal(idPeAcmeIdentifier) })
+	if idx < 0 || !cert.Extensions[idx].Critical {
+		return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "tls-alpn-01 certificate lacks critical acmeIdentifier extension")
+	}
+	var digest []byte
+	if _, err := asn1.Unmarshal(cert.Extensions[idx].Value, &digest); err != nil {
+		return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "parsing acmeIdentifier extension: %v", err)
+	}
+	expected := sha256.Sum256([]byte(keyAuth))
+	if !bytes.Equal(digest, expected[:]) {
+		return newProblem(acme.ProblemTypeIncorrectResponse, http.StatusForbidden, "tls-alpn-01 certificate has wrong key authorization digest")
+	}
+	return nil
+}
+
+// validateDNSTXT validates the dns-01 or dns-account-01
+// challenge whose TXT record is at name.
+func (s *Server) validateDNSTXT(ctx context.Context, typ, name, keyAuth string) *acme.Problem {
+	records, err := s.LookupTXT(ctx, name)
+	if err != nil {
+		return newProblem(acme.ProblemTypeDNS, http.StatusBadRequest, "looking up TXT records for %s: %v", name, err)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	if !slices.Contains(records, base64.RawURLEncoding.EncodeToString(sum[:])) {
+		return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "no TXT record for %s has the expected value for %s (found %d records)", name, typ, len(records))
+	}
+	return nil
+}
+
+// validateDNSPersist01 validates a dns-persist-01 challenge: one of the
+// TXT records at name must authorize the account at accountURL to obtain
+// certificates from the server, and for wildcard identifiers it must
+// have the wildcard policy (draft-ietf-acme-dns-persist §3).
+func (s *Server) validateDNSPersist01(ctx context.Context, name, accountURL string, wildcard bool) *acme.Problem {
+	records, err := s.LookupTXT(ctx, name)
+	if err != nil {
+		return newProblem(acme.ProblemTypeDNS, http.StatusBadRequest, "looking up TXT records for %s: %v", name, err)
+	}
+	for _, record := range records {
+		issuer, rest, _ := strings.Cut(record, ";")
+		if !strings.EqualFold(strings.TrimSpace(issuer), s.PersistIssuerDomainName) {
+			continue
+		}
+		params := make(map[string]string)
+		for _, param := range strings.Split(rest, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			params[strings.ToLower(key)] = value
+		}
+		if params["accounturi"] != accountURL {
+			continue
+		}
+		if wildcard && !strings.EqualFold(params["policy"], "wildcard") {
+			continue
+		}
+		return nil
+	}
+	return newProblem(acme.ProblemTypeUnauthorized, http.StatusForbidden, "no TXT record for %s authorizes account %s (found %d records)", name, accountURL, len(records))
+}
+
+// dnsAccountLabel returns the label of the account at accountURL
+// in dns-account-01 record names: the lowercase base32 encoding of
+// the first 10 bytes of the SHA-256 digest of the URL, after an
+// underscore (draft-ietf-acme-dns-account-label §3.2).
+func dnsAccountLabel(accountURL string) string {
+	sum := sha256.Sum256([]byte(accountURL))
+	return "_" + strings.ToLower(base32.StdEncoding.EncodeToString(sum[:10]))
+}
+
+// dnsPersist01 is the type of the persistent DNS challenge,
+// which the acme package has no constant for.
+const dnsPersist01 = "dns-persist-01"
+
+// challengeTypes returns the types of challenges
+// the server offers for id.
+func (s *Server) challengeTypes(id acme.Identifier, wildcard bool) []string {
+	var types []string
+	if s.HTTPChallengeAddr != "" && !wildcard {
+		types = append(types, acme.ChallengeTypeHTTP01)
+	}
+	if s.TLSALPNChallengeAddr != "" && !wildcard && id.Type == "dns" {
+		types = append(types, acme.ChallengeTypeTLSALPN01)
+	}
+	if s.LookupTXT != nil && id.Type == "dns" {
+		types = append(types, acme.ChallengeTypeDNS01)
+	}
+	if s.LookupTXT != nil && s.DNSAccountChallenge && id.Type == "dns" {
+		types = append(types, acme.ChallengeTypeDNSAccount01)
+	}
+	if s.LookupTXT != nil && s.PersistIssuerDomainName != "" && id.Type == "dns" {
+		types = append(types, dnsPersist01)
+	}
+	return types
+}
+
+// validIdentifier returns an error if id is not an identifier
+// the server can issue certificates for.
+func validIdentifier(id acme.Identifier) error {
+	switch id.Type {
+	case "dns":
+		name := strings.TrimPrefix(id.Value, "*.")
+		if name == "" || strings.Contains(name, "*") || net.ParseIP(name) != nil {
+			return fmt.Errorf("invalid DNS identifier %q", id.Value)
+		}
+	case "ip":
+		if net.ParseIP(id.Value) == nil {
+			return fmt.Errorf("invalid IP identifier %q", id.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported identifier type %q", id.Type)
+	}
+	return nil
+}
+
+const (
+	acmeTLS1Protocol  = "acme-tls/1"
+	validationTimeout = 10 * time.Second
+)
+
+// idPeAcmeIdentifier is the OID of the acmeIdentifier extension (RFC 8737 §6.1).
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
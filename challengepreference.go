@@ -0,0 +1,205 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// preferChallenges makes client prefer the challenge types in
+// preferred, in that order, over other challenges. The acmez client
+// chooses between offered challenges by how successful they have
+// been, so the only way to prefer one is to hide the others: if an
+// authorization offers one of the preferred types, its other
+// challenges are hidden, unless that type has failed for the
+// identifier of the authorization recently, which is remembered
+// in failed; then the next preferred type is tried, if any. Since
+// the authorization is invalid then, it is up to the next attempt
+// to solve another challenge.
+func preferChallenges(client *acmez.Client, preferred []string, failed *challengeFailureCache) {
+	if failed == nil {
+		failed = new(challengeFailureCache)
+	}
+	httpClient := *client.HTTPClient
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = challengePreferrer{
+		next:      next,
+		directory: client.Directory,
+		preferred: preferred,
+		failed:    failed,
+	}
+	client.HTTPClient = &httpClient
+}
+
+// challengePreferrer is an http.RoundTripper that hides all
+// but the most preferred challenge of the authorizations it
+// receives that offer a preferred challenge which has not
+// failed for their identifier.
+type challengePreferrer struct {
+	next      http.RoundTripper
+	directory string
+	preferred []string
+	failed    *challengeFailureCache
+}
+
+// RoundTrip implements http.RoundTripper.
+func (p challengePreferrer) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := p.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var authz acme.Authorization
+	if json.Unmarshal(body, &authz) != nil || authz.Identifier.Value == "" || len(authz.Challenges) < 2 {
+		return resp, nil
+	}
+
+	// once a preferred challenge has failed for an identifier,
+	// the client may fall back to other challenges for it
+	failureKey := func(challengeType string) string {
+		return p.directory + " " + challengeType + " " + authz.Identifier.Type + ":" + authz.IdentifierValue()
+	}
+	for _, chal := range authz.Challenges {
+		if chal.Status == acme.StatusInvalid && slices.Contains(p.preferred, chal.Type) {
+			p.failed.add(failureKey(chal.Type))
+		}
+	}
+
+	for _, challengeType := range p.preferred {
+		if !slices.ContainsFunc(authz.Challenges, func(chal acme.Challenge) bool { return chal.Type == challengeType }) {
+			continue
+		}
+		if p.failed.has(failureKey(challengeType)) {
+			continue
+		}
+		filtered, err := onlyChallengeType(body, challengeType)
+		if err != nil {
+			return resp, nil
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(filtered))
+		resp.ContentLength = int64(len(filtered))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(filtered)))
+		break
+	}
+	return resp, nil
+}
+
+// challengeFailureCache remembers for which identifiers preferred
+// challenges have failed, keyed by directory, challenge type, and
+// identifier. Failures are forgotten after challengeFailureTTL, so
+// that preferred challenges are tried again eventually, and the
+// oldest are forgotten when there are too many.
+type challengeFailureCache struct {
+	mu     sync.Mutex
+	failed map[string]time.Time // when each failure was seen
+}
+
+// add remembers a failure for key.
+func (c *challengeFailureCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed == nil {
+		c.failed = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if _, ok := c.failed[key]; !ok && len(c.failed) >= maxChallengeFailures {
+		var oldestKey string
+		var oldest time.Time
+		for k, seen := range c.failed {
+			if now.Sub(seen) >= challengeFailureTTL {
+				delete(c.failed, k)
+			} else if oldestKey == "" || seen.Before(oldest) {
+				oldestKey, oldest = k, seen
+			}
+		}
+		if len(c.failed) >= maxChallengeFailures {
+			delete(c.failed, oldestKey)
+		}
+	}
+	c.failed[key] = now
+}
+
+// has returns true if a failure for key was seen recently.
+func (c *challengeFailureCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen, ok := c.failed[key]
+	if ok && time.Since(seen) >= challengeFailureTTL {
+		delete(c.failed, key)
+		return false
+	}
+	return ok
+}
+
+// onlyChallengeType returns the authorization object authzJSON
+// with only its challenges of type challengeType; other fields
+// are kept as they are.
+func onlyChallengeType(authzJSON []byte, challengeType string) ([]byte, error) {
+	var authz map[string]json.RawMessage
+	if err := json.Unmarshal(authzJSON, &authz); err != nil {
+		return nil, err
+	}
+	var challenges []json.RawMessage
+	if err := json.Unmarshal(authz["challenges"], &challenges); err != nil {
+		return nil, err
+	}
+	kept := make([]json.RawMessage, 0, len(challenges))
+	for _, chal := range challenges {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(chal, &typed); err != nil {
+			return nil, err
+		}
+		if typed.Type == challengeType {
+			kept = append(kept, chal)
+		}
+	}
+	keptJSON, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	authz["challenges"] = keptJSON
+	return json.Marshal(authz)
+}
+
+const (
+	// how long a failed preferred challenge is not preferred for an identifier
+	challengeFailureTTL = 6 * time.Hour
+
+	// how many failed preferred challenges are remembered at most
+	maxChallengeFailures = 1000
+)
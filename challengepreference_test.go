@@ -0,0 +1,125 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic/certmagictest"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestACMEIssuerPrefersDNSAccount01(t *testing.T) {
+	ctx := context.Background()
+	resolver := startTestDNSServer(t,
+		"account.example. 60 IN SOA ns.account.example. admin.account.example. 1 60 60 60 60",
+	)
+	provider := new(recordingDNSProvider)
+	var failAccountLabels atomic.Bool
+	srv := &certmagictest.Server{
+		LookupTXT: func(ctx context.Context, fqdn string) ([]string, error) {
+			if failAccountLabels.Load() && !strings.HasPrefix(fqdn, "_acme-challenge.") {
+				return nil, nil
+			}
+			return provider.lookupTXT(ctx, fqdn)
+		},
+		DNSAccountChallenge: true,
+	}
+	srv.Start()
+	defer srv.Close()
+
+	solver := &DNS01Solver{
+		DNSManager: DNSManager{
+			DNSProvider:        provider,
+			Resolvers:          []string{resolver},
+			PropagationTimeout: -1,
+		},
+	}
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{DNS01Solver: solver})
+
+	if _, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"account.example", "*.account.example"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	orders := srv.Orders()
+	if expect := []string{acme.ChallengeTypeDNSAccount01, acme.ChallengeTypeDNSAccount01}; !slices.Equal(orders[0].Challenges, expect) {
+		t.Errorf("Expected challenges %v, got %v", expect, orders[0].Challenges)
+	}
+	for _, rec := range provider.appended {
+		if name := rec.RR().Name; !strings.HasPrefix(name, "_") || !strings.HasSuffix(name, "._acme-challenge") {
+			t.Errorf("Expected record name with account label, got %s", name)
+		}
+	}
+
+	// dns-01 is used once dns-account-01 has failed
+	failAccountLabels.Store(true)
+	csr := makeInternalTestCSR(t, []string{"www.account.example"}, nil)
+	if _, err := iss.Issue(ctx, csr); err == nil {
+		t.Fatal("Expected dns-account-01 challenge to fail")
+	}
+	if _, err := iss.Issue(ctx, csr); err != nil {
+		t.Fatal(err)
+	}
+	orders = srv.Orders()
+	if expect := []string{acme.ChallengeTypeDNS01}; !slices.Equal(orders[len(orders)-1].Challenges, expect) {
+		t.Errorf("Expected challenges %v, got %v", expect, orders[len(orders)-1].Challenges)
+	}
+
+	// the solver needs the account to name the record
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeDNSAccount01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "account.example"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	if err := solver.Present(ctx, chal); err == nil {
+		t.Error("Expected error presenting dns-account-01 challenge without account")
+	}
+	ctx = ContextWithACMEAccount(ctx, acme.Account{Location: "https://ca.example/acct/1"})
+	if err := solver.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.CleanUp(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChallengeFailureCache(t *testing.T) {
+	c := new(challengeFailureCache)
+	c.add("a")
+	if !c.has("a") || c.has("b") {
+		t.Fatal("Expected only added failure to be remembered")
+	}
+
+	// failures are forgotten after a while
+	c.failed["a"] = time.Now().Add(-challengeFailureTTL)
+	if c.has("a") || len(c.failed) != 0 {
+		t.Errorf("Expected old failure to be forgotten, got %v", c.failed)
+	}
+
+	// and the oldest when there are too many
+	c.add("oldest")
+	c.failed["oldest"] = time.Now().Add(-time.Minute)
+	for i := range maxChallengeFailures {
+		c.add(strconv.Itoa(i))
+	}
+	if len(c.failed) != maxChallengeFailures || c.has("oldest") || !c.has("0") {
+		t.Errorf("Expected %d failures without the oldest, got %d", maxChallengeFailures, len(c.failed))
+	}
+}
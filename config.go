@@ -32,6 +32,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -102,6 +103,30 @@ type Config struct {
 	// Default: UseFirstIssuer (subject to change).
 	IssuerPolicy IssuerPolicy
 
+	// If set, the results of issuances are recorded
+	// per issuer, and issuers that have been failing
+	// can be skipped (see UseHealthiestIssuer). If
+	// IssuerPolicy is UseHealthiestIssuer and this
+	// is not set, a new IssuerHealth is created.
+	// EXPERIMENTAL: Subject to change or removal.
+	IssuerHealth *IssuerHealth
+
+	// If set, the issuers to use are chosen for each
+	// identifier by the router; identifiers it has
+	// no route for use Issuers.
+	// EXPERIMENTAL: Subject to change or removal.
+	IssuerRouter *IssuerRouter
+
+	// Remembers rate limits that CAs have imposed, so that
+	// affected certificates are not requested until the CA
+	// allows it. If not set, a CARateLimits shared by all
+	// Configs in the process is used, which keeps rate
+	// limits in memory only; to share them within a
+	// cluster, set one with Storage (such as the Storage
+	// of this Config).
+	// EXPERIMENTAL: Subject to change or removal.
+	CARateLimits *CARateLimits
+
 	// If true, private keys already existing in storage
 	// will be reused. Otherwise, a new key will be
 	// created for every new certificate to mitigate
@@ -113,12 +138,55 @@ type Config struct {
 	// the default KeySource is StandardKeyGenerator.
 	KeySource KeyGenerator
 
+	// KeyTypes, if set, causes a certificate to be managed
+	// for each of these key types for every name, side by
+	// side; KeySource is then ignored. This is useful for
+	// serving ECDSA certificates to modern clients while
+	// still serving RSA certificates to legacy clients
+	// that do not support ECDSA (e.g. {P256, RSA2048}).
+	// The first key type is the primary one, and its
+	// certificate is stored where a lone certificate for
+	// the name would be; certificates of the other key
+	// types are stored under distinct storage keys. Each
+	// certificate is renewed and stapled independently,
+	// and the best one for each client is chosen during
+	// the handshake by the CertSelection (by default,
+	// according to ClientHelloInfo.SupportsCertificate).
+	// EXPERIMENTAL: Subject to change or removal.
+	KeyTypes []KeyType
+
 	// CertSelection chooses one of the certificates
 	// with which the ClientHello will be completed;
 	// if not set, DefaultCertificateSelector will
 	// be used.
 	CertSelection CertificateSelector
 
+	// If set, self-signed placeholder certificates are
+	// served during handshakes for managed names that
+	// have no certificate yet, rather than failing the
+	// handshake; and with on-demand TLS, certificates
+	// for allowed names are obtained in the background
+	// while placeholders are served.
+	// EXPERIMENTAL: Subject to change or removal.
+	Placeholder *PlaceholderCertificates
+
+	// If set, TLS session ticket keys are shared by all
+	// instances using the same storage and rotated on a
+	// schedule; they are applied to each tls.Config
+	// returned by TLSConfig().
+	SessionTicketKeys *SessionTicketKeys
+
+	// If set, Encrypted ClientHello (ECH) is enabled on
+	// each tls.Config returned by TLSConfig(), with keys
+	// that are shared through storage and rotated. This
+	// requires TLS 1.3, so older versions are disabled.
+	// EXPERIMENTAL: Subject to change or removal.
+	ECH *ECHManager
+
+	// If set, the observer is informed how a certificate
+	// was (or was not) found for each TLS handshake.
+	HandshakeObserver HandshakeObserver
+
 	// OCSP configures how OCSP is handled. By default,
 	// OCSP responses are fetched for every certificate
 	// with a responder URL, and cached on disk. Changing
@@ -263,6 +331,30 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 	if cfg.KeySource == nil {
 		cfg.KeySource = Default.KeySource
 	}
+	if cfg.KeyTypes == nil {
+		cfg.KeyTypes = Default.KeyTypes
+	}
+	if cfg.Placeholder == nil {
+		cfg.Placeholder = Default.Placeholder
+	}
+	if cfg.SessionTicketKeys == nil {
+		cfg.SessionTicketKeys = Default.SessionTicketKeys
+	}
+	if cfg.ECH == nil {
+		cfg.ECH = Default.ECH
+	}
+	if cfg.HandshakeObserver == nil {
+		cfg.HandshakeObserver = Default.HandshakeObserver
+	}
+	if cfg.IssuerHealth == nil {
+		cfg.IssuerHealth = Default.IssuerHealth
+	}
+	if cfg.IssuerRouter == nil {
+		cfg.IssuerRouter = Default.IssuerRouter
+	}
+	if cfg.CARateLimits == nil {
+		cfg.CARateLimits = Default.CARateLimits
+	}
 	if cfg.DefaultServerName == "" {
 		cfg.DefaultServerName = Default.DefaultServerName
 	}
@@ -289,6 +381,14 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 		cfg.Logger = defaultLogger
 	}
 
+	// the healthiest-issuer policy needs to know about health
+	if cfg.IssuerPolicy == UseHealthiestIssuer && cfg.IssuerHealth == nil {
+		cfg.IssuerHealth = &IssuerHealth{Logger: cfg.Logger}
+	}
+	if cfg.CARateLimits == nil {
+		cfg.CARateLimits = defaultCARateLimits
+	}
+
 	cfg.certCache = certCache
 
 	return &cfg
@@ -365,6 +465,60 @@ func (cfg *Config) ClientCredentials(ctx context.Context, identifiers []string)
 	return chains, nil
 }
 
+// ManagedClientCredentials is like ClientCredentials, except that instead of
+// the certificates at the time of the call, it returns a function that can be
+// used as the GetClientCertificate callback of a tls.Config, which always gets
+// the current certificates from the cache. The certificates are kept renewed
+// like other managed certificates. During a handshake, the first certificate
+// supported by the server is chosen, taking into account the certificate
+// authorities it accepts and the signature schemes it supports; if no
+// certificate is supported, none is sent.
+func (cfg *Config) ManagedClientCredentials(ctx context.Context, identifiers []string) (func(*tls.CertificateRequestInfo) (*tls.Certificate, error), error) {
+	err := cfg.manageAll(ctx, identifiers, false)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make([]string, len(identifiers))
+	for i, id := range identifiers {
+		normalized[i] = normalizedName(id)
+	}
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cfg.getClientCertificate(cri, normalized)
+	}, nil
+}
+
+// getClientCertificate returns the first certificate for any of identifiers
+// that is supported by the server according to cri. Certificates that have
+// been evicted from the cache are loaded from storage again.
+func (cfg *Config) getClientCertificate(cri *tls.CertificateRequestInfo, identifiers []string) (*tls.Certificate, error) {
+	for _, id := range identifiers {
+		certs := cfg.certCache.getAllMatchingCerts(id)
+		if len(certs) == 0 {
+			cert, err := cfg.CacheManagedCertificate(cri.Context(), id)
+			if err != nil {
+				cfg.Logger.Error("loading client certificate", zap.String("identifier", id), zap.Error(err))
+				continue
+			}
+			certs = []Certificate{cert}
+		}
+		for _, cert := range certs {
+			if cert.Expired() {
+				continue
+			}
+			if err := cri.SupportsCertificate(&cert.Certificate); err != nil {
+				cfg.Logger.Debug("client certificate not supported by server",
+					zap.Strings("subjects", cert.Names),
+					zap.Error(err))
+				continue
+			}
+			return &cert.Certificate, nil
+		}
+	}
+
+	// like crypto/tls, send no certificate and let the server decide
+	return new(tls.Certificate), nil
+}
+
 func (cfg *Config) manageAll(ctx context.Context, domainNames []string, async bool) error {
 	if ctx == nil {
 		ctx = context.Background()
@@ -382,6 +536,11 @@ func (cfg *Config) manageAll(ctx context.Context, domainNames []string, async bo
 			continue
 		}
 
+		// placeholders may be served until the name has a certificate
+		if cfg.Placeholder != nil {
+			cfg.Placeholder.manage(domainName)
+		}
+
 		// TODO: consider doing this in a goroutine if async, to utilize multiple cores while loading certs
 		// otherwise, begin management immediately
 		err := cfg.manageOne(ctx, domainName, async)
@@ -394,32 +553,38 @@ func (cfg *Config) manageAll(ctx context.Context, domainNames []string, async bo
 }
 
 func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool) error {
+	for _, keyType := range cfg.keyTypeVariants() {
+		if err := cfg.manageOneKeyType(ctx, domainName, keyType, async); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manageOneKeyType is like manageOne, but only for the certificate
+// of the given key type variant (see Config.KeyTypes).
+func (cfg *Config) manageOneKeyType(ctx context.Context, domainName string, keyType KeyType, async bool) error {
 	// if certificate is already being managed, nothing to do; maintenance will continue
 	certs := cfg.certCache.getAllMatchingCerts(domainName)
 	for _, cert := range certs {
-		if cert.managed {
+		if cert.managed && cert.keyType == keyType {
 			return nil
 		}
 	}
 
 	// first try loading existing certificate from storage
-	cert, err := cfg.CacheManagedCertificate(ctx, domainName)
+	cert, err := cfg.cacheManagedCertificate(ctx, domainName, keyType)
 	if err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
 			return fmt.Errorf("%s: caching certificate: %v", domainName, err)
 		}
 		// if we don't have one in storage, obtain one
 		obtain := func() error {
-			var err error
-			if async {
-				err = cfg.ObtainCertAsync(ctx, domainName)
-			} else {
-				err = cfg.ObtainCertSync(ctx, domainName)
-			}
+			err := cfg.obtainCertKeyType(ctx, domainName, keyType, !async)
 			if err != nil {
 				return fmt.Errorf("%s: obtaining certificate: %w", domainName, err)
 			}
-			cert, err = cfg.CacheManagedCertificate(ctx, domainName)
+			cert, err = cfg.cacheManagedCertificate(ctx, domainName, keyType)
 			if err != nil {
 				return fmt.Errorf("%s: caching certificate after obtaining it: %v", domainName, err)
 			}
@@ -464,12 +629,7 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 
 		// otherwise, simply renew the certificate if needed
 		if cert.NeedsRenewal(cfg) {
-			var err error
-			if async {
-				err = cfg.RenewCertAsync(ctx, domainName, false)
-			} else {
-				err = cfg.RenewCertSync(ctx, domainName, false)
-			}
+			err := cfg.renewCertKeyType(ctx, domainName, keyType, false, !async)
 			if err != nil {
 				return fmt.Errorf("%s: renewing certificate: %w", domainName, err)
 			}
@@ -484,7 +644,7 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 	}
 
 	if async {
-		jm.Submit(cfg.Logger, "renew_"+domainName, renew)
+		jm.Submit(cfg.Logger, "renew_"+variantStorageName(domainName, keyType), renew)
 		return nil
 	}
 	return renew()
@@ -533,16 +693,29 @@ func (cfg *Config) ObtainCertAsync(ctx context.Context, name string) error {
 }
 
 func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool) error {
-	if len(cfg.Issuers) == 0 {
-		return fmt.Errorf("no issuers configured; impossible to obtain or check for existing certificate in storage")
+	for _, keyType := range cfg.keyTypeVariants() {
+		if err := cfg.obtainCertKeyType(ctx, name, keyType, interactive); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
+// obtainCertKeyType obtains the certificate for name of the given
+// key type variant (see Config.KeyTypes). The empty key type is the
+// primary certificate.
+func (cfg *Config) obtainCertKeyType(ctx context.Context, name string, keyType KeyType, interactive bool) error {
 	log := cfg.Logger.Named("obtain")
 
 	name = cfg.transformSubject(ctx, log, name)
+	storageName := variantStorageName(name, keyType)
+
+	if len(cfg.issuersFor(ctx, name)) == 0 {
+		return fmt.Errorf("no issuers configured; impossible to obtain or check for existing certificate in storage")
+	}
 
 	// if storage has all resources for this certificate, obtain is a no-op
-	if cfg.storageHasCertResourcesAnyIssuer(ctx, name) {
+	if cfg.storageHasCertResourcesAnyIssuer(ctx, storageName) {
 		return nil
 	}
 
@@ -556,7 +729,7 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 	log.Info("acquiring lock", zap.String("identifier", name))
 
 	// ensure idempotency of the obtain operation for this name
-	lockKey := cfg.lockKey(certIssueLockOp, name)
+	lockKey := cfg.lockKey(certIssueLockOp, storageName)
 	err = acquireLock(ctx, cfg.Storage, lockKey)
 	if err != nil {
 		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
@@ -583,14 +756,16 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 		}
 
 		// check if obtain is still needed -- might have been obtained during lock
-		if cfg.storageHasCertResourcesAnyIssuer(ctx, name) {
+		if cfg.storageHasCertResourcesAnyIssuer(ctx, storageName) {
 			log.Info("certificate already exists in storage", zap.String("identifier", name))
 			return nil
 		}
 
-		log.Info("obtaining certificate", zap.String("identifier", name))
+		log.Info("obtaining certificate",
+			zap.String("identifier", name),
+			zap.String("key_type", string(keyType)))
 
-		if err := cfg.emit(ctx, "cert_obtaining", map[string]any{"identifier": name}); err != nil {
+		if err := cfg.emit(ctx, "cert_obtaining", map[string]any{"identifier": name, "key_type": keyType}); err != nil {
 			return fmt.Errorf("obtaining certificate aborted by event handler: %w", err)
 		}
 
@@ -601,25 +776,21 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 		var privKeyPEM []byte
 		var issuers []Issuer
 		if cfg.ReusePrivateKeys {
-			privKey, privKeyPEM, issuers, err = cfg.reusePrivateKey(ctx, name)
+			privKey, privKeyPEM, issuers, err = cfg.reusePrivateKey(ctx, storageName)
 			if err != nil {
 				return err
 			}
 		} else {
-			issuers = make([]Issuer, len(cfg.Issuers))
-			copy(issuers, cfg.Issuers)
+			issuers = slices.Clone(cfg.issuersFor(ctx, name))
 		}
 		if cfg.IssuerPolicy == UseFirstRandomIssuer {
 			weakrand.Shuffle(len(issuers), func(i, j int) {
 				issuers[i], issuers[j] = issuers[j], issuers[i]
 			})
 		}
+		issuers = cfg.healthyIssuers(ctx, issuers)
 		if privKey == nil {
-			privKey, err = cfg.KeySource.GenerateKey()
-			if err != nil {
-				return err
-			}
-			privKeyPEM, err = PEMEncodePrivateKey(privKey)
+			privKey, privKeyPEM, err = cfg.certPrivateKey(ctx, storageName, keyType, issuers)
 			if err != nil {
 				return err
 			}
@@ -637,7 +808,7 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 		for i, issuer := range issuers {
 			issuerKeys = append(issuerKeys, issuer.IssuerKey())
 
-			log.Debug(fmt.Sprintf("trying issuer %d/%d", i+1, len(cfg.Issuers)),
+			log.Debug(fmt.Sprintf("trying issuer %d/%d", i+1, len(issuers)),
 				zap.String("issuer", issuer.IssuerKey()))
 
 			if prechecker, ok := issuer.(PreChecker); ok {
@@ -660,11 +831,21 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			}
 
 			issuedCert, err = issuer.Issue(ctx, useCSR)
+			cfg.recordIssuerResult(ctx, issuer, err)
 			if err == nil {
 				issuerUsed = issuer
 				break
 			}
 
+			var errRateLimited ErrRateLimited
+			if errors.As(err, &errRateLimited) && errRateLimited.Skipped {
+				log.Info("skipping issuer until CA rate limit expires",
+					zap.String("identifier", name),
+					zap.String("issuer", issuer.IssuerKey()),
+					zap.Time("retry_after", errRateLimited.RetryAfter))
+				continue
+			}
+
 			// err is usually wrapped, which is nice for simply printing it, but
 			// with our structured error logs we only need the problem string
 			errToLog := err
@@ -681,10 +862,16 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			cfg.emit(ctx, "cert_failed", map[string]any{
 				"renewal":    false,
 				"identifier": name,
+				"key_type":   keyType,
 				"issuers":    issuerKeys,
 				"error":      err,
 			})
 
+			// the key of an issuance that will not be retried is not needed anymore
+			if errors.As(err, new(ErrNoRetry)) {
+				cfg.deleteInFlightPrivateKey(ctx, storageName)
+			}
+
 			// only the error from the last issuer will be returned, but we logged the others
 			return fmt.Errorf("[%s] Obtain: %w", name, err)
 		}
@@ -701,21 +888,24 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			PrivateKeyPEM:  privKeyPEM,
 			IssuerData:     metaJSON,
 			issuerKey:      issuerUsed.IssuerKey(),
+			keyType:        keyType,
 		}
 		err = cfg.saveCertResource(ctx, issuerUsed, certRes)
 		if err != nil {
 			return fmt.Errorf("[%s] Obtain: saving assets: %v", name, err)
 		}
+		cfg.deleteInFlightPrivateKey(ctx, storageName)
 
 		log.Info("certificate obtained successfully",
 			zap.String("identifier", name),
 			zap.String("issuer", issuerUsed.IssuerKey()))
 
-		certKey := certRes.NamesKey()
+		certKey := certRes.storageNamesKey()
 
 		cfg.emit(ctx, "cert_obtained", map[string]any{
 			"renewal":          false,
 			"identifier":       name,
+			"key_type":         keyType,
 			"issuer":           issuerUsed.IssuerKey(),
 			"storage_path":     StorageKeys.CertsSitePrefix(issuerKey, certKey),
 			"private_key_path": StorageKeys.SitePrivateKey(issuerKey, certKey),
@@ -734,6 +924,11 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 		err = f(ctx)
 	} else {
 		err = doWithRetry(ctx, log, f)
+		// once we give up, the key is not needed anymore; but if we
+		// were cancelled, e.g. by a shutdown, the issuance may resume
+		if err != nil && !errors.Is(err, context.Canceled) {
+			cfg.deleteInFlightPrivateKey(ctx, storageName)
+		}
 	}
 
 	return err
@@ -741,14 +936,13 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 
 // reusePrivateKey looks for a private key for domain in storage in the configured issuers
 // paths. For the first private key it finds, it returns that key both decoded and PEM-encoded,
-// as well as the reordered list of issuers to use instead of cfg.Issuers (because if a key
-// is found, that issuer should be tried first, so it is moved to the front in a copy of
-// cfg.Issuers).
+// as well as the reordered list of issuers to use instead of the configured ones (because if
+// a key is found, that issuer should be tried first, so it is moved to the front in a copy of
+// the issuers for domain).
 func (cfg *Config) reusePrivateKey(ctx context.Context, domain string) (privKey crypto.PrivateKey, privKeyPEM []byte, issuers []Issuer, err error) {
-	// make a copy of cfg.Issuers so that if we have to reorder elements, we don't
+	// make a copy of the issuers so that if we have to reorder elements, we don't
 	// inadvertently mutate the configured issuers (see append calls below)
-	issuers = make([]Issuer, len(cfg.Issuers))
-	copy(issuers, cfg.Issuers)
+	issuers = slices.Clone(cfg.issuersFor(ctx, domain))
 
 	for i, issuer := range issuers {
 		// see if this issuer location in storage has a private key for the domain
@@ -779,9 +973,9 @@ func (cfg *Config) reusePrivateKey(ctx context.Context, domain string) (privKey
 
 // storageHasCertResourcesAnyIssuer returns true if storage has all the
 // certificate resources in storage from any configured issuer. It checks
-// all configured issuers in order.
+// all issuers configured for name in order.
 func (cfg *Config) storageHasCertResourcesAnyIssuer(ctx context.Context, name string) bool {
-	for _, iss := range cfg.Issuers {
+	for _, iss := range cfg.issuersFor(ctx, name) {
 		if cfg.storageHasCertResources(ctx, iss, name) {
 			return true
 		}
@@ -805,13 +999,36 @@ func (cfg *Config) RenewCertAsync(ctx context.Context, name string, force bool)
 }
 
 func (cfg *Config) renewCert(ctx context.Context, name string, force, interactive bool) error {
-	if len(cfg.Issuers) == 0 {
-		return fmt.Errorf("no issuers configured; impossible to renew or check existing certificate in storage")
+	for _, keyType := range cfg.keyTypeVariants() {
+		// a key type may have been added to the config since the
+		// other certificates were obtained, in which case there
+		// is nothing to renew yet, so obtain it instead
+		storageName := variantStorageName(cfg.transformSubject(ctx, nil, name), keyType)
+		if keyType != "" && !cfg.storageHasCertResourcesAnyIssuer(ctx, storageName) {
+			if err := cfg.obtainCertKeyType(ctx, name, keyType, interactive); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := cfg.renewCertKeyType(ctx, name, keyType, force, interactive); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
+// renewCertKeyType renews the certificate for name of the given
+// key type variant (see Config.KeyTypes). The empty key type is
+// the primary certificate.
+func (cfg *Config) renewCertKeyType(ctx context.Context, name string, keyType KeyType, force, interactive bool) error {
 	log := cfg.Logger.Named("renew")
 
 	name = cfg.transformSubject(ctx, log, name)
+	storageName := variantStorageName(name, keyType)
+
+	if len(cfg.issuersFor(ctx, name)) == 0 {
+		return fmt.Errorf("no issuers configured; impossible to renew or check existing certificate in storage")
+	}
 
 	// ensure storage is writeable and readable
 	// TODO: this is not necessary every time; should only perform check once every so often for each storage, which may require some global state...
@@ -823,7 +1040,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 	log.Info("acquiring lock", zap.String("identifier", name))
 
 	// ensure idempotency of the renew operation for this name
-	lockKey := cfg.lockKey(certIssueLockOp, name)
+	lockKey := cfg.lockKey(certIssueLockOp, storageName)
 	err = acquireLock(ctx, cfg.Storage, lockKey)
 	if err != nil {
 		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
@@ -852,7 +1069,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		}
 
 		// prepare for renewal (load PEM cert, key, and meta)
-		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, storageName)
 		if err != nil {
 			return err
 		}
@@ -874,11 +1091,13 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 
 		log.Info("renewing certificate",
 			zap.String("identifier", name),
+			zap.String("key_type", string(keyType)),
 			zap.Duration("remaining", timeLeft))
 
 		if err := cfg.emit(ctx, "cert_obtaining", map[string]any{
 			"renewal":    true,
 			"identifier": name,
+			"key_type":   keyType,
 			"forced":     force,
 			"remaining":  timeLeft,
 			"issuer":     certRes.issuerKey, // previous/current issuer
@@ -891,20 +1110,13 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		if cfg.ReusePrivateKeys {
 			privateKey, err = PEMDecodePrivateKey(certRes.PrivateKeyPEM)
 		} else {
-			privateKey, err = cfg.KeySource.GenerateKey()
+			// if we generated a new key, make sure to replace its PEM encoding too!
+			privateKey, certRes.PrivateKeyPEM, err = cfg.certPrivateKey(ctx, storageName, keyType, cfg.issuersFor(ctx, name))
 		}
 		if err != nil {
 			return err
 		}
 
-		// if we generated a new key, make sure to replace its PEM encoding too!
-		if !cfg.ReusePrivateKeys {
-			certRes.PrivateKeyPEM, err = PEMEncodePrivateKey(privateKey)
-			if err != nil {
-				return err
-			}
-		}
-
 		csr, err := cfg.generateCSR(privateKey, []string{name}, false)
 		if err != nil {
 			return err
@@ -914,7 +1126,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		var issuedCert *IssuedCertificate
 		var issuerUsed Issuer
 		var issuerKeys []string
-		for _, issuer := range cfg.Issuers {
+		for _, issuer := range cfg.healthyIssuers(ctx, cfg.issuersFor(ctx, name)) {
 			// TODO: ZeroSSL's API currently requires CommonName to be set, and requires it be
 			// distinct from SANs. If this was a cert it would violate the BRs, but their certs
 			// are compliant, so their CSR requirements just needlessly add friction, complexity,
@@ -950,11 +1162,21 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			}
 
 			issuedCert, err = issuer.Issue(ctx, useCSR)
+			cfg.recordIssuerResult(ctx, issuer, err)
 			if err == nil {
 				issuerUsed = issuer
 				break
 			}
 
+			var errRateLimited ErrRateLimited
+			if errors.As(err, &errRateLimited) && errRateLimited.Skipped {
+				log.Info("skipping issuer until CA rate limit expires",
+					zap.String("identifier", name),
+					zap.String("issuer", issuer.IssuerKey()),
+					zap.Time("retry_after", errRateLimited.RetryAfter))
+				continue
+			}
+
 			// err is usually wrapped, which is nice for simply printing it, but
 			// with our structured error logs we only need the problem string
 			errToLog := err
@@ -971,11 +1193,17 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			cfg.emit(ctx, "cert_failed", map[string]any{
 				"renewal":    true,
 				"identifier": name,
+				"key_type":   keyType,
 				"remaining":  timeLeft,
 				"issuers":    issuerKeys,
 				"error":      err,
 			})
 
+			// the key of an issuance that will not be retried is not needed anymore
+			if errors.As(err, new(ErrNoRetry)) {
+				cfg.deleteInFlightPrivateKey(ctx, storageName)
+			}
+
 			// only the error from the last issuer will be returned, but we logged the others
 			return fmt.Errorf("[%s] Renew: %w", name, err)
 		}
@@ -992,22 +1220,25 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			PrivateKeyPEM:  certRes.PrivateKeyPEM,
 			IssuerData:     metaJSON,
 			issuerKey:      issuerKey,
+			keyType:        keyType,
 		}
 		err = cfg.saveCertResource(ctx, issuerUsed, newCertRes)
 		if err != nil {
 			return fmt.Errorf("[%s] Renew: saving assets: %v", name, err)
 		}
+		cfg.deleteInFlightPrivateKey(ctx, storageName)
 
 		log.Info("certificate renewed successfully",
 			zap.String("identifier", name),
 			zap.String("issuer", issuerKey))
 
-		certKey := newCertRes.NamesKey()
+		certKey := newCertRes.storageNamesKey()
 
 		cfg.emit(ctx, "cert_obtained", map[string]any{
 			"renewal":          true,
 			"remaining":        timeLeft,
 			"identifier":       name,
+			"key_type":         keyType,
 			"issuer":           issuerKey,
 			"storage_path":     StorageKeys.CertsSitePrefix(issuerKey, certKey),
 			"private_key_path": StorageKeys.SitePrivateKey(issuerKey, certKey),
@@ -1026,6 +1257,11 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		err = f(ctx)
 	} else {
 		err = doWithRetry(ctx, log, f)
+		// once we give up, the key is not needed anymore; but if we
+		// were cancelled, e.g. by a shutdown, the issuance may resume
+		if err != nil && !errors.Is(err, context.Canceled) {
+			cfg.deleteInFlightPrivateKey(ctx, storageName)
+		}
 	}
 
 	return err
@@ -1082,13 +1318,14 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 }
 
 // RevokeCert revokes the certificate for domain via ACME protocol. It requires
-// that cfg.Issuers is properly configured with the same issuer that issued the
-// certificate being revoked. See RFC 5280 §5.3.1 for reason codes.
+// that the issuers for domain (cfg.Issuers, or those chosen by cfg.IssuerRouter)
+// are properly configured with the same issuer that issued the certificate being
+// revoked. See RFC 5280 §5.3.1 for reason codes.
 //
 // The certificate assets are deleted from storage after successful revocation
 // to prevent reuse.
 func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, interactive bool) error {
-	for i, issuer := range cfg.Issuers {
+	for i, issuer := range cfg.issuersFor(ctx, domain) {
 		issuerKey := issuer.IssuerKey()
 
 		rev, ok := issuer.(Revoker)
@@ -1096,24 +1333,31 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, in
 			return fmt.Errorf("issuer %d (%s) is not a Revoker", i, issuerKey)
 		}
 
-		certRes, err := cfg.loadCertResource(ctx, issuer, domain)
-		if err != nil {
-			return err
-		}
+		for _, keyType := range cfg.keyTypeVariants() {
+			storageName := variantStorageName(domain, keyType)
 
-		// loadCertResource should already fail if private key is missing.
-		if len(certRes.PrivateKeyPEM) == 0 {
-			return fmt.Errorf("private key not found for %s", certRes.SANs)
-		}
+			certRes, err := cfg.loadCertResource(ctx, issuer, storageName)
+			if err != nil {
+				if keyType != "" && errors.Is(err, fs.ErrNotExist) {
+					continue // not every key type variant necessarily exists
+				}
+				return err
+			}
 
-		err = rev.Revoke(ctx, certRes, reason)
-		if err != nil {
-			return fmt.Errorf("issuer %d (%s): %v", i, issuerKey, err)
-		}
+			// loadCertResource should already fail if private key is missing.
+			if len(certRes.PrivateKeyPEM) == 0 {
+				return fmt.Errorf("private key not found for %s", certRes.SANs)
+			}
 
-		err = cfg.deleteSiteAssets(ctx, issuerKey, domain)
-		if err != nil {
-			return fmt.Errorf("certificate revoked, but unable to fully clean up assets from issuer %s: %v", issuerKey, err)
+			err = rev.Revoke(ctx, certRes, reason)
+			if err != nil {
+				return fmt.Errorf("issuer %d (%s): %v", i, issuerKey, err)
+			}
+
+			err = cfg.deleteSiteAssets(ctx, issuerKey, storageName)
+			if err != nil {
+				return fmt.Errorf("certificate revoked, but unable to fully clean up assets from issuer %s: %v", issuerKey, err)
+			}
 		}
 	}
 
@@ -1143,7 +1387,7 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, in
 // Unlike the package TLS() function, this method does not, by itself,
 // enable certificate management for any domain names.
 func (cfg *Config) TLSConfig() *tls.Config {
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		// these two fields necessary for TLS-ALPN challenge
 		GetCertificate: cfg.GetCertificate,
 		NextProtos:     []string{acmez.ACMETLS1Protocol},
@@ -1157,6 +1401,16 @@ func (cfg *Config) TLSConfig() *tls.Config {
 		CipherSuites:             preferredDefaultCipherSuites(),
 		PreferServerCipherSuites: true,
 	}
+	if cfg.SessionTicketKeys != nil {
+		cfg.SessionTicketKeys.register(tlsConfig, cfg.Storage, cfg.Logger)
+	}
+	if cfg.ECH != nil {
+		// crypto/tls only supports ECH with TLS 1.3
+		tlsConfig.MinVersion = tls.VersionTLS13
+		cfg.ECH.start(cfg.Storage, cfg.Logger)
+		cfg.ECH.configureTLS(tlsConfig)
+	}
+	return tlsConfig
 }
 
 // getACMEChallengeInfo loads the challenge info from either the internal challenge memory
@@ -1186,7 +1440,7 @@ func (cfg *Config) getACMEChallengeInfo(ctx context.Context, identifier string,
 	var chalInfo acme.Challenge
 	var chalInfoBytes []byte
 	var tokenKey string
-	for _, issuer := range cfg.Issuers {
+	for _, issuer := range cfg.allIssuers() {
 		ds := distributedSolver{
 			storage:                cfg.Storage,
 			storageKeyIssuerPrefix: storageKeyACMECAPrefix(issuer.IssuerKey()),
@@ -17,9 +17,12 @@ package certmagic
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -308,3 +311,107 @@ func TestStorageModeTransitionFallback(t *testing.T) {
 	}
 	assertCertResourceContent(t, loaded, "private key", "certificate")
 }
+
+func TestManagedClientCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	iss := newSelfSigningIssuer(t)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+
+	var eventsMu sync.Mutex
+	var events []string
+	cfg = New(cache, Config{
+		Issuers:             []Issuer{iss},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		DisableStorageCheck: true,
+		DisableARI:          true,
+		OCSP:                OCSPConfig{DisableStapling: true},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			eventsMu.Lock()
+			defer eventsMu.Unlock()
+			if event == "cert_obtained" {
+				if renewal, _ := data["renewal"].(bool); renewal {
+					event = "cert_renewed"
+				}
+			}
+			events = append(events, event)
+			return nil
+		},
+		Logger: defaultTestLogger,
+	})
+
+	getClientCert, err := cfg.ManagedClientCredentials(ctx, []string{"client.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cri := &tls.CertificateRequestInfo{
+		AcceptableCAs:    [][]byte{iss.caCert.RawSubject},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		Version:          tls.VersionTLS13,
+	}
+	clientCert, err := getClientCert(cri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clientCert.Certificate) == 0 {
+		t.Fatal("Expected a client certificate for the acceptable CA")
+	}
+	firstLeaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a server that does not accept our CA gets no certificate
+	otherCA := newSelfSigningIssuer(t)
+	otherCA.caCert.RawSubject = []byte("other CA")
+	if clientCert, err := getClientCert(&tls.CertificateRequestInfo{
+		AcceptableCAs:    [][]byte{otherCA.caCert.RawSubject},
+		SignatureSchemes: cri.SignatureSchemes,
+		Version:          tls.VersionTLS13,
+	}); err != nil || len(clientCert.Certificate) != 0 {
+		t.Errorf("Expected no certificate for other CA, got %d certificates (err=%v)", len(clientCert.Certificate), err)
+	}
+
+	// renewal by the cache maintenance is picked up by the callback
+	cfg.RenewalWindowRatio = 0.9999
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var renewed bool
+	for i := 0; i < 500 && !renewed; i++ {
+		clientCert, err := getClientCert(cri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		renewed = leaf.SerialNumber.Cmp(firstLeaf.SerialNumber) != 0
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !renewed {
+		t.Fatal("Expected callback to return renewed certificate")
+	}
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	var obtained, renewedEvents int
+	for _, event := range events {
+		switch event {
+		case "cert_obtained":
+			obtained++
+		case "cert_renewed":
+			renewedEvents++
+		}
+	}
+	if obtained != 1 || renewedEvents != 1 {
+		t.Errorf("Expected 1 obtain and 1 renewal event, got %d and %d: %v", obtained, renewedEvents, events)
+	}
+}
@@ -143,11 +143,11 @@ func fastHash(input []byte) string {
 // saveCertResource saves the certificate resource to disk.
 // It switches storage modes between legacy and bundle mode based on the CERTMAGIC_STORAGE_MODE env.
 func (cfg *Config) saveCertResource(ctx context.Context, issuer Issuer, cert CertificateResource) error {
-	storageMode := StorageModeForDomain(cert.SANs[0])
+	storageMode := StorageModeForDomain(cert.storageNamesKey())
 	cfg.Logger.Debug("saving certificate resource",
 		zap.String("domain", cert.SANs[0]),
 		zap.String("storage_mode", storageMode),
-		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.SANs[0])))
+		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.storageNamesKey())))
 	switch storageMode {
 	case StorageModeTransition:
 		if err := cfg.saveCertResourceBundle(ctx, issuer, cert); err != nil {
@@ -174,7 +174,7 @@ func (cfg *Config) saveCertResourceLegacy(ctx context.Context, issuer Issuer, ce
 	}
 
 	issuerKey := issuer.IssuerKey()
-	certKey := cert.NamesKey()
+	certKey := cert.storageNamesKey()
 
 	all := []keyValue{
 		{
@@ -203,7 +203,7 @@ func (cfg *Config) saveCertResourceBundle(ctx context.Context, issuer Issuer, ce
 	}
 
 	issuerKey := issuer.IssuerKey()
-	certKey := cert.NamesKey()
+	certKey := cert.storageNamesKey()
 
 	key := StorageKeys.SiteBundle(issuerKey, certKey)
 	return cfg.Storage.Store(ctx, key, encoded)
@@ -214,11 +214,14 @@ func (cfg *Config) saveCertResourceBundle(ctx context.Context, issuer Issuer, ce
 // configured, and all 3 have a resource matching certNamesKey), then the newest
 // (latest NotBefore date) resource will be chosen.
 func (cfg *Config) loadCertResourceAnyIssuer(ctx context.Context, certNamesKey string) (CertificateResource, error) {
+	// only the storage of the issuers configured for these names is searched
+	issuers := cfg.issuersFor(ctx, certNamesKey)
+
 	// we can save some extra decoding steps if there's only one issuer, since
 	// we don't need to compare potentially multiple available resources to
 	// select the best one, when there's only one choice anyway
-	if len(cfg.Issuers) == 1 {
-		return cfg.loadCertResource(ctx, cfg.Issuers[0], certNamesKey)
+	if len(issuers) == 1 {
+		return cfg.loadCertResource(ctx, issuers[0], certNamesKey)
 	}
 
 	type decodedCertResource struct {
@@ -231,7 +234,7 @@ func (cfg *Config) loadCertResourceAnyIssuer(ctx context.Context, certNamesKey s
 
 	// load and decode all certificate resources found with the
 	// configured issuers so we can sort by newest
-	for _, issuer := range cfg.Issuers {
+	for _, issuer := range issuers {
 		certRes, err := cfg.loadCertResource(ctx, issuer, certNamesKey)
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
@@ -0,0 +1,216 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+// dnsBatches holds the batches of DNS records of one ACME order, so
+// that records of unrelated orders are never added, waited for, or
+// deleted together. ACMEIssuer puts one in the context of each order
+// (see contextWithDNSBatches).
+type dnsBatches struct {
+	mu sync.Mutex
+
+	// batches that have been queued but not yet
+	// added to their zones, keyed by zone
+	pending map[string]*dnsBatch
+}
+
+// contextWithDNSBatches returns a context for an ACME order in
+// which a DNS01Solver with BatchRecords enabled batches records.
+func contextWithDNSBatches(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyDNSBatches, new(dnsBatches))
+}
+
+const ctxKeyDNSBatches = ctxKey("dns_batches")
+
+// dnsBatch is a set of records in one zone that are added to the zone
+// with one call to the DNS provider, waited for together, and deleted
+// with one call once all of them have been cleaned up.
+//
+// Except for waitMu and propagated, its fields are guarded by the
+// mu of the dnsBatches the batch belongs to.
+type dnsBatch struct {
+	batches *dnsBatches
+	zone    string
+	records []libdns.RR
+
+	// appended is nil while the batch is pending, and closed once
+	// the records have been added to the zone (or failed to be)
+	appended  chan struct{}
+	appendErr error
+	results   []libdns.Record
+
+	// how many of the added records have been cleaned up
+	cleanedUp int
+
+	waitMu     sync.Mutex
+	propagated bool
+}
+
+// queueRecord queues a record to be added to the zone of dnsName with
+// the rest of the zone's pending batch in batches, which it returns
+// along with the record.
+func (m *DNSManager) queueRecord(ctx context.Context, batches *dnsBatches, dnsName, recordType, recordValue string) (*dnsBatch, libdns.RR, error) {
+	logger := m.logger()
+	ctx = ContextWithDNSRoots(ctx, m.TrustedRoots)
+
+	zone, err := FindZoneByFQDN(ctx, logger, dnsName, RecursiveNameservers(m.Resolvers))
+	if err != nil {
+		return nil, libdns.RR{}, fmt.Errorf("could not determine zone for domain %q: %v", dnsName, err)
+	}
+
+	rr := libdns.RR{
+		Type: recordType,
+		Name: libdns.RelativeName(dnsName+".", zone),
+		Data: recordValue,
+		TTL:  m.TTL,
+	}
+
+	logger.Debug("queueing DNS record",
+		zap.String("dns_name", dnsName),
+		zap.String("zone", zone),
+		zap.String("record_name", rr.Name),
+		zap.String("record_type", rr.Type))
+
+	batches.mu.Lock()
+	defer batches.mu.Unlock()
+	if batches.pending == nil {
+		batches.pending = make(map[string]*dnsBatch)
+	}
+	batch, ok := batches.pending[zone]
+	if !ok {
+		batch = &dnsBatch{batches: batches, zone: zone}
+		batches.pending[zone] = batch
+	}
+	batch.records = append(batch.records, rr)
+
+	return batch, rr, nil
+}
+
+// flushRecords adds the records of all pending batches in batches
+// to their zones.
+func (m *DNSManager) flushRecords(ctx context.Context, batches *dnsBatches) {
+	// the batches are added on behalf of all callers waiting for
+	// them, so one of them giving up must not fail the others
+	timeout := m.PropagationTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSPropagationTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	batches.mu.Lock()
+	zones := make([]string, 0, len(batches.pending))
+	for zone, batch := range batches.pending {
+		batch.appended = make(chan struct{})
+		zones = append(zones, zone)
+	}
+	slices.Sort(zones)
+	pending := batches.pending
+	batches.pending = nil
+	batches.mu.Unlock()
+
+	for _, zone := range zones {
+		batch := pending[zone]
+		results, err := m.appendRecords(ctx, zone, batch.records)
+		batches.mu.Lock()
+		batch.results, batch.appendErr = results, err
+		batches.mu.Unlock()
+		close(batch.appended)
+	}
+}
+
+// waitForBatch adds the records of all pending batches of the same
+// order as batch to their zones, then blocks until the records of
+// batch have propagated.
+func (m *DNSManager) waitForBatch(ctx context.Context, batch *dnsBatch) error {
+	m.flushRecords(ctx, batch.batches)
+
+	// the batch may be being added by another call
+	batch.batches.mu.Lock()
+	appended := batch.appended
+	batch.batches.mu.Unlock()
+	select {
+	case <-appended:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if batch.appendErr != nil {
+		return batch.appendErr
+	}
+
+	// the records of a batch only need to be checked once
+	batch.waitMu.Lock()
+	defer batch.waitMu.Unlock()
+	if batch.propagated {
+		return nil
+	}
+	if err := m.waitForRecords(ctx, batch.zone, batch.records); err != nil {
+		return err
+	}
+	batch.propagated = true
+	return nil
+}
+
+// cleanUpBatchedRecord cleans up rr, which was queued in batch. If
+// rr has not been added yet, it is removed from the batch; otherwise
+// the records of the batch are deleted once they are all cleaned up,
+// even if adding them failed, since that may have been partial.
+func (m *DNSManager) cleanUpBatchedRecord(batch *dnsBatch, rr libdns.RR) error {
+	batches := batch.batches
+	batches.mu.Lock()
+	if batch.appended == nil {
+		batch.records = slices.DeleteFunc(batch.records, func(queued libdns.RR) bool {
+			return queued == rr
+		})
+		if len(batch.records) == 0 && batches.pending[batch.zone] == batch {
+			delete(batches.pending, batch.zone)
+		}
+		batches.mu.Unlock()
+		return nil
+	}
+	appended := batch.appended
+	batches.mu.Unlock()
+
+	<-appended
+
+	batches.mu.Lock()
+	batch.cleanedUp++
+	done := batch.cleanedUp == len(batch.records)
+	batches.mu.Unlock()
+
+	if !done {
+		return nil
+	}
+	if batch.appendErr != nil {
+		// some of the records may have been added anyway; providers
+		// ignore records that don't exist when deleting
+		recs := make([]libdns.Record, 0, len(batch.records))
+		for _, rr := range batch.records {
+			recs = append(recs, rr)
+		}
+		return m.deleteRecords(batch.zone, recs)
+	}
+	return m.deleteRecords(batch.zone, batch.results)
+}
@@ -0,0 +1,318 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+)
+
+func TestDNS01SolverBatchesRecords(t *testing.T) {
+	ctx := contextWithDNSBatches(context.Background())
+	batches := ctx.Value(ctxKeyDNSBatches).(*dnsBatches)
+	resolver := startTestDNSServer(t,
+		"batch-a.example. 60 IN SOA ns.batch-a.example. admin.batch-a.example. 1 60 60 60 60",
+		"batch-b.example. 60 IN SOA ns.batch-b.example. admin.batch-b.example. 1 60 60 60 60",
+	)
+	provider := new(recordingDNSProvider)
+	solver := &DNS01Solver{
+		DNSManager: DNSManager{
+			DNSProvider:        provider,
+			Resolvers:          []string{resolver},
+			PropagationTimeout: -1,
+		},
+		BatchRecords: true,
+	}
+	newChallenge := func(identifier, token string) acme.Challenge {
+		return acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			Identifier:       acme.Identifier{Type: "dns", Value: identifier},
+			KeyAuthorization: token + ".thumbprint",
+		}
+	}
+	chals := []acme.Challenge{
+		newChallenge("batch-a.example", "1"),
+		newChallenge("www.batch-a.example", "2"),
+		newChallenge("batch-a.example", "3"), // as for *.batch-a.example
+		newChallenge("batch-b.example", "4"),
+	}
+
+	for _, chal := range chals {
+		if err := solver.Present(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider.appendCalls != 0 {
+		t.Fatalf("Expected records not to be added before waiting, got %d calls", provider.appendCalls)
+	}
+
+	for _, chal := range chals {
+		if err := solver.Wait(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider.appendCalls != 2 || len(provider.appended) != 4 {
+		t.Fatalf("Expected 4 records to be added in 2 calls, got %d in %d", len(provider.appended), provider.appendCalls)
+	}
+	if expect := []string{"batch-a.example.", "batch-a.example.", "batch-a.example.", "batch-b.example."}; !slices.Equal(provider.appendedZone, expect) {
+		t.Errorf("Expected records to be added to zones %v, got %v", expect, provider.appendedZone)
+	}
+
+	// the records of a zone are deleted once all of them are cleaned up
+	for i, expectDeleteCalls := range []int{0, 0, 1, 2} {
+		if err := solver.CleanUp(ctx, chals[i]); err != nil {
+			t.Fatal(err)
+		}
+		if provider.deleteCalls != expectDeleteCalls {
+			t.Errorf("Cleanup %d: expected %d delete calls, got %d", i, expectDeleteCalls, provider.deleteCalls)
+		}
+	}
+	if len(provider.deleted) != 4 {
+		t.Errorf("Expected 4 deleted records, got %v", provider.deleted)
+	}
+
+	// records that were never added are not deleted
+	chal := newChallenge("batch-b.example", "5")
+	if err := solver.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.CleanUp(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if provider.appendCalls != 2 || provider.deleteCalls != 2 || len(batches.pending) != 0 {
+		t.Errorf("Expected record to be dropped without provider calls, got %d append and %d delete calls and pending %v",
+			provider.appendCalls, provider.deleteCalls, batches.pending)
+	}
+}
+
+func TestDNS01SolverBatchesPerOrder(t *testing.T) {
+	resolver := startTestDNSServer(t,
+		"batch-f.example. 60 IN SOA ns.batch-f.example. admin.batch-f.example. 1 60 60 60 60",
+	)
+	provider := new(recordingDNSProvider)
+	solver := &DNS01Solver{
+		DNSManager: DNSManager{
+			DNSProvider:        provider,
+			Resolvers:          []string{resolver},
+			PropagationTimeout: -1,
+		},
+		BatchRecords: true,
+	}
+	order1Ctx := contextWithDNSBatches(context.Background())
+	order2Ctx := contextWithDNSBatches(context.Background())
+	chal1 := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "batch-f.example"},
+		KeyAuthorization: "1.thumbprint",
+	}
+	chal2 := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "www.batch-f.example"},
+		KeyAuthorization: "2.thumbprint",
+	}
+	if err := solver.Present(order1Ctx, chal1); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.Present(order2Ctx, chal2); err != nil {
+		t.Fatal(err)
+	}
+
+	// waiting for one order does not add the records of the other
+	if err := solver.Wait(order1Ctx, chal1); err != nil {
+		t.Fatal(err)
+	}
+	if provider.appendCalls != 1 || len(provider.appended) != 1 {
+		t.Fatalf("Expected only the record of the first order to be added, got %v", provider.appended)
+	}
+
+	// and cleaning up one order deletes its records right away
+	if err := solver.CleanUp(order1Ctx, chal1); err != nil {
+		t.Fatal(err)
+	}
+	if provider.deleteCalls != 1 || len(provider.deleted) != 1 {
+		t.Fatalf("Expected the record of the first order to be deleted, got %v", provider.deleted)
+	}
+
+	if err := solver.Wait(order2Ctx, chal2); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.CleanUp(order2Ctx, chal2); err != nil {
+		t.Fatal(err)
+	}
+	if provider.appendCalls != 2 || provider.deleteCalls != 2 {
+		t.Errorf("Expected 2 append and 2 delete calls, got %d and %d", provider.appendCalls, provider.deleteCalls)
+	}
+}
+
+func TestDNS01SolverWithoutBatching(t *testing.T) {
+	ctx := contextWithDNSBatches(context.Background())
+	resolver := startTestDNSServer(t,
+		"batch-g.example. 60 IN SOA ns.batch-g.example. admin.batch-g.example. 1 60 60 60 60",
+	)
+	provider := new(recordingDNSProvider)
+	solver := &DNS01Solver{
+		DNSManager: DNSManager{
+			DNSProvider:        provider,
+			Resolvers:          []string{resolver},
+			PropagationTimeout: -1,
+		},
+	}
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "batch-g.example"},
+		KeyAuthorization: "1.thumbprint",
+	}
+
+	// unless batching is enabled, Present creates the record
+	if err := solver.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if provider.appendCalls != 1 {
+		t.Fatalf("Expected record to be added by Present, got %d calls", provider.appendCalls)
+	}
+	if err := solver.Wait(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.CleanUp(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if provider.appendCalls != 1 || provider.deleteCalls != 1 {
+		t.Errorf("Expected 1 append and 1 delete call, got %d and %d", provider.appendCalls, provider.deleteCalls)
+	}
+}
+
+func TestDNS01SolverBatchFailures(t *testing.T) {
+	ctx := contextWithDNSBatches(context.Background())
+	resolver := startTestDNSServer(t,
+		"batch-e.example. 60 IN SOA ns.batch-e.example. admin.batch-e.example. 1 60 60 60 60",
+	)
+	provider := new(recordingDNSProvider)
+	solver := &DNS01Solver{
+		DNSManager: DNSManager{
+			DNSProvider:        provider,
+			Resolvers:          []string{resolver},
+			PropagationTimeout: -1,
+		},
+		BatchRecords: true,
+	}
+	var chals []acme.Challenge
+	for _, name := range []string{"batch-e.example", "www.batch-e.example"} {
+		chal := acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			Identifier:       acme.Identifier{Type: "dns", Value: name},
+			KeyAuthorization: name + ".thumbprint",
+		}
+		if err := solver.Present(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+		chals = append(chals, chal)
+	}
+
+	// a canceled waiter does not fail the batch for the others
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_ = solver.Wait(canceledCtx, chals[0])
+	if err := solver.Wait(ctx, chals[1]); err != nil {
+		t.Fatalf("Expected batch to be added despite canceled waiter, got: %v", err)
+	}
+	for _, chal := range chals {
+		if err := solver.CleanUp(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// records are deleted even if adding them failed, which may have been partial
+	provider.appendErr = errors.New("partial failure")
+	for _, chal := range chals {
+		if err := solver.Present(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := solver.Wait(ctx, chals[0]); err == nil {
+		t.Fatal("Expected error adding records")
+	}
+	for _, chal := range chals {
+		if err := solver.CleanUp(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider.appendCalls != 2 || provider.deleteCalls != 2 || len(provider.deleted) != 4 {
+		t.Errorf("Expected 2 batches to be added and deleted, got %d append and %d delete calls and deleted %v",
+			provider.appendCalls, provider.deleteCalls, provider.deleted)
+	}
+}
+
+func TestDNS01SolverBatchPropagation(t *testing.T) {
+	ctx := contextWithDNSBatches(context.Background())
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1keW5hbWljLXVwZGF0ZXM="
+	srv := &dynamicDNSServer{
+		zones:   []string{"batch-c.example.", "batch-d.example."},
+		keyName: "update-key.",
+		secret:  secret,
+	}
+	resolver, updateServer := srv.start(t)
+	solver := &DNS01Solver{
+		DNSManager: DNSManager{
+			DNSProvider: &RFC2136Provider{
+				Server:    updateServer,
+				KeyName:   "update-key.",
+				KeySecret: secret,
+				Resolvers: []string{resolver},
+			},
+			Resolvers: []string{resolver},
+		},
+		BatchRecords: true,
+	}
+
+	var chals []acme.Challenge
+	for _, name := range []string{"batch-c.example", "www.batch-c.example", "batch-d.example"} {
+		chal := acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			Identifier:       acme.Identifier{Type: "dns", Value: name},
+			KeyAuthorization: name + ".thumbprint",
+		}
+		if err := solver.Present(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+		chals = append(chals, chal)
+	}
+	for _, chal := range chals {
+		if err := solver.Wait(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rrs := srv.lookup("_acme-challenge.www.batch-c.example.", dns.TypeTXT); len(rrs) != 1 {
+		t.Errorf("Expected TXT record, got %v", rrs)
+	}
+	for _, chal := range chals {
+		if err := solver.CleanUp(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one update to add and one update to delete the records of each zone
+	expect := []string{"batch-c.example.", "batch-d.example.", "batch-c.example.", "batch-d.example."}
+	if !slices.Equal(srv.updated, expect) {
+		t.Errorf("Expected updates of zones %v, got %v", expect, srv.updated)
+	}
+	if rrs := srv.lookup("_acme-challenge.www.batch-c.example.", dns.TypeTXT); len(rrs) != 0 {
+		t.Errorf("Expected TXT record to be deleted, got %v", rrs)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// ChallengeTypeDNSPersist01 is the type of the persistent DNS
+// challenge, which is validated with a standing TXT record that
+// authorizes an ACME account to issue for a domain indefinitely.
+const ChallengeTypeDNSPersist01 = "dns-persist-01"
+
+// DNSPersistRecordName returns the name of the persistent
+// validation record for domain, which may be a wildcard.
+func DNSPersistRecordName(domain string) string {
+	return "_validation-persist." + strings.TrimPrefix(domain, "*.")
+}
+
+// DNSPersistRecordValue returns the value of the persistent
+// validation record that authorizes account to obtain
+// certificates from the CA with the issuer domain name
+// issuerDomainName (as found in CAA records). If wildcard
+// is true, the record also authorizes wildcard certificates
+// and certificates for subdomains.
+func DNSPersistRecordValue(issuerDomainName string, account acme.Account, wildcard bool) string {
+	value := issuerDomainName + "; accounturi=" + account.Location
+	if wildcard {
+		value += "; policy=wildcard"
+	}
+	return value
+}
+
+// DNSPersist01Solver is a type that makes libdns providers usable
+// as ACME dns-persist-01 challenge solvers. Unlike the records of
+// the DNS01Solver, its records are never deleted: the record is
+// created only if it does not exist yet, so once it does, solving
+// the challenge (and thus renewing certificates) needs no DNS
+// changes at all; the CA verifies the record each time. The solver
+// also verifies that the record exists each time it solves a
+// challenge, and creates it again if it does not; CertMagic does
+// not check the records in between. To do so, for example to
+// notice accidental deletions before a renewal is due, call
+// ProvisionPersistentRecord periodically.
+//
+// The records need the account URL and the issuer domain name of
+// the CA, which the ACMEIssuer provides in the context.
+type DNSPersist01Solver struct {
+	DNSManager
+
+	// The issuer domain name of the CA to authorize, as
+	// found in CAA records. Default: the first issuer
+	// domain name of the CA, if it is a known CA.
+	IssuerDomainName string
+
+	// Whether the records authorize wildcard certificates
+	// and certificates for subdomains, too. This is
+	// required to obtain wildcard certificates.
+	Wildcard bool
+
+	// serializes checking for and creating records, since
+	// example.com and *.example.com share the same record
+	mu sync.Mutex
+
+	// the records of the challenges being solved, keyed by
+	// challenge URL, since several challenges (of the same
+	// or concurrent orders) may share a record
+	presented map[string]dnsPresentMemory
+}
+
+// Present makes sure that the persistent validation record
+// for the challenge exists, creating it if it does not.
+func (s *DNSPersist01Solver) Present(ctx context.Context, challenge acme.Challenge) error {
+	dnsName, value, err := s.record(ctx, challenge)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.presented == nil {
+		s.presented = make(map[string]dnsPresentMemory)
+	}
+
+	// the record may have been created for another challenge
+	for _, mem := range s.presented {
+		if mem.dnsName == dnsName && mem.zoneRec.record.Data == value {
+			s.presented[challenge.URL] = mem
+			return nil
+		}
+	}
+
+	exists, err := s.DNSManager.persistentRecordExists(ctx, dnsName, value)
+	if err != nil {
+		return err
+	}
+	mem := dnsPresentMemory{dnsName: dnsName}
+	if exists {
+		mem.zoneRec.record.Type, mem.zoneRec.record.Data = "TXT", value
+	} else {
+		s.DNSManager.logger().Info("creating persistent validation record",
+			zap.String("dns_name", dnsName),
+			zap.String("value", value))
+		mem.zoneRec, err = s.DNSManager.createRecord(ctx, dnsName, "TXT", value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// remember the record so we know whether to wait for it
+	s.presented[challenge.URL] = mem
+
+	return nil
+}
+
+// Wait blocks until the persistent validation record has
+// propagated, if Present() created it, or until timeout,
+// whichever is first.
+func (s *DNSPersist01Solver) Wait(ctx context.Context, challenge acme.Challenge) error {
+	s.mu.Lock()
+	memory, ok := s.presented[challenge.URL]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no memory of presenting a persistent validation record for %q (usually OK if presenting also failed)", challenge.Identifier.Value)
+	}
+	if memory.zoneRec.zone == "" {
+		return nil // the record existed already
+	}
+	return s.DNSManager.wait(ctx, memory.zoneRec)
+}
+
+// CleanUp forgets about the challenge. It does not delete
+// the persistent validation record, which is meant to stay.
+func (s *DNSPersist01Solver) CleanUp(_ context.Context, challenge acme.Challenge) error {
+	s.mu.Lock()
+	delete(s.presented, challenge.URL)
+	s.mu.Unlock()
+	return nil
+}
+
+// record returns the name and value of the persistent
+// validation record for the challenge.
+func (s *DNSPersist01Solver) record(ctx context.Context, challenge acme.Challenge) (string, string, error) {
+	account, ok := ctx.Value(ctxKeyACMEAccount).(acme.Account)
+	if !ok || account.Location == "" {
+		return "", "", fmt.Errorf("%s challenge for %s requires the ACME account URL in the context", challenge.Type, challenge.Identifier.Value)
+	}
+	issuer := s.IssuerDomainName
+	if issuer == "" {
+		if names, ok := ctx.Value(ctxKeyIssuerDomainNames).([]string); ok && len(names) > 0 {
+			issuer = names[0]
+		}
+	}
+	if issuer == "" {
+		return "", "", fmt.Errorf("%s challenge for %s requires the issuer domain name of the CA", challenge.Type, challenge.Identifier.Value)
+	}
+	dnsName := DNSPersistRecordName(challenge.Identifier.Value)
+	if s.OverrideDomain != "" {
+		dnsName = s.OverrideDomain
+	}
+	return dnsName, DNSPersistRecordValue(issuer, account, s.Wildcard), nil
+}
+
+// ProvisionPersistentRecord makes sure that the persistent
+// validation record for domain with the given value (see
+// DNSPersistRecordValue) exists, creating it and waiting
+// for it to propagate if it does not. Records that exist
+// already are left alone, so it is safe to call this
+// periodically to verify that the record is still there;
+// CertMagic only verifies it when solving a challenge.
+func (m *DNSManager) ProvisionPersistentRecord(ctx context.Context, domain, value string) error {
+	dnsName := DNSPersistRecordName(domain)
+	if m.OverrideDomain != "" {
+		dnsName = m.OverrideDomain
+	}
+	exists, err := m.persistentRecordExists(ctx, dnsName, value)
+	if err != nil || exists {
+		return err
+	}
+	m.logger().Info("creating persistent validation record",
+		zap.String("dns_name", dnsName),
+		zap.String("value", value))
+	zrec, err := m.createRecord(ctx, dnsName, "TXT", value)
+	if err != nil {
+		return err
+	}
+	return m.wait(ctx, zrec)
+}
+
+// persistentRecordExists returns whether the TXT record named
+// dnsName with value appears in authoritative lookups.
+func (m *DNSManager) persistentRecordExists(ctx context.Context, dnsName, value string) (bool, error) {
+	ctx = ContextWithDNSRoots(ctx, m.TrustedRoots)
+	exists, err := checkDNSPropagation(ctx, m.logger(), dns.Fqdn(dnsName), dns.TypeTXT, value,
+		len(m.Resolvers) == 0, RecursiveNameservers(m.Resolvers))
+	if err != nil {
+		return false, fmt.Errorf("looking up persistent validation record %s: %v", dnsName, err)
+	}
+	return exists, nil
+}
+
+const ctxKeyIssuerDomainNames = ctxKey("issuer_domain_names")
+
+// Interface guard
+var _ acmez.Solver = (*DNSPersist01Solver)(nil)
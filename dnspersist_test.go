@@ -0,0 +1,169 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic/certmagictest"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+)
+
+func TestDNSPersistRecordValue(t *testing.T) {
+	account := acme.Account{Location: "https://ca.example/acct/1"}
+	for i, tc := range []struct {
+		wildcard bool
+		expect   string
+	}{
+		{false, "ca.example; accounturi=https://ca.example/acct/1"},
+		{true, "ca.example; accounturi=https://ca.example/acct/1; policy=wildcard"},
+	} {
+		if actual := DNSPersistRecordValue("ca.example", account, tc.wildcard); actual != tc.expect {
+			t.Errorf("Test %d: Expected %q, got %q", i, tc.expect, actual)
+		}
+	}
+	if name := DNSPersistRecordName("*.example.com"); name != "_validation-persist.example.com" {
+		t.Errorf("Expected record name for wildcard to be that of its base domain, got %s", name)
+	}
+}
+
+func TestACMEIssuerDNSPersist01(t *testing.T) {
+	ctx := context.Background()
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1keW5hbWljLXVwZGF0ZXM="
+	dnsSrv := &dynamicDNSServer{
+		zones:   []string{"persist.example."},
+		keyName: "update-key.",
+		secret:  secret,
+	}
+	resolver, updateServer := dnsSrv.start(t)
+	srv := &certmagictest.Server{
+		LookupTXT: func(_ context.Context, fqdn string) ([]string, error) {
+			var values []string
+			for _, rr := range dnsSrv.lookup(dns.Fqdn(fqdn), dns.TypeTXT) {
+				values = append(values, strings.Join(rr.(*dns.TXT).Txt, ""))
+			}
+			return values, nil
+		},
+		PersistIssuerDomainName: "ca.example",
+	}
+	srv.Start()
+	defer srv.Close()
+
+	solver := &DNSPersist01Solver{
+		DNSManager: DNSManager{
+			DNSProvider: &RFC2136Provider{
+				Server:    updateServer,
+				KeyName:   "update-key.",
+				KeySecret: secret,
+				Resolvers: []string{resolver},
+			},
+			Resolvers: []string{resolver},
+		},
+		IssuerDomainName: "ca.example",
+		Wildcard:         true,
+	}
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{DNSPersist01Solver: solver})
+
+	// the record is created once for the name and its wildcard
+	csr := makeInternalTestCSR(t, []string{"persist.example", "*.persist.example"}, nil)
+	if _, err := iss.Issue(ctx, csr); err != nil {
+		t.Fatal(err)
+	}
+	orders := srv.Orders()
+	if expect := []string{ChallengeTypeDNSPersist01, ChallengeTypeDNSPersist01}; !slices.Equal(orders[0].Challenges, expect) {
+		t.Errorf("Expected challenges %v, got %v", expect, orders[0].Challenges)
+	}
+	if expect := []string{"persist.example."}; !slices.Equal(dnsSrv.updated, expect) {
+		t.Errorf("Expected updates of zones %v, got %v", expect, dnsSrv.updated)
+	}
+
+	// renewals need no DNS changes, and the record stays
+	if _, err := iss.Issue(ctx, csr); err != nil {
+		t.Fatal(err)
+	}
+	if len(dnsSrv.updated) != 1 {
+		t.Errorf("Expected no more updates, got %v", dnsSrv.updated)
+	}
+	rrs := dnsSrv.lookup("_validation-persist.persist.example.", dns.TypeTXT)
+	if len(rrs) != 1 || !strings.HasSuffix(rrs[0].(*dns.TXT).Txt[0], "; policy=wildcard") {
+		t.Errorf("Expected persistent record, got %v", rrs)
+	}
+
+	// records can be provisioned ahead of time, and only once
+	value := DNSPersistRecordValue("ca.example", acme.Account{Location: "https://ca.example/acct/1"}, false)
+	for range 2 {
+		if err := solver.ProvisionPersistentRecord(ctx, "www.persist.example", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dnsSrv.updated) != 2 {
+		t.Errorf("Expected one more update, got %v", dnsSrv.updated)
+	}
+	if rrs := dnsSrv.lookup("_validation-persist.www.persist.example.", dns.TypeTXT); len(rrs) != 1 {
+		t.Errorf("Expected provisioned record, got %v", rrs)
+	}
+}
+
+func TestDNSPersist01SolverSharedRecord(t *testing.T) {
+	account := acme.Account{Location: "https://ca.example/acct/1"}
+	ctx := ContextWithACMEAccount(context.Background(), account)
+	resolver := startTestDNSServer(t,
+		"shared.example. 60 IN SOA ns.shared.example. admin.shared.example. 1 60 60 60 60",
+		`_validation-persist.shared.example. 60 IN TXT "ca.example; accounturi=https://ca.example/acct/1; policy=wildcard"`,
+	)
+	provider := new(recordingDNSProvider)
+	solver := &DNSPersist01Solver{
+		DNSManager: DNSManager{
+			DNSProvider: provider,
+			Resolvers:   []string{resolver},
+		},
+		IssuerDomainName: "ca.example",
+		Wildcard:         true,
+	}
+
+	// challenges of concurrent orders for the same
+	// name share the record, but not their memory of it
+	var chals []acme.Challenge
+	for _, url := range []string{"https://ca.example/chal/1", "https://ca.example/chal/2"} {
+		chal := acme.Challenge{
+			URL:        url,
+			Type:       ChallengeTypeDNSPersist01,
+			Identifier: acme.Identifier{Type: "dns", Value: "shared.example"},
+		}
+		if err := solver.Present(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+		chals = append(chals, chal)
+	}
+	if err := solver.CleanUp(ctx, chals[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.Wait(ctx, chals[1]); err != nil {
+		t.Errorf("Expected challenge to be unaffected by cleanup of another, got: %v", err)
+	}
+	if err := solver.CleanUp(ctx, chals[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.Wait(ctx, chals[1]); err == nil {
+		t.Error("Expected no memory of challenge after cleanup")
+	}
+	if provider.appendCalls != 0 || provider.deleteCalls != 0 {
+		t.Errorf("Expected existing record to be left alone, got %d append and %d delete calls", provider.appendCalls, provider.deleteCalls)
+	}
+}
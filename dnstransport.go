@@ -0,0 +1,200 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ContextWithDNSRoots returns a context in which the certificates of
+// DNS-over-HTTPS and DNS-over-TLS resolvers are verified with roots
+// instead of the system's roots, such as for FindZoneByFQDN. The
+// DNSManager does this with its TrustedRoots.
+func ContextWithDNSRoots(ctx context.Context, roots *x509.CertPool) context.Context {
+	if roots == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyDNSRoots, roots)
+}
+
+// isEncryptedDNSResolver returns true if resolver is
+// the URL of a DNS-over-HTTPS or DNS-over-TLS resolver.
+func isEncryptedDNSResolver(resolver string) bool {
+	return strings.HasPrefix(resolver, "https://") || strings.HasPrefix(resolver, "tls://")
+}
+
+// exchangeEncrypted sends m to the DNS-over-HTTPS or
+// DNS-over-TLS resolver, and returns its response.
+func exchangeEncrypted(ctx context.Context, m *dns.Msg, resolver string) (*dns.Msg, error) {
+	roots, _ := ctx.Value(ctxKeyDNSRoots).(*x509.CertPool)
+	key := encryptedDNSResolverKey{resolver, roots}
+	if strings.HasPrefix(resolver, "https://") {
+		return dohClientFor(key).exchange(ctx, m)
+	}
+	return dotClientFor(key).exchange(ctx, m)
+}
+
+// dohClient sends queries to a DNS-over-HTTPS resolver.
+type dohClient struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (c *dohClient) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// "DNS API clients SHOULD use a DNS ID of 0 in every
+	// DNS request" to be friendly to HTTP caches (RFC 8484 §4.1)
+	query := m.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageMediaType)
+	req.Header.Set("Accept", dnsMessageMediaType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s: %v", c.url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS query to %s: HTTP %d", c.url, resp.StatusCode)
+	}
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, fmt.Errorf("decoding response from %s: %v", c.url, err)
+	}
+	in.Id = m.Id
+	return in, nil
+}
+
+// dotClient sends queries to a DNS-over-TLS resolver over
+// one connection, which is reopened if it fails.
+type dotClient struct {
+	addr   string
+	client *dns.Client
+
+	mu   sync.Mutex
+	conn *dns.Conn
+}
+
+func (c *dotClient) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the server may have closed an idle connection,
+	// so try once more with a new one if it fails
+	var err error
+	for range 2 {
+		if c.conn == nil {
+			c.conn, err = c.client.DialContext(ctx, c.addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var in *dns.Msg
+		in, _, err = c.client.ExchangeWithConnContext(ctx, m, c.conn)
+		if err == nil {
+			return in, nil
+		}
+		c.conn.Close()
+		c.conn = nil
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// encryptedDNSResolverKey identifies a client
+// of an encrypted DNS resolver.
+type encryptedDNSResolverKey struct {
+	resolver string
+	roots    *x509.CertPool
+}
+
+func dohClientFor(key encryptedDNSResolverKey) *dohClient {
+	encryptedDNSClientsMu.Lock()
+	defer encryptedDNSClientsMu.Unlock()
+	if c, ok := dohClients[key]; ok {
+		return c
+	}
+	c := &dohClient{
+		url: key.resolver,
+		httpClient: &http.Client{
+			Timeout: dnsTimeout,
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   &tls.Config{RootCAs: key.roots},
+				ForceAttemptHTTP2: true,
+			},
+		},
+	}
+	dohClients[key] = c
+	return c
+}
+
+func dotClientFor(key encryptedDNSResolverKey) *dotClient {
+	encryptedDNSClientsMu.Lock()
+	defer encryptedDNSClientsMu.Unlock()
+	if c, ok := dotClients[key]; ok {
+		return c
+	}
+	addr := strings.TrimPrefix(key.resolver, "tls://")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, "853")
+	}
+	c := &dotClient{
+		addr: addr,
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   dnsTimeout,
+			TLSConfig: &tls.Config{RootCAs: key.roots, ServerName: host},
+		},
+	}
+	dotClients[key] = c
+	return c
+}
+
+var (
+	dohClients            = make(map[encryptedDNSResolverKey]*dohClient)
+	dotClients            = make(map[encryptedDNSResolverKey]*dotClient)
+	encryptedDNSClientsMu sync.Mutex
+)
+
+const ctxKeyDNSRoots = ctxKey("dns_roots")
+
+const dnsMessageMediaType = "application/dns-message"
@@ -0,0 +1,134 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEncryptedDNSResolvers(t *testing.T) {
+	respond := newTestDNSResponder(t,
+		"encrypted.example. 60 IN SOA ns.encrypted.example. admin.encrypted.example. 1 60 60 60 60",
+		`_acme-challenge.www.encrypted.example. 60 IN TXT "token"`,
+	)
+
+	// DNS over HTTPS
+	var dohConns atomic.Int32
+	doh := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, err := respond(query).Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageMediaType)
+		_, _ = w.Write(packed)
+	}))
+	doh.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dohConns.Add(1)
+		}
+	}
+	doh.StartTLS()
+	defer doh.Close()
+
+	// DNS over TLS, with the same certificate
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dotLn := &countingListener{Listener: tcpLn}
+	dot := &dns.Server{
+		Net:      "tcp-tls",
+		Listener: tls.NewListener(dotLn, &tls.Config{Certificates: doh.TLS.Certificates}),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			_ = w.WriteMsg(respond(r))
+		}),
+	}
+	go func() { _ = dot.ActivateAndServe() }()
+	defer dot.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+	ctx := ContextWithDNSRoots(context.Background(), roots)
+
+	resolvers := RecursiveNameservers([]string{doh.URL + "/dns-query", "tls://" + tcpLn.Addr().String()})
+	if !slices.Equal(resolvers, []string{doh.URL + "/dns-query", "tls://" + tcpLn.Addr().String()}) {
+		t.Fatalf("Expected resolver URLs to be unchanged, got %v", resolvers)
+	}
+	for i, resolver := range resolvers {
+		// queries reuse the connection
+		for range 3 {
+			m := createDNSMsg("_acme-challenge.www.encrypted.example.", dns.TypeTXT, true)
+			in, err := sendDNSQuery(ctx, m, resolver)
+			if err != nil {
+				t.Fatalf("%s: %v", resolver, err)
+			}
+			if in.Id != m.Id || len(in.Answer) != 1 || in.Answer[0].(*dns.TXT).Txt[0] != "token" {
+				t.Errorf("%s: unexpected response: %v", resolver, in)
+			}
+		}
+		if conns := []int32{dohConns.Load(), dotLn.accepted.Load()}[i]; conns != 1 {
+			t.Errorf("%s: expected 1 connection, got %d", resolver, conns)
+		}
+
+		zone, err := FindZoneByFQDN(ctx, defaultTestLogger, "_acme-challenge.www.encrypted.example.", []string{resolver})
+		if err != nil {
+			t.Fatalf("%s: %v", resolver, err)
+		}
+		if zone != "encrypted.example." {
+			t.Errorf("%s: expected zone encrypted.example., got %s", resolver, zone)
+		}
+
+		// the certificate must be trusted
+		if _, err := sendDNSQuery(context.Background(), createDNSMsg("encrypted.example.", dns.TypeSOA, true), resolver); err == nil {
+			t.Errorf("%s: expected query to fail without trusted roots", resolver)
+		}
+	}
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
@@ -124,6 +124,75 @@ func fetchSoaByFqdn(ctx context.Context, logger *zap.Logger, fqdn string, namese
 	return nil, fmt.Errorf("could not find the start of authority for %s%s", fqdn, formatDNSError(in, err))
 }
 
+// followCNAMEs returns the name that fqdn is an alias of, by following
+// the chain of CNAME records that starts at fqdn; if fqdn is not an
+// alias, it returns fqdn. Chains that loop or are longer than
+// maxCNAMEChainLength are cnameChainErrors. Aliases are cached for
+// the lowest TTL in their chain.
+func followCNAMEs(ctx context.Context, fqdn string, resolvers []string) (string, error) {
+	fqdn = dns.Fqdn(strings.ToLower(fqdn))
+
+	cnameCacheMu.Lock()
+	ent, ok := cnameCache[fqdn]
+	cnameCacheMu.Unlock()
+	if ok && time.Now().Before(ent.expires) {
+		return ent.target, nil
+	}
+
+	name := fqdn
+	seen := map[string]bool{fqdn: true}
+	var ttl uint32
+	for hops := 0; ; hops++ {
+		answer, err := lookupRecords(ctx, name, dns.TypeCNAME, resolvers)
+		if err != nil {
+			return "", err
+		}
+		var target string
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = strings.ToLower(cname.Target)
+				if hops == 0 || cname.Hdr.Ttl < ttl {
+					ttl = cname.Hdr.Ttl
+				}
+				break
+			}
+		}
+		if target == "" {
+			break
+		}
+		if seen[target] {
+			return "", cnameChainError{fmt.Errorf("CNAME records of %s form a loop at %s", fqdn, target)}
+		}
+		if hops == maxCNAMEChainLength {
+			return "", cnameChainError{fmt.Errorf("chain of CNAME records of %s is longer than %d", fqdn, maxCNAMEChainLength)}
+		}
+		seen[target] = true
+		name = target
+	}
+
+	if name != fqdn {
+		cnameCacheMu.Lock()
+		if len(cnameCache) >= 1000 {
+			for key := range cnameCache {
+				delete(cnameCache, key)
+				break
+			}
+		}
+		cnameCache[fqdn] = cnameCacheEntry{
+			target:  name,
+			expires: time.Now().Add(time.Duration(ttl) * time.Second),
+		}
+		cnameCacheMu.Unlock()
+	}
+	return name, nil
+}
+
+// cnameCacheEntry holds the name that an alias resolves to.
+type cnameCacheEntry struct {
+	target  string
+	expires time.Time
+}
+
 // dnsMsgContainsCNAME checks for a CNAME answer in msg
 func dnsMsgContainsCNAME(msg *dns.Msg) bool {
 	for _, ans := range msg.Answer {
@@ -147,6 +216,26 @@ func dnsQuery(ctx context.Context, fqdn string, rtype uint16, nameservers []stri
 	return in, err
 }
 
+// lookupRecords asks the recursive resolvers for the records of type
+// rtype at fqdn, and returns the answer. A name that does not exist
+// has no records; other unsuccessful responses are errors.
+func lookupRecords(ctx context.Context, fqdn string, rtype uint16, resolvers []string) ([]dns.RR, error) {
+	m := createDNSMsg(fqdn, rtype, true)
+	var in *dns.Msg
+	var err error
+	for _, ns := range resolvers {
+		in, err = sendDNSQuery(ctx, m, ns)
+		if err == nil && (in.Rcode == dns.RcodeSuccess || in.Rcode == dns.RcodeNameError) {
+			return in.Answer, nil
+		}
+	}
+	return nil, fmt.Errorf("looking up %s records of %s%s", dns.TypeToString[rtype], fqdn, formatDNSError(in, err))
+}
+
+// cnameChainError is returned by followCNAMEs if the
+// chain of CNAME records loops or is too long.
+type cnameChainError struct{ error }
+
 func createDNSMsg(fqdn string, rtype uint16, recursive bool) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetQuestion(fqdn, rtype)
@@ -160,6 +249,9 @@ func createDNSMsg(fqdn string, rtype uint16, recursive bool) *dns.Msg {
 }
 
 func sendDNSQuery(ctx context.Context, m *dns.Msg, ns string) (*dns.Msg, error) {
+	if isEncryptedDNSResolver(ns) {
+		return exchangeEncrypted(ctx, m, ns)
+	}
 	udp := &dns.Client{Net: "udp", Timeout: dnsTimeout}
 	in, _, err := udp.ExchangeContext(ctx, m, ns)
 	// two kinds of errors we can handle by retrying with TCP:
@@ -221,6 +313,9 @@ func systemOrDefaultNameservers(path string, defaults []string) []string {
 // If not, the the default DNS server port of 53 will be appended.
 func populateNameserverPorts(servers []string) {
 	for i := range servers {
+		if isEncryptedDNSResolver(servers[i]) {
+			continue
+		}
 		_, port, _ := net.SplitHostPort(servers[i])
 		if port == "" {
 			servers[i] = net.JoinHostPort(servers[i], "53")
@@ -348,6 +443,13 @@ func updateDomainWithCName(r *dns.Msg, fqdn string) string {
 // obtained from resolv.conf and defaultNameservers if none is
 // configured and ensures that all server addresses have a port value.
 //
+// Besides addresses of DNS servers, nameservers can be URLs of
+// encrypted DNS resolvers: "https://host[:port]/path" for DNS over
+// HTTPS (RFC 8484), and "tls://host[:port]" for DNS over TLS (RFC
+// 7858; the default port is 853). Connections to them are reused.
+// Their certificates are verified with the system's roots, unless
+// other roots are set with ContextWithDNSRoots.
+//
 // EXPERIMENTAL: This API was previously unexported, and may be
 // be unexported again in the future. Do not rely on it at this time.
 func RecursiveNameservers(custom []string) []string {
@@ -376,4 +478,13 @@ var (
 	fqdnSOACacheMu sync.Mutex
 )
 
+var (
+	cnameCache   = map[string]cnameCacheEntry{}
+	cnameCacheMu sync.Mutex
+)
+
+// maxCNAMEChainLength is how many CNAME records are followed
+// at most to find the name that an alias resolves to.
+const maxCNAMEChainLength = 8
+
 const defaultResolvConf = "/etc/resolv.conf"
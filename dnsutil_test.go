@@ -15,6 +15,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
@@ -264,3 +265,56 @@ func clearFqdnCache() {
 	fqdnSOACache = make(map[string]*soaCacheEntry)
 	fqdnSOACacheMu.Unlock()
 }
+
+// startTestDNSServer starts a DNS server on the loopback interface
+// that answers queries with the given records, which are in zone
+// file format, and returns its address.
+func startTestDNSServer(t *testing.T, records ...string) string {
+	t.Helper()
+	return serveTestDNS(t, newTestDNSResponder(t, records...))
+}
+
+// serveTestDNS starts a DNS server on the loopback interface
+// that answers queries with respond, and returns its address.
+func serveTestDNS(t *testing.T, respond func(*dns.Msg) *dns.Msg) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			_ = w.WriteMsg(respond(r))
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// newTestDNSResponder returns a function that answers
+// queries with the given records, which are in zone
+// file format.
+func newTestDNSResponder(t *testing.T, records ...string) func(*dns.Msg) *dns.Msg {
+	t.Helper()
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("parsing record %q: %v", record, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Header().Name, q.Name) && rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		return m
+	}
+}
@@ -0,0 +1,641 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ECHManager manages keys for Encrypted ClientHello (ECH) on the
+// server side. It generates HPKE key pairs and their ECH configs,
+// persists them in storage so that all instances sharing the storage
+// use the same keys, and rotates them on a schedule (under a cluster-
+// wide lock). After a rotation, the previous keys are still accepted
+// for the Overlap duration, to give DNS caches time to pick up the
+// new config.
+//
+// Set it as the ECH field of Config to enable ECH on each tls.Config
+// returned by Config.TLSConfig(). The ECHConfigList to publish in
+// HTTPS/SVCB records is available from ConfigList(), and can be
+// published automatically by setting Publisher. The first call to
+// TLSConfig() starts the maintenance goroutine; call Stop() when the
+// keys are no longer needed.
+//
+// The keys are encrypted with EncryptionKey in storage, like
+// the keys of SessionTicketKeys, since anyone who can read the
+// private keys can decrypt the ClientHellos of all clients.
+//
+// With Go versions before 1.25, tls.Configs only receive the keys
+// current at the time TLSConfig() is called.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ECHManager struct {
+	// The public name of the ECH configs, which is the
+	// server name in the unencrypted (outer) ClientHello.
+	// It should be a name for which the server has a
+	// certificate, so that clients can be sent retry
+	// configs securely. Required.
+	PublicName string
+
+	// The key used to encrypt ECH keys in storage, which
+	// must be 16, 24, or 32 bytes (AES-128, -192 or -256).
+	// All instances sharing the storage must use the same
+	// key. Required.
+	EncryptionKey []byte
+
+	// How often to rotate the ECH key. Default: 7 days.
+	RotationInterval time.Duration
+
+	// How long previous keys are still accepted after
+	// being rotated out. This should be longer than the
+	// TTL of DNS records the config is published in.
+	// Default: 24 hours.
+	Overlap time.Duration
+
+	// The storage in which to keep the keys. If nil,
+	// the storage of the Config is used.
+	Storage Storage
+
+	// If set, the ECHConfigList is published to DNS
+	// after each rotation.
+	Publisher *ECHDNSPublisher
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	refreshMu sync.Mutex // serializes refreshes
+
+	mu       sync.RWMutex
+	storage  Storage
+	keys     []echKey
+	stopChan chan struct{}
+}
+
+// ECHDNSPublisher publishes ECH configs in HTTPS records
+// using a DNSProvider.
+//
+// If the DNSProvider implements libdns.RecordSetter, the
+// HTTPS records of each domain are replaced entirely; this
+// will remove any other HTTPS records for those domains.
+// Otherwise, the records are appended and the previously
+// published records (from this process) are deleted.
+type ECHDNSPublisher struct {
+	// The DNS provider to publish records with. Required.
+	DNSProvider DNSProvider
+
+	// The domain names whose HTTPS records to publish.
+	Domains []string
+
+	// The DNS zone the domains are in. If empty, the
+	// zone of each domain is looked up in DNS.
+	Zone string
+
+	// The TTL of the records. Default: 5 minutes.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	published map[string]libdns.Record // keyed by domain
+}
+
+// echKey is an ECH key as persisted in storage.
+type echKey struct {
+	ConfigID uint8 `json:"config_id"`
+
+	// The marshalled ECHConfig.
+	Config []byte `json:"config"`
+
+	// The HPKE private key.
+	PrivateKey []byte `json:"private_key"`
+
+	Created time.Time `json:"created"`
+
+	// When the key was rotated out; zero if current.
+	Retired time.Time `json:"retired,omitzero"`
+}
+
+// ConfigList returns the serialized ECHConfigList with the current
+// config, which is what gets published in the "ech" parameter of
+// HTTPS/SVCB records. It returns an error if no keys are loaded yet.
+func (em *ECHManager) ConfigList() ([]byte, error) {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	if len(em.keys) == 0 {
+		return nil, fmt.Errorf("no ECH keys loaded")
+	}
+	return marshalECHConfigList(em.keys[0].Config)
+}
+
+// Rotate forces a new ECH key to become current, regardless
+// of when the last rotation happened.
+func (em *ECHManager) Rotate(ctx context.Context) error {
+	storage, err := em.getStorage()
+	if err != nil {
+		return err
+	}
+	em.refreshMu.Lock()
+	defer em.refreshMu.Unlock()
+	keys, err := em.rotateLocked(ctx, storage, true)
+	if err != nil {
+		return err
+	}
+	em.setKeys(keys)
+	return nil
+}
+
+// Publish publishes the current ECHConfigList with
+// the Publisher, which must be set.
+func (em *ECHManager) Publish(ctx context.Context) error {
+	if em.Publisher == nil {
+		return fmt.Errorf("no ECH publisher configured")
+	}
+	configList, err := em.ConfigList()
+	if err != nil {
+		return err
+	}
+	return em.Publisher.publish(ctx, em.logger(), configList)
+}
+
+// Stop stops the maintenance goroutine, if running.
+func (em *ECHManager) Stop() {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if em.stopChan != nil {
+		close(em.stopChan)
+		em.stopChan = nil
+	}
+}
+
+// start loads (or creates) the keys from storage, which defaults to
+// the given storage, and starts maintenance, unless already started.
+func (em *ECHManager) start(storage Storage, logger *zap.Logger) {
+	em.mu.Lock()
+	if em.Logger == nil {
+		em.Logger = logger
+	}
+	if em.storage == nil {
+		em.storage = em.Storage
+		if em.storage == nil {
+			em.storage = storage
+		}
+	}
+	start := em.stopChan == nil && em.keys == nil
+	if start {
+		em.stopChan = make(chan struct{})
+	}
+	stopChan := em.stopChan
+	em.mu.Unlock()
+
+	if !start {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	if err := em.refresh(ctx); err != nil {
+		em.logger().Error("loading ECH keys", zap.Error(err))
+	}
+	cancel()
+	go em.maintain(stopChan)
+}
+
+// maintain periodically refreshes the keys until stopChan is closed.
+func (em *ECHManager) maintain(stopChan chan struct{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			em.logger().Error("panic in ECH key maintenance", zap.Any("error", err))
+		}
+	}()
+
+	ticker := time.NewTicker(min(em.rotationInterval()/4, maxECHKeyCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := em.refresh(ctx); err != nil {
+				em.logger().Error("refreshing ECH keys", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// refresh loads the keys from storage, rotating them first if they
+// are missing or due for rotation.
+func (em *ECHManager) refresh(ctx context.Context) error {
+	storage, err := em.getStorage()
+	if err != nil {
+		return err
+	}
+
+	em.refreshMu.Lock()
+	defer em.refreshMu.Unlock()
+
+	keys, err := em.load(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if em.needsRotation(keys) {
+		keys, err = em.rotateLocked(ctx, storage, false)
+		if err != nil {
+			return err
+		}
+	}
+	em.setKeys(keys)
+	return nil
+}
+
+// rotateLocked adds a new current key in storage under a cluster-wide
+// lock, retiring the previous one and dropping keys that have been
+// retired for longer than the overlap. Unless force is true, the keys
+// are only rotated if they still need it after obtaining the lock,
+// since another instance may have just done it. If the keys are
+// rotated and a Publisher is configured, the new config is published.
+func (em *ECHManager) rotateLocked(ctx context.Context, storage Storage, force bool) ([]echKey, error) {
+	if em.PublicName == "" {
+		return nil, fmt.Errorf("ECH public name is required")
+	}
+
+	if err := acquireLock(ctx, storage, echKeysLockKey); err != nil {
+		return nil, fmt.Errorf("acquiring ECH key lock: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, storage, echKeysLockKey); err != nil {
+			em.logger().Error("unable to release ECH key lock", zap.Error(err))
+		}
+	}()
+
+	keys, err := em.load(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if !force && !em.needsRotation(keys) {
+		return keys, nil
+	}
+
+	newKey, err := generateECHKey(em.PublicName, keys)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if len(keys) > 0 && keys[0].Retired.IsZero() {
+		keys[0].Retired = now
+	}
+	keys = append([]echKey{newKey}, keys...)
+	keys = em.pruneKeys(keys, now)
+
+	if err := em.store(ctx, storage, keys); err != nil {
+		return nil, err
+	}
+
+	em.logger().Info("rotated ECH keys",
+		zap.String("public_name", em.PublicName),
+		zap.Uint8("config_id", newKey.ConfigID),
+		zap.Int("keys", len(keys)))
+
+	if em.Publisher != nil {
+		configList, err := marshalECHConfigList(newKey.Config)
+		if err == nil {
+			err = em.Publisher.publish(ctx, em.logger(), configList)
+		}
+		if err != nil {
+			// previous keys are still accepted for a while, and clients
+			// using them will be sent the new config to retry with
+			em.logger().Error("publishing ECH config", zap.Error(err))
+		}
+	}
+
+	return keys, nil
+}
+
+// pruneKeys returns keys without those that were
+// retired longer than the overlap ago.
+func (em *ECHManager) pruneKeys(keys []echKey, now time.Time) []echKey {
+	overlap := em.Overlap
+	if overlap <= 0 {
+		overlap = defaultECHKeyOverlap
+	}
+	pruned := keys[:0]
+	for _, k := range keys {
+		if k.Retired.IsZero() || now.Sub(k.Retired) < overlap {
+			pruned = append(pruned, k)
+		}
+	}
+	return pruned
+}
+
+// needsRotation returns true if there are no keys, or
+// if the newest key is older than the rotation interval.
+func (em *ECHManager) needsRotation(keys []echKey) bool {
+	return len(keys) == 0 || time.Since(keys[0].Created) >= em.rotationInterval()
+}
+
+// setKeys makes keys the keys in use, without those that
+// have been retired for longer than the overlap.
+func (em *ECHManager) setKeys(keys []echKey) {
+	keys = em.pruneKeys(keys, time.Now())
+	if len(keys) == 0 {
+		return
+	}
+	em.mu.Lock()
+	em.keys = keys
+	em.mu.Unlock()
+}
+
+// tlsKeys returns the keys in use in the form needed by crypto/tls.
+// Only the current key is sent to clients as a retry config.
+func (em *ECHManager) tlsKeys() []tls.EncryptedClientHelloKey {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	tlsKeys := make([]tls.EncryptedClientHelloKey, 0, len(em.keys))
+	for i, k := range em.keys {
+		tlsKeys = append(tlsKeys, tls.EncryptedClientHelloKey{
+			Config:      k.Config,
+			PrivateKey:  k.PrivateKey,
+			SendAsRetry: i == 0,
+		})
+	}
+	return tlsKeys
+}
+
+// load loads and decrypts the keys from storage. If
+// there are no keys in storage, an empty result is
+// returned without error.
+func (em *ECHManager) load(ctx context.Context, storage Storage) ([]echKey, error) {
+	ciphertext, err := storage.Load(ctx, echKeysStorageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading ECH keys: %v", err)
+	}
+	aead, err := em.aead()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openStorageValue(aead, echKeysStorageKey, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting ECH keys (is the encryption key correct?): %v", err)
+	}
+	var keys []echKey
+	if err := json.Unmarshal(plaintext, &keys); err != nil {
+		return nil, fmt.Errorf("decoding ECH keys: %v", err)
+	}
+	return keys, nil
+}
+
+// store encrypts and stores the keys in storage.
+func (em *ECHManager) store(ctx context.Context, storage Storage, keys []echKey) error {
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return fmt.Errorf("encoding ECH keys: %v", err)
+	}
+	aead, err := em.aead()
+	if err != nil {
+		return err
+	}
+	ciphertext, err := sealStorageValue(aead, echKeysStorageKey, plaintext)
+	if err != nil {
+		return err
+	}
+	if err := storage.Store(ctx, echKeysStorageKey, ciphertext); err != nil {
+		return fmt.Errorf("storing ECH keys: %v", err)
+	}
+	return nil
+}
+
+func (em *ECHManager) aead() (cipher.AEAD, error) {
+	if len(em.EncryptionKey) == 0 {
+		return nil, fmt.Errorf("no encryption key configured for ECH keys")
+	}
+	aead, err := newStorageAEAD(em.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("ECH key encryption key: %v", err)
+	}
+	return aead, nil
+}
+
+func (em *ECHManager) getStorage() (Storage, error) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if em.storage == nil {
+		em.storage = em.Storage
+	}
+	if em.storage == nil {
+		return nil, fmt.Errorf("no storage configured for ECH keys")
+	}
+	return em.storage, nil
+}
+
+func (em *ECHManager) rotationInterval() time.Duration {
+	if em.RotationInterval > 0 {
+		return em.RotationInterval
+	}
+	return defaultECHKeyRotationInterval
+}
+
+func (em *ECHManager) logger() *zap.Logger {
+	if em.Logger == nil {
+		return zap.NewNop()
+	}
+	return em.Logger
+}
+
+// publish publishes configList in the HTTPS records of all domains.
+func (p *ECHDNSPublisher) publish(ctx context.Context, logger *zap.Logger, configList []byte) error {
+	if p.DNSProvider == nil {
+		return fmt.Errorf("no DNS provider configured to publish ECH config")
+	}
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = defaultECHRecordTTL
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for _, domain := range p.Domains {
+		zone := p.Zone
+		if zone == "" {
+			var err error
+			zone, err = FindZoneByFQDN(ctx, logger, dns.Fqdn(domain), RecursiveNameservers(nil))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: finding zone: %v", domain, err))
+				continue
+			}
+		}
+		rec := libdns.ServiceBinding{
+			Scheme:   "https",
+			Name:     libdns.RelativeName(dns.Fqdn(domain), zone),
+			TTL:      ttl,
+			Priority: 1,
+			Target:   ".",
+			Params:   libdns.SvcParams{"ech": {base64.StdEncoding.EncodeToString(configList)}},
+		}
+
+		if setter, ok := p.DNSProvider.(libdns.RecordSetter); ok {
+			if _, err := setter.SetRecords(ctx, zone, []libdns.Record{rec}); err != nil {
+				errs = append(errs, fmt.Errorf("%s: setting HTTPS record: %v", domain, err))
+			}
+			continue
+		}
+
+		if _, err := p.DNSProvider.AppendRecords(ctx, zone, []libdns.Record{rec}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: appending HTTPS record: %v", domain, err))
+			continue
+		}
+		if previous, ok := p.published[domain]; ok {
+			if _, err := p.DNSProvider.DeleteRecords(ctx, zone, []libdns.Record{previous}); err != nil {
+				logger.Error("deleting previous HTTPS record", zap.String("domain", domain), zap.Error(err))
+			}
+		}
+		if p.published == nil {
+			p.published = make(map[string]libdns.Record)
+		}
+		p.published[domain] = rec
+	}
+
+	if len(errs) == 0 {
+		logger.Info("published ECH config", zap.Strings("domains", p.Domains))
+	}
+	return errors.Join(errs...)
+}
+
+// generateECHKey generates a new ECH key pair and config for
+// publicName, with a config ID that is not used by existing.
+func generateECHKey(publicName string, existing []echKey) (echKey, error) {
+	var configID uint8
+	for {
+		var b [1]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return echKey{}, fmt.Errorf("generating config ID: %v", err)
+		}
+		configID = b[0]
+		inUse := false
+		for _, k := range existing {
+			if k.ConfigID == configID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			break
+		}
+	}
+
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return echKey{}, fmt.Errorf("generating HPKE key: %v", err)
+	}
+
+	config, err := marshalECHConfig(configID, privKey.PublicKey().Bytes(), publicName)
+	if err != nil {
+		return echKey{}, err
+	}
+
+	return echKey{
+		ConfigID:   configID,
+		Config:     config,
+		PrivateKey: privKey.Bytes(),
+		Created:    time.Now().UTC(),
+	}, nil
+}
+
+// marshalECHConfig returns the ECHConfig (draft-ietf-tls-esni-22,
+// section 4) for an X25519 HPKE public key, with cipher suites
+// supported by crypto/tls.
+func marshalECHConfig(configID uint8, publicKey []byte, publicName string) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(echConfigVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		// HpkeKeyConfig
+		b.AddUint8(configID)
+		b.AddUint16(hpkeKEMX25519HKDFSHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []uint16{hpkeAEADAES128GCM, hpkeAEADAES256GCM, hpkeAEADChaCha20Poly1305} {
+				b.AddUint16(hpkeKDFHKDFSHA256)
+				b.AddUint16(aead)
+			}
+		})
+
+		b.AddUint8(0) // maximum_name_length; let clients use their default padding
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("marshaling ECH config: %v", err)
+	}
+	return config, nil
+}
+
+// marshalECHConfigList returns an ECHConfigList of configs.
+func marshalECHConfigList(configs ...[]byte) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, config := range configs {
+			b.AddBytes(config)
+		}
+	})
+	configList, err := b.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("marshaling ECH config list: %v", err)
+	}
+	return configList, nil
+}
+
+const (
+	echKeysStorageKey = "ech/keys.json"
+	echKeysLockKey    = "ech_keys_rotation"
+
+	defaultECHKeyRotationInterval = 7 * 24 * time.Hour
+	defaultECHKeyOverlap          = 24 * time.Hour
+	defaultECHRecordTTL           = 5 * time.Minute
+	maxECHKeyCheckInterval        = 10 * time.Minute
+)
+
+// Identifiers from draft-ietf-tls-esni and RFC 9180.
+const (
+	echConfigVersion         = 0xfe0d
+	hpkeKEMX25519HKDFSHA256  = 0x0020
+	hpkeKDFHKDFSHA256        = 0x0001
+	hpkeAEADAES128GCM        = 0x0001
+	hpkeAEADAES256GCM        = 0x0002
+	hpkeAEADChaCha20Poly1305 = 0x0003
+)
@@ -0,0 +1,27 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package certmagic
+
+import "crypto/tls"
+
+// configureTLS enables ECH on tlsConfig, which
+// always uses the keys that are currently in use.
+func (em *ECHManager) configureTLS(tlsConfig *tls.Config) {
+	tlsConfig.GetEncryptedClientHelloKeys = func(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+		return em.tlsKeys(), nil
+	}
+}
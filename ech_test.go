@@ -0,0 +1,224 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestECHManagerHandshake(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	encKey := bytes.Repeat([]byte{1}, 32)
+	em := &ECHManager{PublicName: "public.example.com", EncryptionKey: encKey}
+	defer em.Stop()
+	em.start(storage, defaultTestLogger)
+
+	cert, err := makePlaceholderCertificate("example.com", P256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert.Certificate}}
+	em.configureTLS(serverConfig)
+
+	handshake := func(configList []byte) bool {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		errChan := make(chan error, 1)
+		go func() { errChan <- tls.Server(serverConn, serverConfig).Handshake() }()
+		client := tls.Client(clientConn, &tls.Config{
+			ServerName:                     "example.com",
+			RootCAs:                        roots,
+			MinVersion:                     tls.VersionTLS13,
+			EncryptedClientHelloConfigList: configList,
+		})
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("Client handshake: %v", err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatalf("Server handshake: %v", err)
+		}
+		return client.ConnectionState().ECHAccepted
+	}
+
+	oldConfigList, err := em.ConfigList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(oldConfigList) {
+		t.Fatal("Expected ECH to be accepted")
+	}
+
+	// another instance sharing the storage uses the same keys
+	other := &ECHManager{PublicName: "public.example.com", EncryptionKey: encKey, Storage: storage}
+	if err := other.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the private keys are not stored in plaintext
+	stored, err := storage.Load(ctx, echKeysStorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("private_key")) {
+		t.Error("Expected ECH keys to be encrypted in storage")
+	}
+	wrongKey := &ECHManager{PublicName: "public.example.com", EncryptionKey: bytes.Repeat([]byte{2}, 32), Storage: storage}
+	if err := wrongKey.refresh(ctx); err == nil {
+		t.Error("Expected error decrypting keys with the wrong encryption key")
+	}
+	if otherConfigList, _ := other.ConfigList(); string(otherConfigList) != string(oldConfigList) {
+		t.Error("Expected instances sharing storage to have the same config")
+	}
+
+	// after rotation, both the new and the previous config are accepted
+	if err := em.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newConfigList, err := em.ConfigList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(newConfigList) == string(oldConfigList) {
+		t.Fatal("Expected config to change after rotation")
+	}
+	if !handshake(newConfigList) {
+		t.Error("Expected ECH to be accepted with new config")
+	}
+	if !handshake(oldConfigList) {
+		t.Error("Expected ECH to be accepted with previous config during overlap")
+	}
+}
+
+func TestConfigTLSConfigECH(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	em := &ECHManager{PublicName: "public.example.com", EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	defer em.Stop()
+	cfg := New(cache, Config{
+		Storage: &FileStorage{Path: t.TempDir()},
+		ECH:     em,
+		Logger:  defaultTestLogger,
+	})
+
+	cert, err := makePlaceholderCertificate("example.com", P256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheUnmanagedTLSCertificate(ctx, cert.Certificate, nil); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	serverConfig := cfg.TLSConfig()
+	if serverConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected ECH to require TLS 1.3, got minimum version %x", serverConfig.MinVersion)
+	}
+	configList, err := em.ConfigList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	errChan := make(chan error, 1)
+	go func() { errChan <- tls.Server(serverConn, serverConfig).Handshake() }()
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:                     "example.com",
+		RootCAs:                        roots,
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: configList,
+	})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Client handshake: %v", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Server handshake: %v", err)
+	}
+	if !client.ConnectionState().ECHAccepted {
+		t.Error("Expected ECH to be accepted")
+	}
+}
+
+func TestECHManagerPruneKeys(t *testing.T) {
+	em := &ECHManager{Overlap: time.Hour}
+	now := time.Now()
+	keys := em.pruneKeys([]echKey{
+		{ConfigID: 1},
+		{ConfigID: 2, Retired: now.Add(-time.Minute)},
+		{ConfigID: 3, Retired: now.Add(-2 * time.Hour)},
+	}, now)
+	if len(keys) != 2 || keys[0].ConfigID != 1 || keys[1].ConfigID != 2 {
+		t.Errorf("Expected keys retired within overlap to be kept, got: %+v", keys)
+	}
+}
+
+func TestECHDNSPublisher(t *testing.T) {
+	ctx := context.Background()
+	provider := new(recordingDNSProvider)
+	em := &ECHManager{
+		PublicName:    "public.example.com",
+		EncryptionKey: bytes.Repeat([]byte{1}, 32),
+		Storage:       &FileStorage{Path: t.TempDir()},
+		Publisher: &ECHDNSPublisher{
+			DNSProvider: provider,
+			Domains:     []string{"example.com", "www.example.com"},
+			Zone:        "example.com.",
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := em.Rotate(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configList, err := em.ConfigList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if len(provider.appended) != 4 || len(provider.deleted) != 2 {
+		t.Fatalf("Expected 4 appended and 2 deleted records, got %d and %d", len(provider.appended), len(provider.deleted))
+	}
+	last := provider.appended[len(provider.appended)-1].(libdns.ServiceBinding)
+	if last.Name != "www" || last.Scheme != "https" {
+		t.Errorf("Unexpected record: %+v", last)
+	}
+	if ech := last.Params["ech"]; len(ech) != 1 || ech[0] != base64.StdEncoding.EncodeToString(configList) {
+		t.Errorf("Expected record to contain current ECH config list, got: %v", ech)
+	}
+}
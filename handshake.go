@@ -51,18 +51,28 @@ func (cfg *Config) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certif
 }
 
 func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if ctx == nil {
+		// tests can't set context on a tls.ClientHelloInfo because it's unexported :(
+		ctx = context.Background()
+	}
+
+	var obs *HandshakeObservation
+	if cfg.HandshakeObserver != nil {
+		obs = &HandshakeObservation{Hello: clientHello, Start: time.Now()}
+		ctx = context.WithValue(ctx, handshakeObservationCtxKey, obs)
+	}
+
 	if err := cfg.emit(ctx, "tls_get_certificate", map[string]any{"client_hello": clientHelloWithoutConn(clientHello)}); err != nil {
 		cfg.Logger.Error("TLS handshake aborted by event handler",
 			zap.String("server_name", clientHello.ServerName),
 			zap.String("remote", clientHello.Conn.RemoteAddr().String()),
 			zap.Error(err))
-		return nil, fmt.Errorf("handshake aborted by event handler: %w", err)
+		err = fmt.Errorf("handshake aborted by event handler: %w", err)
+		obs.setOutcome(HandshakeDenied)
+		cfg.finishHandshakeObservation(ctx, obs, Certificate{}, err)
+		return nil, err
 	}
 
-	if ctx == nil {
-		// tests can't set context on a tls.ClientHelloInfo because it's unexported :(
-		ctx = context.Background()
-	}
 	ctx = context.WithValue(ctx, ClientHelloInfoCtxKey, clientHello)
 
 	// special case: serve up the certificate for a TLS-ALPN ACME challenge
@@ -79,8 +89,11 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 				zap.String("remote_addr", clientHello.Conn.RemoteAddr().String()),
 				zap.String("server_name", clientHello.ServerName),
 				zap.Error(err))
+			cfg.finishHandshakeObservation(ctx, obs, Certificate{}, err)
 			return nil, err
 		}
+		obs.setOutcome(HandshakeChallenge)
+		cfg.finishHandshakeObservation(ctx, obs, Certificate{Certificate: *challengeCert}, nil)
 		cfg.Logger.Info("served key authentication certificate",
 			zap.String("server_name", clientHello.ServerName),
 			zap.String("challenge", "tls-alpn-01"),
@@ -91,10 +104,52 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 
 	// get the certificate and serve it up
 	cert, err := cfg.getCertDuringHandshake(ctx, clientHello, true)
+	if err != nil && cfg.Placeholder != nil && errors.As(err, new(placeholderEligibleError)) {
+		cert, err = cfg.placeholderCertificate(clientHello, err)
+		if err == nil {
+			obs.setOutcome(HandshakePlaceholder)
+		}
+	}
+	cfg.finishHandshakeObservation(ctx, obs, cert, err)
 
 	return &cert.Certificate, err
 }
 
+// finishHandshakeObservation completes obs with the result of getting
+// a certificate, and passes it to the observer. It is a no-op if obs
+// is nil.
+func (cfg *Config) finishHandshakeObservation(ctx context.Context, obs *HandshakeObservation, cert Certificate, err error) {
+	if obs == nil {
+		return
+	}
+	obs.Duration = time.Since(obs.Start)
+	obs.Certificate = cert
+	obs.Err = err
+	if err != nil && (!obs.outcomeSet || (obs.Outcome != HandshakeDenied && obs.Outcome != HandshakeNoCertificate)) {
+		obs.Outcome = HandshakeError
+	}
+	cfg.HandshakeObserver.ObserveHandshake(ctx, obs)
+}
+
+// placeholderCertificate returns a placeholder certificate for hello,
+// which is served because no certificate is available due to reason.
+// If a placeholder can't be made, reason is returned as the error.
+func (cfg *Config) placeholderCertificate(hello *tls.ClientHelloInfo, reason error) (Certificate, error) {
+	name, err := cfg.getNameFromClientHello(hello)
+	if err != nil || name == "" {
+		return Certificate{}, reason
+	}
+	cert, err := cfg.Placeholder.certificate(name)
+	if err != nil {
+		cfg.Logger.Error("making placeholder certificate", zap.String("server_name", name), zap.Error(err))
+		return Certificate{}, reason
+	}
+	logWithRemote(cfg.Logger.Named("handshake"), hello).Debug("serving placeholder certificate",
+		zap.String("server_name", name),
+		zap.NamedError("reason", reason))
+	return cert, nil
+}
+
 // getCertificateFromCache gets a certificate that matches name from the in-memory
 // cache, according to the lookup table associated with cfg. The lookup then
 // points to a certificate in the Instance certificate cache.
@@ -271,10 +326,14 @@ func DefaultCertificateSelector(hello *tls.ClientHelloInfo, choices []Certificat
 // This function is safe for concurrent use.
 func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.ClientHelloInfo, loadOrObtainIfNecessary bool) (Certificate, error) {
 	logger := logWithRemote(cfg.Logger.Named("handshake"), hello)
+	obs := handshakeObservationFromContext(ctx)
 
 	// First check our in-memory cache to see if we've already loaded it
+	stageStart := obs.beginStage()
 	cert, matched, defaulted := cfg.getCertificateFromCache(hello)
+	obs.endStage(HandshakeStageCache, stageStart)
 	if matched {
+		obs.setOutcome(HandshakeCacheHit)
 		logger.Debug("matched certificate in cache",
 			zap.Strings("subjects", cert.Names),
 			zap.Bool("managed", cert.managed),
@@ -332,17 +391,24 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 
 	// If an external Manager is configured, try to get it from them.
 	// Only continue to use our own logic if it returns empty+nil.
+	stageStart = obs.beginStage()
 	externalCert, err := cfg.getCertFromAnyCertManager(ctx, hello, logger)
+	obs.endStage(HandshakeStageManagers, stageStart)
 	if err != nil {
 		return Certificate{}, err
 	}
 	if !externalCert.Empty() {
+		obs.setOutcome(HandshakeManagerServed)
 		return externalCert, nil
 	}
 
 	// Make sure a certificate is allowed for the given name. If not, it doesn't make sense
 	// to try loading one from storage (issue #185) or obtaining one from an issuer.
-	if err := cfg.checkIfCertShouldBeObtained(ctx, name, false); err != nil {
+	stageStart = obs.beginStage()
+	err = cfg.checkIfCertShouldBeObtained(ctx, name, false)
+	obs.endStage(HandshakeStageDecision, stageStart)
+	if err != nil {
+		obs.setOutcome(HandshakeDenied)
 		return Certificate{}, fmt.Errorf("certificate is not allowed for server name %s: %w", name, err)
 	}
 
@@ -368,22 +434,52 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 
 	if loadDynamically && loadOrObtainIfNecessary {
 		// Check to see if we have one on disk
+		stageStart = obs.beginStage()
 		loadedCert, err := cfg.loadCertFromStorage(ctx, logger, hello)
+		obs.endStage(HandshakeStageStorage, stageStart)
 		if err == nil {
+			obs.setOutcome(HandshakeLoadedFromStorage)
 			return loadedCert, nil
 		}
 		logger.Debug("did not load cert from storage",
 			zap.String("server_name", hello.ServerName),
 			zap.Error(err))
 		if cfg.OnDemand != nil {
-			// By this point, we need to ask the CA for a certificate
-			return cfg.obtainOnDemandCertificate(ctx, hello)
+			// By this point, we need to ask the CA for a certificate; if
+			// placeholders are enabled, don't hold up the handshake for it
+			if cfg.Placeholder != nil {
+				obtainCertWaitChansMu.Lock()
+				_, pending := obtainCertWaitChans[name]
+				obtainCertWaitChansMu.Unlock()
+				if !pending {
+					helloCopy := *hello
+					bgCtx := withoutHandshakeObservation(context.WithoutCancel(ctx))
+					go func() {
+						_, _ = cfg.obtainOnDemandCertificate(bgCtx, &helloCopy)
+					}()
+				}
+				placeholder, err := cfg.placeholderCertificate(hello, fmt.Errorf("certificate for %s is pending", name))
+				if err == nil {
+					obs.setOutcome(HandshakePlaceholder)
+				}
+				return placeholder, err
+			}
+			stageStart = obs.beginStage()
+			obtainedCert, err := cfg.obtainOnDemandCertificate(ctx, hello)
+			obs.endStage(HandshakeStageObtain, stageStart)
+			if err == nil {
+				obs.setOutcome(HandshakeObtainedOnDemand)
+			}
+			return obtainedCert, err
 		}
 		return loadedCert, nil
 	}
 
 	// Fall back to another certificate if there is one (either DefaultServerName or FallbackServerName)
 	if defaulted {
+		if obs != nil {
+			obs.setOutcome(cfg.defaultedOutcome(hello, cert))
+		}
 		logger.Debug("fell back to default certificate",
 			zap.Strings("subjects", cert.Names),
 			zap.Bool("managed", cert.managed),
@@ -401,7 +497,29 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 		zap.Bool("load_or_obtain_if_necessary", loadOrObtainIfNecessary),
 		zap.Bool("on_demand", cfg.OnDemand != nil))
 
-	return Certificate{}, fmt.Errorf("no certificate available for '%s'", name)
+	obs.setOutcome(HandshakeNoCertificate)
+	err = fmt.Errorf("no certificate available for '%s'", name)
+	if cfg.Placeholder != nil && (cfg.OnDemand != nil || cfg.Placeholder.isManaged(name)) {
+		// the name is managed, or allowed by the on-demand decision
+		// above, so it is just waiting for its certificate
+		err = placeholderEligibleError{err}
+	}
+	return Certificate{}, err
+}
+
+// defaultedOutcome returns whether cert, which was returned by
+// getCertificateFromCache as a default for hello, is the certificate
+// for the DefaultServerName or for the FallbackServerName.
+func (cfg *Config) defaultedOutcome(hello *tls.ClientHelloInfo, cert Certificate) HandshakeOutcome {
+	if normalizedName(hello.ServerName) == "" && cfg.DefaultServerName != "" {
+		normDefault := normalizedName(cfg.DefaultServerName)
+		for _, name := range cert.Names {
+			if MatchWildcard(normDefault, name) {
+				return HandshakeDefaultCertificate
+			}
+		}
+	}
+	return HandshakeFallbackCertificate
 }
 
 // loadCertFromStorage loads the certificate for name from storage and maintains it
@@ -468,6 +586,26 @@ func (cfg *Config) checkIfCertShouldBeObtained(ctx context.Context, name string,
 		return fmt.Errorf("subject name does not qualify for certificate: %s", name)
 	}
 	if cfg.OnDemand != nil {
+		// check for a backoff first, so that names which failed recently
+		// neither consult the ask endpoint nor use up rate limits
+		if cfg.OnDemand.FailureCache != nil {
+			if err := cfg.OnDemand.FailureCache.check(ctx, name); err != nil {
+				return err
+			}
+		}
+		if cfg.OnDemand.Policy != nil {
+			reason, cached, err := cfg.OnDemand.Policy.decide(ctx, name)
+			cfg.emit(ctx, "on_demand_decision", map[string]any{
+				"identifier": name,
+				"allowed":    err == nil,
+				"reason":     reason,
+				"cached":     cached,
+				"error":      err,
+			})
+			if err != nil {
+				return fmt.Errorf("on-demand policy: %w", err)
+			}
+		}
 		if cfg.OnDemand.DecisionFunc != nil {
 			if err := cfg.OnDemand.DecisionFunc(ctx, name); err != nil {
 				return fmt.Errorf("decision func: %w", err)
@@ -496,6 +634,15 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 		return Certificate{}, err
 	}
 
+	// don't hammer the CA (and storage) for names that failed recently;
+	// usually this was already checked, but not on every path to here
+	if cfg.OnDemand != nil && cfg.OnDemand.FailureCache != nil {
+		if err := cfg.OnDemand.FailureCache.check(ctx, name); err != nil {
+			log.Debug("not obtaining certificate", zap.String("server_name", name), zap.Error(err))
+			return Certificate{}, err
+		}
+	}
+
 	// We must protect this process from happening concurrently, so synchronize.
 	obtainCertWaitChansMu.Lock()
 	wait, ok := obtainCertWaitChans[name]
@@ -553,6 +700,15 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 			log.Error("loading newly-obtained certificate from storage", zap.String("server_name", name), zap.Error(err))
 		}
 	}
+	if cfg.OnDemand != nil && cfg.OnDemand.FailureCache != nil {
+		// the context may have timed out, which is itself a failure worth
+		// recording, but if it was cancelled, the client merely went away
+		if err != nil && !errors.Is(err, context.Canceled) {
+			cfg.OnDemand.FailureCache.recordFailure(context.WithoutCancel(ctx), name, err)
+		} else if err == nil {
+			cfg.OnDemand.FailureCache.recordSuccess(context.WithoutCancel(ctx), name)
+		}
+	}
 
 	// immediately unblock anyone waiting for it
 	unblockWaiters()
@@ -578,7 +734,7 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 			// Check if the certificate still exists on disk. If not, we need to obtain a new one.
 			// This can happen if the certificate was cleaned up by the storage cleaner, but still
 			// remains in the in-memory cache.
-			if !cfg.storageHasCertResourcesAnyIssuer(ctx, cert.Names[0]) {
+			if !cfg.storageHasCertResourcesAnyIssuer(ctx, cert.storageName()) {
 				logger.Debug("certificate not found on disk; obtaining new certificate")
 				return cfg.obtainOnDemandCertificate(ctx, hello)
 			}
@@ -683,8 +839,10 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 	revoked := currentCert.ocsp != nil && currentCert.ocsp.Status == ocsp.Revoked
 
 	// see if another goroutine is already working on this certificate
+	// (each key type variant of a certificate is renewed separately)
+	waitKey := variantStorageName(name, currentCert.keyType)
 	obtainCertWaitChansMu.Lock()
-	wait, ok := obtainCertWaitChans[name]
+	wait, ok := obtainCertWaitChans[waitKey]
 	if ok {
 		// lucky us -- another goroutine is already renewing the certificate
 		obtainCertWaitChansMu.Unlock()
@@ -723,13 +881,13 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 
 	// looks like it's up to us to do all the work and renew the cert
 	wait = make(chan struct{})
-	obtainCertWaitChans[name] = wait
+	obtainCertWaitChans[waitKey] = wait
 	obtainCertWaitChansMu.Unlock()
 
 	unblockWaiters := func() {
 		obtainCertWaitChansMu.Lock()
 		close(wait)
-		delete(obtainCertWaitChans, name)
+		delete(obtainCertWaitChans, waitKey)
 		obtainCertWaitChansMu.Unlock()
 	}
 
@@ -768,7 +926,7 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 		if revoked {
 			newCert, err = cfg.forceRenew(ctx, logger, currentCert)
 		} else {
-			err = cfg.RenewCertAsync(ctx, name, false)
+			err = cfg.renewCertKeyType(ctx, name, currentCert.keyType, false, false)
 			if err == nil {
 				// load from storage while in lock to make the replacement as atomic as possible
 				newCert, err = cfg.reloadManagedCertificate(ctx, currentCert)
@@ -135,7 +135,13 @@ func (am *ACMEIssuer) solveHTTPChallengeBlindly(w http.ResponseWriter, r *http.R
 	tokenStart := strings.LastIndex(r.URL.Path, "/") + 1
 	token := r.URL.Path[tokenStart:]
 	if allBase64URL(token) {
-		acct, err := am.getAccountToUse(r.Context(), am.CA) // assume production CA, I guess
+		// with an account pool, we can only guess the account if it
+		// was chosen by identifier (and the certificate has only one)
+		iss := am
+		if am.AccountPoolAssignment != AssignLeastLoadedAccount {
+			iss = am.assignAccount([]string{hostOnly(r.Host)})
+		}
+		acct, err := iss.getAccountToUse(r.Context(), am.CA) // assume production CA, I guess
 		if err != nil {
 			return fmt.Errorf("getting an account to use: %v", err)
 		}
@@ -0,0 +1,682 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// InternalIssuer issues certificates from a local certificate authority,
+// which is useful for names that public CAs will not issue certificates
+// for (see SubjectQualifiesForPublicCert), like internal names and
+// private IP addresses. The CA consists of a long-lived root and a
+// shorter-lived intermediate, both of which are created in storage as
+// needed (all instances sharing the storage share the CA). Leaf
+// certificates are short-lived, and the intermediate is rotated before
+// it expires. Clients must trust the root (see RootPEM) to trust the
+// certificates.
+//
+// Name constraints, if configured, are put on the intermediate and
+// enforced when issuing. If they change, the intermediate is rotated.
+type InternalIssuer struct {
+	// The name of the CA; CAs with different names are
+	// separate and stored separately. Default: "local".
+	CA string
+
+	// The common names of the root and intermediate.
+	// Defaults: "CertMagic Local Root CA" and
+	// "CertMagic Local Intermediate CA".
+	RootCommonName         string
+	IntermediateCommonName string
+
+	// How long the root, intermediate and leaf certificates
+	// are valid. Defaults: 10 years, 7 days, and 12 hours.
+	RootLifetime         time.Duration
+	IntermediateLifetime time.Duration
+	LeafLifetime         time.Duration
+
+	// Name constraints: if any permitted domains or IP ranges
+	// are set, names must fall within them; names must not
+	// fall within excluded ones. Domains include subdomains
+	// (and a leading "." means only subdomains), and IP
+	// ranges are in CIDR notation.
+	PermittedDNSDomains []string
+	ExcludedDNSDomains  []string
+	PermittedIPRanges   []string
+	ExcludedIPRanges    []string
+
+	// Where to store the CA. REQUIRED.
+	Storage Storage
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu           sync.Mutex
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	interKey     crypto.Signer
+}
+
+// IssuerKey returns the unique key of this issuer's CA.
+func (iss *InternalIssuer) IssuerKey() string {
+	return "internal-" + iss.caName()
+}
+
+// Issue issues a leaf certificate for csr, signed by the intermediate.
+func (iss *InternalIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, ErrNoRetry{fmt.Errorf("invalid CSR signature: %v", err)}
+	}
+	if err := iss.checkNameConstraints(csr); err != nil {
+		return nil, ErrNoRetry{err}
+	}
+
+	intermediate, interKey, err := iss.getIntermediate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:   serialNumber,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      now.Add(-time.Minute), // allow for some clock skew
+		NotAfter:       now.Add(iss.leafLifetime()),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if tmpl.NotAfter.After(intermediate.NotAfter) {
+		tmpl.NotAfter = intermediate.NotAfter
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, intermediate, csr.PublicKey, interKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+
+	iss.logger().Info("issued certificate",
+		zap.String("ca", iss.caName()),
+		zap.Strings("identifiers", namesFromCSR(csr)),
+		zap.String("serial", serialNumber.Text(16)),
+		zap.Time("expires", tmpl.NotAfter))
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+
+	return &IssuedCertificate{Certificate: chain}, nil
+}
+
+// Revoke records the revocation of cert, which must have been issued
+// by this CA. Revoked certificates are listed in the CRL until they
+// expire.
+func (iss *InternalIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
+	if err != nil {
+		return err
+	}
+	root, err := iss.Root(ctx)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	leaf := certs[0]
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   leaf.NotBefore.Add(time.Second), // expired certs can be revoked too
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate was not issued by internal CA %s: %v", iss.caName(), err)
+	}
+
+	lockKey := iss.lockKey()
+	if err := acquireLock(ctx, iss.Storage, lockKey); err != nil {
+		return err
+	}
+	defer func() {
+		if err := releaseLock(ctx, iss.Storage, lockKey); err != nil {
+			iss.logger().Error("unable to release lock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	revoked, err := iss.loadRevoked(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	revoked = slices.DeleteFunc(revoked, func(r InternalRevocation) bool {
+		return now.After(r.Expires) || r.SerialNumber.Cmp(leaf.SerialNumber) == 0
+	})
+	revoked = append(revoked, InternalRevocation{
+		SerialNumber: leaf.SerialNumber,
+		RevokedAt:    now.UTC(),
+		Reason:       reason,
+		Expires:      leaf.NotAfter,
+	})
+	revokedBytes, err := json.Marshal(revoked)
+	if err != nil {
+		return err
+	}
+	if err := iss.Storage.Store(ctx, iss.storageKey("revoked.json"), revokedBytes); err != nil {
+		return fmt.Errorf("storing revocation: %v", err)
+	}
+
+	iss.logger().Info("revoked certificate",
+		zap.String("ca", iss.caName()),
+		zap.Strings("identifiers", cert.SANs),
+		zap.String("serial", leaf.SerialNumber.Text(16)),
+		zap.Int("reason", reason))
+
+	return nil
+}
+
+// InternalRevocation describes a certificate revoked by an InternalIssuer.
+type InternalRevocation struct {
+	SerialNumber *big.Int  `json:"serial_number"`
+	RevokedAt    time.Time `json:"revoked_at"`
+	Reason       int       `json:"reason"`
+	Expires      time.Time `json:"expires"`
+}
+
+// Revocations returns the revoked certificates that have not expired.
+func (iss *InternalIssuer) Revocations(ctx context.Context) ([]InternalRevocation, error) {
+	revoked, err := iss.loadRevoked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return slices.DeleteFunc(revoked, func(r InternalRevocation) bool { return now.After(r.Expires) }), nil
+}
+
+// CRL returns a DER-encoded certificate revocation list of the
+// revoked certificates that have not expired, signed by the current
+// intermediate and valid for the given duration.
+func (iss *InternalIssuer) CRL(ctx context.Context, validFor time.Duration) ([]byte, error) {
+	revoked, err := iss.Revocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, interKey, err := iss.getIntermediate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, r := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   r.SerialNumber,
+			RevocationTime: r.RevokedAt,
+			ReasonCode:     r.Reason,
+		})
+	}
+	now := time.Now()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validFor),
+		RevokedCertificateEntries: entries,
+	}, intermediate, interKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating CRL: %v", err)
+	}
+	return crl, nil
+}
+
+// Root returns the root certificate of the CA, creating the CA if needed.
+func (iss *InternalIssuer) Root(ctx context.Context) (*x509.Certificate, error) {
+	iss.mu.Lock()
+	root := iss.root
+	iss.mu.Unlock()
+	if root != nil {
+		return root, nil
+	}
+	if _, _, err := iss.getIntermediate(ctx); err != nil {
+		return nil, err
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	return iss.root, nil
+}
+
+// RootPEM returns the PEM-encoded root certificate of the CA, creating
+// the CA if needed, for installing into trust stores.
+func (iss *InternalIssuer) RootPEM(ctx context.Context) ([]byte, error) {
+	root, err := iss.Root(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), nil
+}
+
+// RotateIntermediate replaces the intermediate with a new one,
+// regardless of when it expires.
+func (iss *InternalIssuer) RotateIntermediate(ctx context.Context) error {
+	_, _, err := iss.loadOrCreate(ctx, true)
+	return err
+}
+
+// getIntermediate returns the intermediate certificate and key
+// to issue with, loading, creating or rotating them if needed.
+func (iss *InternalIssuer) getIntermediate(ctx context.Context) (*x509.Certificate, crypto.Signer, error) {
+	iss.mu.Lock()
+	intermediate, interKey := iss.intermediate, iss.interKey
+	iss.mu.Unlock()
+	if intermediate != nil && !iss.intermediateNeedsRotation(intermediate) {
+		return intermediate, interKey, nil
+	}
+	return iss.loadOrCreate(ctx, false)
+}
+
+// loadOrCreate loads the CA from storage, creating the root and the
+// intermediate if they do not exist, and rotating the intermediate if
+// it needs to be (or if force is true). It returns the intermediate
+// and its key.
+func (iss *InternalIssuer) loadOrCreate(ctx context.Context, force bool) (*x509.Certificate, crypto.Signer, error) {
+	if iss.Storage == nil {
+		return nil, nil, fmt.Errorf("internal CA %s: no storage configured", iss.caName())
+	}
+
+	lockKey := iss.lockKey()
+	if err := acquireLock(ctx, iss.Storage, lockKey); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := releaseLock(ctx, iss.Storage, lockKey); err != nil {
+			iss.logger().Error("unable to release lock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	root, rootKey, err := iss.loadOrCreateRoot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	intermediate, interKey, err := iss.loadKeyPair(ctx, "intermediate.pem")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err != nil || force || iss.intermediateNeedsRotation(intermediate) {
+		intermediate, interKey, err = iss.createIntermediate(ctx, root, rootKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	iss.mu.Lock()
+	iss.root, iss.intermediate, iss.interKey = root, intermediate, interKey
+	iss.mu.Unlock()
+
+	return intermediate, interKey, nil
+}
+
+// loadOrCreateRoot loads the root certificate and key
+// from storage, or creates them if they do not exist.
+func (iss *InternalIssuer) loadOrCreateRoot(ctx context.Context) (*x509.Certificate, crypto.Signer, error) {
+	root, rootKey, err := iss.loadKeyPair(ctx, "root.pem")
+	if err == nil {
+		return root, rootKey, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	rootKey, err = generateInternalCAKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	rootLifetime := iss.RootLifetime
+	if rootLifetime <= 0 {
+		rootLifetime = defaultInternalRootLifetime
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: iss.commonName(iss.RootCommonName, "Root")},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(rootLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	root, err = iss.createAndStore(ctx, "root.pem", tmpl, nil, rootKey, rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iss.logger().Info("created internal root CA",
+		zap.String("ca", iss.caName()),
+		zap.String("common_name", root.Subject.CommonName),
+		zap.Time("expires", root.NotAfter))
+
+	return root, rootKey, nil
+}
+
+// createIntermediate creates a new intermediate signed by root.
+func (iss *InternalIssuer) createIntermediate(ctx context.Context, root *x509.Certificate, rootKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	interKey, err := generateInternalCAKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	permittedIPs, err := parseCIDRs(iss.PermittedIPRanges)
+	if err != nil {
+		return nil, nil, err
+	}
+	excludedIPs, err := parseCIDRs(iss.ExcludedIPRanges)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: iss.commonName(iss.IntermediateCommonName, "Intermediate")},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(iss.intermediateLifetime()),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		PermittedDNSDomains:   iss.PermittedDNSDomains,
+		ExcludedDNSDomains:    iss.ExcludedDNSDomains,
+		PermittedIPRanges:     permittedIPs,
+		ExcludedIPRanges:      excludedIPs,
+	}
+	tmpl.PermittedDNSDomainsCritical = len(tmpl.PermittedDNSDomains) > 0 || len(tmpl.PermittedIPRanges) > 0
+	if tmpl.NotAfter.After(root.NotAfter) {
+		tmpl.NotAfter = root.NotAfter
+	}
+
+	intermediate, err := iss.createAndStore(ctx, "intermediate.pem", tmpl, root, interKey, rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iss.logger().Info("created internal intermediate CA",
+		zap.String("ca", iss.caName()),
+		zap.String("common_name", intermediate.Subject.CommonName),
+		zap.Time("expires", intermediate.NotAfter))
+
+	return intermediate, interKey, nil
+}
+
+// createAndStore creates a certificate from tmpl for key, signed by
+// parent with parentKey (if parent is nil, it is self-signed), and
+// stores it together with key under name.
+func (iss *InternalIssuer) createAndStore(ctx context.Context, name string, tmpl, parent *x509.Certificate, key, parentKey crypto.Signer) (*x509.Certificate, error) {
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %v", name, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// store the certificate and its key together so they can't get out of sync
+	pair := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pair = append(pair, keyPEM...)
+	if err := iss.Storage.Store(ctx, iss.storageKey(name), pair); err != nil {
+		return nil, fmt.Errorf("storing %s: %v", name, err)
+	}
+
+	return cert, nil
+}
+
+// loadKeyPair loads a certificate and its key stored under name.
+func (iss *InternalIssuer) loadKeyPair(ctx context.Context, name string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := iss.Storage.Load(ctx, iss.storageKey(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, rest := pem.Decode(pair)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%s: no certificate found", name)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	key, err := PEMDecodePrivateKey(bytes.TrimSpace(rest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return cert, key, nil
+}
+
+// loadRevoked loads the list of revocations from storage.
+func (iss *InternalIssuer) loadRevoked(ctx context.Context) ([]InternalRevocation, error) {
+	if iss.Storage == nil {
+		return nil, fmt.Errorf("internal CA %s: no storage configured", iss.caName())
+	}
+	revokedBytes, err := iss.Storage.Load(ctx, iss.storageKey("revoked.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var revoked []InternalRevocation
+	if err := json.Unmarshal(revokedBytes, &revoked); err != nil {
+		return nil, fmt.Errorf("decoding revocations: %v", err)
+	}
+	return revoked, nil
+}
+
+// intermediateNeedsRotation returns true if the intermediate is in the
+// last third of its lifetime, if it would cut the lifetime of new leaf
+// certificates short, or if its name constraints are outdated.
+func (iss *InternalIssuer) intermediateNeedsRotation(intermediate *x509.Certificate) bool {
+	remaining := time.Until(intermediate.NotAfter)
+	lifetime := intermediate.NotAfter.Sub(intermediate.NotBefore)
+	if remaining < lifetime/3 || remaining < iss.leafLifetime() {
+		return true
+	}
+	return !slices.Equal(intermediate.PermittedDNSDomains, iss.PermittedDNSDomains) ||
+		!slices.Equal(intermediate.ExcludedDNSDomains, iss.ExcludedDNSDomains) ||
+		!equalCIDRs(intermediate.PermittedIPRanges, iss.PermittedIPRanges) ||
+		!equalCIDRs(intermediate.ExcludedIPRanges, iss.ExcludedIPRanges)
+}
+
+// checkNameConstraints returns an error if any DNS name or IP
+// address of csr is not allowed by the name constraints.
+func (iss *InternalIssuer) checkNameConstraints(csr *x509.CertificateRequest) error {
+	for _, name := range csr.DNSNames {
+		name = strings.TrimPrefix(name, "*.")
+		if len(iss.PermittedDNSDomains) > 0 && !slices.ContainsFunc(iss.PermittedDNSDomains, func(c string) bool { return matchDomainConstraint(name, c) }) {
+			return fmt.Errorf("%s is not within the permitted domains of internal CA %s", name, iss.caName())
+		}
+		if slices.ContainsFunc(iss.ExcludedDNSDomains, func(c string) bool { return matchDomainConstraint(name, c) }) {
+			return fmt.Errorf("%s is within the excluded domains of internal CA %s", name, iss.caName())
+		}
+	}
+	permittedIPs, err := parseCIDRs(iss.PermittedIPRanges)
+	if err != nil {
+		return err
+	}
+	excludedIPs, err := parseCIDRs(iss.ExcludedIPRanges)
+	if err != nil {
+		return err
+	}
+	for _, ip := range csr.IPAddresses {
+		if len(permittedIPs) > 0 && !slices.ContainsFunc(permittedIPs, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return fmt.Errorf("%s is not within the permitted IP ranges of internal CA %s", ip, iss.caName())
+		}
+		if slices.ContainsFunc(excludedIPs, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return fmt.Errorf("%s is within the excluded IP ranges of internal CA %s", ip, iss.caName())
+		}
+	}
+	return nil
+}
+
+func (iss *InternalIssuer) caName() string {
+	if iss.CA == "" {
+		return defaultInternalCAName
+	}
+	return iss.CA
+}
+
+func (iss *InternalIssuer) commonName(configured, kind string) string {
+	if configured != "" {
+		return configured
+	}
+	return "CertMagic " + strings.ToUpper(iss.caName()[:1]) + iss.caName()[1:] + " " + kind + " CA"
+}
+
+func (iss *InternalIssuer) intermediateLifetime() time.Duration {
+	if iss.IntermediateLifetime > 0 {
+		return iss.IntermediateLifetime
+	}
+	return defaultInternalIntermediateLifetime
+}
+
+func (iss *InternalIssuer) leafLifetime() time.Duration {
+	if iss.LeafLifetime > 0 {
+		return iss.LeafLifetime
+	}
+	return defaultInternalLeafLifetime
+}
+
+func (iss *InternalIssuer) storageKey(name string) string {
+	return path.Join(prefixInternalCA, StorageKeys.Safe(iss.caName()), name)
+}
+
+func (iss *InternalIssuer) lockKey() string {
+	return "internal_ca_" + StorageKeys.Safe(iss.caName())
+}
+
+func (iss *InternalIssuer) logger() *zap.Logger {
+	if iss.Logger == nil {
+		return zap.NewNop()
+	}
+	return iss.Logger
+}
+
+// matchDomainConstraint returns true if name is within the domain
+// constraint, with the semantics of RFC 5280 section 4.2.1.10.
+func matchDomainConstraint(name, constraint string) bool {
+	name, constraint = strings.ToLower(name), strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// parseCIDRs parses IP ranges in CIDR notation.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %v", cidr, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// equalCIDRs returns true if ipNets are the IP ranges of cidrs.
+func equalCIDRs(ipNets []*net.IPNet, cidrs []string) bool {
+	parsed, err := parseCIDRs(cidrs)
+	if err != nil || len(parsed) != len(ipNets) {
+		return false
+	}
+	for i := range parsed {
+		if parsed[i].String() != ipNets[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+func generateInternalCAKey() (crypto.Signer, error) {
+	key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("generating CA key: %v", err)
+	}
+	return key.(crypto.Signer), nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %v", err)
+	}
+	return serialNumber, nil
+}
+
+const (
+	prefixInternalCA      = "internal_ca"
+	defaultInternalCAName = "local"
+
+	defaultInternalRootLifetime         = 10 * 365 * 24 * time.Hour
+	defaultInternalIntermediateLifetime = 7 * 24 * time.Hour
+	defaultInternalLeafLifetime         = 12 * time.Hour
+)
+
+// Interface guards
+var (
+	_ Issuer  = (*InternalIssuer)(nil)
+	_ Revoker = (*InternalIssuer)(nil)
+)
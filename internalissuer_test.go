@@ -0,0 +1,217 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInternalIssuer(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	iss := &InternalIssuer{
+		Storage:             storage,
+		PermittedDNSDomains: []string{"internal"},
+		PermittedIPRanges:   []string{"10.0.0.0/8"},
+		Logger:              defaultTestLogger,
+	}
+
+	issued, err := iss.Issue(ctx, makeInternalTestCSR(t, []string{"app.internal"}, []net.IP{net.ParseIP("10.1.2.3")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("Expected leaf and intermediate, got %d certificates", len(certs))
+	}
+	leaf := certs[0]
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > defaultInternalLeafLifetime+time.Minute {
+		t.Errorf("Expected short-lived leaf, got lifetime %s", lifetime)
+	}
+
+	// the chain verifies against the exported root
+	rootPEM, err := iss.RootPEM(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootPEM) {
+		t.Fatal("Expected exported root to be PEM-encoded")
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	for _, name := range []string{"app.internal", "10.1.2.3"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates}); err != nil {
+			t.Errorf("Expected certificate to verify for %s: %v", name, err)
+		}
+	}
+
+	// names outside the constraints are rejected
+	for _, csr := range []*x509.CertificateRequest{
+		makeInternalTestCSR(t, []string{"example.com"}, nil),
+		makeInternalTestCSR(t, nil, []net.IP{net.ParseIP("192.168.1.1")}),
+	} {
+		_, err := iss.Issue(ctx, csr)
+		var noRetry ErrNoRetry
+		if !errors.As(err, &noRetry) {
+			t.Errorf("Expected name constraint violation for %v %v, got: %v", csr.DNSNames, csr.IPAddresses, err)
+		}
+	}
+
+	// another instance sharing the storage uses the same CA
+	other := &InternalIssuer{Storage: storage, PermittedDNSDomains: []string{"internal"}, PermittedIPRanges: []string{"10.0.0.0/8"}}
+	otherRootPEM, err := other.RootPEM(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(otherRootPEM) != string(rootPEM) {
+		t.Error("Expected instances sharing storage to have the same root")
+	}
+	otherIntermediate, _, err := other.getIntermediate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !otherIntermediate.Equal(certs[1]) {
+		t.Error("Expected instances sharing storage to have the same intermediate")
+	}
+
+	// revoked certificates appear in the CRL
+	if err := iss.Revoke(ctx, CertificateResource{SANs: []string{"app.internal"}, CertificatePEM: issued.Certificate}, 1); err != nil {
+		t.Fatal(err)
+	}
+	crlDER, err := other.CRL(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(otherIntermediate); err != nil {
+		t.Errorf("Expected CRL to be signed by intermediate: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Errorf("Expected revoked certificate in CRL, got: %+v", crl.RevokedCertificateEntries)
+	}
+
+	// certificates from other CAs can't be revoked
+	foreign := &InternalIssuer{CA: "foreign", Storage: storage}
+	foreignIssued, err := foreign.Issue(ctx, makeInternalTestCSR(t, []string{"app.internal"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iss.Revoke(ctx, CertificateResource{CertificatePEM: foreignIssued.Certificate}, 0); err == nil {
+		t.Error("Expected error revoking certificate from another CA")
+	}
+}
+
+func TestInternalIssuerRotation(t *testing.T) {
+	ctx := context.Background()
+	iss := &InternalIssuer{
+		Storage:              &FileStorage{Path: t.TempDir()},
+		IntermediateLifetime: 3 * time.Hour,
+		LeafLifetime:         time.Hour,
+	}
+
+	first, _, err := iss.getIntermediate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iss.intermediateNeedsRotation(first) {
+		t.Fatal("Expected new intermediate to not need rotation")
+	}
+	again, _, err := iss.getIntermediate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(first) {
+		t.Error("Expected intermediate to be reused")
+	}
+
+	// an intermediate that can't cover a full leaf lifetime is rotated
+	iss.LeafLifetime = 4 * time.Hour
+	if !iss.intermediateNeedsRotation(first) {
+		t.Error("Expected intermediate to need rotation")
+	}
+	rotated, _, err := iss.getIntermediate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Equal(first) {
+		t.Error("Expected intermediate to be rotated")
+	}
+
+	// changed name constraints rotate the intermediate too
+	iss.LeafLifetime = time.Hour
+	iss.ExcludedDNSDomains = []string{"secret.internal"}
+	constrained, _, err := iss.getIntermediate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(constrained.ExcludedDNSDomains) != 1 || constrained.ExcludedDNSDomains[0] != "secret.internal" {
+		t.Errorf("Expected rotated intermediate to have new constraints, got: %v", constrained.ExcludedDNSDomains)
+	}
+	root, err := iss.Root(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := constrained.CheckSignatureFrom(root); err != nil {
+		t.Errorf("Expected rotated intermediate to be signed by the same root: %v", err)
+	}
+}
+
+func TestMatchDomainConstraint(t *testing.T) {
+	for i, tc := range []struct {
+		name, constraint string
+		expect           bool
+	}{
+		{"example.internal", "example.internal", true},
+		{"sub.example.internal", "example.internal", true},
+		{"Sub.Example.Internal", "example.internal", true},
+		{"badexample.internal", "example.internal", false},
+		{"example.internal", ".example.internal", false},
+		{"sub.example.internal", ".example.internal", true},
+	} {
+		if actual := matchDomainConstraint(tc.name, tc.constraint); actual != tc.expect {
+			t.Errorf("Test %d: Expected %t for %s in %s, got %t", i, tc.expect, tc.name, tc.constraint, actual)
+		}
+	}
+}
+
+func makeInternalTestCSR(t *testing.T, dnsNames []string, ips []net.IP) *x509.CertificateRequest {
+	t.Helper()
+	key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: dnsNames, IPAddresses: ips}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
@@ -0,0 +1,587 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// IssuerHealth tracks how well each issuer (by IssuerKey) has been
+// doing at issuing certificates: how often it succeeds, and which
+// classes of errors it fails with. It acts as a circuit breaker:
+// after FailureThreshold consecutive failures, the circuit of an
+// issuer opens and, while the UseHealthiestIssuer policy is in
+// effect, the issuer is skipped for a cool-down period. Once the
+// cool-down elapses, the issuer is tried again; if that fails too,
+// the circuit reopens with twice the cool-down, up to MaxCoolDown.
+// A success closes the circuit.
+//
+// Failures that are specific to the names being issued for, such as
+// failed challenges or rejected identifiers, are recorded but do
+// not count towards opening the circuit.
+//
+// If Storage is set, health is persisted there so that all instances
+// in a cluster share it, and updates are made under a storage lock.
+// Health is only recorded for Configs that have an IssuerHealth,
+// regardless of their IssuerPolicy, so it can be used for monitoring
+// alone.
+type IssuerHealth struct {
+	// How many consecutive failures open the circuit. Default: 3.
+	FailureThreshold int
+
+	// How long the circuit stays open at first. Default: 5 minutes.
+	CoolDown time.Duration
+
+	// The maximum time the circuit stays open. Default: 1 hour.
+	MaxCoolDown time.Duration
+
+	// If set, health is persisted to this storage.
+	Storage Storage
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu       sync.Mutex
+	statuses map[string]IssuerHealthStatus
+	loaded   map[string]time.Time   // when each status was last loaded from storage
+	updating map[string]*sync.Mutex // serializes updates of each status
+}
+
+// IssuerHealthStatus describes the health of an issuer.
+type IssuerHealthStatus struct {
+	// The key of the issuer (see Issuer.IssuerKey).
+	IssuerKey string `json:"issuer_key"`
+
+	// Total number of successful and failed issuances.
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+
+	// Number of failures by error class.
+	Errors map[IssuerErrorClass]uint64 `json:"errors,omitempty"`
+
+	// Outcomes of the most recent issuances, oldest
+	// first; true means success.
+	Recent []bool `json:"recent,omitempty"`
+
+	// Failures in a row that count towards opening the circuit.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+
+	// When the last success and failure happened.
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastFailure time.Time `json:"last_failure,omitzero"`
+
+	// The error of the last failure.
+	LastError string `json:"last_error,omitempty"`
+
+	// If the circuit is open (or half-open, if this is in
+	// the past), the issuer is skipped until this time.
+	OpenUntil time.Time `json:"open_until,omitzero"`
+
+	// The cool-down the circuit was last opened with.
+	CoolDown time.Duration `json:"cool_down,omitempty"`
+}
+
+// SuccessRate returns the fraction of recent issuances
+// that succeeded, or 1 if there are none.
+func (s IssuerHealthStatus) SuccessRate() float64 {
+	if len(s.Recent) == 0 {
+		return 1
+	}
+	var successes int
+	for _, ok := range s.Recent {
+		if ok {
+			successes++
+		}
+	}
+	return float64(successes) / float64(len(s.Recent))
+}
+
+// CircuitOpen returns true if the issuer is to be skipped at now.
+func (s IssuerHealthStatus) CircuitOpen(now time.Time) bool {
+	return now.Before(s.OpenUntil)
+}
+
+// IssuerErrorClass classifies errors returned by issuers.
+type IssuerErrorClass string
+
+// Issuer error classes.
+const (
+	// The issuer is rate limiting us.
+	IssuerErrorRateLimited IssuerErrorClass = "rate_limited"
+
+	// The issuer rejected our credentials or account.
+	IssuerErrorUnauthorized IssuerErrorClass = "unauthorized"
+
+	// The issuer could not be reached.
+	IssuerErrorNetwork IssuerErrorClass = "network"
+
+	// The issuer had an internal error.
+	IssuerErrorServer IssuerErrorClass = "server"
+
+	// The issuer refused the particular names or CSR, for
+	// example because a challenge failed. This does not
+	// count towards opening the circuit.
+	IssuerErrorRejected IssuerErrorClass = "rejected"
+
+	// Any other error.
+	IssuerErrorOther IssuerErrorClass = "other"
+)
+
+// ClassifyIssuerError returns the class of err, which was returned
+// by an issuer. It returns an empty class if err is nil, if the
+// operation was canceled, or if the issuer was not asked because
+// of a known CA rate limit, which say nothing about the issuer.
+func ClassifyIssuerError(err error) IssuerErrorClass {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errRateLimitedByCA) {
+		return ""
+	}
+
+	var problem acme.Problem
+	if errors.As(err, &problem) {
+		// challenge failures carry the authorization they belong to
+		if _, ok := problem.Resource.(acme.Authorization); ok {
+			return IssuerErrorRejected
+		}
+		switch problem.Type {
+		case acme.ProblemTypeRateLimited:
+			return IssuerErrorRateLimited
+		case acme.ProblemTypeUnauthorized,
+			acme.ProblemTypeAccountDoesNotExist,
+			acme.ProblemTypeExternalAccountRequired,
+			acme.ProblemTypeUserActionRequired:
+			return IssuerErrorUnauthorized
+		case acme.ProblemTypeServerInternal:
+			return IssuerErrorServer
+		case acme.ProblemTypeBadCSR,
+			acme.ProblemTypeCAA,
+			acme.ProblemTypeConnection,
+			acme.ProblemTypeDNS,
+			acme.ProblemTypeIncorrectResponse,
+			acme.ProblemTypeRejectedIdentifier,
+			acme.ProblemTypeTLS,
+			acme.ProblemTypeUnsupportedIdentifier:
+			return IssuerErrorRejected
+		}
+		switch {
+		case problem.Status == http.StatusTooManyRequests:
+			return IssuerErrorRateLimited
+		case problem.Status == http.StatusUnauthorized, problem.Status == http.StatusForbidden:
+			return IssuerErrorUnauthorized
+		case problem.Status >= http.StatusInternalServerError:
+			return IssuerErrorServer
+		}
+		return IssuerErrorOther
+	}
+
+	if errors.As(err, new(ErrNoRetry)) {
+		return IssuerErrorRejected
+	}
+
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return IssuerErrorNetwork
+	}
+
+	return IssuerErrorOther
+}
+
+// Status returns the health of the issuer with the given key
+// as last seen by this instance.
+func (h *IssuerHealth) Status(issuerKey string) IssuerHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, ok := h.statuses[issuerKey]
+	if !ok {
+		return IssuerHealthStatus{IssuerKey: issuerKey}
+	}
+	return status.clone()
+}
+
+// Statuses returns the health of all issuers seen by this
+// instance, sorted by issuer key.
+func (h *IssuerHealth) Statuses() []IssuerHealthStatus {
+	h.mu.Lock()
+	list := make([]IssuerHealthStatus, 0, len(h.statuses))
+	for _, status := range h.statuses {
+		list = append(list, status.clone())
+	}
+	h.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].IssuerKey < list[j].IssuerKey })
+	return list
+}
+
+// Reset closes the circuit of the issuer with the given key,
+// allowing it to be used again immediately. Its counters are
+// kept.
+func (h *IssuerHealth) Reset(ctx context.Context, issuerKey string) error {
+	unlock, err := h.lock(ctx, issuerKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := h.load(ctx, issuerKey)
+	if err != nil {
+		return err
+	}
+	status.ConsecutiveFailures = 0
+	status.OpenUntil = time.Time{}
+	status.CoolDown = 0
+	h.set(status)
+	return h.store(ctx, status)
+}
+
+// ServeHTTP serves the health of all issuers as JSON.
+func (h *IssuerHealth) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	type issuerHealthJSON struct {
+		IssuerHealthStatus
+		SuccessRate float64 `json:"success_rate"`
+		CircuitOpen bool    `json:"circuit_open"`
+	}
+	now := time.Now()
+	statuses := h.Statuses()
+	list := make([]issuerHealthJSON, 0, len(statuses))
+	for _, status := range statuses {
+		list = append(list, issuerHealthJSON{
+			IssuerHealthStatus: status,
+			SuccessRate:        status.SuccessRate(),
+			CircuitOpen:        status.CircuitOpen(now),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// order returns the issuers that should be tried, in order: those
+// whose circuit is closed (or half-open), in their configured order.
+// If every circuit is open, only the issuer whose cool-down ends
+// first is returned, so that issuance is not refused outright.
+func (h *IssuerHealth) order(ctx context.Context, issuers []Issuer) []Issuer {
+	now := time.Now()
+	available := make([]Issuer, 0, len(issuers))
+	var next Issuer
+	var nextOpenUntil time.Time
+	for _, issuer := range issuers {
+		status := h.refresh(ctx, issuer.IssuerKey())
+		if !status.CircuitOpen(now) {
+			available = append(available, issuer)
+			continue
+		}
+		h.logger().Debug("skipping issuer with open circuit",
+			zap.String("issuer", issuer.IssuerKey()),
+			zap.Time("open_until", status.OpenUntil))
+		if next == nil || status.OpenUntil.Before(nextOpenUntil) {
+			next, nextOpenUntil = issuer, status.OpenUntil
+		}
+	}
+	if len(available) == 0 && next != nil {
+		return []Issuer{next}
+	}
+	return available
+}
+
+// record records the result of an issuance by the issuer with the
+// given key, where err is the error returned by the issuer (nil if
+// it succeeded). It returns the updated status, and whether the
+// circuit was opened or closed as a result.
+func (h *IssuerHealth) record(ctx context.Context, issuerKey string, err error) (status IssuerHealthStatus, opened, closed bool) {
+	class := ClassifyIssuerError(err)
+	if err != nil && class == "" {
+		return h.Status(issuerKey), false, false
+	}
+
+	unlock, lockErr := h.lock(ctx, issuerKey)
+	if lockErr != nil {
+		// health is only advisory, so record it anyway
+		h.logger().Error("locking issuer health", zap.String("issuer", issuerKey), zap.Error(lockErr))
+	} else {
+		defer unlock()
+	}
+
+	status, loadErr := h.load(ctx, issuerKey)
+	if loadErr != nil {
+		h.logger().Error("loading issuer health", zap.String("issuer", issuerKey), zap.Error(loadErr))
+	}
+
+	now := time.Now()
+	wasOpen := !status.OpenUntil.IsZero()
+	status.Recent = append(status.Recent, err == nil)
+	if len(status.Recent) > issuerHealthWindow {
+		status.Recent = status.Recent[len(status.Recent)-issuerHealthWindow:]
+	}
+
+	if err == nil {
+		status.Successes++
+		status.LastSuccess = now
+		status.ConsecutiveFailures = 0
+		status.OpenUntil = time.Time{}
+		status.CoolDown = 0
+		closed = wasOpen
+	} else {
+		status.Failures++
+		status.LastFailure = now
+		status.LastError = err.Error()
+		if status.Errors == nil {
+			status.Errors = make(map[IssuerErrorClass]uint64)
+		}
+		status.Errors[class]++
+		if class != IssuerErrorRejected {
+			status.ConsecutiveFailures++
+			if wasOpen || status.ConsecutiveFailures >= h.failureThreshold() {
+				opened = !status.CircuitOpen(now)
+				status.CoolDown = h.nextCoolDown(status.CoolDown)
+				status.OpenUntil = now.Add(status.CoolDown)
+			}
+		}
+	}
+
+	h.set(status)
+	if err := h.store(ctx, status); err != nil {
+		h.logger().Error("storing issuer health", zap.String("issuer", issuerKey), zap.Error(err))
+	}
+
+	if opened {
+		h.logger().Warn("issuer failing; opened circuit",
+			zap.String("issuer", issuerKey),
+			zap.Int("consecutive_failures", status.ConsecutiveFailures),
+			zap.String("error_class", string(class)),
+			zap.Time("open_until", status.OpenUntil))
+	} else if closed {
+		h.logger().Info("issuer recovered; closed circuit", zap.String("issuer", issuerKey))
+	}
+
+	return status.clone(), opened, closed
+}
+
+// lock serializes updates of the status of the issuer with the
+// given key: within this process, and if Storage is set, across all
+// instances sharing it. The returned function releases the lock.
+func (h *IssuerHealth) lock(ctx context.Context, issuerKey string) (func(), error) {
+	h.mu.Lock()
+	if h.updating == nil {
+		h.updating = make(map[string]*sync.Mutex)
+	}
+	mu, ok := h.updating[issuerKey]
+	if !ok {
+		mu = new(sync.Mutex)
+		h.updating[issuerKey] = mu
+	}
+	h.mu.Unlock()
+
+	mu.Lock()
+	if h.Storage == nil {
+		return mu.Unlock, nil
+	}
+	lockKey := issuerHealthLockKey(issuerKey)
+	if err := acquireLock(ctx, h.Storage, lockKey); err != nil {
+		mu.Unlock()
+		return nil, fmt.Errorf("acquiring issuer health lock: %v", err)
+	}
+	return func() {
+		if err := releaseLock(ctx, h.Storage, lockKey); err != nil {
+			h.logger().Error("unable to release issuer health lock",
+				zap.String("issuer", issuerKey),
+				zap.Error(err))
+		}
+		mu.Unlock()
+	}, nil
+}
+
+// refresh returns the status of the issuer with the given key,
+// reloading it from storage if it was not loaded recently.
+func (h *IssuerHealth) refresh(ctx context.Context, issuerKey string) IssuerHealthStatus {
+	h.mu.Lock()
+	status, ok := h.statuses[issuerKey]
+	fresh := ok && time.Since(h.loaded[issuerKey]) < issuerHealthRefreshInterval
+	h.mu.Unlock()
+	if h.Storage == nil || fresh {
+		if !ok {
+			status.IssuerKey = issuerKey
+		}
+		return status
+	}
+	status, err := h.load(ctx, issuerKey)
+	if err != nil {
+		h.logger().Error("loading issuer health", zap.String("issuer", issuerKey), zap.Error(err))
+	}
+	h.set(status)
+	return status
+}
+
+// load returns the status of the issuer with the given key from
+// storage if Storage is set, otherwise from memory.
+func (h *IssuerHealth) load(ctx context.Context, issuerKey string) (IssuerHealthStatus, error) {
+	status := h.Status(issuerKey)
+	if h.Storage == nil {
+		return status, nil
+	}
+	statusBytes, err := h.Storage.Load(ctx, issuerHealthStorageKey(issuerKey))
+	if errors.Is(err, fs.ErrNotExist) {
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("loading issuer health: %v", err)
+	}
+	var stored IssuerHealthStatus
+	if err := json.Unmarshal(statusBytes, &stored); err != nil {
+		return status, fmt.Errorf("decoding issuer health: %v", err)
+	}
+	stored.IssuerKey = issuerKey
+	return stored, nil
+}
+
+// set stores status in memory.
+func (h *IssuerHealth) set(status IssuerHealthStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.statuses == nil {
+		h.statuses = make(map[string]IssuerHealthStatus)
+		h.loaded = make(map[string]time.Time)
+	}
+	h.statuses[status.IssuerKey] = status.clone()
+	h.loaded[status.IssuerKey] = time.Now()
+}
+
+// store persists status if Storage is set.
+func (h *IssuerHealth) store(ctx context.Context, status IssuerHealthStatus) error {
+	if h.Storage == nil {
+		return nil
+	}
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("encoding issuer health: %v", err)
+	}
+	return h.Storage.Store(ctx, issuerHealthStorageKey(status.IssuerKey), statusBytes)
+}
+
+func (h *IssuerHealth) failureThreshold() int {
+	if h.FailureThreshold <= 0 {
+		return defaultIssuerFailureThreshold
+	}
+	return h.FailureThreshold
+}
+
+// nextCoolDown returns the cool-down to open the circuit
+// with, given the one it was last opened with (if any).
+func (h *IssuerHealth) nextCoolDown(last time.Duration) time.Duration {
+	initial, maximum := h.CoolDown, h.MaxCoolDown
+	if initial <= 0 {
+		initial = defaultIssuerCoolDown
+	}
+	if maximum <= 0 {
+		maximum = defaultIssuerMaxCoolDown
+	}
+	if last <= 0 {
+		return min(initial, maximum)
+	}
+	return min(2*last, maximum)
+}
+
+func (h *IssuerHealth) logger() *zap.Logger {
+	if h.Logger == nil {
+		return zap.NewNop()
+	}
+	return h.Logger
+}
+
+// clone returns a copy of s that shares no memory with s.
+func (s IssuerHealthStatus) clone() IssuerHealthStatus {
+	if s.Errors != nil {
+		errs := make(map[IssuerErrorClass]uint64, len(s.Errors))
+		for class, n := range s.Errors {
+			errs[class] = n
+		}
+		s.Errors = errs
+	}
+	s.Recent = append([]bool(nil), s.Recent...)
+	return s
+}
+
+// healthyIssuers returns the issuers to try, in order, according
+// to the issuer policy of cfg and the health of the issuers.
+func (cfg *Config) healthyIssuers(ctx context.Context, issuers []Issuer) []Issuer {
+	if cfg.IssuerPolicy != UseHealthiestIssuer || cfg.IssuerHealth == nil {
+		return issuers
+	}
+	return cfg.IssuerHealth.order(ctx, issuers)
+}
+
+// recordIssuerResult records the result of an issuance by issuer,
+// where err is the error it returned, if cfg tracks issuer health.
+func (cfg *Config) recordIssuerResult(ctx context.Context, issuer Issuer, err error) {
+	if cfg.IssuerHealth == nil {
+		return
+	}
+	status, opened, closed := cfg.IssuerHealth.record(ctx, issuer.IssuerKey(), err)
+	if opened {
+		cfg.emit(ctx, "issuer_circuit_opened", map[string]any{
+			"issuer":               issuer.IssuerKey(),
+			"error_class":          ClassifyIssuerError(err),
+			"consecutive_failures": status.ConsecutiveFailures,
+			"open_until":           status.OpenUntil,
+		})
+	} else if closed {
+		cfg.emit(ctx, "issuer_circuit_closed", map[string]any{
+			"issuer": issuer.IssuerKey(),
+		})
+	}
+}
+
+// issuerHealthStorageKey returns the storage key of
+// the health of the issuer with the given key.
+func issuerHealthStorageKey(issuerKey string) string {
+	return path.Join(prefixIssuerHealth, StorageKeys.Safe(issuerKey)+".json")
+}
+
+// issuerHealthLockKey returns the name of the lock for
+// updating the health of the issuer with the given key.
+func issuerHealthLockKey(issuerKey string) string {
+	return "issuer_health_" + StorageKeys.Safe(issuerKey)
+}
+
+const (
+	prefixIssuerHealth = "issuer_health"
+
+	// how many recent issuances the success rate is computed from
+	issuerHealthWindow = 20
+
+	// how often health is reloaded from storage when choosing issuers
+	issuerHealthRefreshInterval = time.Minute
+
+	defaultIssuerFailureThreshold = 3
+	defaultIssuerCoolDown         = 5 * time.Minute
+	defaultIssuerMaxCoolDown      = time.Hour
+)
+
+// Interface guard
+var _ http.Handler = (*IssuerHealth)(nil)
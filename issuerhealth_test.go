@@ -0,0 +1,219 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// unreachableIssuer is an Issuer for tests that always fails
+// as if its server could not be reached.
+type unreachableIssuer struct{ attempts int }
+
+func (iss *unreachableIssuer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	iss.attempts++
+	return nil, &url.Error{Op: "Post", URL: "https://ca.example/acme/new-order", Err: syscall.ECONNREFUSED}
+}
+
+func (iss *unreachableIssuer) IssuerKey() string { return "unreachable" }
+
+func TestIssuerHealthPolicy(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	var eventsMu sync.Mutex
+	var events []string
+	down, up := new(unreachableIssuer), newSelfSigningIssuer(t)
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{down, up},
+		IssuerPolicy:        UseHealthiestIssuer,
+		IssuerHealth:        &IssuerHealth{FailureThreshold: 2, Storage: storage},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		DisableStorageCheck: true,
+		OCSP:                OCSPConfig{DisableStapling: true},
+		Logger:              defaultTestLogger,
+		OnEvent: func(_ context.Context, event string, _ map[string]any) error {
+			eventsMu.Lock()
+			events = append(events, event)
+			eventsMu.Unlock()
+			return nil
+		},
+	})
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatalf("Obtaining certificate for %s: %v", name, err)
+		}
+	}
+	if down.attempts != 2 {
+		t.Errorf("Expected failing issuer to be skipped after 2 attempts, got %d attempts", down.attempts)
+	}
+	if up.issued != 3 {
+		t.Errorf("Expected 3 certificates from healthy issuer, got %d", up.issued)
+	}
+
+	status := cfg.IssuerHealth.Status(down.IssuerKey())
+	if !status.CircuitOpen(time.Now()) || status.ConsecutiveFailures != 2 || status.Errors[IssuerErrorNetwork] != 2 {
+		t.Errorf("Expected open circuit after 2 network errors, got: %+v", status)
+	}
+	if rate := cfg.IssuerHealth.Status(up.IssuerKey()).SuccessRate(); rate != 1 {
+		t.Errorf("Expected success rate of 1 for healthy issuer, got %v", rate)
+	}
+	eventsMu.Lock()
+	if fmt.Sprint(events) != fmt.Sprint([]string{"cert_obtaining", "cert_obtained", "cert_obtaining", "issuer_circuit_opened", "cert_obtained", "cert_obtaining", "cert_obtained"}) {
+		t.Errorf("Unexpected events: %v", events)
+	}
+	eventsMu.Unlock()
+
+	// another instance sharing the storage skips the issuer too
+	other := &IssuerHealth{Storage: storage}
+	if issuers := other.order(ctx, []Issuer{down, up}); len(issuers) != 1 || issuers[0] != up {
+		t.Errorf("Expected only the healthy issuer, got: %v", issuers)
+	}
+
+	// if every circuit is open, the one closing first is still tried
+	if issuers := other.order(ctx, []Issuer{down}); len(issuers) != 1 || issuers[0] != down {
+		t.Errorf("Expected the failing issuer as a last resort, got: %v", issuers)
+	}
+
+	// after a reset, the issuer is used again
+	if err := other.Reset(ctx, down.IssuerKey()); err != nil {
+		t.Fatal(err)
+	}
+	if issuers := other.order(ctx, []Issuer{down, up}); len(issuers) != 2 {
+		t.Errorf("Expected both issuers after reset, got: %v", issuers)
+	}
+}
+
+func TestIssuerHealthCircuit(t *testing.T) {
+	ctx := context.Background()
+	h := &IssuerHealth{FailureThreshold: 2, CoolDown: time.Minute, MaxCoolDown: 3 * time.Minute}
+	rateLimited := acme.Problem{Type: acme.ProblemTypeRateLimited, Status: http.StatusTooManyRequests}
+
+	// failures specific to the names do not open the circuit
+	for range 5 {
+		if _, opened, _ := h.record(ctx, "ca", ErrNoRetry{errors.New("rejected")}); opened {
+			t.Fatal("Expected rejected identifiers not to open the circuit")
+		}
+	}
+	if _, opened, _ := h.record(ctx, "ca", rateLimited); opened {
+		t.Fatal("Expected circuit to stay closed after 1 failure")
+	}
+	status, opened, _ := h.record(ctx, "ca", rateLimited)
+	if !opened || status.CoolDown != time.Minute {
+		t.Fatalf("Expected circuit to open for 1m, got opened=%t status=%+v", opened, status)
+	}
+
+	// each failure after the cool-down reopens the circuit for longer
+	for _, expect := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		h.mu.Lock()
+		status := h.statuses["ca"]
+		status.OpenUntil = time.Now().Add(-time.Second)
+		h.statuses["ca"] = status
+		h.mu.Unlock()
+
+		status, opened, _ = h.record(ctx, "ca", rateLimited)
+		if !opened || status.CoolDown != expect {
+			t.Errorf("Expected circuit to reopen for %s, got opened=%t status=%+v", expect, opened, status)
+		}
+	}
+
+	status, _, closed := h.record(ctx, "ca", nil)
+	if !closed || status.CircuitOpen(time.Now()) || status.ConsecutiveFailures != 0 {
+		t.Errorf("Expected success to close circuit, got closed=%t status=%+v", closed, status)
+	}
+	if status.Successes != 1 || status.Failures != 10 || status.Errors[IssuerErrorRejected] != 5 || status.Errors[IssuerErrorRateLimited] != 5 {
+		t.Errorf("Unexpected counters: %+v", status)
+	}
+	if rate := status.SuccessRate(); rate != 1.0/11 {
+		t.Errorf("Expected success rate of 1/11, got %v", rate)
+	}
+
+	// canceled operations say nothing about the issuer
+	if status, _, _ := h.record(ctx, "ca", context.Canceled); status.Failures != 10 {
+		t.Errorf("Expected cancellation not to be recorded, got: %+v", status)
+	}
+}
+
+func TestIssuerHealthConcurrentRecords(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	instances := []*IssuerHealth{{Storage: storage}, {Storage: storage}}
+
+	// concurrent updates, also from instances sharing the
+	// storage, must not overwrite each other
+	const perInstance = 3
+	var wg sync.WaitGroup
+	for _, h := range instances {
+		for range perInstance {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.record(ctx, "ca", ErrNoRetry{errors.New("rejected")})
+			}()
+		}
+	}
+	wg.Wait()
+
+	status, err := instances[0].load(ctx, "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := uint64(len(instances) * perInstance); status.Failures != expect {
+		t.Errorf("Expected %d failures, got %d", expect, status.Failures)
+	}
+}
+
+func TestClassifyIssuerError(t *testing.T) {
+	for i, tc := range []struct {
+		err    error
+		expect IssuerErrorClass
+	}{
+		{err: nil, expect: ""},
+		{err: fmt.Errorf("obtaining: %w", context.Canceled), expect: ""},
+		{err: fmt.Errorf("new order: %w", acme.Problem{Type: acme.ProblemTypeRateLimited}), expect: IssuerErrorRateLimited},
+		{err: acme.Problem{Status: http.StatusTooManyRequests}, expect: IssuerErrorRateLimited},
+		{err: acme.Problem{Type: acme.ProblemTypeAccountDoesNotExist}, expect: IssuerErrorUnauthorized},
+		{err: acme.Problem{Type: acme.ProblemTypeUnauthorized}, expect: IssuerErrorUnauthorized},
+		{err: acme.Problem{Type: acme.ProblemTypeUnauthorized, Resource: acme.Authorization{}}, expect: IssuerErrorRejected},
+		{err: acme.Problem{Type: acme.ProblemTypeCAA}, expect: IssuerErrorRejected},
+		{err: acme.Problem{Status: http.StatusServiceUnavailable}, expect: IssuerErrorServer},
+		{err: acme.Problem{Type: acme.ProblemTypeMalformed, Status: http.StatusBadRequest}, expect: IssuerErrorOther},
+		{err: ErrNoRetry{errors.New("name not allowed")}, expect: IssuerErrorRejected},
+		{err: fmt.Errorf("fetching directory: %w", &url.Error{Op: "Get", Err: syscall.ECONNRESET}), expect: IssuerErrorNetwork},
+		{err: context.DeadlineExceeded, expect: IssuerErrorNetwork},
+		{err: errors.New("something else"), expect: IssuerErrorOther},
+	} {
+		if actual := ClassifyIssuerError(tc.err); actual != tc.expect {
+			t.Errorf("Test %d (%v): expected %q, got %q", i, tc.err, tc.expect, actual)
+		}
+	}
+}
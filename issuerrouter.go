@@ -0,0 +1,175 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+)
+
+// IssuerRouter chooses which issuers to use for each identifier,
+// so that a single Config can, for example, get certificates for
+// one customer's domains from one CA and for all other domains
+// from another. The issuers chosen for an identifier are used to
+// obtain and renew its certificates, and they are the only ones
+// whose storage is searched for its existing certificates.
+//
+// Issuers that require a Config, like ACMEIssuer, should be made
+// with the Config the router is used with.
+type IssuerRouter struct {
+	// The routes, in order; the first route that matches
+	// an identifier determines its issuers. Identifiers
+	// that match no route use the Config's Issuers.
+	Routes []IssuerRoute
+
+	// Optional function that returns the tags of an
+	// identifier, which routes can match (see
+	// IssuerRoute.Tags). It is called often, including
+	// while loading certificates during handshakes, so
+	// it should be fast.
+	Tags func(ctx context.Context, identifier string) []string
+}
+
+// IssuerRoute routes identifiers that match all of its
+// criteria to its issuers. A route with no criteria
+// matches every identifier.
+type IssuerRoute struct {
+	// If set, the identifier must be one of these names or a
+	// subdomain of one of them; a leading "." matches only
+	// subdomains. For example, "example.com" matches
+	// "example.com", "www.example.com" and "*.example.com",
+	// while ".example.com" matches only the latter two.
+	Suffixes []string
+
+	// If set, the identifier must have at least one of
+	// these tags (see IssuerRouter.Tags).
+	Tags []string
+
+	// If set, the identifier must be of one of these kinds.
+	Kinds []IdentifierKind
+
+	// The issuers to use, in order. If empty, certificates
+	// will not be obtained for matching identifiers.
+	Issuers []Issuer
+}
+
+// IdentifierKind is a kind of identifier a certificate can be for.
+type IdentifierKind string
+
+// Identifier kinds.
+const (
+	// A DNS name without wildcards.
+	IdentifierKindDNS IdentifierKind = "dns"
+
+	// A DNS name with a wildcard label, like "*.example.com".
+	IdentifierKindWildcard IdentifierKind = "wildcard"
+
+	// An IP address.
+	IdentifierKindIP IdentifierKind = "ip"
+)
+
+// identifierKind returns the kind of identifier.
+func identifierKind(identifier string) IdentifierKind {
+	if net.ParseIP(identifier) != nil {
+		return IdentifierKindIP
+	}
+	if strings.HasPrefix(identifier, "*.") {
+		return IdentifierKindWildcard
+	}
+	return IdentifierKindDNS
+}
+
+// Route returns the issuers of the first route that matches
+// identifier. If no route matches, it returns false.
+func (r *IssuerRouter) Route(ctx context.Context, identifier string) ([]Issuer, bool) {
+	identifier = strings.ToLower(identifier)
+	var tags []string
+	var tagsLoaded bool
+	for _, route := range r.Routes {
+		if len(route.Kinds) > 0 && !slices.Contains(route.Kinds, identifierKind(identifier)) {
+			continue
+		}
+		if len(route.Suffixes) > 0 && !slices.ContainsFunc(route.Suffixes, func(suffix string) bool {
+			return matchIssuerRouteSuffix(identifier, suffix)
+		}) {
+			continue
+		}
+		if len(route.Tags) > 0 {
+			if !tagsLoaded && r.Tags != nil {
+				tags, tagsLoaded = r.Tags(ctx, identifier), true
+			}
+			if !slices.ContainsFunc(route.Tags, func(tag string) bool { return slices.Contains(tags, tag) }) {
+				continue
+			}
+		}
+		return route.Issuers, true
+	}
+	return nil, false
+}
+
+// matchIssuerRouteSuffix returns true if identifier matches suffix
+// as described by IssuerRoute.Suffixes. IP addresses never match.
+func matchIssuerRouteSuffix(identifier, suffix string) bool {
+	if identifierKind(identifier) == IdentifierKindIP {
+		return false
+	}
+	suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+	if strings.HasPrefix(suffix, ".") {
+		return strings.HasSuffix(identifier, suffix)
+	}
+	return identifier == suffix || strings.HasSuffix(identifier, "."+suffix)
+}
+
+// issuersFor returns the issuers to use for the certificates of
+// identifier, which may also be a storage name of a key type
+// variant (see variantStorageName).
+func (cfg *Config) issuersFor(ctx context.Context, identifier string) []Issuer {
+	if cfg.IssuerRouter == nil {
+		return cfg.Issuers
+	}
+	// identifiers never contain "+", so anything after it is a key type
+	identifier, _, _ = strings.Cut(identifier, "+")
+	if issuers, ok := cfg.IssuerRouter.Route(ctx, identifier); ok {
+		return issuers
+	}
+	return cfg.Issuers
+}
+
+// allIssuers returns all issuers cfg may use for any identifier,
+// without duplicate issuer keys. It is useful for finding the
+// issuer of an existing certificate by its issuer key.
+func (cfg *Config) allIssuers() []Issuer {
+	if cfg.IssuerRouter == nil {
+		return cfg.Issuers
+	}
+	all := make([]Issuer, 0, len(cfg.Issuers))
+	seen := make(map[string]struct{})
+	add := func(issuers []Issuer) {
+		for _, iss := range issuers {
+			if _, ok := seen[iss.IssuerKey()]; ok {
+				continue
+			}
+			seen[iss.IssuerKey()] = struct{}{}
+			all = append(all, iss)
+		}
+	}
+	add(cfg.Issuers)
+	for _, route := range cfg.IssuerRouter.Routes {
+		add(route.Issuers)
+	}
+	return all
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// keyedIssuer is an Issuer for tests that has its own issuer key.
+type keyedIssuer struct {
+	*selfSigningIssuer
+	key string
+}
+
+func (iss keyedIssuer) IssuerKey() string { return iss.key }
+
+func TestIssuerRouterRoute(t *testing.T) {
+	ctx := context.Background()
+	customer := keyedIssuer{key: "customer"}
+	wildcard := keyedIssuer{key: "wildcard"}
+	ip := keyedIssuer{key: "ip"}
+	premium := keyedIssuer{key: "premium"}
+	router := &IssuerRouter{
+		Routes: []IssuerRoute{
+			{Suffixes: []string{"customer.example"}, Issuers: []Issuer{customer}},
+			{Tags: []string{"premium"}, Kinds: []IdentifierKind{IdentifierKindDNS}, Issuers: []Issuer{premium}},
+			{Suffixes: []string{".example.net."}, Kinds: []IdentifierKind{IdentifierKindWildcard}, Issuers: []Issuer{wildcard}},
+			{Kinds: []IdentifierKind{IdentifierKindIP}, Issuers: []Issuer{ip}},
+			{Suffixes: []string{"blocked.example"}},
+		},
+		Tags: func(_ context.Context, identifier string) []string {
+			if identifier == "vip.example.org" || identifier == "*.vip.example.org" {
+				return []string{"premium"}
+			}
+			return nil
+		},
+	}
+
+	for i, tc := range []struct {
+		identifier string
+		expect     string // issuer key; "-" for no route, "" for no issuers
+	}{
+		{identifier: "customer.example", expect: "customer"},
+		{identifier: "WWW.Customer.Example", expect: "customer"},
+		{identifier: "*.customer.example", expect: "customer"},
+		{identifier: "notcustomer.example", expect: "-"},
+		{identifier: "vip.example.org", expect: "premium"},
+		{identifier: "*.vip.example.org", expect: "-"},
+		{identifier: "*.example.net", expect: "wildcard"},
+		{identifier: "*.sub.example.net", expect: "wildcard"},
+		{identifier: "sub.example.net", expect: "-"},
+		{identifier: "192.0.2.1", expect: "ip"},
+		{identifier: "2001:db8::1", expect: "ip"},
+		{identifier: "a.blocked.example", expect: ""},
+	} {
+		issuers, ok := router.Route(ctx, tc.identifier)
+		var actual string
+		switch {
+		case !ok:
+			actual = "-"
+		case len(issuers) > 0:
+			actual = issuers[0].IssuerKey()
+		}
+		if actual != tc.expect {
+			t.Errorf("Test %d (%s): expected route to '%s', got '%s'", i, tc.identifier, tc.expect, actual)
+		}
+	}
+
+	cfg := &Config{Issuers: []Issuer{keyedIssuer{key: "default"}, customer}, IssuerRouter: router}
+	var allKeys []string
+	for _, iss := range cfg.allIssuers() {
+		allKeys = append(allKeys, iss.IssuerKey())
+	}
+	if !slices.Equal(allKeys, []string{"default", "customer", "premium", "wildcard", "ip"}) {
+		t.Errorf("Unexpected issuers: %v", allKeys)
+	}
+}
+
+func TestIssuerRouterManage(t *testing.T) {
+	ctx := context.Background()
+	defaultIss := keyedIssuer{newSelfSigningIssuer(t), "default"}
+	customerIss := keyedIssuer{newSelfSigningIssuer(t), "customer"}
+
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{defaultIss},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		DisableStorageCheck: true,
+		OCSP:                OCSPConfig{DisableStapling: true},
+		Logger:              defaultTestLogger,
+	})
+
+	// a certificate obtained before routing was set up
+	const customerDomain = "shop.customer.example"
+	if err := cfg.ObtainCertSync(ctx, customerDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.IssuerRouter = &IssuerRouter{
+		Routes: []IssuerRoute{{Suffixes: []string{"customer.example"}, Issuers: []Issuer{customerIss}}},
+	}
+
+	// only the storage of the routed issuer is searched, so the
+	// certificate is obtained again from the routed issuer
+	if cfg.storageHasCertResourcesAnyIssuer(ctx, customerDomain) {
+		t.Error("Expected certificate from unrouted issuer not to be found")
+	}
+	if err := cfg.ManageSync(ctx, []string{customerDomain, "other.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if defaultIss.issued != 2 || customerIss.issued != 1 {
+		t.Errorf("Expected 2 certificates from default issuer and 1 from customer issuer, got %d and %d",
+			defaultIss.issued, customerIss.issued)
+	}
+	if !cfg.storageHasCertResources(ctx, customerIss, customerDomain) {
+		t.Error("Expected certificate in storage of customer issuer")
+	}
+	if !cfg.storageHasCertResources(ctx, defaultIss, "other.example") {
+		t.Error("Expected certificate in storage of default issuer")
+	}
+
+	// renewals use the routed issuer as well
+	if err := cfg.RenewCertSync(ctx, customerDomain, true); err != nil {
+		t.Fatal(err)
+	}
+	if defaultIss.issued != 2 || customerIss.issued != 2 {
+		t.Errorf("Expected renewal from customer issuer, got %d and %d certificates", defaultIss.issued, customerIss.issued)
+	}
+}
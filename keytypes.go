@@ -0,0 +1,68 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+// keyTypeVariants returns the key type variants of the certificates
+// to manage for each name. The primary certificate is always first
+// and is represented by the empty key type, since its storage keys
+// are the same as if only a single certificate was managed for the
+// name (this allows adding key types to an existing deployment
+// without orphaning its certificates). The remaining values are the
+// additional key types from cfg.KeyTypes, without duplicates.
+func (cfg *Config) keyTypeVariants() []KeyType {
+	variants := []KeyType{""}
+	if len(cfg.KeyTypes) == 0 {
+		return variants
+	}
+	seen := map[KeyType]struct{}{cfg.KeyTypes[0]: {}}
+	for _, kt := range cfg.KeyTypes[1:] {
+		if _, ok := seen[kt]; ok || kt == "" {
+			continue
+		}
+		seen[kt] = struct{}{}
+		variants = append(variants, kt)
+	}
+	return variants
+}
+
+// keyGenerator returns the source of private keys for certificates
+// of the given key type variant.
+func (cfg *Config) keyGenerator(keyType KeyType) KeyGenerator {
+	if keyType != "" {
+		return StandardKeyGenerator{KeyType: keyType}
+	}
+	if len(cfg.KeyTypes) > 0 {
+		return StandardKeyGenerator{KeyType: cfg.KeyTypes[0]}
+	}
+	return cfg.KeySource
+}
+
+// variantStorageName returns the name used to address the storage
+// items of the certificate for name of the given key type variant.
+// The primary certificate (empty key type) uses name as-is. Other
+// variants get a suffix that can't be part of a valid subject name,
+// which becomes "_plus_<keytype>" after StorageKeys.Safe().
+func variantStorageName(name string, keyType KeyType) string {
+	if keyType == "" {
+		return name
+	}
+	return name + "+" + string(keyType)
+}
+
+// storageName returns the name used to address the storage items of
+// cert, which is distinct for each of its key type variants.
+func (cert Certificate) storageName() string {
+	return variantStorageName(cert.Names[0], cert.keyType)
+}
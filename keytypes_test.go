@@ -0,0 +1,227 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// selfSigningIssuer is an Issuer for tests that issues certificates
+// signed by its own throwaway CA.
+type selfSigningIssuer struct {
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	issued int
+}
+
+func newSelfSigningIssuer(t *testing.T) *selfSigningIssuer {
+	t.Helper()
+	privKey, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := privKey.(crypto.Signer)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &selfSigningIssuer{caCert: caCert, caKey: key}
+}
+
+func (iss *selfSigningIssuer) Issue(_ context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	iss.issued++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(iss.issued + 1)),
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, iss.caCert, csr.PublicKey, iss.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCertificate{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+func (iss *selfSigningIssuer) IssuerKey() string { return "self_signing" }
+
+func TestKeyTypeVariants(t *testing.T) {
+	for i, tc := range []struct {
+		keyTypes []KeyType
+		expect   []KeyType
+	}{
+		{keyTypes: nil, expect: []KeyType{""}},
+		{keyTypes: []KeyType{P256}, expect: []KeyType{""}},
+		{keyTypes: []KeyType{P256, RSA2048}, expect: []KeyType{"", RSA2048}},
+		{keyTypes: []KeyType{P256, RSA2048, P256, RSA2048}, expect: []KeyType{"", RSA2048}},
+	} {
+		cfg := &Config{KeyTypes: tc.keyTypes}
+		if actual := cfg.keyTypeVariants(); !reflect.DeepEqual(actual, tc.expect) {
+			t.Errorf("Test %d: Expected %v, got %v", i, tc.expect, actual)
+		}
+	}
+}
+
+func TestManageMultipleKeyTypes(t *testing.T) {
+	ctx := context.Background()
+
+	iss := newSelfSigningIssuer(t)
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{iss},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		KeyTypes:            []KeyType{P256, RSA2048},
+		DisableStorageCheck: true,
+		OCSP:                OCSPConfig{DisableStapling: true},
+		Logger:              defaultTestLogger,
+	})
+
+	const domain = "example.com"
+	if err := cfg.ManageSync(ctx, []string{domain}); err != nil {
+		t.Fatalf("Managing certificates: %v", err)
+	}
+
+	if iss.issued != 2 {
+		t.Errorf("Expected 2 certificates to be issued, got %d", iss.issued)
+	}
+	for _, storageName := range []string{domain, domain + "+" + string(RSA2048)} {
+		if !cfg.storageHasCertResources(ctx, iss, storageName) {
+			t.Errorf("Expected certificate resources in storage for %s", storageName)
+		}
+	}
+
+	certs := cache.getAllMatchingCerts(domain)
+	if len(certs) != 2 {
+		t.Fatalf("Expected 2 certificates in cache, got %d", len(certs))
+	}
+	var ecdsaCert, rsaCert Certificate
+	for _, cert := range certs {
+		switch cert.PrivateKey.(type) {
+		case *ecdsa.PrivateKey:
+			ecdsaCert = cert
+		case *rsa.PrivateKey:
+			rsaCert = cert
+		}
+	}
+	if ecdsaCert.Empty() || rsaCert.Empty() {
+		t.Fatalf("Expected one ECDSA and one RSA certificate, got: %v", certs)
+	}
+	if ecdsaCert.keyType != "" || rsaCert.keyType != RSA2048 {
+		t.Errorf("Expected key types to be primary and %s, got '%s' and '%s'", RSA2048, ecdsaCert.keyType, rsaCert.keyType)
+	}
+
+	// managing again should be a no-op since both are already managed
+	if err := cfg.ManageSync(ctx, []string{domain}); err != nil {
+		t.Fatalf("Managing certificates again: %v", err)
+	}
+	if iss.issued != 2 {
+		t.Errorf("Expected no more certificates to be issued, got %d total", iss.issued)
+	}
+
+	// a legacy client that only supports RSA should get the RSA cert, and a
+	// modern client should get the ECDSA one
+	for i, tc := range []struct {
+		hello  *tls.ClientHelloInfo
+		expect Certificate
+	}{
+		{
+			hello: &tls.ClientHelloInfo{
+				ServerName:        domain,
+				CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{tls.VersionTLS12},
+				SupportedCurves:   []tls.CurveID{tls.CurveP256},
+				SupportedPoints:   []uint8{0},
+				SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+			},
+			expect: rsaCert,
+		},
+		{
+			hello: &tls.ClientHelloInfo{
+				ServerName:        domain,
+				CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{tls.VersionTLS13},
+				SupportedCurves:   []tls.CurveID{tls.CurveP256},
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			},
+			expect: ecdsaCert,
+		},
+	} {
+		cert, err := DefaultCertificateSelector(tc.hello, certs)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if cert.hash != tc.expect.hash {
+			t.Errorf("Test %d: Expected certificate with key type '%s', got '%s'", i, tc.expect.keyType, cert.keyType)
+		}
+	}
+
+	// renewing a variant must only replace that variant
+	if err := cfg.renewCertKeyType(ctx, domain, RSA2048, true, true); err != nil {
+		t.Fatalf("Renewing RSA certificate: %v", err)
+	}
+	if iss.issued != 3 {
+		t.Errorf("Expected 3 certificates to be issued, got %d", iss.issued)
+	}
+	newRSACert, err := cfg.reloadManagedCertificate(ctx, rsaCert)
+	if err != nil {
+		t.Fatalf("Reloading RSA certificate: %v", err)
+	}
+	if _, ok := newRSACert.PrivateKey.(*rsa.PrivateKey); !ok || newRSACert.hash == rsaCert.hash {
+		t.Errorf("Expected renewed RSA certificate, got: %v", newRSACert)
+	}
+	certs = cache.getAllMatchingCerts(domain)
+	if len(certs) != 2 {
+		t.Fatalf("Expected 2 certificates in cache after renewal, got %d", len(certs))
+	}
+	for _, cert := range certs {
+		if cert.hash != ecdsaCert.hash && cert.hash != newRSACert.hash {
+			t.Errorf("Unexpected certificate in cache after renewal: %v", cert.Names)
+		}
+	}
+}
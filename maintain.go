@@ -240,14 +240,14 @@ func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificat
 	renewName := oldCert.Names[0]
 
 	// queue up this renewal job (is a no-op if already active or queued)
-	jm.Submit(cfg.Logger, "renew_"+renewName, func() error {
+	jm.Submit(cfg.Logger, "renew_"+oldCert.storageName(), func() error {
 		timeLeft := expiresAt(oldCert.Leaf).Sub(time.Now().UTC())
 		log.Info("attempting certificate renewal",
 			zap.Strings("identifiers", oldCert.Names),
 			zap.Duration("remaining", timeLeft))
 
 		// perform renewal - crucially, this happens OUTSIDE a lock on certCache
-		err := cfg.RenewCertAsync(ctx, renewName, false)
+		err := cfg.renewCertKeyType(ctx, renewName, oldCert.keyType, false, false)
 		if err != nil {
 			if cfg.OnDemand != nil {
 				// loaded dynamically, remove dynamically
@@ -430,11 +430,11 @@ func (cfg *Config) storageHasNewerARI(ctx context.Context, cert Certificate) (bo
 // loadStoredACMECertificateMetadata loads the stored ACME certificate data.
 // It switches storage modes between legacy and bundle mode based on the CERTMAGIC_STORAGE_MODE env.
 func (cfg *Config) loadStoredACMECertificateMetadata(ctx context.Context, cert Certificate) (acme.Certificate, error) {
-	storageMode := StorageModeForDomain(cert.Names[0])
+	storageMode := StorageModeForDomain(cert.storageName())
 	cfg.Logger.Debug("loading stored ACME certificate metadata",
 		zap.String("domain", cert.Names[0]),
 		zap.String("storage_mode", storageMode),
-		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.Names[0])))
+		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.storageName())))
 	switch storageMode {
 	case StorageModeTransition:
 		acmecert, err := cfg.loadStoredACMECertificateMetadataBundle(ctx, cert)
@@ -452,7 +452,7 @@ func (cfg *Config) loadStoredACMECertificateMetadata(ctx context.Context, cert C
 // loadStoredACMECertificateMetadataLegacy loads the stored ACME certificate data
 // from the cert's sidecar JSON file.
 func (cfg *Config) loadStoredACMECertificateMetadataLegacy(ctx context.Context, cert Certificate) (acme.Certificate, error) {
-	metaBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteMeta(cert.issuerKey, cert.Names[0]))
+	metaBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteMeta(cert.issuerKey, cert.storageName()))
 	if err != nil {
 		return acme.Certificate{}, fmt.Errorf("loading cert metadata: %w", err)
 	}
@@ -472,7 +472,7 @@ func (cfg *Config) loadStoredACMECertificateMetadataLegacy(ctx context.Context,
 
 // loadStoredACMECertificateMetadataBundle loads the stored ACME certificate data from the cert bundle.
 func (cfg *Config) loadStoredACMECertificateMetadataBundle(ctx context.Context, cert Certificate) (acme.Certificate, error) {
-	bundleBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.Names[0]))
+	bundleBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.storageName()))
 	if err != nil {
 		return acme.Certificate{}, fmt.Errorf("loading cert metadata: %w", err)
 	}
@@ -500,11 +500,11 @@ func (cfg *Config) loadStoredACMECertificateMetadataBundle(ctx context.Context,
 // NeedsRefresh() on the RenewalInfo first, and only call this if that returns true.
 // It switches storage modes between legacy and bundle mode based on the CERTMAGIC_STORAGE_MODE env.
 func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.Logger) (updatedCert Certificate, changed bool, err error) {
-	storageMode := StorageModeForDomain(cert.Names[0])
+	storageMode := StorageModeForDomain(cert.storageName())
 	cfg.Logger.Debug("updating ARI",
 		zap.String("domain", cert.Names[0]),
 		zap.String("storage_mode", storageMode),
-		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.Names[0])))
+		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.storageName())))
 	switch storageMode {
 	case StorageModeTransition:
 		updatedCert, changed, err = cfg.updateARILegacy(ctx, cert, logger)
@@ -530,7 +530,7 @@ func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.
 // In transition mode, we use updateARILegacy as the source of truth (which fetches
 // from CA if needed), then call this function to also update the bundle storage.
 func (cfg *Config) storeARIToBundle(ctx context.Context, cert Certificate) error {
-	bundleBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.Names[0]))
+	bundleBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.storageName()))
 	if err != nil {
 		return fmt.Errorf("loading certificate bundle: %v", err)
 	}
@@ -552,7 +552,7 @@ func (cfg *Config) storeARIToBundle(ctx context.Context, cert Certificate) error
 	if err != nil {
 		return fmt.Errorf("encoding certificate bundle: %v", err)
 	}
-	if err = cfg.Storage.Store(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.Names[0]), encoded); err != nil {
+	if err = cfg.Storage.Store(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.storageName()), encoded); err != nil {
 		return fmt.Errorf("storing certificate bundle: %v", err)
 	}
 	return nil
@@ -640,7 +640,7 @@ func (cfg *Config) updateARILegacy(ctx context.Context, cert Certificate, logger
 	}
 
 	// of the issuers configured, hopefully one of them is the ACME CA we got the cert from
-	for _, iss := range cfg.Issuers {
+	for _, iss := range cfg.allIssuers() {
 		if ariGetter, ok := iss.(RenewalInfoGetter); ok && iss.IssuerKey() == cert.issuerKey {
 			newARI, err = ariGetter.GetRenewalInfo(ctx, cert) // be sure to use existing newARI variable so we can compare against old value in the defer
 			if err != nil {
@@ -708,7 +708,7 @@ func (cfg *Config) updateARILegacy(ctx context.Context, cert Certificate, logger
 				err = fmt.Errorf("got new ARI from %s, but could not re-encode certificate metadata: %v", iss.IssuerKey(), err)
 				return
 			}
-			if err = cfg.Storage.Store(ctx, StorageKeys.SiteMeta(cert.issuerKey, cert.Names[0]), certResBytes); err != nil {
+			if err = cfg.Storage.Store(ctx, StorageKeys.SiteMeta(cert.issuerKey, cert.storageName()), certResBytes); err != nil {
 				err = fmt.Errorf("got new ARI from %s, but could not store it with certificate metadata: %v", iss.IssuerKey(), err)
 				return
 			}
@@ -808,7 +808,7 @@ func (cfg *Config) updateARIBundle(ctx context.Context, cert Certificate, logger
 	}
 
 	// of the issuers configured, hopefully one of them is the ACME CA we got the cert from
-	for _, iss := range cfg.Issuers {
+	for _, iss := range cfg.allIssuers() {
 		if ariGetter, ok := iss.(RenewalInfoGetter); ok && iss.IssuerKey() == cert.issuerKey {
 			newARI, err = ariGetter.GetRenewalInfo(ctx, cert) // be sure to use existing newARI variable so we can compare against old value in the defer
 			if err != nil {
@@ -856,7 +856,7 @@ func (cfg *Config) updateARIBundle(ctx context.Context, cert Certificate, logger
 
 			// update the ARI value in storage
 			var bundleBytes []byte
-			bundleBytes, err = cfg.Storage.Load(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.Names[0]))
+			bundleBytes, err = cfg.Storage.Load(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.storageName()))
 			if err != nil {
 				err = fmt.Errorf("got new ARI from %s, but failed loading certificate bundle: %v", iss.IssuerKey(), err)
 				return
@@ -886,7 +886,7 @@ func (cfg *Config) updateARIBundle(ctx context.Context, cert Certificate, logger
 				err = fmt.Errorf("got new ARI from %s, but could not re-encode certificate bundle: %v", iss.IssuerKey(), err)
 				return
 			}
-			if err = cfg.Storage.Store(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.Names[0]), encoded); err != nil {
+			if err = cfg.Storage.Store(ctx, StorageKeys.SiteBundle(cert.issuerKey, cert.storageName()), encoded); err != nil {
 				err = fmt.Errorf("got new ARI from %s, but could not store it with certificate bundle: %v", iss.IssuerKey(), err)
 				return
 			}
@@ -1274,12 +1274,12 @@ func (cfg *Config) forceRenew(ctx context.Context, logger *zap.Logger, cert Cert
 
 	var err error
 	if obtainInsteadOfRenew {
-		err = cfg.ObtainCertAsync(ctx, renewName)
+		err = cfg.obtainCertKeyType(ctx, renewName, cert.keyType, false)
 	} else {
 		// notice that we force renewal; otherwise, it might see that the
 		// certificate isn't close to expiring and return, but we really
 		// need a replacement certificate! see issue #4191
-		err = cfg.RenewCertAsync(ctx, renewName, true)
+		err = cfg.renewCertKeyType(ctx, renewName, cert.keyType, true, false)
 	}
 	if err != nil {
 		if cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
@@ -1302,7 +1302,7 @@ func (cfg *Config) forceRenew(ctx context.Context, logger *zap.Logger, cert Cert
 func (cfg *Config) moveCompromisedPrivateKey(ctx context.Context, cert Certificate, logger *zap.Logger) error {
 	// find the issuer that matches the cert's issuer key
 	var issuer Issuer
-	for _, iss := range cfg.Issuers {
+	for _, iss := range cfg.allIssuers() {
 		if iss.IssuerKey() == cert.issuerKey {
 			issuer = iss
 			break
@@ -1313,29 +1313,29 @@ func (cfg *Config) moveCompromisedPrivateKey(ctx context.Context, cert Certifica
 	}
 
 	// load cert resource to get private key (handles both legacy and bundle storage modes)
-	certRes, err := cfg.loadCertResource(ctx, issuer, cert.Names[0])
+	certRes, err := cfg.loadCertResource(ctx, issuer, cert.storageName())
 	if err != nil {
 		return err
 	}
 
 	// store the compromised key for audit purposes
-	compromisedPrivKeyStorageKey := StorageKeys.SitePrivateKey(cert.issuerKey, cert.Names[0]) + ".compromised"
+	compromisedPrivKeyStorageKey := StorageKeys.SitePrivateKey(cert.issuerKey, cert.storageName()) + ".compromised"
 	err = cfg.Storage.Store(ctx, compromisedPrivKeyStorageKey, certRes.PrivateKeyPEM)
 	if err != nil {
 		return err
 	}
 
-	privKeyStorageKey := StorageKeys.SitePrivateKey(cert.issuerKey, cert.Names[0])
-	bundleKey := StorageKeys.SiteBundle(cert.issuerKey, cert.Names[0])
+	privKeyStorageKey := StorageKeys.SitePrivateKey(cert.issuerKey, cert.storageName())
+	bundleKey := StorageKeys.SiteBundle(cert.issuerKey, cert.storageName())
 
 	// Delete the storage containing the compromised key based on storage mode.
 	// We intentionally ignore delete errors since the file might not exist,
 	// and we avoid calling .Exists() before .Delete() to minimize storage roundtrips.
-	storageMode := StorageModeForDomain(cert.Names[0])
+	storageMode := StorageModeForDomain(cert.storageName())
 	logger.Debug("deleting compromised private key",
 		zap.String("domain", cert.Names[0]),
 		zap.String("storage_mode", storageMode),
-		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.Names[0])))
+		zap.Int("rollout_bucket", RolloutBucketForDomain(cert.storageName())))
 	switch storageMode {
 	case StorageModeTransition:
 		cfg.Storage.Delete(ctx, bundleKey)
@@ -0,0 +1,389 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeObserver observes how a certificate was (or was not) found
+// for each TLS handshake. Set it as the HandshakeObserver field of
+// Config. It is called synchronously at the end of GetCertificate, so
+// implementations must return quickly; they must also be safe for
+// concurrent use.
+//
+// This package provides adapters for span-based tracing
+// (HandshakeSpanObserver) and for counters in the Prometheus
+// exposition format (HandshakeCounters), neither of which have
+// external dependencies.
+type HandshakeObserver interface {
+	// ObserveHandshake is called with the observation of a handshake.
+	// The observation must not be retained after the call returns.
+	ObserveHandshake(ctx context.Context, obs *HandshakeObservation)
+}
+
+// HandshakeObservation describes how a certificate was
+// (or was not) found during a TLS handshake.
+type HandshakeObservation struct {
+	// The ClientHello of the handshake.
+	Hello *tls.ClientHelloInfo
+
+	// When getting the certificate started, and how long it took.
+	Start    time.Time
+	Duration time.Duration
+
+	// The outcome of getting the certificate.
+	Outcome HandshakeOutcome
+
+	// The certificate that is served; empty if none.
+	Certificate Certificate
+
+	// The error, if no certificate is served.
+	Err error
+
+	// The time spent in each stage; index by HandshakeStage.
+	Stages [handshakeStageCount]time.Duration
+
+	outcomeSet bool
+}
+
+// HandshakeOutcome is how a certificate was
+// (or was not) found during a TLS handshake.
+type HandshakeOutcome uint8
+
+// Handshake outcomes.
+const (
+	// No certificate was available for the handshake.
+	HandshakeNoCertificate HandshakeOutcome = iota
+
+	// A certificate was found in the cache.
+	HandshakeCacheHit
+
+	// The certificate for the DefaultServerName was used.
+	HandshakeDefaultCertificate
+
+	// The certificate for the FallbackServerName was used.
+	HandshakeFallbackCertificate
+
+	// The certificate was loaded from storage.
+	HandshakeLoadedFromStorage
+
+	// The certificate was obtained on-demand.
+	HandshakeObtainedOnDemand
+
+	// The certificate came from an external certificate Manager.
+	HandshakeManagerServed
+
+	// A certificate was not allowed for the name (on-demand
+	// DecisionFunc, Policy, or the host allowlist).
+	HandshakeDenied
+
+	// A placeholder certificate was served.
+	HandshakePlaceholder
+
+	// A certificate for a TLS-ALPN challenge was served.
+	HandshakeChallenge
+
+	// Getting a certificate failed for another reason.
+	HandshakeError
+
+	handshakeOutcomeCount
+)
+
+// String returns the name of the outcome, in snake case.
+func (o HandshakeOutcome) String() string {
+	if o < handshakeOutcomeCount {
+		return handshakeOutcomeNames[o]
+	}
+	return fmt.Sprintf("unknown(%d)", o)
+}
+
+var handshakeOutcomeNames = [handshakeOutcomeCount]string{
+	HandshakeNoCertificate:       "no_certificate",
+	HandshakeCacheHit:            "cache_hit",
+	HandshakeDefaultCertificate:  "default_certificate",
+	HandshakeFallbackCertificate: "fallback_certificate",
+	HandshakeLoadedFromStorage:   "loaded_from_storage",
+	HandshakeObtainedOnDemand:    "obtained_on_demand",
+	HandshakeManagerServed:       "manager_served",
+	HandshakeDenied:              "denied",
+	HandshakePlaceholder:         "placeholder",
+	HandshakeChallenge:           "challenge",
+	HandshakeError:               "error",
+}
+
+// HandshakeStage is a stage of getting a certificate
+// during a TLS handshake.
+type HandshakeStage uint8
+
+// Handshake stages.
+const (
+	// Looking up the certificate in the cache.
+	HandshakeStageCache HandshakeStage = iota
+
+	// Asking external certificate managers.
+	HandshakeStageManagers
+
+	// Deciding whether a certificate is allowed.
+	HandshakeStageDecision
+
+	// Loading the certificate from storage.
+	HandshakeStageStorage
+
+	// Obtaining the certificate on-demand.
+	HandshakeStageObtain
+
+	handshakeStageCount
+)
+
+// String returns the name of the stage, in snake case.
+func (s HandshakeStage) String() string {
+	if s < handshakeStageCount {
+		return handshakeStageNames[s]
+	}
+	return fmt.Sprintf("unknown(%d)", s)
+}
+
+var handshakeStageNames = [handshakeStageCount]string{
+	HandshakeStageCache:    "cache",
+	HandshakeStageManagers: "managers",
+	HandshakeStageDecision: "decision",
+	HandshakeStageStorage:  "storage",
+	HandshakeStageObtain:   "obtain",
+}
+
+// handshakeObservationFromContext returns the observation being
+// recorded for the handshake of ctx, or nil if there is none.
+func handshakeObservationFromContext(ctx context.Context) *HandshakeObservation {
+	obs, _ := ctx.Value(handshakeObservationCtxKey).(*HandshakeObservation)
+	return obs
+}
+
+// withoutHandshakeObservation returns a context that does not
+// record into any handshake observation of ctx; for work that
+// continues in the background after the handshake.
+func withoutHandshakeObservation(ctx context.Context) context.Context {
+	if handshakeObservationFromContext(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, handshakeObservationCtxKey, (*HandshakeObservation)(nil))
+}
+
+// setOutcome sets the outcome, if obs is not nil.
+func (obs *HandshakeObservation) setOutcome(outcome HandshakeOutcome) {
+	if obs != nil {
+		obs.Outcome = outcome
+		obs.outcomeSet = true
+	}
+}
+
+// beginStage returns the start time of a stage, if obs is not nil.
+func (obs *HandshakeObservation) beginStage() time.Time {
+	if obs == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// endStage adds the time since start to stage, if obs is not nil.
+func (obs *HandshakeObservation) endStage(stage HandshakeStage, start time.Time) {
+	if obs != nil {
+		obs.Stages[stage] += time.Since(start)
+	}
+}
+
+type handshakeObservationCtxKeyType struct{}
+
+var handshakeObservationCtxKey handshakeObservationCtxKeyType
+
+// HandshakeObservers is a HandshakeObserver that
+// calls each of its observers in order.
+type HandshakeObservers []HandshakeObserver
+
+// ObserveHandshake implements HandshakeObserver.
+func (hos HandshakeObservers) ObserveHandshake(ctx context.Context, obs *HandshakeObservation) {
+	for _, ho := range hos {
+		ho.ObserveHandshake(ctx, obs)
+	}
+}
+
+// HandshakeSpan is a trace span of getting a certificate during a
+// TLS handshake, modeled after OpenTelemetry spans so that it can
+// be converted easily. Each stage that took time is a span event.
+type HandshakeSpan struct {
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Events     []HandshakeSpanEvent
+
+	// Non-empty if the span ended with an error.
+	ErrorMessage string
+}
+
+// HandshakeSpanEvent is an event within a HandshakeSpan.
+type HandshakeSpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]any
+}
+
+// HandshakeSpanObserver is a HandshakeObserver that
+// turns each observation into a HandshakeSpan.
+type HandshakeSpanObserver struct {
+	// Export is called with each span. Required.
+	Export func(ctx context.Context, span HandshakeSpan)
+}
+
+// ObserveHandshake implements HandshakeObserver.
+func (hso HandshakeSpanObserver) ObserveHandshake(ctx context.Context, obs *HandshakeObservation) {
+	span := HandshakeSpan{
+		Name:  "certmagic.get_certificate",
+		Start: obs.Start,
+		End:   obs.Start.Add(obs.Duration),
+		Attributes: map[string]any{
+			"tls.server_name":   obs.Hello.ServerName,
+			"certmagic.outcome": obs.Outcome.String(),
+		},
+	}
+	if len(obs.Certificate.Names) > 0 {
+		span.Attributes["certmagic.certificate.names"] = obs.Certificate.Names
+		span.Attributes["certmagic.certificate.managed"] = obs.Certificate.managed
+	}
+	if obs.Err != nil {
+		span.ErrorMessage = obs.Err.Error()
+	}
+	// stages happen in order, so their start times can be approximated
+	stageStart := obs.Start
+	for stage, duration := range obs.Stages {
+		if duration == 0 {
+			continue
+		}
+		span.Events = append(span.Events, HandshakeSpanEvent{
+			Name: "certmagic.stage." + HandshakeStage(stage).String(),
+			Time: stageStart,
+			Attributes: map[string]any{
+				"certmagic.stage.duration_seconds": duration.Seconds(),
+			},
+		})
+		stageStart = stageStart.Add(duration)
+	}
+	hso.Export(ctx, span)
+}
+
+// HandshakeCounters is a HandshakeObserver that counts handshake
+// outcomes and time spent in each stage, without allocating. The
+// counters can be exported in the Prometheus text exposition format
+// with WriteTo or by serving it over HTTP.
+type HandshakeCounters struct {
+	outcomes       [handshakeOutcomeCount]atomic.Uint64
+	stageNanos     [handshakeStageCount]atomic.Uint64
+	stageEntries   [handshakeStageCount]atomic.Uint64
+	durationNanos  atomic.Uint64
+	certificatesOK atomic.Uint64
+}
+
+// ObserveHandshake implements HandshakeObserver.
+func (hc *HandshakeCounters) ObserveHandshake(_ context.Context, obs *HandshakeObservation) {
+	if obs.Outcome < handshakeOutcomeCount {
+		hc.outcomes[obs.Outcome].Add(1)
+	}
+	for stage, duration := range obs.Stages {
+		if duration > 0 {
+			hc.stageNanos[stage].Add(uint64(duration))
+			hc.stageEntries[stage].Add(1)
+		}
+	}
+	hc.durationNanos.Add(uint64(obs.Duration))
+	if obs.Err == nil {
+		hc.certificatesOK.Add(1)
+	}
+}
+
+// Count returns how many handshakes had the given outcome.
+func (hc *HandshakeCounters) Count(outcome HandshakeOutcome) uint64 {
+	if outcome >= handshakeOutcomeCount {
+		return 0
+	}
+	return hc.outcomes[outcome].Load()
+}
+
+// StageDuration returns the total time spent in stage.
+func (hc *HandshakeCounters) StageDuration(stage HandshakeStage) time.Duration {
+	if stage >= handshakeStageCount {
+		return 0
+	}
+	return time.Duration(hc.stageNanos[stage].Load())
+}
+
+// WriteTo writes the counters to w in the Prometheus
+// text exposition format.
+func (hc *HandshakeCounters) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+
+	sb.WriteString("# HELP certmagic_handshakes_total TLS handshakes by how the certificate was found.\n")
+	sb.WriteString("# TYPE certmagic_handshakes_total counter\n")
+	for outcome := range hc.outcomes {
+		fmt.Fprintf(&sb, "certmagic_handshakes_total{outcome=%q} %d\n",
+			HandshakeOutcome(outcome).String(), hc.outcomes[outcome].Load())
+	}
+
+	sb.WriteString("# HELP certmagic_handshake_stage_seconds_total Time spent getting certificates, by stage.\n")
+	sb.WriteString("# TYPE certmagic_handshake_stage_seconds_total counter\n")
+	for stage := range hc.stageNanos {
+		fmt.Fprintf(&sb, "certmagic_handshake_stage_seconds_total{stage=%q} %g\n",
+			HandshakeStage(stage).String(), time.Duration(hc.stageNanos[stage].Load()).Seconds())
+	}
+
+	sb.WriteString("# HELP certmagic_handshake_stage_entries_total Times each stage was entered while getting certificates.\n")
+	sb.WriteString("# TYPE certmagic_handshake_stage_entries_total counter\n")
+	for stage := range hc.stageEntries {
+		fmt.Fprintf(&sb, "certmagic_handshake_stage_entries_total{stage=%q} %d\n",
+			HandshakeStage(stage).String(), hc.stageEntries[stage].Load())
+	}
+
+	sb.WriteString("# HELP certmagic_handshake_seconds_total Time spent getting certificates.\n")
+	sb.WriteString("# TYPE certmagic_handshake_seconds_total counter\n")
+	fmt.Fprintf(&sb, "certmagic_handshake_seconds_total %g\n", time.Duration(hc.durationNanos.Load()).Seconds())
+
+	sb.WriteString("# HELP certmagic_handshake_certificates_served_total TLS handshakes for which a certificate was served.\n")
+	sb.WriteString("# TYPE certmagic_handshake_certificates_served_total counter\n")
+	fmt.Fprintf(&sb, "certmagic_handshake_certificates_served_total %d\n", hc.certificatesOK.Load())
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the counters in the Prometheus text exposition format.
+func (hc *HandshakeCounters) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = hc.WriteTo(w)
+}
+
+// Interface guards
+var (
+	_ HandshakeObserver = HandshakeObservers(nil)
+	_ HandshakeObserver = HandshakeSpanObserver{}
+	_ HandshakeObserver = (*HandshakeCounters)(nil)
+	_ io.WriterTo       = (*HandshakeCounters)(nil)
+	_ http.Handler      = (*HandshakeCounters)(nil)
+)
@@ -0,0 +1,163 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHandshakeObserver(t *testing.T) {
+	c := &Cache{
+		cache:      make(map[string]Certificate),
+		cacheIndex: make(map[string][]string),
+		logger:     defaultTestLogger,
+	}
+	c.cacheCertificate(Certificate{
+		Names:       []string{"example.com"},
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{DNSNames: []string{"example.com"}}},
+	})
+
+	counters := new(HandshakeCounters)
+	var spans []HandshakeSpan
+	observer := HandshakeObservers{
+		counters,
+		HandshakeSpanObserver{Export: func(_ context.Context, span HandshakeSpan) {
+			spans = append(spans, span)
+		}},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i, tc := range []struct {
+		cfg          *Config
+		serverName   string
+		expectErr    bool
+		expectResult HandshakeOutcome
+		expectStage  HandshakeStage
+	}{
+		{
+			cfg:          &Config{},
+			serverName:   "example.com",
+			expectResult: HandshakeCacheHit,
+			expectStage:  HandshakeStageCache,
+		},
+		{
+			cfg:          &Config{DefaultServerName: "example.com"},
+			serverName:   "",
+			expectResult: HandshakeDefaultCertificate,
+			expectStage:  HandshakeStageCache,
+		},
+		{
+			cfg:          &Config{FallbackServerName: "example.com"},
+			serverName:   "nomatch.example.net",
+			expectResult: HandshakeFallbackCertificate,
+			expectStage:  HandshakeStageDecision,
+		},
+		{
+			cfg:          &Config{},
+			serverName:   "nomatch.example.net",
+			expectErr:    true,
+			expectResult: HandshakeNoCertificate,
+			expectStage:  HandshakeStageDecision,
+		},
+		{
+			cfg: &Config{OnDemand: &OnDemandConfig{
+				DecisionFunc: func(context.Context, string) error { return errors.New("not allowed") },
+			}},
+			serverName:   "denied.example.net",
+			expectErr:    true,
+			expectResult: HandshakeDenied,
+			expectStage:  HandshakeStageDecision,
+		},
+	} {
+		tc.cfg.Logger = defaultTestLogger
+		tc.cfg.certCache = c
+		var observed *HandshakeObservation
+		tc.cfg.HandshakeObserver = HandshakeObservers{
+			observer,
+			handshakeObserverFunc(func(_ context.Context, obs *HandshakeObservation) {
+				copied := *obs
+				observed = &copied
+			}),
+		}
+
+		_, err := tc.cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: tc.serverName, Conn: conn})
+		if (err != nil) != tc.expectErr {
+			t.Errorf("Test %d: Expected error=%t, got: %v", i, tc.expectErr, err)
+		}
+		if observed == nil {
+			t.Fatalf("Test %d: Handshake was not observed", i)
+		}
+		if observed.Outcome != tc.expectResult {
+			t.Errorf("Test %d: Expected outcome %s, got %s", i, tc.expectResult, observed.Outcome)
+		}
+		if observed.Stages[tc.expectStage] <= 0 {
+			t.Errorf("Test %d: Expected time to be spent in stage %s, got: %v", i, tc.expectStage, observed.Stages)
+		}
+		if observed.Err != err {
+			t.Errorf("Test %d: Expected observed error %v, got %v", i, err, observed.Err)
+		}
+	}
+
+	if len(spans) != 5 {
+		t.Fatalf("Expected 5 spans, got %d", len(spans))
+	}
+	if spans[0].Attributes["certmagic.outcome"] != "cache_hit" || spans[0].ErrorMessage != "" {
+		t.Errorf("Unexpected first span: %+v", spans[0])
+	}
+	if spans[4].Attributes["certmagic.outcome"] != "denied" || spans[4].ErrorMessage == "" {
+		t.Errorf("Unexpected last span: %+v", spans[4])
+	}
+
+	if n := counters.Count(HandshakeCacheHit); n != 1 {
+		t.Errorf("Expected 1 cache hit, got %d", n)
+	}
+	var sb strings.Builder
+	if _, err := counters.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		`certmagic_handshakes_total{outcome="cache_hit"} 1`,
+		`certmagic_handshakes_total{outcome="denied"} 1`,
+		`certmagic_handshakes_total{outcome="obtained_on_demand"} 0`,
+		`certmagic_handshake_stage_entries_total{stage="decision"} 4`,
+		`certmagic_handshake_certificates_served_total 3`,
+	} {
+		if !strings.Contains(sb.String(), expect) {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", expect, sb.String())
+		}
+	}
+}
+
+type handshakeObserverFunc func(context.Context, *HandshakeObservation)
+
+func (f handshakeObserverFunc) ObserveHandshake(ctx context.Context, obs *HandshakeObservation) {
+	f(ctx, obs)
+}
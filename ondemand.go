@@ -0,0 +1,330 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/publicsuffix"
+)
+
+// OnDemandPolicy is an admission controller for on-demand TLS. It
+// decides whether a certificate may be obtained (or renewed) for a
+// name by composing, in this order:
+//
+//  1. Deny patterns: names matching any of them are denied.
+//  2. Allow patterns: if set, names must match at least one.
+//  3. The ask endpoint: if set, it must approve the name.
+//  4. Rate limits per registrable domain (eTLD+1), then global.
+//
+// Answers from the ask endpoint are cached according to the TTLs.
+// Rate limits are only consumed by names which are otherwise
+// allowed. Set it as the Policy field of OnDemandConfig, where an
+// "on_demand_decision" event is emitted for every decision.
+//
+// An OnDemandPolicy must not be copied after first use.
+type OnDemandPolicy struct {
+	// Names matching any of these patterns are denied. Patterns are
+	// exact names or wildcards as understood by MatchWildcard().
+	Deny []string `json:"deny,omitempty"`
+
+	// If set, names must match at least one of these patterns.
+	// Patterns are exact names or wildcards as understood by
+	// MatchWildcard().
+	Allow []string `json:"allow,omitempty"`
+
+	// If set, a GET request is made to this URL with the name
+	// in the "domain" query parameter. The name is allowed
+	// only if the endpoint responds with a 2xx status code.
+	AskURL string `json:"ask_url,omitempty"`
+
+	// How long to wait for the ask endpoint. Default: 10s.
+	AskTimeout time.Duration `json:"ask_timeout,omitempty"`
+
+	// How long to remember approvals from the ask endpoint.
+	// If zero, approvals are not cached.
+	AllowCacheTTL time.Duration `json:"allow_cache_ttl,omitempty"`
+
+	// How long to remember denials from the ask endpoint.
+	// If zero, denials are not cached. Errors reaching the
+	// endpoint are never cached.
+	DenyCacheTTL time.Duration `json:"deny_cache_ttl,omitempty"`
+
+	// Limits how often names under the same registrable
+	// domain (eTLD+1) can be approved.
+	RateLimitPerDomain OnDemandRateLimit `json:"rate_limit_per_domain,omitempty"`
+
+	// Limits how often any names can be approved.
+	RateLimitGlobal OnDemandRateLimit `json:"rate_limit_global,omitempty"`
+
+	// The HTTP client to use for the ask endpoint; if
+	// nil, a default client is used.
+	HTTPClient *http.Client `json:"-"`
+
+	// An optional logger.
+	Logger *zap.Logger `json:"-"`
+
+	mu                    sync.Mutex
+	answers               map[string]onDemandAnswer
+	domainLimiters        map[string]*onDemandLimiter
+	domainLimitersSweepAt int
+	globalLimiter         *onDemandLimiter
+}
+
+// OnDemandRateLimit configures a rate limit of at most
+// Events within the sliding Window. It is disabled if
+// Events or Window is zero.
+type OnDemandRateLimit struct {
+	Events int           `json:"events,omitempty"`
+	Window time.Duration `json:"window,omitempty"`
+}
+
+func (rl OnDemandRateLimit) enabled() bool { return rl.Events > 0 && rl.Window > 0 }
+
+// onDemandAnswer is a cached answer from the ask endpoint.
+type onDemandAnswer struct {
+	allowed bool
+	expires time.Time
+}
+
+// onDemandLimiter is a sliding window rate limiter. Unlike
+// RingBufferRateLimiter, it can be checked without using up
+// an event, so that a name which is denied by one limit does
+// not use up the budget of another. It is protected by the
+// mu of its OnDemandPolicy.
+type onDemandLimiter struct {
+	events   []time.Time
+	lastUsed time.Time
+}
+
+// allow returns true if another event is allowed within limit
+// at now. It forgets events which have left the window.
+func (l *onDemandLimiter) allow(limit OnDemandRateLimit, now time.Time) bool {
+	l.events = slices.DeleteFunc(l.events, func(t time.Time) bool {
+		return now.Sub(t) >= limit.Window
+	})
+	return len(l.events) < limit.Events
+}
+
+// take records an event at now.
+func (l *onDemandLimiter) take(now time.Time) {
+	l.events = append(l.events, now)
+	l.lastUsed = now
+}
+
+// Check returns nil if a certificate may be obtained for name
+// according to the policy, or an error explaining why not.
+func (p *OnDemandPolicy) Check(ctx context.Context, name string) error {
+	_, _, err := p.decide(ctx, name)
+	return err
+}
+
+// decide evaluates the policy for name. It returns a short reason
+// describing the decision, whether the decision came from the
+// answer cache, and a non-nil error if name is not allowed.
+func (p *OnDemandPolicy) decide(ctx context.Context, name string) (reason string, cached bool, err error) {
+	if slices.ContainsFunc(p.Deny, func(pattern string) bool { return MatchWildcard(name, pattern) }) {
+		return "deny_pattern", false, fmt.Errorf("%s matches a deny pattern", name)
+	}
+	if len(p.Allow) > 0 && !slices.ContainsFunc(p.Allow, func(pattern string) bool { return MatchWildcard(name, pattern) }) {
+		return "no_allow_pattern", false, fmt.Errorf("%s does not match any allow pattern", name)
+	}
+
+	if p.AskURL != "" {
+		var allowed bool
+		allowed, cached, err = p.ask(ctx, name)
+		if err != nil {
+			return "ask_error", false, fmt.Errorf("asking %s about %s: %w", p.AskURL, name, err)
+		}
+		if !allowed {
+			return "ask_denied", cached, fmt.Errorf("%s is not allowed by ask endpoint", name)
+		}
+	}
+
+	if reason, err := p.takeRateLimits(name); err != nil {
+		return reason, cached, err
+	}
+
+	return "allowed", cached, nil
+}
+
+// takeRateLimits uses up an event of the global rate limit and of
+// the rate limit of the registrable domain of name. If either limit
+// denies name, neither is used up, and a reason and error are
+// returned.
+func (p *OnDemandPolicy) takeRateLimits(name string) (reason string, err error) {
+	globalEnabled, domainEnabled := p.RateLimitGlobal.enabled(), p.RateLimitPerDomain.enabled()
+	if !globalEnabled && !domainEnabled {
+		return "", nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if globalEnabled {
+		if p.globalLimiter == nil {
+			p.globalLimiter = new(onDemandLimiter)
+		}
+		if !p.globalLimiter.allow(p.RateLimitGlobal, now) {
+			return "rate_limited_global", fmt.Errorf("%s: %w", name, ErrOnDemandRateLimited)
+		}
+	}
+	var domainLimiter *onDemandLimiter
+	if domainEnabled {
+		domainLimiter = p.domainLimiter(name, now)
+		if !domainLimiter.allow(p.RateLimitPerDomain, now) {
+			return "rate_limited_domain", fmt.Errorf("%s: %w", name, ErrOnDemandRateLimited)
+		}
+	}
+
+	if globalEnabled {
+		p.globalLimiter.take(now)
+	}
+	if domainLimiter != nil {
+		domainLimiter.take(now)
+	}
+	return "", nil
+}
+
+// ask consults the ask endpoint about name, or the cache of its answers.
+func (p *OnDemandPolicy) ask(ctx context.Context, name string) (allowed, cached bool, err error) {
+	p.mu.Lock()
+	answer, ok := p.answers[name]
+	p.mu.Unlock()
+	if ok && time.Now().Before(answer.expires) {
+		return answer.allowed, true, nil
+	}
+
+	askURL, err := url.Parse(p.AskURL)
+	if err != nil {
+		return false, false, err
+	}
+	qs := askURL.Query()
+	qs.Set("domain", name)
+	askURL.RawQuery = qs.Encode()
+
+	timeout := p.AskTimeout
+	if timeout <= 0 {
+		timeout = defaultOnDemandAskTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, askURL.String(), nil)
+	if err != nil {
+		return false, false, err
+	}
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, false, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024*64))
+	resp.Body.Close()
+
+	allowed = resp.StatusCode >= 200 && resp.StatusCode <= 299
+	if p.Logger != nil {
+		p.Logger.Debug("on-demand ask endpoint responded",
+			zap.String("identifier", name),
+			zap.Int("status_code", resp.StatusCode),
+			zap.Bool("allowed", allowed))
+	}
+
+	ttl := p.DenyCacheTTL
+	if allowed {
+		ttl = p.AllowCacheTTL
+	}
+	if ttl > 0 {
+		p.mu.Lock()
+		if p.answers == nil {
+			p.answers = make(map[string]onDemandAnswer)
+		}
+		if len(p.answers) >= maxOnDemandCachedAnswers {
+			now := time.Now()
+			for key, a := range p.answers {
+				if now.After(a.expires) {
+					delete(p.answers, key)
+				}
+			}
+			if len(p.answers) >= maxOnDemandCachedAnswers {
+				p.answers = make(map[string]onDemandAnswer)
+			}
+		}
+		p.answers[name] = onDemandAnswer{allowed: allowed, expires: time.Now().Add(ttl)}
+		p.mu.Unlock()
+	}
+
+	return allowed, false, nil
+}
+
+// domainLimiter returns the rate limiter for the registrable domain
+// of name, creating it if needed. Once there are many limiters, those
+// that have been unused for longer than their window are cleaned up
+// along the way. It must be called with p.mu held.
+func (p *OnDemandPolicy) domainLimiter(name string, now time.Time) *onDemandLimiter {
+	key, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		key = name // e.g. IP addresses or public suffixes themselves
+	}
+
+	if rl, ok := p.domainLimiters[key]; ok {
+		rl.lastUsed = now
+		return rl
+	}
+
+	if p.domainLimiters == nil {
+		p.domainLimiters = make(map[string]*onDemandLimiter)
+	}
+	if len(p.domainLimiters) >= max(p.domainLimitersSweepAt, minOnDemandDomainLimitersSweep) {
+		for otherKey, rl := range p.domainLimiters {
+			if now.Sub(rl.lastUsed) > p.RateLimitPerDomain.Window {
+				delete(p.domainLimiters, otherKey)
+			}
+		}
+		// if most limiters are still in use, don't sweep
+		// again until the map has grown substantially
+		p.domainLimitersSweepAt = 2 * len(p.domainLimiters)
+	}
+	rl := &onDemandLimiter{lastUsed: now}
+	p.domainLimiters[key] = rl
+	return rl
+}
+
+// ErrOnDemandRateLimited is returned when an on-demand
+// certificate is denied because of an OnDemandPolicy
+// rate limit.
+var ErrOnDemandRateLimited = errors.New("on-demand rate limit exceeded")
+
+const (
+	defaultOnDemandAskTimeout = 10 * time.Second
+	maxOnDemandCachedAnswers  = 10000
+
+	// how many per-domain rate limiters there must be
+	// before idle ones are cleaned up
+	minOnDemandDomainLimitersSweep = 1000
+)
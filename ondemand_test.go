@@ -0,0 +1,171 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnDemandPolicyPatternsAndAsk(t *testing.T) {
+	ctx := context.Background()
+
+	var asked atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		if r.URL.Query().Get("domain") == "good.example.com" {
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	policy := &OnDemandPolicy{
+		Deny:          []string{"*.bad.example.com"},
+		Allow:         []string{"*.example.com"},
+		AskURL:        srv.URL,
+		AllowCacheTTL: time.Minute,
+		DenyCacheTTL:  time.Minute,
+	}
+
+	for i, tc := range []struct {
+		name         string
+		expectReason string
+		expectCached bool
+		expectAsked  int32
+	}{
+		{name: "foo.bad.example.com", expectReason: "deny_pattern"},
+		{name: "example.net", expectReason: "no_allow_pattern"},
+		{name: "good.example.com", expectReason: "allowed", expectAsked: 1},
+		{name: "good.example.com", expectReason: "allowed", expectCached: true, expectAsked: 1},
+		{name: "other.example.com", expectReason: "ask_denied", expectAsked: 2},
+		{name: "other.example.com", expectReason: "ask_denied", expectCached: true, expectAsked: 2},
+	} {
+		reason, cached, err := policy.decide(ctx, tc.name)
+		if reason != tc.expectReason {
+			t.Errorf("Test %d (%s): Expected reason %s, got %s (err=%v)", i, tc.name, tc.expectReason, reason, err)
+		}
+		if (err == nil) != (tc.expectReason == "allowed") {
+			t.Errorf("Test %d (%s): Unexpected error value: %v", i, tc.name, err)
+		}
+		if cached != tc.expectCached {
+			t.Errorf("Test %d (%s): Expected cached=%t, got %t", i, tc.name, tc.expectCached, cached)
+		}
+		if n := asked.Load(); n != tc.expectAsked {
+			t.Errorf("Test %d (%s): Expected ask endpoint to have been called %d times, got %d", i, tc.name, tc.expectAsked, n)
+		}
+	}
+
+	// errors reaching the endpoint are not cached
+	srv.Close()
+	if reason, _, err := policy.decide(ctx, "new.example.com"); err == nil || reason != "ask_error" {
+		t.Errorf("Expected ask error, got reason=%s err=%v", reason, err)
+	}
+}
+
+func TestOnDemandPolicyRateLimits(t *testing.T) {
+	ctx := context.Background()
+
+	policy := &OnDemandPolicy{
+		RateLimitPerDomain: OnDemandRateLimit{Events: 1, Window: time.Minute},
+		RateLimitGlobal:    OnDemandRateLimit{Events: 2, Window: 300 * time.Millisecond},
+	}
+
+	decide := func(name string) error {
+		return policy.Check(ctx, name)
+	}
+
+	if err := decide("a.example.com"); err != nil {
+		t.Fatalf("Expected a.example.com to be allowed, got: %v", err)
+	}
+	if err := decide("b.example.com"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Errorf("Expected per-domain rate limit for b.example.com, got: %v", err)
+	}
+
+	// the per-domain denial did not use up the global budget
+	if err := decide("a.example.net"); err != nil {
+		t.Errorf("Expected a.example.net to be allowed, got: %v", err)
+	}
+	if err := decide("a.example.org"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Errorf("Expected global rate limit for a.example.org, got: %v", err)
+	}
+
+	// the global denial did not use up the budget of example.org
+	time.Sleep(350 * time.Millisecond)
+	if err := decide("a.example.org"); err != nil {
+		t.Errorf("Expected a.example.org to be allowed, got: %v", err)
+	}
+}
+
+func TestOnDemandPolicyDomainLimiterSweep(t *testing.T) {
+	policy := &OnDemandPolicy{
+		RateLimitPerDomain: OnDemandRateLimit{Events: 1, Window: time.Minute},
+	}
+	now := time.Now()
+	policy.domainLimiters = make(map[string]*onDemandLimiter)
+	for i := range minOnDemandDomainLimitersSweep {
+		lastUsed := now.Add(-2 * time.Minute)
+		if i == 0 {
+			lastUsed = now
+		}
+		policy.domainLimiters[fmt.Sprintf("example%d.com", i)] = &onDemandLimiter{lastUsed: lastUsed}
+	}
+
+	policy.domainLimiter("example.net", now)
+
+	if len(policy.domainLimiters) != 2 {
+		t.Errorf("Expected idle limiters to be cleaned up, got %d limiters", len(policy.domainLimiters))
+	}
+	if _, ok := policy.domainLimiters["example0.com"]; !ok {
+		t.Error("Expected limiter in use to be kept")
+	}
+}
+
+func TestCheckIfCertShouldBeObtainedWithPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	var events []map[string]any
+	cfg := &Config{
+		OnDemand: &OnDemandConfig{
+			Policy: &OnDemandPolicy{Deny: []string{"denied.example.com"}},
+		},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "on_demand_decision" {
+				events = append(events, data)
+			}
+			return nil
+		},
+		Logger: defaultTestLogger,
+	}
+
+	if err := cfg.checkIfCertShouldBeObtained(ctx, "allowed.example.com", true); err != nil {
+		t.Errorf("Expected allowed.example.com to be allowed, got: %v", err)
+	}
+	if err := cfg.checkIfCertShouldBeObtained(ctx, "denied.example.com", true); err == nil {
+		t.Error("Expected denied.example.com to be denied")
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 decision events, got %d", len(events))
+	}
+	if events[0]["allowed"] != true || events[1]["allowed"] != false || events[1]["reason"] != "deny_pattern" {
+		t.Errorf("Unexpected decision events: %v", events)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OnDemandFailureCache remembers names for which obtaining a certificate
+// on-demand failed, so that handshakes for those names do not retry the
+// whole issuance flow every time. After each consecutive failure, the
+// name is backed off exponentially, starting at InitialBackoff and up
+// to MaxBackoff. A successful issuance clears the entry.
+//
+// If Storage is set, entries are also persisted there so that all
+// instances in a cluster share them. Entries in memory are then only
+// a cache that is refreshed from storage after a short while, so
+// failures, successes and clears on other instances are seen too.
+//
+// Entries are kept in memory until their backoff has elapsed; with
+// Storage, they are loaded again when needed. Without Storage, they
+// are kept until MaxBackoff after that, so that the backoff keeps
+// growing if the name fails again.
+type OnDemandFailureCache struct {
+	// The backoff after the first failure. Default: 1 minute.
+	InitialBackoff time.Duration
+
+	// The maximum backoff. Default: 24 hours.
+	MaxBackoff time.Duration
+
+	// If set, entries are persisted to this storage.
+	Storage Storage
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu      sync.Mutex
+	entries map[string]cachedOnDemandFailure
+}
+
+// cachedOnDemandFailure is a failure entry in memory.
+type cachedOnDemandFailure struct {
+	OnDemandFailure
+	loaded time.Time // when it was loaded from or stored to Storage
+}
+
+// OnDemandFailure describes recent failures to obtain
+// a certificate on-demand for a name.
+type OnDemandFailure struct {
+	// The name the certificate was for.
+	Name string `json:"name"`
+
+	// The number of consecutive failures.
+	Failures int `json:"failures"`
+
+	// When the last failure happened.
+	LastFailure time.Time `json:"last_failure"`
+
+	// The error of the last failure.
+	LastError string `json:"last_error,omitempty"`
+
+	// Issuance is not attempted again before this time.
+	RetryAfter time.Time `json:"retry_after"`
+}
+
+// Get returns the failure entry for name, if any. Entries whose
+// backoff has elapsed are still returned until they are cleared
+// by a successful issuance or by calling Clear, or until they
+// are forgotten (see OnDemandFailureCache).
+func (fc *OnDemandFailureCache) Get(ctx context.Context, name string) (OnDemandFailure, bool, error) {
+	fc.mu.Lock()
+	cached, ok := fc.entries[name]
+	fc.mu.Unlock()
+	if fc.Storage == nil {
+		return cached.OnDemandFailure, ok, nil
+	}
+	if ok && time.Since(cached.loaded) < onDemandFailureRefreshInterval {
+		return cached.OnDemandFailure, true, nil
+	}
+
+	var entry OnDemandFailure
+	entryBytes, err := fc.Storage.Load(ctx, onDemandFailureStorageKey(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		// cleared, possibly by another instance
+		fc.mu.Lock()
+		delete(fc.entries, name)
+		fc.mu.Unlock()
+		return OnDemandFailure{}, false, nil
+	}
+	if err != nil {
+		return OnDemandFailure{}, false, fmt.Errorf("loading on-demand failure entry: %v", err)
+	}
+	if err := json.Unmarshal(entryBytes, &entry); err != nil {
+		return OnDemandFailure{}, false, fmt.Errorf("decoding on-demand failure entry: %v", err)
+	}
+
+	fc.remember(entry)
+
+	return entry, true, nil
+}
+
+// List returns all failure entries, sorted by name. If Storage
+// is set, entries recorded by other instances are included.
+func (fc *OnDemandFailureCache) List(ctx context.Context) ([]OnDemandFailure, error) {
+	all := make(map[string]OnDemandFailure)
+	fc.mu.Lock()
+	for name, cached := range fc.entries {
+		all[name] = cached.OnDemandFailure
+	}
+	fc.mu.Unlock()
+
+	if fc.Storage != nil {
+		keys, err := fc.Storage.List(ctx, prefixOnDemandFailures, false)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("listing on-demand failure entries: %v", err)
+		}
+		for _, key := range keys {
+			entryBytes, err := fc.Storage.Load(ctx, key)
+			if err != nil {
+				continue // may have been cleared in the meantime
+			}
+			var entry OnDemandFailure
+			if err := json.Unmarshal(entryBytes, &entry); err != nil {
+				continue
+			}
+			if existing, ok := all[entry.Name]; !ok || entry.LastFailure.After(existing.LastFailure) {
+				all[entry.Name] = entry
+			}
+		}
+	}
+
+	list := make([]OnDemandFailure, 0, len(all))
+	for _, entry := range all {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Clear removes the failure entry for name, allowing
+// issuance to be attempted again immediately.
+func (fc *OnDemandFailureCache) Clear(ctx context.Context, name string) error {
+	fc.mu.Lock()
+	delete(fc.entries, name)
+	fc.mu.Unlock()
+	if fc.Storage == nil {
+		return nil
+	}
+	err := fc.Storage.Delete(ctx, onDemandFailureStorageKey(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ClearAll removes all failure entries.
+func (fc *OnDemandFailureCache) ClearAll(ctx context.Context) error {
+	list, err := fc.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range list {
+		if err := fc.Clear(ctx, entry.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns an error wrapping ErrOnDemandBackoff if name
+// is currently backed off after failures.
+func (fc *OnDemandFailureCache) check(ctx context.Context, name string) error {
+	entry, ok, err := fc.Get(ctx, name)
+	if err != nil {
+		// don't let a storage problem prevent issuance
+		fc.logger().Error("checking on-demand failure cache", zap.String("identifier", name), zap.Error(err))
+		return nil
+	}
+	if ok && time.Now().Before(entry.RetryAfter) {
+		return fmt.Errorf("%s failed %d times, last: %s; %w until %s",
+			name, entry.Failures, entry.LastError, ErrOnDemandBackoff, entry.RetryAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// recordFailure records a failure to obtain a certificate for
+// name and returns the updated entry. If issuance was skipped
+// because of a known CA rate limit, the name is backed off until
+// the rate limit ends instead of counting as another failure.
+func (fc *OnDemandFailureCache) recordFailure(ctx context.Context, name string, failure error) OnDemandFailure {
+	entry, _, err := fc.Get(ctx, name)
+	if err != nil {
+		fc.logger().Error("loading on-demand failure entry", zap.String("identifier", name), zap.Error(err))
+	}
+
+	now := time.Now()
+	entry.Name = name
+	entry.LastFailure = now
+	entry.LastError = failure.Error()
+	var errRateLimited ErrRateLimited
+	if errors.As(failure, &errRateLimited) && errRateLimited.Skipped && errRateLimited.RetryAfter.After(now) {
+		entry.RetryAfter = errRateLimited.RetryAfter
+	} else {
+		entry.Failures++
+		entry.RetryAfter = now.Add(fc.backoff(entry.Failures))
+	}
+
+	fc.remember(entry)
+
+	if fc.Storage != nil {
+		entryBytes, err := json.Marshal(entry)
+		if err == nil {
+			err = fc.Storage.Store(ctx, onDemandFailureStorageKey(name), entryBytes)
+		}
+		if err != nil {
+			fc.logger().Error("storing on-demand failure entry", zap.String("identifier", name), zap.Error(err))
+		}
+	}
+
+	fc.logger().Warn("on-demand certificate issuance failed; backing off",
+		zap.String("identifier", name),
+		zap.Int("failures", entry.Failures),
+		zap.Time("retry_after", entry.RetryAfter),
+		zap.Error(failure))
+
+	return entry
+}
+
+// recordSuccess clears any failure entry for name.
+func (fc *OnDemandFailureCache) recordSuccess(ctx context.Context, name string) {
+	fc.mu.Lock()
+	_, inMemory := fc.entries[name]
+	fc.mu.Unlock()
+	if !inMemory && fc.Storage == nil {
+		return
+	}
+	if err := fc.Clear(ctx, name); err != nil {
+		fc.logger().Error("clearing on-demand failure entry", zap.String("identifier", name), zap.Error(err))
+	}
+}
+
+// remember keeps entry in memory, and forgets the
+// entries that do not need to be kept anymore.
+func (fc *OnDemandFailureCache) remember(entry OnDemandFailure) {
+	now := time.Now()
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.entries == nil {
+		fc.entries = make(map[string]cachedOnDemandFailure)
+	}
+	for name, cached := range fc.entries {
+		forgetAfter := cached.RetryAfter
+		if fc.Storage == nil {
+			forgetAfter = forgetAfter.Add(fc.maxBackoff())
+		}
+		if now.After(forgetAfter) {
+			delete(fc.entries, name)
+		}
+	}
+	fc.entries[entry.Name] = cachedOnDemandFailure{OnDemandFailure: entry, loaded: now}
+}
+
+// backoff returns the backoff duration after the given
+// number of consecutive failures.
+func (fc *OnDemandFailureCache) backoff(failures int) time.Duration {
+	initial, maximum := fc.InitialBackoff, fc.maxBackoff()
+	if initial <= 0 {
+		initial = defaultOnDemandInitialBackoff
+	}
+	backoff := initial
+	for i := 1; i < failures && backoff < maximum; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maximum)
+}
+
+// maxBackoff returns the maximum backoff duration.
+func (fc *OnDemandFailureCache) maxBackoff() time.Duration {
+	if fc.MaxBackoff <= 0 {
+		return defaultOnDemandMaxBackoff
+	}
+	return fc.MaxBackoff
+}
+
+func (fc *OnDemandFailureCache) logger() *zap.Logger {
+	if fc.Logger == nil {
+		return zap.NewNop()
+	}
+	return fc.Logger
+}
+
+// onDemandFailureStorageKey returns the storage key
+// of the failure entry for name.
+func onDemandFailureStorageKey(name string) string {
+	return path.Join(prefixOnDemandFailures, StorageKeys.Safe(name)+".json")
+}
+
+// ErrOnDemandBackoff is returned when an on-demand certificate
+// is not obtained because previous attempts for the same name
+// failed recently (see OnDemandFailureCache).
+var ErrOnDemandBackoff = errors.New("backing off after on-demand issuance failures")
+
+const (
+	prefixOnDemandFailures = "on_demand_failures"
+
+	// how long failure entries in memory are used before
+	// they are loaded from storage again
+	onDemandFailureRefreshInterval = 10 * time.Second
+
+	defaultOnDemandInitialBackoff = time.Minute
+	defaultOnDemandMaxBackoff     = 24 * time.Hour
+)
@@ -0,0 +1,240 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingIssuer is an Issuer for tests that always fails, without
+// retries, with err or else a generic error.
+type failingIssuer struct {
+	attempts int
+	err      error
+}
+
+func (iss *failingIssuer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	iss.attempts++
+	if iss.err != nil {
+		return nil, ErrNoRetry{iss.err}
+	}
+	return nil, ErrNoRetry{errors.New("DNS does not point here")}
+}
+
+func (iss *failingIssuer) IssuerKey() string { return "failing" }
+
+func TestOnDemandFailureCacheBackoff(t *testing.T) {
+	fc := &OnDemandFailureCache{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for failures, expect := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  5 * time.Second,
+		40: 5 * time.Second,
+	} {
+		if actual := fc.backoff(failures); actual != expect {
+			t.Errorf("After %d failures: expected backoff %s, got %s", failures, expect, actual)
+		}
+	}
+}
+
+func TestOnDemandFailureCacheSharedInStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	fc1 := &OnDemandFailureCache{Storage: storage}
+	fc2 := &OnDemandFailureCache{Storage: storage}
+
+	if err := fc1.check(ctx, "example.com"); err != nil {
+		t.Fatalf("Expected no backoff before any failures, got: %v", err)
+	}
+	fc1.recordFailure(ctx, "example.com", errors.New("oops"))
+	entry := fc1.recordFailure(ctx, "example.com", errors.New("oops again"))
+	if entry.Failures != 2 || entry.LastError != "oops again" {
+		t.Errorf("Unexpected entry: %+v", entry)
+	}
+
+	// the other instance sees the entry through storage
+	if err := fc2.check(ctx, "example.com"); !errors.Is(err, ErrOnDemandBackoff) {
+		t.Errorf("Expected backoff error from other instance, got: %v", err)
+	}
+	list, err := fc2.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "example.com" || list[0].Failures != 2 {
+		t.Errorf("Unexpected list: %+v", list)
+	}
+
+	if err := fc2.ClearAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := (&OnDemandFailureCache{Storage: storage}).Get(ctx, "example.com"); ok || err != nil {
+		t.Errorf("Expected entry to be cleared from storage, got ok=%t err=%v", ok, err)
+	}
+
+	// the first instance sees the clear once its entry is refreshed
+	fc1.mu.Lock()
+	cached := fc1.entries["example.com"]
+	cached.loaded = cached.loaded.Add(-onDemandFailureRefreshInterval)
+	fc1.entries["example.com"] = cached
+	fc1.mu.Unlock()
+	if err := fc1.check(ctx, "example.com"); err != nil {
+		t.Errorf("Expected no backoff after clear on other instance, got: %v", err)
+	}
+	if len(fc1.entries) != 0 {
+		t.Errorf("Expected cleared entry to be forgotten, got %v", fc1.entries)
+	}
+}
+
+func TestOnDemandFailureCacheForgetsEntries(t *testing.T) {
+	ctx := context.Background()
+	fc := &OnDemandFailureCache{InitialBackoff: time.Minute, MaxBackoff: time.Hour}
+
+	fc.recordFailure(ctx, "old.example.com", errors.New("oops"))
+	fc.mu.Lock()
+	old := fc.entries["old.example.com"]
+	old.RetryAfter = time.Now().Add(-2 * time.Hour)
+	fc.entries["old.example.com"] = old
+	fc.mu.Unlock()
+
+	// entries are forgotten some time after their backoff elapsed
+	fc.recordFailure(ctx, "new.example.com", errors.New("oops"))
+	if _, ok, _ := fc.Get(ctx, "old.example.com"); ok {
+		t.Error("Expected old entry to be forgotten")
+	}
+	if entry, ok, _ := fc.Get(ctx, "new.example.com"); !ok || entry.Failures != 1 {
+		t.Errorf("Expected new entry, got %+v (ok=%t)", entry, ok)
+	}
+}
+
+func TestObtainOnDemandCertificateBacksOff(t *testing.T) {
+	ctx := context.Background()
+
+	iss := new(failingIssuer)
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	fc := &OnDemandFailureCache{InitialBackoff: time.Hour}
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{iss},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		OnDemand:            &OnDemandConfig{FailureCache: fc},
+		DisableStorageCheck: true,
+		Logger:              defaultTestLogger,
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	if _, err := cfg.obtainOnDemandCertificate(ctx, hello); err == nil {
+		t.Fatal("Expected first attempt to fail")
+	}
+	if _, err := cfg.obtainOnDemandCertificate(ctx, hello); !errors.Is(err, ErrOnDemandBackoff) {
+		t.Errorf("Expected second attempt to be backed off, got: %v", err)
+	}
+	if iss.attempts != 1 {
+		t.Errorf("Expected 1 issuance attempt, got %d", iss.attempts)
+	}
+
+	if err := fc.Clear(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.obtainOnDemandCertificate(ctx, hello); err == nil || errors.Is(err, ErrOnDemandBackoff) {
+		t.Errorf("Expected issuance to be attempted again after clearing, got: %v", err)
+	}
+	if iss.attempts != 2 {
+		t.Errorf("Expected 2 issuance attempts, got %d", iss.attempts)
+	}
+}
+
+func TestOnDemandFailureCacheSkippedRateLimit(t *testing.T) {
+	ctx := context.Background()
+	fc := &OnDemandFailureCache{InitialBackoff: time.Minute}
+
+	retryAfter := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	entry := fc.recordFailure(ctx, "example.com", ErrRateLimited{
+		Err:        errRateLimitedByCA,
+		RetryAfter: retryAfter,
+		Skipped:    true,
+	})
+	if entry.Failures != 0 || !entry.RetryAfter.Equal(retryAfter) {
+		t.Errorf("Expected backoff until end of rate limit without counting a failure, got %+v", entry)
+	}
+
+	entry = fc.recordFailure(ctx, "example.com", errors.New("oops"))
+	if entry.Failures != 1 {
+		t.Errorf("Expected 1 failure, got %+v", entry)
+	}
+}
+
+func TestObtainOnDemandCertificateCanceled(t *testing.T) {
+	ctx := context.Background()
+
+	iss := &failingIssuer{err: context.Canceled}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	fc := &OnDemandFailureCache{InitialBackoff: time.Hour}
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{iss},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		OnDemand:            &OnDemandConfig{FailureCache: fc},
+		DisableStorageCheck: true,
+		Logger:              defaultTestLogger,
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	if _, err := cfg.obtainOnDemandCertificate(ctx, hello); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation, got: %v", err)
+	}
+	if _, ok, _ := fc.Get(ctx, "example.com"); ok {
+		t.Error("Expected cancellation not to be recorded as a failure")
+	}
+}
+
+func TestCheckIfCertShouldBeObtainedBackedOff(t *testing.T) {
+	ctx := context.Background()
+
+	var asks atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asks.Add(1)
+	}))
+	defer srv.Close()
+
+	fc := new(OnDemandFailureCache)
+	cfg := &Config{OnDemand: &OnDemandConfig{
+		FailureCache: fc,
+		Policy:       &OnDemandPolicy{AskURL: srv.URL},
+	}}
+
+	fc.recordFailure(ctx, "example.com", errors.New("oops"))
+	if err := cfg.checkIfCertShouldBeObtained(ctx, "example.com", true); !errors.Is(err, ErrOnDemandBackoff) {
+		t.Errorf("Expected backoff error, got: %v", err)
+	}
+	if asks.Load() != 0 {
+		t.Errorf("Expected ask endpoint not to be consulted for a backed off name, got %d requests", asks.Load())
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlaceholderCertificates configures self-signed placeholder certificates
+// to serve during handshakes for which no certificate is available, for
+// example because the name is unknown, or because a certificate is still
+// being obtained on-demand (in which case issuance continues in the
+// background instead of holding up the handshake). Clients will not trust
+// placeholder certificates, but they complete the handshake rather than
+// receiving a TLS alert, which some clients (like aggressive health
+// checkers) handle better.
+//
+// Placeholders are only served for names that may get a certificate:
+// names that are managed, and with on-demand TLS, names that are allowed
+// by the on-demand decision. Handshakes for other names fail as usual.
+//
+// Placeholder certificates are generated on-the-fly, cached in memory per
+// name, short-lived, and never written to storage. They have the tag
+// PlaceholderCertificateTag.
+type PlaceholderCertificates struct {
+	// How long placeholder certificates are valid for.
+	// Default: 1 hour.
+	Lifetime time.Duration
+
+	// The type of key for placeholder certificates.
+	// Default: P256.
+	KeyType KeyType
+
+	mu      sync.Mutex
+	certs   map[string]Certificate
+	pending map[string]*placeholderCall // keyed by name
+	managed map[string]struct{}         // names managed without on-demand TLS
+}
+
+// placeholderCall is the generation of a placeholder
+// certificate, which other callers can wait for.
+type placeholderCall struct {
+	done chan struct{}
+	cert Certificate
+	err  error
+}
+
+// certificate returns a placeholder certificate for name, generating
+// one if a usable one is not already cached. Concurrent calls for the
+// same name share one generation.
+func (pc *PlaceholderCertificates) certificate(name string) (Certificate, error) {
+	lifetime := pc.Lifetime
+	if lifetime <= 0 {
+		lifetime = defaultPlaceholderLifetime
+	}
+
+	pc.mu.Lock()
+
+	// reuse cached certificate unless it is in the last tenth of its lifetime
+	if cert, ok := pc.certs[name]; ok && time.Now().Before(cert.Leaf.NotAfter.Add(-lifetime/10)) {
+		pc.mu.Unlock()
+		return cert, nil
+	}
+
+	// if one is being generated already, wait for it
+	if call, ok := pc.pending[name]; ok {
+		pc.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &placeholderCall{done: make(chan struct{})}
+	if pc.pending == nil {
+		pc.pending = make(map[string]*placeholderCall)
+	}
+	pc.pending[name] = call
+	pc.mu.Unlock()
+
+	// generating a key takes a while, so don't hold the lock
+	call.cert, call.err = makePlaceholderCertificate(name, pc.KeyType, lifetime)
+
+	pc.mu.Lock()
+	delete(pc.pending, name)
+	if call.err == nil {
+		pc.cacheLocked(name, call.cert)
+	}
+	pc.mu.Unlock()
+	close(call.done)
+
+	return call.cert, call.err
+}
+
+// cacheLocked caches cert for name. If the cache is full, expired
+// certificates are evicted, or if there are none, the one that
+// expires first. It must be called while holding pc.mu.
+func (pc *PlaceholderCertificates) cacheLocked(name string, cert Certificate) {
+	if pc.certs == nil {
+		pc.certs = make(map[string]Certificate)
+	}
+	if _, ok := pc.certs[name]; !ok && len(pc.certs) >= maxPlaceholderCertificates {
+		now := time.Now()
+		var oldestName string
+		var oldest time.Time
+		for otherName, other := range pc.certs {
+			if now.After(other.Leaf.NotAfter) {
+				delete(pc.certs, otherName)
+				continue
+			}
+			if oldestName == "" || other.Leaf.NotAfter.Before(oldest) {
+				oldestName, oldest = otherName, other.Leaf.NotAfter
+			}
+		}
+		if len(pc.certs) >= maxPlaceholderCertificates {
+			delete(pc.certs, oldestName)
+		}
+	}
+	pc.certs[name] = cert
+}
+
+// manage registers name, which is managed without on-demand
+// TLS, so that placeholders are served for it until it has a
+// certificate.
+func (pc *PlaceholderCertificates) manage(name string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.managed == nil {
+		pc.managed = make(map[string]struct{})
+	}
+	pc.managed[name] = struct{}{}
+}
+
+// isManaged returns true if name, or a wildcard
+// matching it, has been registered with manage.
+func (pc *PlaceholderCertificates) isManaged(name string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if _, ok := pc.managed[name]; ok {
+		return true
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		_, ok := pc.managed["*."+rest]
+		return ok
+	}
+	return false
+}
+
+// placeholderEligibleError wraps the error of a handshake for
+// a name that may get a certificate, so a placeholder may be
+// served instead (see PlaceholderCertificates).
+type placeholderEligibleError struct{ error }
+
+func (e placeholderEligibleError) Unwrap() error { return e.error }
+
+// makePlaceholderCertificate generates a self-signed certificate for name.
+func makePlaceholderCertificate(name string, keyType KeyType, lifetime time.Duration) (Certificate, error) {
+	if keyType == "" {
+		keyType = P256
+	}
+	privKey, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return Certificate{}, err
+	}
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return Certificate{}, fmt.Errorf("private key of type %T is not a signer", privKey)
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"CertMagic Placeholder"}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	if _, ok := signer.(*rsa.PrivateKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("creating placeholder certificate: %v", err)
+	}
+
+	cert := Certificate{Tags: []string{PlaceholderCertificateTag}}
+	err = fillCertFromLeaf(&cert, tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  privKey,
+	})
+	if err != nil {
+		return Certificate{}, err
+	}
+	return cert, nil
+}
+
+// PlaceholderCertificateTag is the tag of placeholder certificates.
+const PlaceholderCertificateTag = "certmagic_placeholder"
+
+const (
+	defaultPlaceholderLifetime = time.Hour
+	maxPlaceholderCertificates = 10000
+)
@@ -0,0 +1,228 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlaceholderCertificates(t *testing.T) {
+	pc := &PlaceholderCertificates{Lifetime: time.Hour}
+
+	cert1, err := pc.certificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert1.HasTag(PlaceholderCertificateTag) {
+		t.Errorf("Expected placeholder tag, got: %v", cert1.Tags)
+	}
+	if len(cert1.Names) != 1 || cert1.Names[0] != "example.com" {
+		t.Errorf("Unexpected names: %v", cert1.Names)
+	}
+	if err := cert1.Leaf.CheckSignature(cert1.Leaf.SignatureAlgorithm, cert1.Leaf.RawTBSCertificate, cert1.Leaf.Signature); err != nil {
+		t.Errorf("Expected self-signed certificate: %v", err)
+	}
+	if _, err := cert1.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: x509.NewCertPool()}); err == nil {
+		t.Error("Expected placeholder certificate not to be trusted")
+	}
+
+	cert2, err := pc.certificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert1.hash != cert2.hash {
+		t.Error("Expected placeholder certificate to be reused")
+	}
+
+	ipCert, err := pc.certificate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ipCert.Leaf.IPAddresses) != 1 || len(ipCert.Leaf.DNSNames) != 0 {
+		t.Errorf("Expected IP SAN, got IPs %v and DNS names %v", ipCert.Leaf.IPAddresses, ipCert.Leaf.DNSNames)
+	}
+}
+
+func TestPlaceholderCertificatesConcurrentAndEviction(t *testing.T) {
+	pc := new(PlaceholderCertificates)
+
+	// concurrent calls for a name share one certificate
+	hashes := make(chan string, 10)
+	var wg sync.WaitGroup
+	for range cap(hashes) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := pc.certificate("example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			hashes <- cert.hash
+		}()
+	}
+	wg.Wait()
+	close(hashes)
+	first := <-hashes
+	for hash := range hashes {
+		if hash != first {
+			t.Fatal("Expected concurrent calls to share one placeholder certificate")
+		}
+	}
+
+	// a full cache evicts the entry that expires first, not all of them
+	cached := pc.certs["example.com"]
+	for i := range maxPlaceholderCertificates - 1 {
+		leaf := *cached.Leaf
+		leaf.NotAfter = leaf.NotAfter.Add(time.Duration(i+1) * time.Second)
+		pc.certs[fmt.Sprintf("%d.example.com", i)] = Certificate{Certificate: tls.Certificate{Leaf: &leaf}}
+	}
+	if _, err := pc.certificate("new.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(pc.certs) != maxPlaceholderCertificates {
+		t.Errorf("Expected full cache, got %d entries", len(pc.certs))
+	}
+	if _, ok := pc.certs["example.com"]; ok {
+		t.Error("Expected the certificate that expires first to be evicted")
+	}
+	if _, ok := pc.certs["0.example.com"]; !ok {
+		t.Error("Expected other certificates to stay cached")
+	}
+}
+
+func TestPlaceholderOnlyForManagedNames(t *testing.T) {
+	iss := &signalingIssuer{attempted: make(chan struct{})}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{iss},
+		Storage:             &FileStorage{Path: t.TempDir()},
+		Placeholder:         &PlaceholderCertificates{},
+		DisableStorageCheck: true,
+		Logger:              defaultTestLogger,
+	})
+	if err := cfg.ManageAsync(context.Background(), []string{"*.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com", Conn: conn}); err != nil {
+		t.Errorf("Expected placeholder certificate for managed name, got error: %v", err)
+	}
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.net", Conn: conn}); err == nil {
+		t.Error("Expected no placeholder certificate for a name that is not managed")
+	}
+	if len(cfg.Placeholder.certs) != 1 {
+		t.Errorf("Expected 1 placeholder certificate, got %d", len(cfg.Placeholder.certs))
+	}
+}
+
+func TestPlaceholderWhileObtainingOnDemand(t *testing.T) {
+	iss := &signalingIssuer{attempted: make(chan struct{})}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	storage := &FileStorage{Path: t.TempDir()}
+	cfg := New(cache, Config{
+		Issuers:             []Issuer{iss},
+		Storage:             storage,
+		OnDemand:            &OnDemandConfig{},
+		Placeholder:         &PlaceholderCertificates{},
+		DisableStorageCheck: true,
+		Logger:              defaultTestLogger,
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	tlsCert, err := cfg.GetCertificateWithContext(context.Background(), hello)
+	if err != nil {
+		t.Fatalf("Expected placeholder certificate, got error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "example.com" || leaf.Issuer.CommonName != "example.com" {
+		t.Errorf("Expected self-signed placeholder for example.com, got subject %s issued by %s", leaf.Subject, leaf.Issuer)
+	}
+
+	// issuance is attempted in the background
+	select {
+	case <-iss.attempted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected issuance to be attempted in the background")
+	}
+	for i := 0; i < 100; i++ {
+		obtainCertWaitChansMu.Lock()
+		_, pending := obtainCertWaitChans["example.com"]
+		obtainCertWaitChansMu.Unlock()
+		if !pending {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if certs := cache.getAllCerts(); len(certs) != 0 {
+		t.Errorf("Expected placeholder not to be cached, but cache has %d certificates", len(certs))
+	}
+	err = filepath.WalkDir(storage.Path, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(fpath, ".crt") || strings.HasSuffix(fpath, ".key") {
+			t.Errorf("Expected no certificate or key to be stored, found: %s", fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signalingIssuer is an Issuer for tests that always fails,
+// and closes attempted when issuance is first attempted.
+type signalingIssuer struct{ attempted chan struct{} }
+
+func (iss *signalingIssuer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	close(iss.attempted)
+	return nil, ErrNoRetry{errors.New("not today")}
+}
+
+func (iss *signalingIssuer) IssuerKey() string { return "signaling" }
@@ -0,0 +1,252 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// ReachabilityCheck configures checking, before ordering a certificate,
+// whether the CA will be able to reach this node or cluster at each of
+// its names. The HTTP-01 and TLS-ALPN-01 challenges are then only tried
+// if they can succeed, instead of failing validation at the CA, which
+// counts against its rate limits. It has no effect on wildcard names,
+// which require the DNS challenge, or if the DNS challenge is enabled.
+type ReachabilityCheck struct {
+	// The IP addresses and CIDR ranges of this node or
+	// cluster. If a name resolves to addresses that are
+	// not in this list, the HTTP-01 and TLS-ALPN-01
+	// challenges are disabled. If empty, addresses are
+	// not checked.
+	OwnAddresses []string
+
+	// If true, a request for a synthetic HTTP-01 challenge
+	// token is sent to each address of a name, which must
+	// be answered by HTTPChallengeHandler (of any instance
+	// in the cluster); otherwise, the HTTP-01 challenge is
+	// disabled.
+	ProbeHTTP bool
+
+	// The port to send probe requests to. Default: 80
+	// (HTTPChallengePort), which is where CAs connect.
+	ProbePort int
+
+	// How long to wait for a response to a probe.
+	// Default: 10 seconds.
+	ProbeTimeout time.Duration
+
+	// The DNS resolvers to look up addresses with.
+	// Default: the system's resolvers, or well-known
+	// public resolvers (see RecursiveNameservers).
+	Resolvers []string
+}
+
+// withReachableChallenges returns am, or a copy of it with the HTTP-01
+// and TLS-ALPN-01 challenges disabled if the reachability check shows
+// that they cannot succeed for names. It returns an error if none of
+// the enabled challenges can succeed. Names whose addresses cannot be
+// looked up are not considered unreachable.
+func (am *ACMEIssuer) withReachableChallenges(ctx context.Context, names []string) (*ACMEIssuer, error) {
+	rc := am.ReachabilityCheck
+	if rc == nil || am.DNS01Solver != nil || am.DNSPersist01Solver != nil || (am.DisableHTTPChallenge && am.DisableTLSALPNChallenge) {
+		return am, nil
+	}
+	resolvers := RecursiveNameservers(rc.Resolvers)
+
+	httpOK, tlsALPNOK := !am.DisableHTTPChallenge, !am.DisableTLSALPNChallenge
+	var reasons []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			continue // wildcards can only be validated with the DNS challenge
+		}
+		addrs, err := lookupAddresses(ctx, name, resolvers)
+		if err != nil {
+			am.Logger.Warn("could not look up addresses; skipping reachability check",
+				zap.String("identifier", name),
+				zap.Error(err))
+			continue
+		}
+		if len(addrs) == 0 {
+			reasons = append(reasons, name+" has no addresses")
+			httpOK, tlsALPNOK = false, false
+			continue
+		}
+		if len(rc.OwnAddresses) > 0 {
+			var foreign []string
+			for _, addr := range addrs {
+				if !addressInRanges(addr.String(), rc.OwnAddresses) {
+					foreign = append(foreign, addr.String())
+				}
+			}
+			if len(foreign) > 0 {
+				reasons = append(reasons, fmt.Sprintf("%s resolves to addresses that are not ours: %s", name, strings.Join(foreign, ", ")))
+				httpOK, tlsALPNOK = false, false
+				continue
+			}
+		}
+		if httpOK && rc.ProbeHTTP {
+			if err := am.probeHTTPChallenge(ctx, name, addrs); err != nil {
+				reasons = append(reasons, err.Error())
+				httpOK = false
+			}
+		}
+	}
+
+	if httpOK == !am.DisableHTTPChallenge && tlsALPNOK == !am.DisableTLSALPNChallenge {
+		return am, nil
+	}
+	if !httpOK && !tlsALPNOK {
+		return nil, fmt.Errorf("%v: no enabled challenge type can succeed: %s", names, strings.Join(reasons, "; "))
+	}
+	am.Logger.Warn("disabling challenge types that cannot succeed",
+		zap.Strings("identifiers", names),
+		zap.Bool("http-01", httpOK),
+		zap.Bool("tls-alpn-01", tlsALPNOK),
+		zap.Strings("reasons", reasons))
+
+	am.mu.Lock()
+	iss := *am
+	am.mu.Unlock()
+	iss.DisableHTTPChallenge = !httpOK
+	iss.DisableTLSALPNChallenge = !tlsALPNOK
+	return &iss, nil
+}
+
+// probeHTTPChallenge presents a synthetic HTTP-01 challenge for name
+// the same way a real one would be presented, then requests it from
+// each of addrs like a CA would. It returns an error if the response
+// from any of them is not correct.
+func (am *ACMEIssuer) probeHTTPChallenge(ctx context.Context, name string, addrs []netip.Addr) error {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeHTTP01,
+		Token:            token,
+		KeyAuthorization: token + ".reachability-probe",
+		Identifier:       acme.Identifier{Type: "dns", Value: name},
+	}
+	if SubjectIsIP(name) {
+		chal.Identifier.Type = "ip"
+	}
+
+	var solver acmez.Solver = probeSolver{}
+	if !am.DisableDistributedSolvers {
+		solver = distributedSolver{
+			storage:                am.config.Storage,
+			storageKeyIssuerPrefix: am.storageKeyCAPrefix(am.CA),
+			solver:                 solver,
+		}
+	}
+	solver = solverWrapper{solver}
+	if err := solver.Present(ctx, chal); err != nil {
+		return fmt.Errorf("presenting probe challenge for %s: %v", name, err)
+	}
+	defer func() {
+		if err := solver.CleanUp(ctx, chal); err != nil {
+			am.Logger.Error("cleaning up probe challenge", zap.String("identifier", name), zap.Error(err))
+		}
+	}()
+
+	rc := am.ReachabilityCheck
+	port := rc.ProbePort
+	if port == 0 {
+		port = HTTPChallengePort
+	}
+	timeout := rc.ProbeTimeout
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: nil, DisableKeepAlives: true},
+	}
+	for _, addr := range addrs {
+		probeURL := "http://" + net.JoinHostPort(addr.String(), strconv.Itoa(port)) + chal.HTTP01ResourcePath()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = name
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("probing %s at %s: %v", name, addr, err)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("probing %s at %s: reading response: %v", name, addr, err)
+		}
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(bytes.TrimSpace(body), []byte(chal.KeyAuthorization)) {
+			return fmt.Errorf("probing %s at %s: HTTP challenge was not answered (HTTP %d)", name, addr, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// probeSolver is the solver of probe challenges; presenting
+// them only requires the wrappers around it to do their job.
+type probeSolver struct{}
+
+func (probeSolver) Present(context.Context, acme.Challenge) error { return nil }
+func (probeSolver) CleanUp(context.Context, acme.Challenge) error { return nil }
+
+// lookupAddresses returns the IPv4 and IPv6 addresses of name,
+// which is its own address if it is an IP address.
+func lookupAddresses(ctx context.Context, name string, resolvers []string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(name); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	var addrs []netip.Addr
+	for _, rtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := lookupRecords(ctx, dns.Fqdn(name), rtype, resolvers)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range answer {
+			var ip net.IP
+			switch rec := rr.(type) {
+			case *dns.A:
+				ip = rec.A
+			case *dns.AAAA:
+				ip = rec.AAAA
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+	}
+	return addrs, nil
+}
+
+const defaultProbeTimeout = 10 * time.Second
@@ -0,0 +1,132 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/certmagic/certmagictest"
+)
+
+func TestWithReachableChallenges(t *testing.T) {
+	ctx := context.Background()
+	resolver := startTestDNSServer(t,
+		"ours.example. 60 IN A 127.0.0.1",
+		"elsewhere.example. 60 IN A 192.0.2.1",
+		"mixed.example. 60 IN A 127.0.0.1",
+		"mixed.example. 60 IN AAAA 2001:db8::1",
+	)
+
+	cfg := &Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger}
+	am := NewACMEIssuer(cfg, ACMEIssuer{
+		CA:     "https://ca.example/directory",
+		Logger: defaultTestLogger,
+	})
+	cfg.Issuers = []Issuer{am}
+
+	serving := httptest.NewServer(am.HTTPChallengeHandler(http.NotFoundHandler()))
+	defer serving.Close()
+	notServing := httptest.NewServer(http.NotFoundHandler())
+	defer notServing.Close()
+
+	newCheck := func(srv *httptest.Server) *ReachabilityCheck {
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ReachabilityCheck{
+			OwnAddresses: []string{"127.0.0.0/8"},
+			ProbeHTTP:    true,
+			ProbePort:    port,
+			Resolvers:    []string{resolver},
+		}
+	}
+
+	for i, tc := range []struct {
+		name          string
+		check         *ReachabilityCheck
+		disableTLS    bool
+		expectErr     bool
+		expectHTTP    bool
+		expectTLSALPN bool
+	}{
+		{name: "ours.example", check: newCheck(serving), expectHTTP: true, expectTLSALPN: true},
+		{name: "ours.example", check: newCheck(notServing), expectTLSALPN: true},
+		{name: "ours.example", check: newCheck(notServing), disableTLS: true, expectErr: true},
+		{name: "127.0.0.1", check: newCheck(serving), expectHTTP: true, expectTLSALPN: true},
+		{name: "elsewhere.example", check: newCheck(serving), expectErr: true},
+		{name: "mixed.example", check: newCheck(serving), expectErr: true},
+		{name: "nowhere.example", check: newCheck(serving), expectErr: true},
+		{name: "*.elsewhere.example", check: newCheck(serving), expectHTTP: true, expectTLSALPN: true},
+	} {
+		am.ReachabilityCheck = tc.check
+		am.DisableTLSALPNChallenge = tc.disableTLS
+		iss, err := am.withReachableChallenges(ctx, []string{tc.name})
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d (%s): expected error, got none", i, tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d (%s): unexpected error: %v", i, tc.name, err)
+			continue
+		}
+		if iss.DisableHTTPChallenge == tc.expectHTTP || iss.DisableTLSALPNChallenge == tc.expectTLSALPN {
+			t.Errorf("Test %d (%s): expected http-01=%t and tls-alpn-01=%t, got http-01=%t and tls-alpn-01=%t",
+				i, tc.name, tc.expectHTTP, tc.expectTLSALPN, !iss.DisableHTTPChallenge, !iss.DisableTLSALPNChallenge)
+		}
+		if tc.expectHTTP && tc.expectTLSALPN && iss != am {
+			t.Errorf("Test %d (%s): expected issuer not to be copied if no challenge is disabled", i, tc.name)
+		}
+	}
+
+	// probe challenges are cleaned up
+	if _, ok := GetACMEChallenge("ours.example"); ok {
+		t.Error("Expected probe challenge to be removed from memory")
+	}
+	if _, _, err := cfg.getACMEChallengeInfo(ctx, "ours.example", true); err == nil {
+		t.Error("Expected probe challenge to be removed from storage")
+	}
+}
+
+func TestACMEIssuerUnreachable(t *testing.T) {
+	srv := &certmagictest.Server{}
+	srv.Start()
+	defer srv.Close()
+
+	resolver := startTestDNSServer(t, "elsewhere.example. 60 IN A 192.0.2.1")
+	iss := newTestACMEIssuer(t, srv, ACMEIssuer{
+		ReachabilityCheck: &ReachabilityCheck{
+			OwnAddresses: []string{"127.0.0.1"},
+			Resolvers:    []string{resolver},
+		},
+	})
+	if _, err := iss.Issue(context.Background(), makeInternalTestCSR(t, []string{"elsewhere.example"}, nil)); err == nil {
+		t.Fatal("Expected issuance to fail")
+	}
+	if len(srv.Orders()) != 0 {
+		t.Errorf("Expected no orders, got %d", len(srv.Orders()))
+	}
+}
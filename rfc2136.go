@@ -0,0 +1,235 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// RFC2136Provider is a DNSProvider that adds and deletes records
+// with dynamic updates (RFC 2136), which are supported by most
+// authoritative DNS servers, like BIND, Knot, and PowerDNS. Updates
+// are authenticated with a TSIG key (RFC 8945), if one is configured.
+//
+// The zone that a record is updated in is the zone the record
+// actually belongs to, as found with FindZoneByFQDN; it can be a
+// child of the zone passed in, if that zone delegates part of it.
+type RFC2136Provider struct {
+	// The address (host:port) of the DNS server to send
+	// updates to. Default: the primary name server of
+	// the zone (from its SOA record), on port 53.
+	Server string
+
+	// The name of the TSIG key. If empty,
+	// updates are not authenticated.
+	KeyName string
+
+	// The algorithm of the TSIG key: "hmac-sha256"
+	// or "hmac-sha512". Default: "hmac-sha256".
+	KeyAlgorithm string
+
+	// The base64-encoded secret of the TSIG key.
+	KeySecret string
+
+	// The DNS resolvers to find zones with.
+	// Default: the system's resolvers, or well-
+	// known public resolvers (see RecursiveNameservers).
+	Resolvers []string
+
+	// An optional logger.
+	Logger *zap.Logger
+}
+
+// AppendRecords adds recs to the zone, and returns them.
+// Implements libdns.RecordAppender.
+func (p *RFC2136Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.update(ctx, zone, recs, func(m *dns.Msg, rrs []dns.RR, _ libdns.RR) {
+		m.Insert(rrs)
+	})
+}
+
+// DeleteRecords deletes recs from the zone, and returns them; since
+// dynamic updates do not report what was deleted, this includes
+// records that did not exist. A record with an empty type deletes
+// all records of its name, and a record with empty data deletes all
+// records of its name and type. TTLs are ignored.
+// Implements libdns.RecordDeleter.
+func (p *RFC2136Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.update(ctx, zone, recs, func(m *dns.Msg, rrs []dns.RR, rr libdns.RR) {
+		switch {
+		case rr.Type == "":
+			m.RemoveName(rrs)
+		case rr.Data == "":
+			m.RemoveRRset(rrs)
+		default:
+			m.Remove(rrs)
+		}
+	})
+}
+
+// update sends one dynamic update for each zone that recs belong to,
+// in which each record is added by addToUpdate.
+func (p *RFC2136Provider) update(ctx context.Context, zone string, recs []libdns.Record, addToUpdate func(*dns.Msg, []dns.RR, libdns.RR)) ([]libdns.Record, error) {
+	logger := p.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	resolvers := RecursiveNameservers(p.Resolvers)
+
+	// group records by the zones they are actually in,
+	// keeping the order of zones for deterministic updates
+	updates := make(map[string]*dns.Msg)
+	var zones []string
+	var results []libdns.Record
+	for _, rec := range recs {
+		rr := rec.RR()
+		fqdn := libdns.AbsoluteName(rr.Name, zone)
+		if !strings.HasSuffix(fqdn, ".") {
+			fqdn += "."
+		}
+		recZone, err := FindZoneByFQDN(ctx, logger, fqdn, resolvers)
+		if err != nil {
+			return nil, fmt.Errorf("finding zone of %s: %v", fqdn, err)
+		}
+		dnsRR, err := rfc2136RR(fqdn, rr)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := updates[recZone]
+		if !ok {
+			m = new(dns.Msg)
+			m.SetUpdate(recZone)
+			updates[recZone] = m
+			zones = append(zones, recZone)
+		}
+		addToUpdate(m, []dns.RR{dnsRR}, rr)
+
+		if rr.Type == "" || rr.Data == "" {
+			results = append(results, rr)
+			continue
+		}
+		parsed, err := rr.Parse()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, parsed)
+	}
+
+	for _, updateZone := range zones {
+		if err := p.send(ctx, logger, updateZone, updates[updateZone], resolvers); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// send sends the dynamic update m for zone, signed with
+// the TSIG key if there is one.
+func (p *RFC2136Provider) send(ctx context.Context, logger *zap.Logger, zone string, m *dns.Msg, resolvers []string) error {
+	server := p.Server
+	if server == "" {
+		soa, err := lookupSoaByFqdn(ctx, logger, zone, resolvers)
+		if err != nil {
+			return fmt.Errorf("finding primary name server of zone %s: %v", zone, err)
+		}
+		server = net.JoinHostPort(strings.TrimSuffix(soa.primaryNs, "."), "53")
+	}
+
+	client := &dns.Client{Net: "tcp", Timeout: dnsTimeout}
+	if p.KeyName != "" {
+		algorithm, err := tsigAlgorithm(p.KeyAlgorithm)
+		if err != nil {
+			return err
+		}
+		keyName := dns.Fqdn(strings.ToLower(p.KeyName))
+		client.TsigSecret = map[string]string{keyName: p.KeySecret}
+		m.SetTsig(keyName, algorithm, 300, time.Now().Unix())
+	}
+
+	logger.Debug("sending dynamic DNS update",
+		zap.String("zone", zone),
+		zap.String("server", server),
+		zap.Int("changes", len(m.Ns)))
+
+	in, _, err := client.ExchangeContext(ctx, m, server)
+	if err != nil {
+		return fmt.Errorf("sending dynamic update for zone %s to %s: %v", zone, server, err)
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dynamic update for zone %s refused by %s: %s", zone, server, dns.RcodeToString[in.Rcode])
+	}
+	return nil
+}
+
+// rfc2136RR converts rr, which is at fqdn, to a DNS resource record.
+// Its data may be empty, in which case the record is only suitable
+// for deleting an RRset.
+func rfc2136RR(fqdn string, rr libdns.RR) (dns.RR, error) {
+	ttl := uint32(rr.TTL / time.Second)
+	if rr.Type == "" || rr.Data == "" {
+		rrtype := dns.TypeANY
+		if rr.Type != "" {
+			var ok bool
+			if rrtype, ok = dns.StringToType[strings.ToUpper(rr.Type)]; !ok {
+				return nil, fmt.Errorf("unknown record type %q", rr.Type)
+			}
+		}
+		return &dns.ANY{Hdr: dns.RR_Header{Name: fqdn, Rrtype: rrtype, Class: dns.ClassINET}}, nil
+	}
+	if strings.EqualFold(rr.Type, "TXT") {
+		// libdns TXT data is unescaped and can be longer than
+		// the 255 bytes that a single character-string can hold
+		var txt []string
+		for data := rr.Data; len(data) > 0; {
+			n := min(len(data), 255)
+			txt = append(txt, txtEscaper.Replace(data[:n]))
+			data = data[n:]
+		}
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: txt,
+		}, nil
+	}
+	dnsRR, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", fqdn, ttl, rr.Type, rr.Data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record %s: %v", rr.Type, fqdn, err)
+	}
+	return dnsRR, nil
+}
+
+// tsigAlgorithm returns the TSIG algorithm name of alg.
+func tsigAlgorithm(alg string) (string, error) {
+	switch strings.ToLower(strings.TrimSuffix(alg, ".")) {
+	case "", "hmac-sha256":
+		return dns.HmacSHA256, nil
+	case "hmac-sha512":
+		return dns.HmacSHA512, nil
+	}
+	return "", fmt.Errorf("unsupported TSIG algorithm %q", alg)
+}
+
+// txtEscaper escapes TXT data the way the dns package expects.
+var txtEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Interface guard
+var _ DNSProvider = (*RFC2136Provider)(nil)
@@ -0,0 +1,231 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+// dynamicDNSServer is an authoritative DNS server for testing
+// that accepts dynamic updates signed with its TSIG key.
+type dynamicDNSServer struct {
+	zones   []string
+	keyName string
+	secret  string
+
+	mu      sync.Mutex
+	records []dns.RR
+	updated []string // zones, in order of updates
+}
+
+// start starts s on the loopback interface, and returns
+// its UDP address for queries and TCP address for updates.
+func (s *dynamicDNSServer) start(t *testing.T) (string, string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsigSecret := map[string]string{s.keyName: s.secret}
+	acceptUpdates := func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: s, TsigSecret: tsigSecret, MsgAcceptFunc: acceptUpdates},
+		{Listener: ln, Handler: s, TsigSecret: tsigSecret, MsgAcceptFunc: acceptUpdates},
+	} {
+		go func() { _ = srv.ActivateAndServe() }()
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+	return pc.LocalAddr().String(), ln.Addr().String()
+}
+
+func (s *dynamicDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	if r.Opcode != dns.OpcodeUpdate {
+		if q.Qtype == dns.TypeSOA && slices.Contains(s.zones, q.Name) {
+			soa, _ := dns.NewRR(q.Name + " 60 IN SOA ns." + q.Name + " admin." + q.Name + " 1 60 60 60 60")
+			m.Answer = append(m.Answer, soa)
+		}
+		for _, rr := range s.records {
+			if strings.EqualFold(rr.Header().Name, q.Name) && rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	tsig := r.IsTsig()
+	switch {
+	case tsig == nil || w.TsigStatus() != nil:
+		m.Rcode = dns.RcodeNotAuth
+	case !slices.Contains(s.zones, q.Name):
+		m.Rcode = dns.RcodeNotZone
+	default:
+		s.updated = append(s.updated, q.Name)
+		for _, rr := range r.Ns {
+			hdr := rr.Header()
+			switch hdr.Class {
+			case dns.ClassINET:
+				s.records = append(s.records, rr)
+			case dns.ClassANY:
+				s.records = slices.DeleteFunc(s.records, func(existing dns.RR) bool {
+					return strings.EqualFold(existing.Header().Name, hdr.Name) &&
+						(hdr.Rrtype == dns.TypeANY || existing.Header().Rrtype == hdr.Rrtype)
+				})
+			case dns.ClassNONE:
+				hdr.Class = dns.ClassINET
+				s.records = slices.DeleteFunc(s.records, func(existing dns.RR) bool {
+					return dns.IsDuplicate(existing, rr)
+				})
+			}
+		}
+	}
+	if tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	_ = w.WriteMsg(m)
+}
+
+func (s *dynamicDNSServer) lookup(name string, rrtype uint16) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rrs []dns.RR
+	for _, rr := range s.records {
+		if rr.Header().Name == name && rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	ctx := context.Background()
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1keW5hbWljLXVwZGF0ZXM="
+	srv := &dynamicDNSServer{
+		zones:   []string{"rfc2136.example.", "sub.rfc2136.example."},
+		keyName: "update-key.",
+		secret:  secret,
+	}
+	resolver, updateServer := srv.start(t)
+
+	for _, alg := range []string{"hmac-sha256", "hmac-sha512"} {
+		provider := &RFC2136Provider{
+			Server:       updateServer,
+			KeyName:      "update-key",
+			KeyAlgorithm: alg,
+			KeySecret:    secret,
+			Resolvers:    []string{resolver},
+		}
+
+		// long TXT records are split into several strings
+		value := strings.Repeat("x", 300)
+		added, err := provider.AppendRecords(ctx, "rfc2136.example.", []libdns.Record{
+			libdns.TXT{Name: "_acme-challenge.www", Text: value, TTL: time.Minute},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if txt, ok := added[0].(libdns.TXT); !ok || txt.Name != "_acme-challenge.www" || txt.Text != value {
+			t.Errorf("%s: expected added TXT record to be returned, got %#v", alg, added[0])
+		}
+		rrs := srv.lookup("_acme-challenge.www.rfc2136.example.", dns.TypeTXT)
+		if len(rrs) != 1 || strings.Join(rrs[0].(*dns.TXT).Txt, "") != value || len(rrs[0].(*dns.TXT).Txt) != 2 {
+			t.Fatalf("%s: expected TXT record in 2 strings, got %v", alg, rrs)
+		}
+
+		if _, err := provider.DeleteRecords(ctx, "rfc2136.example.", added); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if rrs := srv.lookup("_acme-challenge.www.rfc2136.example.", dns.TypeTXT); len(rrs) != 0 {
+			t.Errorf("%s: expected TXT record to be deleted, got %v", alg, rrs)
+		}
+	}
+
+	// records are updated in the zone they belong to,
+	// even if a parent zone is given
+	provider := &RFC2136Provider{
+		Server:    updateServer,
+		KeyName:   "update-key.",
+		KeySecret: secret,
+		Resolvers: []string{resolver},
+	}
+	srv.updated = nil
+	_, err := provider.AppendRecords(ctx, "rfc2136.example.", []libdns.Record{
+		libdns.RR{Name: "host.sub", Type: "A", Data: "192.0.2.1", TTL: time.Minute},
+		libdns.RR{Name: "host.sub", Type: "A", Data: "192.0.2.2", TTL: time.Minute},
+		libdns.RR{Name: "www", Type: "A", Data: "192.0.2.3", TTL: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"sub.rfc2136.example.", "rfc2136.example."}; !slices.Equal(srv.updated, expect) {
+		t.Errorf("Expected updates of zones %v, got %v", expect, srv.updated)
+	}
+	if rrs := srv.lookup("host.sub.rfc2136.example.", dns.TypeA); len(rrs) != 2 {
+		t.Errorf("Expected 2 A records, got %v", rrs)
+	}
+
+	// records without data delete the whole RRset
+	if _, err := provider.DeleteRecords(ctx, "sub.rfc2136.example.", []libdns.Record{libdns.RR{Name: "host", Type: "A"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rrs := srv.lookup("host.sub.rfc2136.example.", dns.TypeA); len(rrs) != 0 {
+		t.Errorf("Expected A records to be deleted, got %v", rrs)
+	}
+
+	// quotes and backslashes in TXT data are escaped once; the
+	// dns package keeps TXT strings in presentation format
+	if _, err := provider.AppendRecords(ctx, "rfc2136.example.", []libdns.Record{
+		libdns.TXT{Name: "txt", Text: `say "hi" \ bye`, TTL: time.Minute},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rrs := srv.lookup("txt.rfc2136.example.", dns.TypeTXT)
+	if len(rrs) != 1 || !slices.Equal(rrs[0].(*dns.TXT).Txt, []string{`say \"hi\" \\ bye`}) {
+		t.Errorf("Expected TXT record with escaped quotes and backslash, got %v", rrs)
+	}
+
+	// updates with the wrong key are refused
+	provider.KeySecret = "d3Jvbmc="
+	if _, err := provider.AppendRecords(ctx, "rfc2136.example.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token"},
+	}); err == nil {
+		t.Error("Expected update with wrong key to fail")
+	}
+	provider.KeySecret, provider.KeyAlgorithm = secret, "hmac-md5"
+	if _, err := provider.AppendRecords(ctx, "rfc2136.example.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token"},
+	}); err == nil {
+		t.Error("Expected update with unsupported algorithm to fail")
+	}
+}
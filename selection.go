@@ -0,0 +1,165 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// RuleBasedCertificateSelector is a CertificateSelector that chooses
+// among the candidate certificates according to declarative rules.
+// Rules are evaluated in order. The first rule which matches the
+// ClientHello and which allows at least one of the candidates wins,
+// and the best of the allowed candidates is chosen according to
+// DefaultCertificateSelector (i.e. the client must support it, and
+// unexpired certificates are preferred).
+//
+// This is useful, for example, when certificates with overlapping
+// names are served on different IP addresses: a rule can restrict
+// connections arriving on each address to certificates having a
+// certain tag.
+//
+// If no rule selects a certificate, an error is returned, unless
+// Fallback is true, in which case all candidates are considered.
+type RuleBasedCertificateSelector struct {
+	// The rules, evaluated in order.
+	Rules []CertificateSelectionRule `json:"rules,omitempty"`
+
+	// If true and no rule selects a certificate, all candidates
+	// are considered as if no rules were configured. Otherwise,
+	// it is an error for no rule to select a certificate.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// SelectCertificate implements CertificateSelector.
+func (s RuleBasedCertificateSelector) SelectCertificate(hello *tls.ClientHelloInfo, choices []Certificate) (Certificate, error) {
+	for _, rule := range s.Rules {
+		if !rule.matchesHello(hello) {
+			continue
+		}
+		var allowed []Certificate
+		for _, cert := range choices {
+			if rule.allowsCert(cert) {
+				allowed = append(allowed, cert)
+			}
+		}
+		if len(allowed) > 0 {
+			return DefaultCertificateSelector(hello, allowed)
+		}
+	}
+	if s.Fallback {
+		return DefaultCertificateSelector(hello, choices)
+	}
+	return Certificate{}, fmt.Errorf("no certificate selected by any of %d rules (among %d choices)", len(s.Rules), len(choices))
+}
+
+// CertificateSelectionRule is a rule for a RuleBasedCertificateSelector.
+// The fields that describe the handshake are conditions: all of those
+// that are set must match for the rule to apply. The fields that
+// describe certificates narrow the candidates once the rule applies.
+// A rule with no conditions applies to every handshake.
+type CertificateSelectionRule struct {
+	// The local IP addresses or CIDR ranges on which the
+	// connection must have arrived (i.e. the listener
+	// address the client connected to).
+	LocalAddresses []string `json:"local_addresses,omitempty"`
+
+	// The client must offer at least one of these application
+	// protocols via ALPN.
+	ALPN []string `json:"alpn,omitempty"`
+
+	// The client must support at least one of these signature
+	// schemes (e.g. to route legacy clients to RSA certificates).
+	SignatureSchemes []tls.SignatureScheme `json:"signature_schemes,omitempty"`
+
+	// Certificates must have all of these tags.
+	Tags []string `json:"tags,omitempty"`
+
+	// Certificates must have at least one of these tags.
+	AnyTags []string `json:"any_tags,omitempty"`
+
+	// Certificates must not have any of these tags.
+	ExcludeTags []string `json:"exclude_tags,omitempty"`
+}
+
+// matchesHello returns true if all of the conditions of the rule are
+// satisfied by hello.
+func (rule CertificateSelectionRule) matchesHello(hello *tls.ClientHelloInfo) bool {
+	if len(rule.LocalAddresses) > 0 {
+		if hello.Conn == nil {
+			return false
+		}
+		if !addressInRanges(localIPFromConn(hello.Conn), rule.LocalAddresses) {
+			return false
+		}
+	}
+	if len(rule.ALPN) > 0 && !slices.ContainsFunc(hello.SupportedProtos, func(proto string) bool {
+		return slices.Contains(rule.ALPN, proto)
+	}) {
+		return false
+	}
+	if len(rule.SignatureSchemes) > 0 && !slices.ContainsFunc(hello.SignatureSchemes, func(scheme tls.SignatureScheme) bool {
+		return slices.Contains(rule.SignatureSchemes, scheme)
+	}) {
+		return false
+	}
+	return true
+}
+
+// allowsCert returns true if cert satisfies the certificate
+// constraints of the rule.
+func (rule CertificateSelectionRule) allowsCert(cert Certificate) bool {
+	for _, tag := range rule.Tags {
+		if !cert.HasTag(tag) {
+			return false
+		}
+	}
+	if len(rule.AnyTags) > 0 && !slices.ContainsFunc(rule.AnyTags, cert.HasTag) {
+		return false
+	}
+	return !slices.ContainsFunc(rule.ExcludeTags, cert.HasTag)
+}
+
+// addressInRanges returns true if the IP address addr is equal to one
+// of the IP addresses or within one of the CIDR ranges in ranges.
+// Invalid entries in ranges never match.
+func addressInRanges(addr string, ranges []string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, r := range ranges {
+		if strings.Contains(r, "/") {
+			prefix, err := netip.ParsePrefix(r)
+			if err == nil && prefix.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		other, err := netip.ParseAddr(r)
+		if err == nil && other.Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Interface guard
+var _ CertificateSelector = RuleBasedCertificateSelector{}
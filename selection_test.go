@@ -0,0 +1,130 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+// localAddrConn is a net.Conn that only reports a local address.
+type localAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c localAddrConn) LocalAddr() net.Addr { return c.addr }
+
+func TestRuleBasedCertificateSelector(t *testing.T) {
+	makeCert := func(hash string, tags ...string) Certificate {
+		return Certificate{
+			Names: []string{"example.com"},
+			Tags:  tags,
+			hash:  hash,
+			Certificate: tls.Certificate{Leaf: &x509.Certificate{
+				DNSNames:  []string{"example.com"},
+				NotBefore: time.Now().Add(-time.Hour),
+				NotAfter:  time.Now().Add(time.Hour),
+			}},
+		}
+	}
+	brandA := makeCert("a", "brand-a")
+	brandB := makeCert("b", "brand-b")
+	brandBH2 := makeCert("b-h2", "brand-b", "h2")
+	choices := []Certificate{brandA, brandB, brandBH2}
+
+	connOn := func(ip string) net.Conn {
+		return localAddrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 443}}
+	}
+
+	selector := RuleBasedCertificateSelector{
+		Rules: []CertificateSelectionRule{
+			{LocalAddresses: []string{"192.0.2.1"}, Tags: []string{"brand-a"}},
+			{LocalAddresses: []string{"198.51.100.0/24"}, ALPN: []string{"h2"}, Tags: []string{"brand-b", "h2"}},
+			{LocalAddresses: []string{"198.51.100.0/24"}, AnyTags: []string{"brand-b"}, ExcludeTags: []string{"h2"}},
+			{LocalAddresses: []string{"2001:db8::1"}, Tags: []string{"nonexistent"}},
+		},
+	}
+
+	for i, tc := range []struct {
+		hello       *tls.ClientHelloInfo
+		fallback    bool
+		expectHash  string
+		expectError bool
+	}{
+		{
+			hello:      &tls.ClientHelloInfo{Conn: connOn("192.0.2.1")},
+			expectHash: "a",
+		},
+		{
+			hello:      &tls.ClientHelloInfo{Conn: connOn("::ffff:192.0.2.1")},
+			expectHash: "a",
+		},
+		{
+			hello:      &tls.ClientHelloInfo{Conn: connOn("198.51.100.7"), SupportedProtos: []string{"h2", "http/1.1"}},
+			expectHash: "b-h2",
+		},
+		{
+			hello:      &tls.ClientHelloInfo{Conn: connOn("198.51.100.7"), SupportedProtos: []string{"http/1.1"}},
+			expectHash: "b",
+		},
+		{
+			hello:       &tls.ClientHelloInfo{Conn: connOn("2001:db8::1")},
+			expectError: true,
+		},
+		{
+			hello:       &tls.ClientHelloInfo{Conn: connOn("203.0.113.1")},
+			expectError: true,
+		},
+		{
+			hello:       &tls.ClientHelloInfo{},
+			expectError: true,
+		},
+		{
+			hello:      &tls.ClientHelloInfo{Conn: connOn("203.0.113.1")},
+			fallback:   true,
+			expectHash: "a",
+		},
+	} {
+		selector.Fallback = tc.fallback
+		cert, err := selector.SelectCertificate(tc.hello, choices)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got certificate %s", i, cert.hash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if cert.hash != tc.expectHash {
+			t.Errorf("Test %d: Expected certificate %s, got %s", i, tc.expectHash, cert.hash)
+		}
+	}
+}
+
+func TestCertificateSelectionRuleSignatureSchemes(t *testing.T) {
+	rule := CertificateSelectionRule{SignatureSchemes: []tls.SignatureScheme{tls.PKCS1WithSHA256, tls.PSSWithSHA256}}
+	if !rule.matchesHello(&tls.ClientHelloInfo{SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256}}) {
+		t.Error("Expected rule to match client supporting one of the signature schemes")
+	}
+	if rule.matchesHello(&tls.ClientHelloInfo{SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}}) {
+		t.Error("Expected rule to not match client supporting none of the signature schemes")
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+	"weak"
+
+	"go.uber.org/zap"
+)
+
+// SessionTicketKeys manages TLS session ticket keys that are shared by
+// all instances using the same storage, so that sessions can be resumed
+// across a cluster and across restarts. Keys are stored in storage,
+// encrypted with EncryptionKey, and rotated on a schedule by whichever
+// instance notices first (under a cluster-wide lock). The current key
+// is used to encrypt new tickets and a number of previous keys are kept
+// so that existing tickets can still be decrypted.
+//
+// The key that becomes current at the next rotation is stored ahead of
+// time, and all instances load it for decrypting only. It is promoted
+// only once it has been stored for at least as long as instances take
+// to refresh the keys, so that every instance can decrypt the tickets
+// of an instance that has just rotated.
+//
+// Set it as the SessionTicketKeys field of Config; every tls.Config
+// returned by Config.TLSConfig() is then kept up to date with the keys.
+// The first call to TLSConfig() starts the maintenance goroutine; call
+// Stop() when the keys are no longer needed.
+type SessionTicketKeys struct {
+	// The key used to encrypt session ticket keys in storage,
+	// which must be 16, 24, or 32 bytes (AES-128, -192 or -256).
+	// All instances sharing the storage must use the same key.
+	// Required.
+	EncryptionKey []byte
+
+	// How often to rotate the session ticket key.
+	// Default: 12 hours.
+	RotationInterval time.Duration
+
+	// How many previous keys to keep for decrypting tickets
+	// issued before the latest rotation. Default: 3.
+	PreviousKeys int
+
+	// The storage in which to keep the keys. If nil,
+	// the storage of the Config is used.
+	Storage Storage
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	refreshMu sync.Mutex // serializes refreshes
+
+	mu       sync.Mutex
+	storage  Storage
+	keys     [][32]byte
+	configs  []weak.Pointer[tls.Config]
+	stopChan chan struct{}
+}
+
+// sessionTicketKeyFile is the decrypted contents of
+// the session ticket keys in storage.
+type sessionTicketKeyFile struct {
+	// Newest key first.
+	Keys []storedSessionTicketKey `json:"keys"`
+
+	// The key that becomes current at the next rotation;
+	// until then, it is only used to decrypt tickets.
+	Next *storedSessionTicketKey `json:"next,omitempty"`
+}
+
+type storedSessionTicketKey struct {
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// Rotate forces a new session ticket key to become current,
+// regardless of when the last rotation happened. The next key
+// is promoted even if it was only stored recently, so other
+// instances may not be able to decrypt tickets issued with it
+// until they refresh the keys.
+func (stk *SessionTicketKeys) Rotate(ctx context.Context) error {
+	storage, err := stk.getStorage()
+	if err != nil {
+		return err
+	}
+	stk.refreshMu.Lock()
+	defer stk.refreshMu.Unlock()
+	keyFile, err := stk.rotateLocked(ctx, storage, true)
+	if err != nil {
+		return err
+	}
+	stk.apply(keyFile)
+	return nil
+}
+
+// Stop stops the maintenance goroutine, if running. Configs
+// retain the keys they have but are no longer updated.
+func (stk *SessionTicketKeys) Stop() {
+	stk.mu.Lock()
+	defer stk.mu.Unlock()
+	if stk.stopChan != nil {
+		close(stk.stopChan)
+		stk.stopChan = nil
+	}
+}
+
+// register keeps tlsConfig up to date with the session ticket keys.
+// The first registration loads (or creates) the keys from storage,
+// which defaults to the given storage, and starts maintenance.
+func (stk *SessionTicketKeys) register(tlsConfig *tls.Config, storage Storage, logger *zap.Logger) {
+	stk.mu.Lock()
+	if stk.Logger == nil {
+		stk.Logger = logger
+	}
+	if stk.storage == nil {
+		stk.storage = stk.Storage
+		if stk.storage == nil {
+			stk.storage = storage
+		}
+	}
+	stk.configs = append(stk.configs, weak.Make(tlsConfig))
+	keys := stk.keys
+	start := stk.stopChan == nil && keys == nil
+	if start {
+		stk.stopChan = make(chan struct{})
+	}
+	stopChan := stk.stopChan
+	stk.mu.Unlock()
+
+	if start {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := stk.refresh(ctx); err != nil {
+			stk.logger().Error("loading session ticket keys", zap.Error(err))
+		}
+		cancel()
+		go stk.maintain(stopChan)
+		return
+	}
+
+	if len(keys) > 0 {
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+}
+
+// maintain periodically refreshes the keys until stopChan is closed.
+func (stk *SessionTicketKeys) maintain(stopChan chan struct{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			stk.logger().Error("panic in session ticket key maintenance", zap.Any("error", err))
+		}
+	}()
+
+	ticker := time.NewTicker(stk.checkInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := stk.refresh(ctx); err != nil {
+				stk.logger().Error("refreshing session ticket keys", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// refresh loads the keys from storage, rotating them first if they
+// are missing or due for rotation, and applies them to all configs.
+func (stk *SessionTicketKeys) refresh(ctx context.Context) error {
+	storage, err := stk.getStorage()
+	if err != nil {
+		return err
+	}
+
+	stk.refreshMu.Lock()
+	defer stk.refreshMu.Unlock()
+
+	keyFile, err := stk.load(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if stk.needsRotation(keyFile) {
+		keyFile, err = stk.rotateLocked(ctx, storage, false)
+		if err != nil {
+			return err
+		}
+	}
+	stk.apply(keyFile)
+	return nil
+}
+
+// rotateLocked rotates the keys in storage under a cluster-wide lock:
+// the next key is promoted to be the current one, and a new next key
+// is stored. If there is no next key yet, one is stored and promoted
+// at a later rotation. Unless force is true, the keys are only rotated
+// if they still need it after obtaining the lock, since another
+// instance may have just done it. It returns the resulting keys.
+func (stk *SessionTicketKeys) rotateLocked(ctx context.Context, storage Storage, force bool) (sessionTicketKeyFile, error) {
+	if err := acquireLock(ctx, storage, sessionTicketKeysLockKey); err != nil {
+		return sessionTicketKeyFile{}, fmt.Errorf("acquiring session ticket key lock: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, storage, sessionTicketKeysLockKey); err != nil {
+			stk.logger().Error("unable to release session ticket key lock", zap.Error(err))
+		}
+	}()
+
+	keyFile, err := stk.load(ctx, storage)
+	if err != nil {
+		return sessionTicketKeyFile{}, err
+	}
+	if !force && !stk.needsRotation(keyFile) {
+		return keyFile, nil
+	}
+
+	newKey := func() (*storedSessionTicketKey, error) {
+		key := &storedSessionTicketKey{Key: make([]byte, 32), Created: time.Now().UTC()}
+		if _, err := rand.Read(key.Key); err != nil {
+			return nil, fmt.Errorf("generating session ticket key: %v", err)
+		}
+		return key, nil
+	}
+
+	var current *storedSessionTicketKey
+	switch {
+	case keyFile.Next != nil && (force || stk.nextKeyDistributed(keyFile)):
+		promoted := *keyFile.Next
+		promoted.Created = time.Now().UTC()
+		current = &promoted
+	case len(keyFile.Keys) == 0 || force:
+		// no instance can have issued tickets yet, or
+		// a new key is forced and there is no next key
+		current, err = newKey()
+		if err != nil {
+			return sessionTicketKeyFile{}, err
+		}
+	case keyFile.Next != nil:
+		return keyFile, nil // not all instances may have the next key yet
+	}
+	if current != nil {
+		keyFile.Keys = append([]storedSessionTicketKey{*current}, keyFile.Keys...)
+		if maxKeys := 1 + stk.previousKeys(); len(keyFile.Keys) > maxKeys {
+			keyFile.Keys = keyFile.Keys[:maxKeys]
+		}
+	}
+	keyFile.Next, err = newKey()
+	if err != nil {
+		return sessionTicketKeyFile{}, err
+	}
+
+	if err := stk.store(ctx, storage, keyFile); err != nil {
+		return sessionTicketKeyFile{}, err
+	}
+
+	stk.logger().Info("rotated session ticket keys", zap.Int("keys", len(keyFile.Keys)))
+
+	return keyFile, nil
+}
+
+// needsRotation returns true if there are no keys or no next key,
+// or if the current key is older than the rotation interval and
+// the next key can be promoted.
+func (stk *SessionTicketKeys) needsRotation(keyFile sessionTicketKeyFile) bool {
+	if len(keyFile.Keys) == 0 || keyFile.Next == nil {
+		return true
+	}
+	return time.Since(keyFile.Keys[0].Created) >= stk.rotationInterval() && stk.nextKeyDistributed(keyFile)
+}
+
+// nextKeyDistributed returns true if the next key has been in
+// storage long enough for all instances to have loaded it.
+func (stk *SessionTicketKeys) nextKeyDistributed(keyFile sessionTicketKeyFile) bool {
+	return keyFile.Next != nil && time.Since(keyFile.Next.Created) >= stk.checkInterval()
+}
+
+// apply sets the keys on all registered configs
+// that are still in use, and forgets the others.
+func (stk *SessionTicketKeys) apply(keyFile sessionTicketKeyFile) {
+	// the first key encrypts tickets, and all of them decrypt
+	// tickets, including the next key, which other instances
+	// may have promoted already
+	stored := keyFile.Keys
+	if keyFile.Next != nil && len(stored) > 0 {
+		stored = append([]storedSessionTicketKey{stored[0], *keyFile.Next}, stored[1:]...)
+	}
+	keys := make([][32]byte, 0, len(stored))
+	for _, k := range stored {
+		if len(k.Key) != 32 {
+			continue
+		}
+		keys = append(keys, [32]byte(k.Key))
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	stk.mu.Lock()
+	defer stk.mu.Unlock()
+	stk.keys = keys
+	live := stk.configs[:0]
+	for _, ptr := range stk.configs {
+		if tlsConfig := ptr.Value(); tlsConfig != nil {
+			tlsConfig.SetSessionTicketKeys(keys)
+			live = append(live, ptr)
+		}
+	}
+	clear(stk.configs[len(live):])
+	stk.configs = live
+}
+
+// load loads and decrypts the keys from storage. If
+// there are no keys in storage, an empty result is
+// returned without error.
+func (stk *SessionTicketKeys) load(ctx context.Context, storage Storage) (sessionTicketKeyFile, error) {
+	ciphertext, err := storage.Load(ctx, sessionTicketKeysStorageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sessionTicketKeyFile{}, nil
+	}
+	if err != nil {
+		return sessionTicketKeyFile{}, fmt.Errorf("loading session ticket keys: %v", err)
+	}
+	aead, err := stk.aead()
+	if err != nil {
+		return sessionTicketKeyFile{}, err
+	}
+	plaintext, err := openStorageValue(aead, sessionTicketKeysStorageKey, ciphertext)
+	if err != nil {
+		return sessionTicketKeyFile{}, fmt.Errorf("decrypting session ticket keys (is the encryption key correct?): %v", err)
+	}
+	var keyFile sessionTicketKeyFile
+	if err := json.Unmarshal(plaintext, &keyFile); err != nil {
+		return sessionTicketKeyFile{}, fmt.Errorf("decoding session ticket keys: %v", err)
+	}
+	return keyFile, nil
+}
+
+// store encrypts and stores the keys in storage.
+func (stk *SessionTicketKeys) store(ctx context.Context, storage Storage, keyFile sessionTicketKeyFile) error {
+	plaintext, err := json.Marshal(keyFile)
+	if err != nil {
+		return fmt.Errorf("encoding session ticket keys: %v", err)
+	}
+	aead, err := stk.aead()
+	if err != nil {
+		return err
+	}
+	ciphertext, err := sealStorageValue(aead, sessionTicketKeysStorageKey, plaintext)
+	if err != nil {
+		return err
+	}
+	if err := storage.Store(ctx, sessionTicketKeysStorageKey, ciphertext); err != nil {
+		return fmt.Errorf("storing session ticket keys: %v", err)
+	}
+	return nil
+}
+
+func (stk *SessionTicketKeys) aead() (cipher.AEAD, error) {
+	if len(stk.EncryptionKey) == 0 {
+		return nil, fmt.Errorf("no encryption key configured for session ticket keys")
+	}
+	aead, err := newStorageAEAD(stk.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("session ticket key encryption key: %v", err)
+	}
+	return aead, nil
+}
+
+// newStorageAEAD returns an AES-GCM cipher for encrypting
+// secrets in storage with the given encryption key.
+func newStorageAEAD(encryptionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealStorageValue encrypts plaintext to be stored at storageKey.
+// The random nonce is prepended to the ciphertext, and the storage
+// key is authenticated so that values cannot be swapped in storage.
+func sealStorageValue(aead cipher.AEAD, storageKey string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(storageKey)), nil
+}
+
+// openStorageValue decrypts a value that was sealed
+// by sealStorageValue and loaded from storageKey.
+func openStorageValue(aead cipher.AEAD, storageKey string, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(storageKey))
+}
+
+func (stk *SessionTicketKeys) getStorage() (Storage, error) {
+	stk.mu.Lock()
+	defer stk.mu.Unlock()
+	if stk.storage == nil {
+		stk.storage = stk.Storage
+	}
+	if stk.storage == nil {
+		return nil, fmt.Errorf("no storage configured for session ticket keys")
+	}
+	return stk.storage, nil
+}
+
+func (stk *SessionTicketKeys) rotationInterval() time.Duration {
+	if stk.RotationInterval > 0 {
+		return stk.RotationInterval
+	}
+	return defaultSessionTicketKeyRotationInterval
+}
+
+func (stk *SessionTicketKeys) previousKeys() int {
+	if stk.PreviousKeys > 0 {
+		return stk.PreviousKeys
+	}
+	return defaultSessionTicketPreviousKeys
+}
+
+// checkInterval returns how often to check whether keys have been
+// rotated, which is frequently enough for all instances to pick up
+// a new key soon after it has been rotated in.
+func (stk *SessionTicketKeys) checkInterval() time.Duration {
+	return min(stk.rotationInterval()/4, maxSessionTicketKeyCheckInterval)
+}
+
+func (stk *SessionTicketKeys) logger() *zap.Logger {
+	if stk.Logger == nil {
+		return zap.NewNop()
+	}
+	return stk.Logger
+}
+
+const (
+	sessionTicketKeysStorageKey = "session_ticket_keys"
+	sessionTicketKeysLockKey    = "session_ticket_keys_rotation"
+
+	defaultSessionTicketKeyRotationInterval = 12 * time.Hour
+	defaultSessionTicketPreviousKeys        = 3
+	maxSessionTicketKeyCheckInterval        = 10 * time.Minute
+)
@@ -0,0 +1,151 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionTicketKeysSharedAndRotated(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	encKey := bytes.Repeat([]byte{1}, 32)
+
+	stk1 := &SessionTicketKeys{EncryptionKey: encKey, PreviousKeys: 2, Storage: storage}
+	stk2 := &SessionTicketKeys{EncryptionKey: encKey, PreviousKeys: 2, Storage: storage}
+	defer stk1.Stop()
+	defer stk2.Stop()
+
+	stk1.register(new(tls.Config), nil, defaultTestLogger)
+	stk2.register(new(tls.Config), nil, defaultTestLogger)
+	if len(stk1.keys) != 2 || len(stk2.keys) != 2 || stk1.keys[0] != stk2.keys[0] || stk1.keys[1] != stk2.keys[1] {
+		t.Fatalf("Expected both instances to share the current and next key, got %d and %d keys", len(stk1.keys), len(stk2.keys))
+	}
+	first, next := stk1.keys[0], stk1.keys[1]
+
+	// the next key, which every instance has already, becomes current
+	if err := stk1.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stk1.keys[0] != next {
+		t.Error("Expected next key to become current")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := stk1.Rotate(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stk2.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(stk2.keys) != 4 {
+		t.Fatalf("Expected current key, next key and 2 previous keys, got %d keys", len(stk2.keys))
+	}
+	for i := range stk1.keys {
+		if stk1.keys[i] != stk2.keys[i] {
+			t.Errorf("Key %d differs between instances", i)
+		}
+		if stk1.keys[i] == first {
+			t.Errorf("Expected oldest key to have been dropped, but found it at index %d", i)
+		}
+	}
+
+	// keys are encrypted in storage
+	stored, err := storage.Load(ctx, sessionTicketKeysStorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, stk1.keys[0][:]) {
+		t.Error("Expected session ticket keys to be encrypted in storage")
+	}
+
+	// scheduled rotations only promote a next key once all instances have had time to load it
+	keyFile, err := stk1.load(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile.Keys[0].Created = keyFile.Keys[0].Created.Add(-defaultSessionTicketKeyRotationInterval)
+	if stk1.needsRotation(keyFile) {
+		t.Error("Expected next key that was just stored not to be promoted")
+	}
+	keyFile.Next.Created = keyFile.Next.Created.Add(-stk1.checkInterval())
+	if !stk1.needsRotation(keyFile) {
+		t.Error("Expected next key to be promoted after the check interval")
+	}
+
+	wrongKey := &SessionTicketKeys{EncryptionKey: bytes.Repeat([]byte{2}, 32), Storage: storage}
+	if err := wrongKey.refresh(ctx); err == nil {
+		t.Error("Expected error decrypting keys with the wrong encryption key")
+	}
+}
+
+func TestSessionTicketKeysResumptionAcrossInstances(t *testing.T) {
+	storage := &FileStorage{Path: t.TempDir()}
+	encKey := bytes.Repeat([]byte{1}, 32)
+
+	cert, err := makePlaceholderCertificate("example.com", P256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	newServerConfig := func() *tls.Config {
+		stk := &SessionTicketKeys{EncryptionKey: encKey}
+		t.Cleanup(stk.Stop)
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert.Certificate},
+			MaxVersion:   tls.VersionTLS12,
+		}
+		stk.register(tlsConfig, storage, defaultTestLogger)
+		return tlsConfig
+	}
+	serverA, serverB := newServerConfig(), newServerConfig()
+
+	clientConfig := &tls.Config{
+		ServerName:         "example.com",
+		RootCAs:            roots,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	handshake := func(serverConfig *tls.Config) bool {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		errChan := make(chan error, 1)
+		go func() { errChan <- tls.Server(serverConn, serverConfig).Handshake() }()
+		client := tls.Client(clientConn, clientConfig)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("Client handshake: %v", err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatalf("Server handshake: %v", err)
+		}
+		return client.ConnectionState().DidResume
+	}
+
+	if handshake(serverA) {
+		t.Fatal("Expected first handshake not to resume a session")
+	}
+	if !handshake(serverB) {
+		t.Error("Expected session from one instance to be resumed by another instance")
+	}
+}
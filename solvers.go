@@ -17,7 +17,9 @@ package certmagic
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -241,6 +243,12 @@ func (s *tlsALPNSolver) CleanUp(_ context.Context, chal acme.Challenge) error {
 // DNS01Solver is a type that makes libdns providers usable as ACME dns-01
 // challenge solvers. See https://github.com/libdns/libdns
 //
+// It also solves dns-account-01 challenges, whose records are named with
+// a label derived from the ACME account URL, so that several ACME clients
+// with different accounts can validate the same name at the same time.
+// The account must be in the context (see ContextWithACMEAccount), which
+// ACMEIssuer does automatically.
+//
 // Note that challenges may be solved concurrently by some clients (such as
 // acmez, which CertMagic uses), meaning that multiple TXT records may be
 // created in a DNS zone simultaneously, and in some cases distinct TXT records
@@ -250,19 +258,68 @@ func (s *tlsALPNSolver) CleanUp(_ context.Context, chal acme.Challenge) error {
 // between different records with the same name by looking at their values.
 // DNS provider APIs and implementations of the libdns interfaces must also
 // support multiple same-named TXT records.
+//
+// Records can optionally be batched; see BatchRecords.
 type DNS01Solver struct {
 	DNSManager
+
+	// If true, the records of an order are batched per zone:
+	// Present only queues a record, and the first call to Wait
+	// adds all queued records of the order to their zones with
+	// one AppendRecords call per zone, then waits once for each
+	// zone's records to propagate. Likewise, the records of a
+	// zone are deleted with one DeleteRecords call once all of
+	// them have been cleaned up. This way, a certificate with
+	// many names does not need as many calls to the DNS provider
+	// and propagation checks.
+	//
+	// This relies on the ACME client calling Present for all
+	// challenges of an order before Wait for any, which acmez
+	// currently does but does not guarantee; records presented
+	// later are still created, just in another batch. Records
+	// are only batched for orders placed by ACMEIssuer.
+	//
+	// EXPERIMENTAL: Subject to change or removal.
+	BatchRecords bool
 }
 
-// Present creates the DNS TXT record for the given ACME challenge.
+// Present creates the DNS TXT record for the given ACME challenge,
+// or queues it to be created in Wait if records are batched.
 func (s *DNS01Solver) Present(ctx context.Context, challenge acme.Challenge) error {
-	dnsName := challenge.DNS01TXTRecordName()
+	dnsName, err := dnsChallengeRecordName(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	recordName := dnsName
 	if s.OverrideDomain != "" {
 		dnsName = s.OverrideDomain
+		recordName = dnsName
+	} else {
+		// the challenge name may be delegated to another zone
+		recordName, err = s.DNSManager.delegatedName(ctx, dnsName)
+		if err != nil {
+			return err
+		}
 	}
 	keyAuth := challenge.DNS01KeyAuthorization()
 
-	zrec, err := s.DNSManager.createRecord(ctx, dnsName, "TXT", keyAuth)
+	if batches := s.dnsBatches(ctx); batches != nil {
+		batch, rr, err := s.DNSManager.queueRecord(ctx, batches, recordName, "TXT", keyAuth)
+		if err != nil {
+			return err
+		}
+
+		// remember the record and its batch so we can wait for it and clean it up
+		s.saveDNSPresentMemory(dnsPresentMemory{
+			dnsName: dnsName,
+			zoneRec: zoneRecord{batch.zone, rr},
+			batch:   batch,
+		})
+
+		return nil
+	}
+
+	zrec, err := s.DNSManager.createRecord(ctx, recordName, "TXT", keyAuth)
 	if err != nil {
 		return err
 	}
@@ -276,12 +333,26 @@ func (s *DNS01Solver) Present(ctx context.Context, challenge acme.Challenge) err
 	return nil
 }
 
+// dnsBatches returns the batches of the order in ctx,
+// or nil if records are not batched.
+func (s *DNS01Solver) dnsBatches(ctx context.Context) *dnsBatches {
+	if !s.BatchRecords {
+		return nil
+	}
+	batches, _ := ctx.Value(ctxKeyDNSBatches).(*dnsBatches)
+	return batches
+}
+
 // Wait blocks until the TXT record created in Present() appears in
 // authoritative lookups, i.e. until it has propagated, or until
-// timeout, whichever is first.
+// timeout, whichever is first. If records are batched, it creates
+// the queued records of the order first.
 func (s *DNS01Solver) Wait(ctx context.Context, challenge acme.Challenge) error {
 	// prepare for the checks by determining what to look for
-	dnsName := challenge.DNS01TXTRecordName()
+	dnsName, err := dnsChallengeRecordName(ctx, challenge)
+	if err != nil {
+		return err
+	}
 	if s.OverrideDomain != "" {
 		dnsName = s.OverrideDomain
 	}
@@ -292,17 +363,25 @@ func (s *DNS01Solver) Wait(ctx context.Context, challenge acme.Challenge) error
 	if err != nil {
 		return err
 	}
+	if memory.batch != nil {
+		return s.DNSManager.waitForBatch(ctx, memory.batch)
+	}
 	return s.DNSManager.wait(ctx, memory.zoneRec)
 }
 
-// CleanUp deletes the DNS TXT record created in Present().
+// CleanUp deletes the DNS TXT record created in Present(); if records
+// are batched, together with the rest of its batch once that is all
+// cleaned up.
 //
 // We ignore the context because cleanup is often/likely performed after
 // a context cancellation, and properly-implemented DNS providers should
 // honor cancellation, which would result in cleanup being aborted.
 // Cleanup must always occur.
 func (s *DNS01Solver) CleanUp(ctx context.Context, challenge acme.Challenge) error {
-	dnsName := challenge.DNS01TXTRecordName()
+	dnsName, err := dnsChallengeRecordName(ctx, challenge)
+	if err != nil {
+		return err
+	}
 	if s.OverrideDomain != "" {
 		dnsName = s.OverrideDomain
 	}
@@ -317,12 +396,47 @@ func (s *DNS01Solver) CleanUp(ctx context.Context, challenge acme.Challenge) err
 		return err
 	}
 
-	if err := s.DNSManager.cleanUpRecord(ctx, memory.zoneRec); err != nil {
-		return err
+	if memory.batch != nil {
+		return s.DNSManager.cleanUpBatchedRecord(memory.batch, memory.zoneRec.record)
 	}
-	return nil
+	return s.DNSManager.cleanUpRecord(ctx, memory.zoneRec)
+}
+
+// SupportsDNSAccount01 returns true because the solver
+// can solve dns-account-01 challenges as well.
+func (s *DNS01Solver) SupportsDNSAccount01() bool { return true }
+
+// DNSAccount01Solver is implemented by dns-01 solvers that can
+// also solve dns-account-01 challenges. ACMEIssuer prefers the
+// dns-account-01 challenge when the CA offers it and its
+// DNS01Solver supports it.
+type DNSAccount01Solver interface {
+	acmez.Solver
+	SupportsDNSAccount01() bool
+}
+
+// ContextWithACMEAccount returns a context that carries account,
+// which solvers need for dns-account-01 challenges, since their
+// records are named after the account URL.
+func ContextWithACMEAccount(ctx context.Context, account acme.Account) context.Context {
+	return context.WithValue(ctx, ctxKeyACMEAccount, account)
+}
+
+// dnsChallengeRecordName returns the name of the TXT record
+// for the dns-01 or dns-account-01 challenge.
+func dnsChallengeRecordName(ctx context.Context, challenge acme.Challenge) (string, error) {
+	if challenge.Type != acme.ChallengeTypeDNSAccount01 {
+		return challenge.DNS01TXTRecordName(), nil
+	}
+	account, ok := ctx.Value(ctxKeyACMEAccount).(acme.Account)
+	if !ok || account.Location == "" {
+		return "", fmt.Errorf("%s challenge for %s requires the ACME account URL in the context", challenge.Type, challenge.Identifier.Value)
+	}
+	return challenge.DNSAccount01TXTRecordName(account), nil
 }
 
+const ctxKeyACMEAccount = ctxKey("acme_account")
+
 // DNSManager is a type that makes libdns providers usable for performing
 // DNS verification. See https://github.com/libdns/libdns
 //
@@ -351,11 +465,19 @@ type DNSManager struct {
 	PropagationTimeout time.Duration
 
 	// Preferred DNS resolver(s) to use when doing DNS lookups.
+	// These may be DNS-over-HTTPS or DNS-over-TLS resolver
+	// URLs (see RecursiveNameservers).
 	Resolvers []string
 
+	// The root certificates to verify DNS-over-HTTPS and
+	// DNS-over-TLS resolvers with. Default: system roots.
+	TrustedRoots *x509.CertPool
+
 	// Override the domain to set the TXT record on. This is
-	// to delegate the challenge to a different domain. Note
-	// that the solver doesn't follow CNAME/NS record.
+	// to delegate the challenge to a different domain. If
+	// not set, the solver follows CNAME records of the
+	// challenge domain to find the domain it is delegated
+	// to, if any; it does not follow NS records.
 	OverrideDomain string
 
 	// An optional logger.
@@ -378,6 +500,7 @@ type DNSManager struct {
 
 func (m *DNSManager) createRecord(ctx context.Context, dnsName, recordType, recordValue string) (zoneRecord, error) {
 	logger := m.logger()
+	ctx = ContextWithDNSRoots(ctx, m.TrustedRoots)
 
 	zone, err := FindZoneByFQDN(ctx, logger, dnsName, RecursiveNameservers(m.Resolvers))
 	if err != nil {
@@ -391,30 +514,79 @@ func (m *DNSManager) createRecord(ctx context.Context, dnsName, recordType, reco
 		TTL:  m.TTL,
 	}
 
-	logger.Debug("creating DNS record",
-		zap.String("dns_name", dnsName),
-		zap.String("zone", zone),
-		zap.String("record_name", rr.Name),
-		zap.String("record_type", rr.Type),
-		zap.String("record_data", rr.Data),
-		zap.Duration("record_ttl", rr.TTL))
+	results, err := m.appendRecords(ctx, zone, []libdns.RR{rr})
+	if err != nil {
+		return zoneRecord{}, err
+	}
+
+	return zoneRecord{zone, results[0].RR()}, nil
+}
 
-	results, err := m.DNSProvider.AppendRecords(ctx, zone, []libdns.Record{rr})
+// appendRecords adds rrs to zone with one call to the DNS provider,
+// and returns the records it added.
+func (m *DNSManager) appendRecords(ctx context.Context, zone string, rrs []libdns.RR) ([]libdns.Record, error) {
+	logger := m.logger()
+
+	recs := make([]libdns.Record, 0, len(rrs))
+	for _, rr := range rrs {
+		logger.Debug("creating DNS record",
+			zap.String("zone", zone),
+			zap.String("record_name", rr.Name),
+			zap.String("record_type", rr.Type),
+			zap.String("record_data", rr.Data),
+			zap.Duration("record_ttl", rr.TTL))
+		recs = append(recs, rr)
+	}
+
+	results, err := m.DNSProvider.AppendRecords(ctx, zone, recs)
 	if err != nil {
-		return zoneRecord{}, fmt.Errorf("adding temporary record for zone %q: %w", zone, err)
+		return nil, fmt.Errorf("adding temporary records for zone %q: %w", zone, err)
 	}
-	if len(results) != 1 {
-		return zoneRecord{}, fmt.Errorf("expected one record, got %d: %v", len(results), results)
+	if len(results) != len(recs) {
+		return nil, fmt.Errorf("expected %d records, got %d: %v", len(recs), len(results), results)
 	}
 
-	return zoneRecord{zone, results[0].RR()}, nil
+	return results, nil
+}
+
+// delegatedName returns the name that dnsName is delegated to with
+// CNAME records, so that records for dnsName can be created there, or
+// dnsName if it is not delegated or the delegation can't be looked up.
+func (m *DNSManager) delegatedName(ctx context.Context, dnsName string) (string, error) {
+	target, err := followCNAMEs(ContextWithDNSRoots(ctx, m.TrustedRoots), dnsName, RecursiveNameservers(m.Resolvers))
+	if errors.As(err, new(cnameChainError)) {
+		return "", fmt.Errorf("following delegation of %s: %v", dnsName, err)
+	}
+	if err != nil {
+		// most names are not delegated, so a failed lookup
+		// should not prevent trying the name itself
+		m.logger().Warn("unable to look up delegation; using name as is",
+			zap.String("dns_name", dnsName),
+			zap.Error(err))
+		return dnsName, nil
+	}
+	target = strings.TrimSuffix(target, ".")
+	if strings.EqualFold(target, strings.TrimSuffix(dnsName, ".")) {
+		return dnsName, nil
+	}
+	m.logger().Info("following CNAME delegation",
+		zap.String("dns_name", dnsName),
+		zap.String("target", target))
+	return target, nil
 }
 
-// wait blocks until the TXT record created in Present() appears in
+// wait blocks until the record created by createRecord appears in
 // authoritative lookups, i.e. until it has propagated, or until
 // timeout, whichever is first.
 func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
+	return m.waitForRecords(ctx, zrec.zone, []libdns.RR{zrec.record})
+}
+
+// waitForRecords blocks until all of rrs, which are in zone, appear
+// in authoritative lookups, or until timeout, whichever is first.
+func (m *DNSManager) waitForRecords(ctx context.Context, zone string, rrs []libdns.RR) error {
 	logger := m.logger()
+	ctx = ContextWithDNSRoots(ctx, m.TrustedRoots)
 
 	// if configured to, pause before doing propagation checks
 	// (even if they are disabled, the wait might be desirable on its own)
@@ -442,13 +614,6 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 	checkAuthoritativeServers := len(m.Resolvers) == 0
 	resolvers := RecursiveNameservers(m.Resolvers)
 
-	recType := dns.TypeTXT
-	if zrec.record.RR().Type == "CNAME" {
-		recType = dns.TypeCNAME
-	}
-
-	absName := libdns.AbsoluteName(zrec.record.Name, zrec.zone)
-
 	var err error
 	start := time.Now()
 	for time.Since(start) < timeout {
@@ -458,23 +623,37 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 			return ctx.Err()
 		}
 
-		logger.Debug("checking DNS propagation",
-			zap.String("fqdn", absName),
-			zap.String("record_type", zrec.record.Type),
-			zap.String("expected_data", zrec.record.Data),
-			zap.Strings("resolvers", resolvers))
+		// only check the records that have not propagated yet
+		var notReady []libdns.RR
+		for _, rr := range rrs {
+			recType := dns.TypeTXT
+			if rr.Type == "CNAME" {
+				recType = dns.TypeCNAME
+			}
+			absName := libdns.AbsoluteName(rr.Name, zone)
+
+			logger.Debug("checking DNS propagation",
+				zap.String("fqdn", absName),
+				zap.String("record_type", rr.Type),
+				zap.String("expected_data", rr.Data),
+				zap.Strings("resolvers", resolvers))
 
-		var ready bool
-		ready, err = checkDNSPropagation(ctx, logger, absName, recType, zrec.record.Data, checkAuthoritativeServers, resolvers)
-		if err != nil {
-			return fmt.Errorf("checking DNS propagation of %q (relative=%s zone=%s resolvers=%v): %w", absName, zrec.record.Name, zrec.zone, resolvers, err)
+			var ready bool
+			ready, err = checkDNSPropagation(ctx, logger, absName, recType, rr.Data, checkAuthoritativeServers, resolvers)
+			if err != nil {
+				return fmt.Errorf("checking DNS propagation of %q (relative=%s zone=%s resolvers=%v): %w", absName, rr.Name, zone, resolvers, err)
+			}
+			if !ready {
+				notReady = append(notReady, rr)
+			}
 		}
-		if ready {
+		if len(notReady) == 0 {
 			return nil
 		}
+		rrs = notReady
 	}
 
-	return fmt.Errorf("timed out waiting for record to fully propagate; verify DNS provider configuration is correct - last error: %v", err)
+	return fmt.Errorf("timed out waiting for %d record(s) in zone %q to fully propagate; verify DNS provider configuration is correct - last error: %v", len(rrs), zone, err)
 }
 
 type zoneRecord struct {
@@ -482,16 +661,21 @@ type zoneRecord struct {
 	record libdns.RR
 }
 
-// CleanUp deletes the DNS TXT record created in Present().
+// cleanUpRecord deletes the record created by createRecord.
 //
 // We ignore the context because cleanup is often/likely performed after
 // a context cancellation, and properly-implemented DNS providers should
 // honor cancellation, which would result in cleanup being aborted.
 // Cleanup must always occur.
 func (m *DNSManager) cleanUpRecord(_ context.Context, zrec zoneRecord) error {
+	return m.deleteRecords(zrec.zone, []libdns.Record{zrec.record})
+}
+
+// deleteRecords deletes recs from zone with one call to the DNS provider.
+func (m *DNSManager) deleteRecords(zone string, recs []libdns.Record) error {
 	logger := m.logger()
 
-	// clean up the record - use a different context though, since
+	// clean up the records - use a different context though, since
 	// one common reason cleanup is performed is because a context
 	// was canceled, and if so, any HTTP requests by this provider
 	// should fail if the provider is properly implemented
@@ -503,15 +687,18 @@ func (m *DNSManager) cleanUpRecord(_ context.Context, zrec zoneRecord) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	logger.Debug("deleting DNS record",
-		zap.String("zone", zrec.zone),
-		zap.String("record_name", zrec.record.Name),
-		zap.String("record_type", zrec.record.Type),
-		zap.String("record_data", zrec.record.Data))
+	for _, rec := range recs {
+		rr := rec.RR()
+		logger.Debug("deleting DNS record",
+			zap.String("zone", zone),
+			zap.String("record_name", rr.Name),
+			zap.String("record_type", rr.Type),
+			zap.String("record_data", rr.Data))
+	}
 
-	_, err := m.DNSProvider.DeleteRecords(ctx, zrec.zone, []libdns.Record{zrec.record})
+	_, err := m.DNSProvider.DeleteRecords(ctx, zone, recs)
 	if err != nil {
-		return fmt.Errorf("deleting temporary record for name %q in zone %q: %w", zrec.zone, zrec.record, err)
+		return fmt.Errorf("deleting temporary records %v in zone %q: %w", recs, zone, err)
 	}
 	return nil
 }
@@ -531,6 +718,7 @@ const defaultDNSPropagationTimeout = 2 * time.Minute
 type dnsPresentMemory struct {
 	dnsName string
 	zoneRec zoneRecord
+	batch   *dnsBatch
 }
 
 func (s *DNSManager) saveDNSPresentMemory(mem dnsPresentMemory) {
@@ -847,4 +1035,6 @@ var (
 	_ acmez.Solver = (*solverWrapper)(nil)
 	_ acmez.Waiter = (*solverWrapper)(nil)
 	_ acmez.Waiter = (*distributedSolver)(nil)
+
+	_ DNSAccount01Solver = (*DNS01Solver)(nil)
 )
@@ -15,9 +15,16 @@
 package certmagic
 
 import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/libdns/libdns"
 	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
 )
 
 func Test_challengeKey(t *testing.T) {
@@ -155,3 +162,153 @@ func Test_challengeKey(t *testing.T) {
 		})
 	}
 }
+
+func TestDNS01SolverFollowsCNAMEs(t *testing.T) {
+	ctx := context.Background()
+	respond := newTestDNSResponder(t,
+		"servfail.example. 60 IN SOA ns.servfail.example. admin.servfail.example. 1 60 60 60 60",
+		"validation.example. 60 IN SOA ns.validation.example. admin.validation.example. 1 60 60 60 60",
+		"customer.example. 60 IN SOA ns.customer.example. admin.customer.example. 1 60 60 60 60",
+		"_acme-challenge.customer.example. 300 IN CNAME _acme-challenge.customer.validation.example.",
+		"_acme-challenge.chained.example. 300 IN CNAME hop.chained.example.",
+		"hop.chained.example. 60 IN CNAME chained.validation.example.",
+		"_acme-challenge.loop.example. 60 IN CNAME loop.validation.example.",
+		"loop.validation.example. 60 IN CNAME _acme-challenge.loop.example.",
+		"_acme-challenge.long.example. 60 IN CNAME 1.long.example.",
+		"1.long.example. 60 IN CNAME 2.long.example.",
+		"2.long.example. 60 IN CNAME 3.long.example.",
+		"3.long.example. 60 IN CNAME 4.long.example.",
+		"4.long.example. 60 IN CNAME 5.long.example.",
+		"5.long.example. 60 IN CNAME 6.long.example.",
+		"6.long.example. 60 IN CNAME 7.long.example.",
+		"7.long.example. 60 IN CNAME 8.long.example.",
+		"8.long.example. 60 IN CNAME 9.long.example.",
+	)
+	resolver := serveTestDNS(t, func(r *dns.Msg) *dns.Msg {
+		if r.Question[0].Qtype == dns.TypeCNAME && strings.HasSuffix(r.Question[0].Name, "servfail.example.") {
+			return new(dns.Msg).SetRcode(r, dns.RcodeServerFailure)
+		}
+		return respond(r)
+	})
+
+	for i, tc := range []struct {
+		identifier   string
+		expectZone   string
+		expectRecord string
+		expectErr    bool
+	}{
+		{identifier: "customer.example", expectZone: "validation.example.", expectRecord: "_acme-challenge.customer"},
+		{identifier: "chained.example", expectZone: "validation.example.", expectRecord: "chained"},
+		{identifier: "www.customer.example", expectZone: "customer.example.", expectRecord: "_acme-challenge.www"},
+		{identifier: "servfail.example", expectZone: "servfail.example.", expectRecord: "_acme-challenge"},
+		{identifier: "loop.example", expectErr: true},
+		{identifier: "long.example", expectErr: true},
+	} {
+		provider := new(recordingDNSProvider)
+		solver := &DNS01Solver{
+			DNSManager: DNSManager{
+				DNSProvider:        provider,
+				Resolvers:          []string{resolver},
+				PropagationTimeout: -1,
+			},
+		}
+		chal := acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			Identifier:       acme.Identifier{Type: "dns", Value: tc.identifier},
+			KeyAuthorization: "token.thumbprint",
+		}
+		err := solver.Present(ctx, chal)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d (%s): expected error, got none", i, tc.identifier)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d (%s): %v", i, tc.identifier, err)
+			continue
+		}
+		if err := solver.Wait(ctx, chal); err != nil {
+			t.Errorf("Test %d (%s): %v", i, tc.identifier, err)
+		}
+		if err := solver.CleanUp(ctx, chal); err != nil {
+			t.Errorf("Test %d (%s): %v", i, tc.identifier, err)
+		}
+		if len(provider.appended) != 1 || provider.appendedZone[0] != tc.expectZone || provider.appended[0].RR().Name != tc.expectRecord {
+			t.Errorf("Test %d (%s): expected record %s in zone %s, got %v in %v", i, tc.identifier, tc.expectRecord, tc.expectZone, provider.appended, provider.appendedZone)
+		}
+		if len(provider.deleted) != 1 || provider.deletedZone[0] != tc.expectZone || provider.deleted[0].RR() != provider.appended[0].RR() {
+			t.Errorf("Test %d (%s): expected created record to be deleted, got %v in %v", i, tc.identifier, provider.deleted, provider.deletedZone)
+		}
+	}
+
+	// delegations are cached for the lowest TTL in their chain
+	cnameCacheMu.Lock()
+	ent := cnameCache["_acme-challenge.chained.example."]
+	cnameCacheMu.Unlock()
+	if ent.target != "chained.validation.example." || time.Until(ent.expires) > time.Minute {
+		t.Errorf("Expected delegation to be cached for at most 1m, got %+v", ent)
+	}
+}
+
+// recordingDNSProvider is a DNSProvider for tests that
+// records which records it is asked to add and delete.
+type recordingDNSProvider struct {
+	mu           sync.Mutex
+	appended     []libdns.Record
+	deleted      []libdns.Record
+	appendedZone []string // zone of each appended record
+	deletedZone  []string // zone of each deleted record
+	appendCalls  int
+	deleteCalls  int
+
+	// if set, records are added but this error is
+	// returned, as if adding them was partial
+	appendErr error
+}
+
+func (p *recordingDNSProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.appendCalls++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.appended = append(p.appended, recs...)
+	for range recs {
+		p.appendedZone = append(p.appendedZone, zone)
+	}
+	if p.appendErr != nil {
+		return nil, p.appendErr
+	}
+	return recs, nil
+}
+
+func (p *recordingDNSProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deleteCalls++
+	p.deleted = append(p.deleted, recs...)
+	for range recs {
+		p.deletedZone = append(p.deletedZone, zone)
+	}
+	return recs, nil
+}
+
+// lookupTXT returns the values of the TXT records at fqdn
+// that have been appended and not deleted.
+func (p *recordingDNSProvider) lookupTXT(_ context.Context, fqdn string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var values []string
+	for i, rec := range p.appended {
+		rr := rec.RR()
+		if rr.Type != "TXT" || libdns.AbsoluteName(rr.Name, p.appendedZone[i]) != fqdn+"." {
+			continue
+		}
+		if !slices.ContainsFunc(p.deleted, func(deleted libdns.Record) bool { return deleted.RR() == rr }) {
+			values = append(values, rr.Data)
+		}
+	}
+	return values, nil
+}